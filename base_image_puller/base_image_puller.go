@@ -42,6 +42,13 @@ type Fetcher interface {
 	Close() error
 }
 
+// VerifiableStream is a layer stream that can only be verified once it has
+// been read to the end. These layers are downloaded as they are read, so the
+// puller reads them ahead of their unpacking, while it holds a download slot.
+type VerifiableStream interface {
+	Verify() error
+}
+
 type DependencyRegisterer interface {
 	Register(id string, chainIDs []string) error
 }
@@ -49,6 +56,7 @@ type DependencyRegisterer interface {
 type UnpackOutput struct {
 	BytesWritten    int64
 	OpaqueWhiteouts []string
+	SkippedDevices  int
 }
 
 type Unpacker interface {
@@ -65,24 +73,44 @@ type VolumeDriver interface {
 	HandleOpaqueWhiteouts(logger lager.Logger, id string, opaqueWhiteouts []string) error
 }
 
+// DefaultMaxParallelDownloads is how many layer blobs are fetched at the same
+// time unless configured otherwise
+const DefaultMaxParallelDownloads = 3
+
 type BaseImagePuller struct {
-	fetcher        Fetcher
-	unpacker       Unpacker
-	volumeDriver   VolumeDriver
-	metricsEmitter groot.MetricsEmitter
-	locksmith      groot.Locksmith
+	fetcher              Fetcher
+	unpacker             Unpacker
+	volumeDriver         VolumeDriver
+	metricsEmitter       groot.MetricsEmitter
+	locksmith            groot.Locksmith
+	maxParallelDownloads int
+}
+
+type downloadedLayer struct {
+	stream io.ReadCloser
+	err    error
 }
 
 func NewBaseImagePuller(fetcher Fetcher, unpacker Unpacker, volumeDriver VolumeDriver, metricsEmitter groot.MetricsEmitter, locksmith groot.Locksmith) *BaseImagePuller {
 	return &BaseImagePuller{
-		fetcher:        fetcher,
-		unpacker:       unpacker,
-		volumeDriver:   volumeDriver,
-		metricsEmitter: metricsEmitter,
-		locksmith:      locksmith,
+		fetcher:              fetcher,
+		unpacker:             unpacker,
+		volumeDriver:         volumeDriver,
+		metricsEmitter:       metricsEmitter,
+		locksmith:            locksmith,
+		maxParallelDownloads: DefaultMaxParallelDownloads,
 	}
 }
 
+// WithMaxParallelDownloads sets how many layer blobs can be fetched at the
+// same time. Layers are still unpacked one by one, from parent to child.
+func (p *BaseImagePuller) WithMaxParallelDownloads(maxParallelDownloads int) *BaseImagePuller {
+	if maxParallelDownloads > 0 {
+		p.maxParallelDownloads = maxParallelDownloads
+	}
+	return p
+}
+
 func (p *BaseImagePuller) FetchBaseImageInfo(logger lager.Logger) (groot.BaseImageInfo, error) {
 	logger = logger.Session("fetching-image-info")
 	logger.Info("starting")
@@ -92,7 +120,7 @@ func (p *BaseImagePuller) FetchBaseImageInfo(logger lager.Logger) (groot.BaseIma
 }
 
 func (p *BaseImagePuller) Pull(logger lager.Logger, baseImageInfo groot.BaseImageInfo, spec groot.BaseImageSpec) error {
-	logger = logger.Session("pulling-image-layers", lager.Data{"spec": spec})
+	logger = logger.Session("pulling-image-layers", lager.Data{"spec": spec, "maxParallelDownloads": p.maxParallelDownloads})
 	logger.Info("starting")
 	defer logger.Info("ending")
 
@@ -100,7 +128,13 @@ func (p *BaseImagePuller) Pull(logger lager.Logger, baseImageInfo groot.BaseImag
 		return err
 	}
 
-	return p.buildLayer(logger, len(baseImageInfo.LayerInfos)-1, baseImageInfo.LayerInfos, spec)
+	firstMissingIndex, lockFiles, err := p.lockMissingLayers(logger, baseImageInfo.LayerInfos)
+	defer p.unlockLayers(logger, lockFiles)
+	if err != nil {
+		return err
+	}
+
+	return p.buildLayers(logger, firstMissingIndex, baseImageInfo.LayerInfos, spec)
 }
 
 func (p *BaseImagePuller) quotaExceeded(logger lager.Logger, layerInfos []groot.LayerInfo, spec groot.BaseImageSpec) error {
@@ -135,59 +169,155 @@ func (p *BaseImagePuller) volumeExists(logger lager.Logger, chainID string) bool
 	return false
 }
 
-func (p *BaseImagePuller) buildLayer(logger lager.Logger, index int, layerInfos []groot.LayerInfo, spec groot.BaseImageSpec) error {
-	if index < 0 {
-		return nil
+// lockMissingLayers walks the layers from the top down, acquiring the lock
+// of each layer that is not in the store yet. It stops as soon as it finds
+// a layer that already has a volume, since its ancestors must exist as well.
+// It returns the index of the bottom-most layer that needs to be built.
+func (p *BaseImagePuller) lockMissingLayers(logger lager.Logger, layerInfos []groot.LayerInfo) (int, []*os.File, error) {
+	firstMissingIndex := len(layerInfos)
+	lockFiles := []*os.File{}
+
+	for index := len(layerInfos) - 1; index >= 0; index-- {
+		layerInfo := layerInfos[index]
+		layerLogger := logger.Session("build-layer", lager.Data{
+			"blobID":        layerInfo.BlobID,
+			"chainID":       layerInfo.ChainID,
+			"parentChainID": layerInfo.ParentChainID,
+		})
+		if p.volumeExists(layerLogger, layerInfo.ChainID) {
+			break
+		}
+
+		lockFile, err := p.locksmith.Lock(layerInfo.ChainID)
+		if err != nil {
+			return 0, lockFiles, errorspkg.Wrap(err, "acquiring lock")
+		}
+		lockFiles = append(lockFiles, lockFile)
+
+		if p.volumeExists(layerLogger, layerInfo.ChainID) {
+			break
+		}
+
+		firstMissingIndex = index
 	}
 
-	layerInfo := layerInfos[index]
-	logger = logger.Session("build-layer", lager.Data{
-		"blobID":        layerInfo.BlobID,
-		"chainID":       layerInfo.ChainID,
-		"parentChainID": layerInfo.ParentChainID,
-	})
-	if p.volumeExists(logger, layerInfo.ChainID) {
+	return firstMissingIndex, lockFiles, nil
+}
+
+func (p *BaseImagePuller) unlockLayers(logger lager.Logger, lockFiles []*os.File) {
+	for i := len(lockFiles) - 1; i >= 0; i-- {
+		if err := p.locksmith.Unlock(lockFiles[i]); err != nil {
+			logger.Error("failed-to-unlock", err)
+		}
+	}
+}
+
+func (p *BaseImagePuller) buildLayers(logger lager.Logger, firstMissingIndex int, layerInfos []groot.LayerInfo, spec groot.BaseImageSpec) error {
+	missingLayerInfos := layerInfos[firstMissingIndex:]
+	if len(missingLayerInfos) == 0 {
 		return nil
 	}
 
-	lockFile, err := p.locksmith.Lock(layerInfo.ChainID)
-	if err != nil {
-		return errorspkg.Wrap(err, "acquiring lock")
+	cancel := make(chan struct{})
+	downloads := p.downloadLayers(logger, missingLayerInfos, cancel)
+
+	for i, layerInfo := range missingLayerInfos {
+		download := <-downloads[i]
+		err := download.err
+		if err == nil {
+			parentLayerInfo := p.parentLayerInfo(layerInfos, firstMissingIndex+i)
+			err = p.unpackLayer(logger, layerInfo, parentLayerInfo, spec, download.stream)
+			download.stream.Close()
+		}
+
+		if err != nil {
+			// the downloads in flight are not waited for, so that the locks of
+			// the layers are released as soon as the pull fails
+			close(cancel)
+			p.discardDownloads(downloads[i+1:])
+			return err
+		}
 	}
-	defer p.locksmith.Unlock(lockFile)
 
-	if p.volumeExists(logger, layerInfo.ChainID) {
-		return nil
+	return nil
+}
+
+// downloadLayers fetches the given layers in the background, with at most
+// maxParallelDownloads blobs in flight at any time. Parent layers are
+// always started first. Each returned channel receives exactly one result.
+func (p *BaseImagePuller) downloadLayers(logger lager.Logger, layerInfos []groot.LayerInfo, cancel <-chan struct{}) []chan downloadedLayer {
+	downloads := make([]chan downloadedLayer, len(layerInfos))
+	for i := range downloads {
+		downloads[i] = make(chan downloadedLayer, 1)
 	}
 
-	if err := p.buildLayer(logger, index-1, layerInfos, spec); err != nil {
-		return err
+	semaphore := make(chan struct{}, p.maxParallelDownloads)
+	go func() {
+		for index, layerInfo := range layerInfos {
+			select {
+			case semaphore <- struct{}{}:
+			case <-cancel:
+				for _, download := range downloads[index:] {
+					download <- downloadedLayer{err: errorspkg.New("download cancelled")}
+				}
+				return
+			}
+
+			go func(layerInfo groot.LayerInfo, download chan<- downloadedLayer) {
+				defer func() { <-semaphore }()
+				defer p.metricsEmitter.TryEmitDurationFrom(logger, MetricsDownloadTimeName, time.Now())
+
+				stream, err := p.downloadLayer(logger, layerInfo)
+				download <- downloadedLayer{stream: stream, err: err}
+
+				// streamed layers are still downloading while they are unpacked
+				if prefetchedStream, ok := stream.(*prefetchedStream); ok {
+					<-prefetchedStream.downloaded
+				}
+			}(layerInfo, downloads[index])
+		}
+	}()
+
+	return downloads
+}
+
+// discardDownloads closes the streams of the downloads as they finish.
+// Closing a streamed layer stops its download.
+func (p *BaseImagePuller) discardDownloads(downloads []chan downloadedLayer) {
+	for _, download := range downloads {
+		go func(download <-chan downloadedLayer) {
+			if result := <-download; result.err == nil {
+				result.stream.Close()
+			}
+		}(download)
 	}
+}
 
-	var parentLayerInfo groot.LayerInfo
+func (p *BaseImagePuller) parentLayerInfo(layerInfos []groot.LayerInfo, index int) groot.LayerInfo {
 	if index > 0 {
-		parentLayerInfo = layerInfos[index-1]
+		return layerInfos[index-1]
 	}
 
-	return p.downloadLayer(logger, layerInfo, parentLayerInfo, spec)
-
+	return groot.LayerInfo{}
 }
 
-func (p *BaseImagePuller) downloadLayer(logger lager.Logger, layerInfo, parentLayerInfo groot.LayerInfo, spec groot.BaseImageSpec) error {
+func (p *BaseImagePuller) downloadLayer(logger lager.Logger, layerInfo groot.LayerInfo) (io.ReadCloser, error) {
 	logger = logger.Session("downloading-layer", lager.Data{"LayerInfo": layerInfo})
 	logger.Debug("starting")
 	defer logger.Debug("ending")
-	defer p.metricsEmitter.TryEmitDurationFrom(logger, MetricsDownloadTimeName, time.Now())
 
 	stream, size, err := p.fetcher.StreamBlob(logger, layerInfo)
 	if err != nil {
-		return errorspkg.Wrapf(err, "streaming blob `%s`", layerInfo.BlobID)
+		return nil, errorspkg.Wrapf(err, "streaming blob `%s`", layerInfo.BlobID)
 	}
-	defer stream.Close()
 
 	logger.Debug("got-stream-for-blob", lager.Data{"size": size})
 
-	return p.unpackLayer(logger, layerInfo, parentLayerInfo, spec, stream)
+	if verifiableStream, ok := stream.(verifiableReadCloser); ok {
+		return newPrefetchedStream(verifiableStream), nil
+	}
+
+	return stream, nil
 }
 
 func (p *BaseImagePuller) unpackLayer(logger lager.Logger, layerInfo, parentLayerInfo groot.LayerInfo, spec groot.BaseImageSpec, stream io.ReadCloser) error {
@@ -213,6 +343,16 @@ func (p *BaseImagePuller) unpackLayer(logger lager.Logger, layerInfo, parentLaye
 		return err
 	}
 
+	if verifiableStream, ok := stream.(VerifiableStream); ok {
+		if err := verifiableStream.Verify(); err != nil {
+			logger.Error("verifying-layer-failed", err)
+			if errD := p.volumeDriver.DestroyVolume(logger, tempVolumeName); errD != nil {
+				logger.Error("volume-cleanup-failed", errD)
+			}
+			return errorspkg.Wrapf(err, "verifying layer `%s`", layerInfo.BlobID)
+		}
+	}
+
 	return p.finalizeVolume(logger, tempVolumeName, volumePath, layerInfo.ChainID, volSize)
 }
 
@@ -264,6 +404,10 @@ func (p *BaseImagePuller) unpackLayerToTemporaryDirectory(logger lager.Logger, u
 		return 0, errorspkg.Wrap(err, "handling opaque whiteouts")
 	}
 
+	if unpackOutput.SkippedDevices > 0 {
+		logger.Info("skipped-devices", lager.Data{"count": unpackOutput.SkippedDevices})
+	}
+
 	logger.Debug("layer-unpacked")
 	return unpackOutput.BytesWritten, nil
 }
@@ -380,6 +380,219 @@ var _ = Describe("Base Image Puller", func() {
 			}
 		})
 
+		Describe("parallel downloads", func() {
+			var releaseDownloads chan struct{}
+
+			BeforeEach(func() {
+				releaseDownloads = make(chan struct{})
+				fakeFetcher.StreamBlobStub = func(_ lager.Logger, layerInfo groot.LayerInfo) (io.ReadCloser, int64, error) {
+					<-releaseDownloads
+					return ioutil.NopCloser(strings.NewReader(layerInfo.BlobID)), 0, nil
+				}
+			})
+
+			It("downloads all the layers at the same time by default", func() {
+				Expect(layerInfos).To(HaveLen(base_image_puller.DefaultMaxParallelDownloads))
+				errs := pullInBackground(baseImagePuller, logger, baseImageInfo)
+
+				Eventually(fakeFetcher.StreamBlobCallCount).Should(Equal(3))
+				close(releaseDownloads)
+				Eventually(errs).Should(Receive(BeNil()))
+			})
+
+			Context("when unpacking a layer fails while its children are downloading", func() {
+				var closedStreams chan string
+
+				BeforeEach(func() {
+					closedStreams = make(chan string, 3)
+					// the downloads outlive the test, so they must not see the
+					// channels of the next one
+					released, closed := releaseDownloads, closedStreams
+					fakeFetcher.StreamBlobStub = func(_ lager.Logger, layerInfo groot.LayerInfo) (io.ReadCloser, int64, error) {
+						if layerInfo.ChainID != "layer-111" {
+							<-released
+						}
+						return &closeRecordingStream{
+							Reader:        strings.NewReader(layerInfo.BlobID),
+							chainID:       layerInfo.ChainID,
+							closedStreams: closed,
+						}, 0, nil
+					}
+					fakeUnpacker.UnpackReturns(base_image_puller.UnpackOutput{}, errors.New("failed to unpack the blob"))
+				})
+
+				It("releases the locks without waiting for the downloads", func() {
+					errs := pullInBackground(baseImagePuller, logger, baseImageInfo)
+
+					Eventually(errs).Should(Receive(MatchError(ContainSubstring("failed to unpack the blob"))))
+					Expect(fakeLocksmith.UnlockCallCount()).To(Equal(fakeLocksmith.LockCallCount()))
+					close(releaseDownloads)
+				})
+
+				It("closes the streams of the downloads once they finish", func() {
+					errs := pullInBackground(baseImagePuller, logger, baseImageInfo)
+					Eventually(errs).Should(Receive(HaveOccurred()))
+
+					Expect(closedStreams).To(Receive(Equal("layer-111")))
+					close(releaseDownloads)
+					Eventually(closedStreams).Should(Receive())
+					Eventually(closedStreams).Should(Receive())
+				})
+			})
+
+			Context("when the maximum number of parallel downloads is one", func() {
+				BeforeEach(func() {
+					baseImagePuller = baseImagePuller.WithMaxParallelDownloads(1)
+				})
+
+				It("downloads one layer at a time", func() {
+					errs := pullInBackground(baseImagePuller, logger, baseImageInfo)
+
+					Eventually(fakeFetcher.StreamBlobCallCount).Should(Equal(1))
+					Consistently(fakeFetcher.StreamBlobCallCount).Should(Equal(1))
+					close(releaseDownloads)
+					Eventually(errs).Should(Receive(BeNil()))
+				})
+			})
+
+			Context("when the maximum number of parallel downloads is set", func() {
+				BeforeEach(func() {
+					baseImagePuller = baseImagePuller.WithMaxParallelDownloads(2)
+				})
+
+				It("downloads up to that many layers at the same time", func() {
+					errs := pullInBackground(baseImagePuller, logger, baseImageInfo)
+
+					Eventually(fakeFetcher.StreamBlobCallCount).Should(Equal(2))
+					Consistently(fakeFetcher.StreamBlobCallCount).Should(Equal(2))
+					// the two downloads start concurrently, in any order
+					_, firstLayerInfo := fakeFetcher.StreamBlobArgsForCall(0)
+					_, secondLayerInfo := fakeFetcher.StreamBlobArgsForCall(1)
+					Expect([]string{firstLayerInfo.ChainID, secondLayerInfo.ChainID}).To(ConsistOf("layer-111", "chain-222"))
+
+					close(releaseDownloads)
+					Eventually(errs).Should(Receive(BeNil()))
+					Expect(fakeFetcher.StreamBlobCallCount()).To(Equal(3))
+				})
+
+				It("unpacks the layers from parent to child", func() {
+					fakeFetcher.StreamBlobStub = func(_ lager.Logger, layerInfo groot.LayerInfo) (io.ReadCloser, int64, error) {
+						if layerInfo.ChainID == "layer-111" {
+							time.Sleep(100 * time.Millisecond)
+						}
+						return ioutil.NopCloser(strings.NewReader(layerInfo.BlobID)), 0, nil
+					}
+
+					Expect(baseImagePuller.Pull(logger, baseImageInfo, groot.BaseImageSpec{})).To(Succeed())
+
+					Expect(fakeUnpacker.UnpackCallCount()).To(Equal(3))
+					for i, layerInfo := range layerInfos {
+						_, unpackSpec := fakeUnpacker.UnpackArgsForCall(i)
+						Expect(unpackSpec.TargetPath).To(ContainSubstring(layerInfo.ChainID + "-incomplete-"))
+						Expect(readAll(unpackSpec.Stream)).To(Equal(layerInfo.BlobID))
+					}
+				})
+
+				It("still uses the locksmith for each layer", func() {
+					close(releaseDownloads)
+					Expect(baseImagePuller.Pull(logger, baseImageInfo, groot.BaseImageSpec{})).To(Succeed())
+
+					Expect(fakeLocksmith.LockCallCount()).To(Equal(3))
+					Expect(fakeLocksmith.UnlockCallCount()).To(Equal(3))
+				})
+
+				Context("when the layers are streamed", func() {
+					var finishDownload func(chainID string)
+
+					BeforeEach(func() {
+						close(releaseDownloads)
+
+						layersLock := &sync.Mutex{}
+						layerWriters := map[string]*io.PipeWriter{}
+						fakeFetcher.StreamBlobStub = func(_ lager.Logger, layerInfo groot.LayerInfo) (io.ReadCloser, int64, error) {
+							reader, writer := io.Pipe()
+							layersLock.Lock()
+							defer layersLock.Unlock()
+							layerWriters[layerInfo.ChainID] = writer
+							return &verifiableStream{ReadCloser: reader}, 0, nil
+						}
+
+						layerWriter := func(chainID string) *io.PipeWriter {
+							layersLock.Lock()
+							defer layersLock.Unlock()
+							return layerWriters[chainID]
+						}
+						finishDownload = func(chainID string) {
+							Eventually(func() *io.PipeWriter { return layerWriter(chainID) }).ShouldNot(BeNil())
+							Expect(layerWriter(chainID).Close()).To(Succeed())
+						}
+					})
+
+					It("holds a download slot until each layer was read to the end", func() {
+						errs := pullInBackground(baseImagePuller, logger, baseImageInfo)
+
+						Eventually(fakeFetcher.StreamBlobCallCount).Should(Equal(2))
+						Consistently(fakeFetcher.StreamBlobCallCount).Should(Equal(2))
+
+						finishDownload("layer-111")
+						Eventually(fakeFetcher.StreamBlobCallCount).Should(Equal(3))
+
+						finishDownload("chain-222")
+						finishDownload("chain-333")
+						Eventually(errs).Should(Receive(BeNil()))
+					})
+
+					It("reads the layers ahead of their unpacking", func() {
+						unpacking := make(chan struct{})
+						fakeUnpacker.UnpackStub = func(_ lager.Logger, _ base_image_puller.UnpackSpec) (base_image_puller.UnpackOutput, error) {
+							<-unpacking
+							return base_image_puller.UnpackOutput{}, nil
+						}
+						fakeFetcher.StreamBlobStub = func(_ lager.Logger, layerInfo groot.LayerInfo) (io.ReadCloser, int64, error) {
+							return &verifiableStream{ReadCloser: ioutil.NopCloser(strings.NewReader(layerInfo.BlobID))}, 0, nil
+						}
+						errs := pullInBackground(baseImagePuller, logger, baseImageInfo)
+
+						Eventually(fakeUnpacker.UnpackCallCount).Should(Equal(1))
+						// all the layers are read while the first one is being unpacked,
+						// so the download slots are released
+						Eventually(func() int { return downloadTimeMetrics(fakeMetricsEmitter) }).Should(Equal(3))
+
+						close(unpacking)
+						Eventually(errs).Should(Receive(BeNil()))
+					})
+
+					It("emits the download time once each layer was read to the end", func() {
+						errs := pullInBackground(baseImagePuller, logger, baseImageInfo)
+
+						Eventually(fakeFetcher.StreamBlobCallCount).Should(Equal(2))
+						Consistently(func() int { return downloadTimeMetrics(fakeMetricsEmitter) }).Should(Equal(0))
+
+						finishDownload("layer-111")
+						Eventually(func() int { return downloadTimeMetrics(fakeMetricsEmitter) }).Should(Equal(1))
+
+						finishDownload("chain-222")
+						finishDownload("chain-333")
+						Eventually(errs).Should(Receive(BeNil()))
+						Eventually(func() int { return downloadTimeMetrics(fakeMetricsEmitter) }).Should(Equal(3))
+					})
+				})
+
+				Context("when unpacking a layer fails", func() {
+					BeforeEach(func() {
+						close(releaseDownloads)
+						fakeUnpacker.UnpackReturns(base_image_puller.UnpackOutput{}, errors.New("failed to unpack the blob"))
+					})
+
+					It("stops and does not unpack the child layers", func() {
+						err := baseImagePuller.Pull(logger, baseImageInfo, groot.BaseImageSpec{})
+						Expect(err).To(MatchError(ContainSubstring("failed to unpack the blob")))
+						Expect(fakeUnpacker.UnpackCallCount()).To(Equal(1))
+					})
+				})
+			})
+		})
+
 		Context("when writing volume metadata fails", func() {
 			BeforeEach(func() {
 				fakeVolumeDriver.WriteVolumeMetaReturns(errors.New("metadata failed"))
@@ -618,6 +831,36 @@ var _ = Describe("Base Image Puller", func() {
 			})
 		})
 
+		Context("when the stream fails verification once it is unpacked", func() {
+			BeforeEach(func() {
+				fakeFetcher.StreamBlobStub = func(_ lager.Logger, layerInfo groot.LayerInfo) (io.ReadCloser, int64, error) {
+					verifyErr := error(nil)
+					if layerInfo.ChainID == "chain-222" {
+						verifyErr = errors.New("diffID digest mismatch")
+					}
+					return &verifiableStream{ReadCloser: ioutil.NopCloser(strings.NewReader(layerInfo.BlobID)), err: verifyErr}, 0, nil
+				}
+			})
+
+			It("returns an error", func() {
+				err := baseImagePuller.Pull(logger, baseImageInfo, groot.BaseImageSpec{})
+				Expect(err).To(MatchError(ContainSubstring("verifying layer `i-am-another-layer`: diffID digest mismatch")))
+			})
+
+			It("destroys the unpacked volume without moving it into place", func() {
+				err := baseImagePuller.Pull(logger, baseImageInfo, groot.BaseImageSpec{})
+				Expect(err).To(HaveOccurred())
+
+				Expect(fakeVolumeDriver.DestroyVolumeCallCount()).To(Equal(1))
+				_, id := fakeVolumeDriver.DestroyVolumeArgsForCall(0)
+				Expect(id).To(HavePrefix("chain-222-incomplete-"))
+
+				Expect(fakeVolumeDriver.MoveVolumeCallCount()).To(Equal(1))
+				_, _, to := fakeVolumeDriver.MoveVolumeArgsForCall(0)
+				Expect(filepath.Base(to)).To(Equal("layer-111"))
+			})
+		})
+
 		Context("when streaming a blob fails", func() {
 			BeforeEach(func() {
 				fakeFetcher.StreamBlobReturns(nil, 0, errors.New("failed to stream blob"))
@@ -723,6 +966,50 @@ var _ = Describe("Base Image Puller", func() {
 	})
 })
 
+type verifiableStream struct {
+	io.ReadCloser
+	err error
+}
+
+func (s *verifiableStream) Verify() error {
+	return s.err
+}
+
+type closeRecordingStream struct {
+	io.Reader
+	chainID       string
+	closedStreams chan<- string
+}
+
+func (s *closeRecordingStream) Close() error {
+	s.closedStreams <- s.chainID
+	return nil
+}
+
+func pullInBackground(baseImagePuller *base_image_puller.BaseImagePuller, logger lager.Logger, baseImageInfo groot.BaseImageInfo) chan error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- baseImagePuller.Pull(logger, baseImageInfo, groot.BaseImageSpec{})
+	}()
+	return errs
+}
+
+func downloadTimeMetrics(metricsEmitter *grootfakes.FakeMetricsEmitter) int {
+	count := 0
+	for i := 0; i < metricsEmitter.TryEmitDurationFromCallCount(); i++ {
+		if _, name, _ := metricsEmitter.TryEmitDurationFromArgsForCall(i); name == base_image_puller.MetricsDownloadTimeName {
+			count++
+		}
+	}
+	return count
+}
+
+func readAll(reader io.Reader) string {
+	contents, err := ioutil.ReadAll(reader)
+	Expect(err).NotTo(HaveOccurred())
+	return string(contents)
+}
+
 func chainIDs(layerInfos []groot.LayerInfo) []string {
 	chainIDs := []string{}
 	for _, layerInfo := range layerInfos {
@@ -0,0 +1,8 @@
+package base_image_puller
+
+import "io"
+
+// NewPrefetchedStream is only exported for tests
+func NewPrefetchedStream(stream verifiableReadCloser) io.ReadCloser {
+	return newPrefetchedStream(stream)
+}
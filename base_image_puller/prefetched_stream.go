@@ -0,0 +1,125 @@
+package base_image_puller // import "code.cloudfoundry.org/grootfs/base_image_puller"
+
+import (
+	"io"
+	"io/ioutil"
+	"sync"
+
+	errorspkg "github.com/pkg/errors"
+)
+
+// prefetchBufferSize is how much of a streamed layer is read ahead of its
+// unpacking, in chunks of prefetchChunkSize
+const (
+	prefetchBufferSize = 8 * 1024 * 1024
+	prefetchChunkSize  = 32 * 1024
+)
+
+var errStreamClosed = errorspkg.New("stream closed")
+
+type verifiableReadCloser interface {
+	io.ReadCloser
+	VerifiableStream
+}
+
+// prefetchedStream reads a streamed layer in the background into a bounded
+// buffer. Streamed layers are only downloaded as they are read, so this is
+// what lets them download while their parents are unpacked. downloaded is
+// closed once the layer was read to the end, or reading it failed or was
+// abandoned.
+type prefetchedStream struct {
+	stream     verifiableReadCloser
+	chunks     chan []byte
+	chunk      []byte
+	err        error
+	stop       chan struct{}
+	downloaded chan struct{}
+	closeOnce  *sync.Once
+	closeErr   error
+}
+
+func newPrefetchedStream(stream verifiableReadCloser) *prefetchedStream {
+	s := &prefetchedStream{
+		stream:     stream,
+		chunks:     make(chan []byte, prefetchBufferSize/prefetchChunkSize),
+		stop:       make(chan struct{}),
+		downloaded: make(chan struct{}),
+		closeOnce:  &sync.Once{},
+	}
+	go s.prefetch()
+
+	return s
+}
+
+func (s *prefetchedStream) prefetch() {
+	defer close(s.downloaded)
+	defer close(s.chunks)
+
+	for {
+		// closed streams are not read any further, even when there is room
+		// left in the buffer
+		select {
+		case <-s.stop:
+			s.err = errStreamClosed
+			return
+		default:
+		}
+
+		chunk := make([]byte, prefetchChunkSize)
+		n, err := s.stream.Read(chunk)
+		if n > 0 {
+			select {
+			case s.chunks <- chunk[:n]:
+			case <-s.stop:
+				s.err = errStreamClosed
+				return
+			}
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				s.err = err
+			}
+			return
+		}
+	}
+}
+
+func (s *prefetchedStream) Read(p []byte) (int, error) {
+	for len(s.chunk) == 0 {
+		chunk, ok := <-s.chunks
+		if !ok {
+			if s.err != nil {
+				return 0, s.err
+			}
+			return 0, io.EOF
+		}
+		s.chunk = chunk
+	}
+
+	n := copy(p, s.chunk)
+	s.chunk = s.chunk[n:]
+	return n, nil
+}
+
+// Verify reads what the unpacker left of the layer before verifying it, as
+// the layer is only verifiable once it was read to the end
+func (s *prefetchedStream) Verify() error {
+	if _, err := io.Copy(ioutil.Discard, s); err != nil {
+		return err
+	}
+
+	return s.stream.Verify()
+}
+
+// Close stops reading the layer and closes the stream. It can be called more
+// than once.
+func (s *prefetchedStream) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.downloaded
+		s.closeErr = s.stream.Close()
+	})
+
+	return s.closeErr
+}
@@ -0,0 +1,64 @@
+package base_image_puller_test
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/grootfs/base_image_puller"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Prefetched stream", func() {
+	It("reads the whole stream", func() {
+		stream := base_image_puller.NewPrefetchedStream(&verifiableStream{ReadCloser: ioutil.NopCloser(strings.NewReader("a-layer"))})
+		Expect(ioutil.ReadAll(stream)).To(Equal([]byte("a-layer")))
+		Expect(stream.Close()).To(Succeed())
+	})
+
+	It("can be closed more than once", func() {
+		stream := base_image_puller.NewPrefetchedStream(&verifiableStream{ReadCloser: ioutil.NopCloser(strings.NewReader("a-layer"))})
+		Expect(stream.Close()).To(Succeed())
+		Expect(stream.Close()).To(Succeed())
+	})
+
+	It("stops reading the stream once closed", func() {
+		reader := &gatedReader{gate: make(chan struct{}), mutex: &sync.Mutex{}}
+		stream := base_image_puller.NewPrefetchedStream(&verifiableStream{ReadCloser: ioutil.NopCloser(reader)})
+		Eventually(reader.readCount).Should(Equal(1))
+
+		closed := make(chan error)
+		go func() {
+			closed <- stream.Close()
+		}()
+		Consistently(closed).ShouldNot(Receive())
+
+		close(reader.gate)
+		Eventually(closed).Should(Receive(BeNil()))
+		Expect(reader.readCount()).To(Equal(1))
+	})
+})
+
+// gatedReader returns endless data, each read blocking until the gate is
+// closed
+type gatedReader struct {
+	gate  chan struct{}
+	mutex *sync.Mutex
+	reads int
+}
+
+func (r *gatedReader) Read(p []byte) (int, error) {
+	r.mutex.Lock()
+	r.reads++
+	r.mutex.Unlock()
+
+	<-r.gate
+	return copy(p, "data"), nil
+}
+
+func (r *gatedReader) readCount() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.reads
+}
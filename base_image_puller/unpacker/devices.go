@@ -0,0 +1,55 @@
+package unpacker // import "code.cloudfoundry.org/grootfs/base_image_puller/unpacker"
+
+import (
+	"io/ioutil"
+	"strings"
+)
+
+// DeviceNumber is the major and minor number of a device node
+type DeviceNumber struct {
+	Major int64
+	Minor int64
+}
+
+// DeviceFilter decides which device nodes of the layers are created. Device
+// nodes are only created when running as root in the initial user namespace,
+// unless they are skipped. When there are allowed devices, other devices are
+// skipped.
+type DeviceFilter struct {
+	Skip           bool
+	AllowedDevices []DeviceNumber
+}
+
+func (f DeviceFilter) allows(major, minor int64) bool {
+	if f.Skip {
+		return false
+	}
+
+	if len(f.AllowedDevices) == 0 {
+		return true
+	}
+
+	for _, device := range f.AllowedDevices {
+		if device.Major == major && device.Minor == minor {
+			return true
+		}
+	}
+
+	return false
+}
+
+// canCreateDevices checks whether this process can create device nodes,
+// which is only the case for root in the initial user namespace. It has to be
+// called before chrooting, as it reads procfs.
+func canCreateDevices(uid int) bool {
+	if uid != 0 {
+		return false
+	}
+
+	uidMap, err := ioutil.ReadFile("/proc/self/uid_map")
+	if err != nil {
+		return false
+	}
+
+	return strings.Join(strings.Fields(string(uidMap)), " ") == "0 0 4294967295"
+}
@@ -70,6 +70,8 @@ func init() {
 			fail(logger, "creating-tar-unpacker", err)
 		}
 
+		// IDs are already mapped by the user namespace, including the root ID of
+		// file capabilities
 		var unpackOutput base_image_puller.UnpackOutput
 		if unpackOutput, err = unpacker.Unpack(logger, base_image_puller.UnpackSpec{
 			Stream:        os.Stdin,
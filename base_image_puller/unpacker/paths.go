@@ -0,0 +1,121 @@
+package unpacker // import "code.cloudfoundry.org/grootfs/base_image_puller/unpacker"
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"strings"
+
+	errorspkg "github.com/pkg/errors"
+)
+
+// maxSymlinks is the number of symlinks followed when resolving a path, as
+// in the kernel
+const maxSymlinks = 40
+
+// safeEntryPath returns where a layer entry is unpacked in root. Entries whose
+// name goes above the root are rejected. The parent directories are resolved
+// inside the root, so that a symlink in the layer can't take the entry
+// elsewhere. The entry itself is not resolved, as it replaces whatever is
+// there.
+func safeEntryPath(root, name string) (string, error) {
+	cleanName, ok := layerRelativePath(name)
+	if !ok {
+		return "", errorspkg.Errorf("entry `%s` is outside of the layer", name)
+	}
+
+	return resolveEntry(root, name, cleanName)
+}
+
+// hardLinkTarget returns the path of the file a hard link entry points to.
+// Like entry names, hard link targets are relative to the root of the layer.
+func hardLinkTarget(root string, tarHeader *tar.Header) (string, error) {
+	cleanLinkname, ok := layerRelativePath(tarHeader.Linkname)
+	if !ok {
+		return "", errorspkg.Errorf("hard link `%s` points to `%s`, outside of the layer", tarHeader.Name, tarHeader.Linkname)
+	}
+
+	return resolveEntry(root, tarHeader.Linkname, cleanLinkname)
+}
+
+// layerRelativePath cleans an entry name. Leading slashes are dropped, like
+// tar does, and names with `..` components that go above the root are
+// rejected.
+func layerRelativePath(name string) (string, bool) {
+	cleanName := filepath.Clean(strings.TrimLeft(name, "/"))
+	if cleanName == ".." || strings.HasPrefix(cleanName, "../") {
+		return "", false
+	}
+
+	return cleanName, true
+}
+
+func resolveEntry(root, name, cleanName string) (string, error) {
+	if cleanName == "." {
+		return filepath.Join(root, "."), nil
+	}
+
+	parentPath, err := resolveInRoot(root, filepath.Dir(cleanName))
+	if err != nil {
+		return "", errorspkg.Wrapf(err, "resolving the parent directory of `%s`", name)
+	}
+
+	return filepath.Join(parentPath, filepath.Base(cleanName)), nil
+}
+
+// resolveInRoot follows the symlinks in path as if root was the filesystem
+// root: absolute targets are relative to root and `..` never goes above it.
+// Components that don't exist yet are kept as they are.
+func resolveInRoot(root, path string) (string, error) {
+	resolved := root
+	remaining := splitPath(path)
+	followed := 0
+
+	for len(remaining) > 0 {
+		component := remaining[0]
+		remaining = remaining[1:]
+
+		switch component {
+		case ".":
+			continue
+		case "..":
+			if resolved != root {
+				resolved = filepath.Dir(resolved)
+			}
+			continue
+		}
+
+		next := filepath.Join(resolved, component)
+		info, err := os.Lstat(next)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		followed++
+		if followed > maxSymlinks {
+			return "", errorspkg.Errorf("too many levels of symbolic links in `%s`", path)
+		}
+
+		target, err := os.Readlink(next)
+		if err != nil {
+			return "", errorspkg.Wrapf(err, "reading symlink `%s`", next)
+		}
+		if filepath.IsAbs(target) {
+			resolved = root
+		}
+		remaining = append(splitPath(target), remaining...)
+	}
+
+	return resolved, nil
+}
+
+func splitPath(path string) []string {
+	components := []string{}
+	for _, component := range strings.Split(path, "/") {
+		if component != "" {
+			components = append(components, component)
+		}
+	}
+	return components
+}
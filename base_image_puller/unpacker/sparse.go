@@ -0,0 +1,89 @@
+package unpacker // import "code.cloudfoundry.org/grootfs/base_image_puller/unpacker"
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+
+	errorspkg "github.com/pkg/errors"
+)
+
+// sparseBlockSize is the granularity holes are recreated with. Only whole
+// blocks of zeros become holes, as the filesystem can't allocate less.
+const sparseBlockSize = 4096
+
+// isSparse checks whether an entry was archived as a sparse file, either in
+// the old GNU format or in one of the GNU PAX formats
+func isSparse(tarHeader *tar.Header) bool {
+	if tarHeader.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+
+	for key := range tarHeader.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// copySparse writes the contents of a sparse entry to file, seeking over the
+// blocks of zeros instead of writing them. The tar reader fills the holes of
+// the entry with zeros, so they become holes in file again.
+func copySparse(file *os.File, reader io.Reader, size int64) error {
+	buffer := make([]byte, 32*sparseBlockSize)
+	zeros := make([]byte, sparseBlockSize)
+
+	var written int64
+	for written < size {
+		n, err := io.ReadFull(reader, buffer)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		for chunk := buffer[:n]; len(chunk) > 0; {
+			blockSize := sparseBlockSize
+			if len(chunk) < blockSize {
+				blockSize = len(chunk)
+			}
+
+			if bytes.Equal(chunk[:blockSize], zeros[:blockSize]) {
+				if _, err := file.Seek(int64(blockSize), io.SeekCurrent); err != nil {
+					return err
+				}
+			} else if _, err := file.Write(chunk[:blockSize]); err != nil {
+				return err
+			}
+
+			chunk = chunk[blockSize:]
+			written += int64(blockSize)
+		}
+	}
+
+	// seeking doesn't extend the file, so trailing holes need a truncate
+	return file.Truncate(size)
+}
+
+// allocatedSize returns the space a file takes in the filesystem, which is
+// less than its size when it has holes
+func allocatedSize(path string) (int64, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return 0, errorspkg.Wrapf(err, "stating file `%s`", path)
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.Size(), nil
+	}
+
+	// st_blocks is always in 512 byte units
+	return stat.Blocks * 512, nil
+}
@@ -19,6 +19,7 @@ import (
 
 	"github.com/containers/storage/pkg/reexec"
 	"github.com/urfave/cli"
+	"golang.org/x/sys/unix"
 
 	"code.cloudfoundry.org/grootfs/base_image_puller"
 	"code.cloudfoundry.org/grootfs/groot"
@@ -70,11 +71,14 @@ func init() {
 type UnpackStrategy struct {
 	Name               string
 	WhiteoutDevicePath string
+	Xattrs             XattrFilter
+	Devices            DeviceFilter
 }
 
 type TarUnpacker struct {
-	whiteoutHandler whiteoutHandler
-	strategy        UnpackStrategy
+	whiteoutHandler  whiteoutHandler
+	strategy         UnpackStrategy
+	devicesPermitted bool
 }
 
 func NewTarUnpacker(unpackStrategy UnpackStrategy) (*TarUnpacker, error) {
@@ -97,8 +101,9 @@ func NewTarUnpacker(unpackStrategy UnpackStrategy) (*TarUnpacker, error) {
 	}
 
 	return &TarUnpacker{
-		whiteoutHandler: woHandler,
-		strategy:        unpackStrategy,
+		whiteoutHandler:  woHandler,
+		strategy:         unpackStrategy,
+		devicesPermitted: canCreateDevices(os.Getuid()),
 	}, nil
 }
 
@@ -195,6 +200,11 @@ func (u *TarUnpacker) unpack(logger lager.Logger, spec base_image_puller.UnpackS
 	logger.Info("starting")
 	defer logger.Info("ending")
 
+	ids, err := newIDMappings(spec)
+	if err != nil {
+		return base_image_puller.UnpackOutput{}, err
+	}
+
 	if err := safeMkdir(spec.TargetPath, 0755); err != nil {
 		return base_image_puller.UnpackOutput{}, err
 	}
@@ -205,9 +215,13 @@ func (u *TarUnpacker) unpack(logger lager.Logger, spec base_image_puller.UnpackS
 		return base_image_puller.UnpackOutput{}, errors.Wrap(err, "failed to chroot")
 	}
 
+	// entries are unpacked relative to the working directory, the root of
+	// the chroot, when there is no base directory
+	root := spec.BaseDirectory
 	tarReader := tar.NewReader(spec.Stream)
 	opaqueWhiteouts := []string{}
 	var totalBytesUnpacked int64
+	var skippedDevices int
 	for {
 		tarHeader, err := tarReader.Next()
 		if err == io.EOF {
@@ -216,7 +230,10 @@ func (u *TarUnpacker) unpack(logger lager.Logger, spec base_image_puller.UnpackS
 			return base_image_puller.UnpackOutput{}, err
 		}
 
-		entryPath := filepath.Join(spec.BaseDirectory, tarHeader.Name)
+		entryPath, err := safeEntryPath(root, tarHeader.Name)
+		if err != nil {
+			return base_image_puller.UnpackOutput{}, err
+		}
 
 		if strings.Contains(tarHeader.Name, ".wh..wh..opq") {
 			opaqueWhiteouts = append(opaqueWhiteouts, entryPath)
@@ -230,7 +247,13 @@ func (u *TarUnpacker) unpack(logger lager.Logger, spec base_image_puller.UnpackS
 			continue
 		}
 
-		entrySize, err := u.handleEntry(entryPath, tarReader, tarHeader, spec)
+		if isDevice(tarHeader) && !u.createsDevice(tarHeader) {
+			logger.Debug("skipping-device", lager.Data{"path": entryPath, "major": tarHeader.Devmajor, "minor": tarHeader.Devminor})
+			skippedDevices++
+			continue
+		}
+
+		entrySize, err := u.handleEntry(logger, root, entryPath, tarReader, tarHeader, ids)
 		if err != nil {
 			return base_image_puller.UnpackOutput{}, err
 		}
@@ -241,32 +264,39 @@ func (u *TarUnpacker) unpack(logger lager.Logger, spec base_image_puller.UnpackS
 	return base_image_puller.UnpackOutput{
 		BytesWritten:    totalBytesUnpacked,
 		OpaqueWhiteouts: opaqueWhiteouts,
+		SkippedDevices:  skippedDevices,
 	}, nil
 }
 
-func (u *TarUnpacker) handleEntry(entryPath string, tarReader *tar.Reader, tarHeader *tar.Header, spec base_image_puller.UnpackSpec) (entrySize int64, err error) {
+func (u *TarUnpacker) handleEntry(logger lager.Logger, root, entryPath string, tarReader *tar.Reader, tarHeader *tar.Header, ids idMappings) (entrySize int64, err error) {
 	switch tarHeader.Typeflag {
 	case tar.TypeBlock, tar.TypeChar:
-		// ignore devices
-		return 0, nil
+		if err = u.createDevice(entryPath, tarHeader, ids); err != nil {
+			return 0, err
+		}
+
+	case tar.TypeFifo:
+		if err = u.createFifo(entryPath, tarHeader, ids); err != nil {
+			return 0, err
+		}
 
 	case tar.TypeLink:
-		if err = u.createLink(entryPath, tarHeader); err != nil {
+		if err = u.createLink(root, entryPath, tarHeader); err != nil {
 			return 0, err
 		}
 
 	case tar.TypeSymlink:
-		if err = u.createSymlink(entryPath, tarHeader, spec); err != nil {
+		if err = u.createSymlink(entryPath, tarHeader, ids); err != nil {
 			return 0, err
 		}
 
 	case tar.TypeDir:
-		if err = u.createDirectory(entryPath, tarHeader, spec); err != nil {
+		if err = u.createDirectory(logger, entryPath, tarHeader, ids); err != nil {
 			return 0, err
 		}
 
-	case tar.TypeReg, tar.TypeRegA:
-		if entrySize, err = u.createRegularFile(entryPath, tarHeader, tarReader, spec); err != nil {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+		if entrySize, err = u.createRegularFile(logger, entryPath, tarHeader, tarReader, ids); err != nil {
 			return 0, err
 		}
 	}
@@ -274,8 +304,14 @@ func (u *TarUnpacker) handleEntry(entryPath string, tarReader *tar.Reader, tarHe
 	return entrySize, nil
 }
 
-func (u *TarUnpacker) createDirectory(path string, tarHeader *tar.Header, spec base_image_puller.UnpackSpec) error {
-	if _, err := os.Stat(path); err != nil {
+func (u *TarUnpacker) createDirectory(logger lager.Logger, path string, tarHeader *tar.Header, ids idMappings) error {
+	// a symlink in place of the directory would make the chown and chmod
+	// below apply to its target
+	if err := removeExistingFile(path); err != nil {
+		return err
+	}
+
+	if _, err := os.Lstat(path); err != nil {
 		if err = os.Mkdir(path, tarHeader.FileInfo().Mode()); err != nil {
 			newErr := errors.Wrapf(err, "creating directory `%s`", path)
 
@@ -289,8 +325,10 @@ func (u *TarUnpacker) createDirectory(path string, tarHeader *tar.Header, spec b
 	}
 
 	if os.Getuid() == 0 {
-		uid := u.translateID(tarHeader.Uid, spec.UIDMappings)
-		gid := u.translateID(tarHeader.Gid, spec.GIDMappings)
+		uid, gid, err := ids.hostOwner(tarHeader)
+		if err != nil {
+			return err
+		}
 		if err := os.Chown(path, uid, gid); err != nil {
 			return errors.Wrapf(err, "chowning directory %d:%d `%s`", uid, gid, path)
 		}
@@ -301,6 +339,10 @@ func (u *TarUnpacker) createDirectory(path string, tarHeader *tar.Header, spec b
 		return errors.Wrapf(err, "chmoding directory `%s`", path)
 	}
 
+	if err := u.setXattrs(logger, path, tarHeader, ids); err != nil {
+		return err
+	}
+
 	if err := changeModTime(path, tarHeader.ModTime); err != nil {
 		return errors.Wrapf(err, "setting the modtime for directory `%s`: %s", path)
 	}
@@ -308,7 +350,7 @@ func (u *TarUnpacker) createDirectory(path string, tarHeader *tar.Header, spec b
 	return nil
 }
 
-func (u *TarUnpacker) createSymlink(path string, tarHeader *tar.Header, spec base_image_puller.UnpackSpec) error {
+func (u *TarUnpacker) createSymlink(path string, tarHeader *tar.Header, ids idMappings) error {
 	if _, err := os.Lstat(path); err == nil {
 		if err := os.Remove(path); err != nil {
 			return errors.Wrapf(err, "removing file `%s`", path)
@@ -324,8 +366,10 @@ func (u *TarUnpacker) createSymlink(path string, tarHeader *tar.Header, spec bas
 	}
 
 	if os.Getuid() == 0 {
-		uid := u.translateID(tarHeader.Uid, spec.UIDMappings)
-		gid := u.translateID(tarHeader.Gid, spec.GIDMappings)
+		uid, gid, err := ids.hostOwner(tarHeader)
+		if err != nil {
+			return err
+		}
 
 		if err := os.Lchown(path, uid, gid); err != nil {
 			return errors.Wrapf(err, "chowning link %d:%d `%s`", uid, gid, path)
@@ -335,11 +379,107 @@ func (u *TarUnpacker) createSymlink(path string, tarHeader *tar.Header, spec bas
 	return nil
 }
 
-func (u *TarUnpacker) createLink(path string, tarHeader *tar.Header) error {
-	return os.Link(tarHeader.Linkname, path)
+func isDevice(tarHeader *tar.Header) bool {
+	return tarHeader.Typeflag == tar.TypeBlock || tarHeader.Typeflag == tar.TypeChar
+}
+
+func (u *TarUnpacker) createsDevice(tarHeader *tar.Header) bool {
+	return u.devicesPermitted && u.strategy.Devices.allows(tarHeader.Devmajor, tarHeader.Devminor)
 }
 
-func (u *TarUnpacker) createRegularFile(path string, tarHeader *tar.Header, tarReader *tar.Reader, spec base_image_puller.UnpackSpec) (int64, error) {
+func (u *TarUnpacker) createDevice(path string, tarHeader *tar.Header, ids idMappings) error {
+	if err := removeExisting(path); err != nil {
+		return err
+	}
+
+	mode := uint32(tarHeader.Mode & 07777)
+	if tarHeader.Typeflag == tar.TypeBlock {
+		mode |= unix.S_IFBLK
+	} else {
+		mode |= unix.S_IFCHR
+	}
+	device := unix.Mkdev(uint32(tarHeader.Devmajor), uint32(tarHeader.Devminor))
+	if err := unix.Mknod(path, mode, int(device)); err != nil {
+		return errors.Wrapf(err, "creating device `%s`", path)
+	}
+
+	return u.setSpecialFileAttributes(path, tarHeader, ids)
+}
+
+func (u *TarUnpacker) createFifo(path string, tarHeader *tar.Header, ids idMappings) error {
+	if err := removeExisting(path); err != nil {
+		return err
+	}
+
+	if err := unix.Mkfifo(path, uint32(tarHeader.Mode&07777)); err != nil {
+		return errors.Wrapf(err, "creating fifo `%s`", path)
+	}
+
+	return u.setSpecialFileAttributes(path, tarHeader, ids)
+}
+
+// setSpecialFileAttributes sets the owner, permissions and modtime of
+// devices and fifos
+func (u *TarUnpacker) setSpecialFileAttributes(path string, tarHeader *tar.Header, ids idMappings) error {
+	if os.Getuid() == 0 {
+		uid, gid, err := ids.hostOwner(tarHeader)
+		if err != nil {
+			return err
+		}
+		if err := os.Lchown(path, uid, gid); err != nil {
+			return errors.Wrapf(err, "chowning %d:%d `%s`", uid, gid, path)
+		}
+	}
+
+	// we need to explicitly apply perms because mknod is subject to umask
+	if err := os.Chmod(path, tarHeader.FileInfo().Mode()); err != nil {
+		return errors.Wrapf(err, "chmoding `%s`", path)
+	}
+
+	if err := changeModTime(path, tarHeader.ModTime); err != nil {
+		return errors.Wrapf(err, "setting the modtime for `%s`", path)
+	}
+
+	return nil
+}
+
+func removeExisting(path string) error {
+	if _, err := os.Lstat(path); err == nil {
+		if err := os.Remove(path); err != nil {
+			return errors.Wrapf(err, "removing file `%s`", path)
+		}
+	}
+
+	return nil
+}
+
+// removeExistingFile removes whatever is at path unless it is a directory
+func removeExistingFile(path string) error {
+	if info, err := os.Lstat(path); err == nil && !info.IsDir() {
+		if err := os.Remove(path); err != nil {
+			return errors.Wrapf(err, "removing file `%s`", path)
+		}
+	}
+
+	return nil
+}
+
+func (u *TarUnpacker) createLink(root, path string, tarHeader *tar.Header) error {
+	targetPath, err := hardLinkTarget(root, tarHeader)
+	if err != nil {
+		return err
+	}
+
+	return os.Link(targetPath, path)
+}
+
+func (u *TarUnpacker) createRegularFile(logger lager.Logger, path string, tarHeader *tar.Header, tarReader *tar.Reader, ids idMappings) (int64, error) {
+	// the file is replaced rather than truncated, so that existing symlinks
+	// and hard links are not written through
+	if err := removeExistingFile(path); err != nil {
+		return 0, err
+	}
+
 	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, tarHeader.FileInfo().Mode())
 	if err != nil {
 		newErr := errors.Wrapf(err, "creating file `%s`", path)
@@ -352,7 +492,13 @@ func (u *TarUnpacker) createRegularFile(path string, tarHeader *tar.Header, tarR
 		return 0, newErr
 	}
 
-	fileSize, err := io.Copy(file, tarReader)
+	sparse := isSparse(tarHeader)
+	fileSize := tarHeader.Size
+	if sparse {
+		err = copySparse(file, tarReader, tarHeader.Size)
+	} else {
+		fileSize, err = io.Copy(file, tarReader)
+	}
 	if err != nil {
 		_ = file.Close()
 		return 0, errors.Wrapf(err, "writing to file `%s`", path)
@@ -362,9 +508,18 @@ func (u *TarUnpacker) createRegularFile(path string, tarHeader *tar.Header, tarR
 		return 0, errors.Wrapf(err, "closing file `%s`", path)
 	}
 
+	// holes don't take space in the volume, so they are not counted
+	if sparse {
+		if fileSize, err = allocatedSize(path); err != nil {
+			return 0, err
+		}
+	}
+
 	if os.Getuid() == 0 {
-		uid := u.translateID(tarHeader.Uid, spec.UIDMappings)
-		gid := u.translateID(tarHeader.Gid, spec.GIDMappings)
+		uid, gid, err := ids.hostOwner(tarHeader)
+		if err != nil {
+			return 0, err
+		}
 		if err := os.Chown(path, uid, gid); err != nil {
 			return 0, errors.Wrapf(err, "chowning file %d:%d `%s`", uid, gid, path)
 		}
@@ -375,6 +530,11 @@ func (u *TarUnpacker) createRegularFile(path string, tarHeader *tar.Header, tarR
 		return 0, errors.Wrapf(err, "chmoding file `%s`", path)
 	}
 
+	// chown drops file capabilities, so they are set after it
+	if err := u.setXattrs(logger, path, tarHeader, ids); err != nil {
+		return 0, err
+	}
+
 	if err := changeModTime(path, tarHeader.ModTime); err != nil {
 		return 0, errors.Wrapf(err, "setting the modtime for file `%s`", path)
 	}
@@ -382,6 +542,43 @@ func (u *TarUnpacker) createRegularFile(path string, tarHeader *tar.Header, tarR
 	return fileSize, nil
 }
 
+// setXattrs applies the extended attributes that the unpack strategy allows.
+// File capabilities are only rewritten for the root of the user namespace
+// when there are id mappings. Attributes that the filesystem doesn't support,
+// or that the user is not allowed to set, are skipped. The kernel rejects the
+// values it doesn't understand outside the `user.` namespace with EINVAL, so
+// those are skipped as well.
+func (u *TarUnpacker) setXattrs(logger lager.Logger, path string, tarHeader *tar.Header, ids idMappings) error {
+	for name, value := range tarHeader.Xattrs {
+		if !u.strategy.Xattrs.allows(name) {
+			logger.Debug("skipping-xattr", lager.Data{"path": path, "xattr": name})
+			continue
+		}
+
+		data := []byte(value)
+		if name == capabilityXattr && !ids.uids.Empty() {
+			rootID, err := ids.uids.HostID(0)
+			if err != nil {
+				return errors.Wrapf(err, "translating the root id of the capabilities of `%s`", path)
+			}
+			data, err = namespacedCapability(data, rootID)
+			if err != nil {
+				return errors.Wrapf(err, "rewriting the capabilities of `%s`", path)
+			}
+		}
+
+		if err := unix.Lsetxattr(path, name, data, 0); err != nil {
+			if err == unix.ENOTSUP || err == unix.EPERM || (err == unix.EINVAL && !inXattrNamespace(name, "user")) {
+				logger.Info("xattr-not-set", lager.Data{"path": path, "xattr": name, "error": err.Error()})
+				continue
+			}
+			return errors.Wrapf(err, "setting xattr `%s` on `%s`", name, path)
+		}
+	}
+
+	return nil
+}
+
 func cleanWhiteoutDir(path string) error {
 	contents, err := ioutil.ReadDir(path)
 	if err != nil {
@@ -397,32 +594,38 @@ func cleanWhiteoutDir(path string) error {
 	return nil
 }
 
-func (u *TarUnpacker) translateID(id int, mappings []groot.IDMappingSpec) int {
-	if id == 0 {
-		return u.translateRootID(mappings)
-	}
+// idMappings translate the owners of the layer entries to host IDs
+type idMappings struct {
+	uids groot.IDMap
+	gids groot.IDMap
+}
 
-	for _, mapping := range mappings {
-		if mapping.Size == 1 {
-			continue
-		}
+func newIDMappings(spec base_image_puller.UnpackSpec) (idMappings, error) {
+	uids, err := groot.NewIDMap(spec.UIDMappings)
+	if err != nil {
+		return idMappings{}, errors.Wrap(err, "invalid uid mappings")
+	}
 
-		if id >= mapping.NamespaceID && id < mapping.NamespaceID+mapping.Size {
-			return mapping.HostID + id - 1
-		}
+	gids, err := groot.NewIDMap(spec.GIDMappings)
+	if err != nil {
+		return idMappings{}, errors.Wrap(err, "invalid gid mappings")
 	}
 
-	return id
+	return idMappings{uids: uids, gids: gids}, nil
 }
 
-func (u *TarUnpacker) translateRootID(mappings []groot.IDMappingSpec) int {
-	for _, mapping := range mappings {
-		if mapping.Size == 1 {
-			return mapping.HostID
-		}
+func (m idMappings) hostOwner(tarHeader *tar.Header) (int, int, error) {
+	uid, err := m.uids.HostID(tarHeader.Uid)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "translating the owner of `%s`", tarHeader.Name)
+	}
+
+	gid, err := m.gids.HostID(tarHeader.Gid)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "translating the group of `%s`", tarHeader.Name)
 	}
 
-	return 0
+	return uid, gid, nil
 }
 
 func chroot(path string) error {
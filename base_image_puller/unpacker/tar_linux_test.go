@@ -1,20 +1,25 @@
 package unpacker_test
 
 import (
+	"archive/tar"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"os/exec"
 	"path"
+	"syscall"
 	"time"
 
 	"code.cloudfoundry.org/grootfs/base_image_puller"
 	"code.cloudfoundry.org/grootfs/base_image_puller/unpacker"
+	"code.cloudfoundry.org/grootfs/groot"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/lager/lagertest"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gbytes"
 	"github.com/onsi/gomega/gexec"
+	"golang.org/x/sys/unix"
 )
 
 var _ = Describe("Tar unpacker - Linux tests", func() {
@@ -52,20 +57,91 @@ var _ = Describe("Tar unpacker - Linux tests", func() {
 		Expect(os.RemoveAll(targetPath)).To(Succeed())
 	})
 
-	Describe("Devices files", func() {
-		BeforeEach(func() {
-			Expect(exec.Command("sudo", "mknod", path.Join(baseImagePath, "a_device"), "c", "1", "8").Run()).To(Succeed())
-		})
+	Describe("devices and fifos", func() {
+		var unpackOutput base_image_puller.UnpackOutput
 
-		It("excludes them", func() {
-			_, err := tarUnpacker.Unpack(logger, base_image_puller.UnpackSpec{
+		JustBeforeEach(func() {
+			buffer := gbytes.NewBuffer()
+			tarWriter := tar.NewWriter(buffer)
+			Expect(tarWriter.WriteHeader(&tar.Header{
+				Name: "null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3,
+			})).To(Succeed())
+			Expect(tarWriter.WriteHeader(&tar.Header{
+				Name: "loop0", Typeflag: tar.TypeBlock, Mode: 0660, Devmajor: 7, Devminor: 0,
+			})).To(Succeed())
+			Expect(tarWriter.WriteHeader(&tar.Header{
+				Name: "a_fifo", Typeflag: tar.TypeFifo, Mode: 0640, Uid: 1000, Gid: 1000,
+			})).To(Succeed())
+			Expect(tarWriter.Close()).To(Succeed())
+			stream = buffer
+
+			var err error
+			unpackOutput, err = tarUnpacker.Unpack(logger, base_image_puller.UnpackSpec{
 				Stream:     stream,
 				TargetPath: targetPath,
 			})
 			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("creates fifos", func() {
+			stat, err := os.Lstat(path.Join(targetPath, "a_fifo"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stat.Mode() & os.ModeNamedPipe).To(Equal(os.ModeNamedPipe))
+			Expect(stat.Mode().Perm()).To(Equal(os.FileMode(0640)))
+			Expect(stat.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(1000)))
+		})
+
+		It("creates devices as root", func() {
+			stat, err := os.Lstat(path.Join(targetPath, "null"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stat.Mode() & os.ModeCharDevice).To(Equal(os.ModeCharDevice))
+			Expect(stat.Mode().Perm()).To(Equal(os.FileMode(0666)))
+			Expect(stat.Sys().(*syscall.Stat_t).Rdev).To(Equal(unix.Mkdev(1, 3)))
+
+			stat, err = os.Lstat(path.Join(targetPath, "loop0"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stat.Mode() & os.ModeDevice).To(Equal(os.ModeDevice))
+			Expect(stat.Mode() & os.ModeCharDevice).To(BeZero())
+			Expect(stat.Sys().(*syscall.Stat_t).Rdev).To(Equal(unix.Mkdev(7, 0)))
+
+			Expect(unpackOutput.SkippedDevices).To(BeZero())
+		})
+
+		Context("when devices are skipped", func() {
+			BeforeEach(func() {
+				var err error
+				tarUnpacker, err = unpacker.NewTarUnpacker(unpacker.UnpackStrategy{
+					Name:    "defaultfs",
+					Devices: unpacker.DeviceFilter{Skip: true},
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("excludes them and reports how many were skipped", func() {
+				Expect(path.Join(targetPath, "null")).NotTo(BeAnExistingFile())
+				Expect(path.Join(targetPath, "loop0")).NotTo(BeAnExistingFile())
+				Expect(path.Join(targetPath, "a_fifo")).To(BeAnExistingFile())
+				Expect(unpackOutput.SkippedDevices).To(Equal(2))
+			})
+		})
+
+		Context("when only some devices are allowed", func() {
+			BeforeEach(func() {
+				var err error
+				tarUnpacker, err = unpacker.NewTarUnpacker(unpacker.UnpackStrategy{
+					Name: "defaultfs",
+					Devices: unpacker.DeviceFilter{
+						AllowedDevices: []unpacker.DeviceNumber{{Major: 1, Minor: 3}},
+					},
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
 
-			filePath := path.Join(targetPath, "a_device")
-			Expect(filePath).ToNot(BeAnExistingFile())
+			It("only creates those", func() {
+				Expect(path.Join(targetPath, "null")).To(BeAnExistingFile())
+				Expect(path.Join(targetPath, "loop0")).NotTo(BeAnExistingFile())
+				Expect(unpackOutput.SkippedDevices).To(Equal(1))
+			})
 		})
 	})
 
@@ -112,4 +188,442 @@ var _ = Describe("Tar unpacker - Linux tests", func() {
 			Expect(symlinkFi.ModTime().Unix()).To(Equal(symlinkModTime.Unix()))
 		})
 	})
+
+	Describe("extended attributes", func() {
+		var (
+			xattrs      map[string]string
+			capability  []byte
+			uidMappings []groot.IDMappingSpec
+		)
+
+		unpack := func() error {
+			_, err := tarUnpacker.Unpack(logger, base_image_puller.UnpackSpec{
+				Stream:      stream,
+				TargetPath:  targetPath,
+				UIDMappings: uidMappings,
+				GIDMappings: uidMappings,
+			})
+			return err
+		}
+
+		getXattr := func(path, name string) ([]byte, error) {
+			value := make([]byte, 256)
+			size, err := unix.Lgetxattr(path, name, value)
+			if err != nil {
+				return nil, err
+			}
+			return value[:size], nil
+		}
+
+		BeforeEach(func() {
+			uidMappings = nil
+			// cap_net_raw+ep
+			capability = []byte{
+				0x01, 0x00, 0x00, 0x02,
+				0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			}
+			xattrs = map[string]string{
+				"user.groot":             "hello",
+				"security.capability":    string(capability),
+				"trusted.overlay.opaque": "y",
+			}
+		})
+
+		JustBeforeEach(func() {
+			buffer := gbytes.NewBuffer()
+			tarWriter := tar.NewWriter(buffer)
+			Expect(tarWriter.WriteHeader(&tar.Header{
+				Name: "a_dir/", Typeflag: tar.TypeDir, Mode: 0755,
+				Xattrs: map[string]string{"user.groot": "hello-dir"},
+			})).To(Succeed())
+			Expect(tarWriter.WriteHeader(&tar.Header{
+				Name: "a_dir/ping", Typeflag: tar.TypeReg, Mode: 0755, Size: 4,
+				Xattrs: xattrs,
+			})).To(Succeed())
+			_, err := tarWriter.Write([]byte("ping"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tarWriter.Close()).To(Succeed())
+			stream = buffer
+		})
+
+		It("preserves them on files and directories", func() {
+			Expect(unpack()).To(Succeed())
+
+			value, err := getXattr(path.Join(targetPath, "a_dir"), "user.groot")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(value)).To(Equal("hello-dir"))
+
+			value, err = getXattr(path.Join(targetPath, "a_dir", "ping"), "user.groot")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(value)).To(Equal("hello"))
+
+			value, err = getXattr(path.Join(targetPath, "a_dir", "ping"), "security.capability")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal(capability))
+		})
+
+		It("does not take overlay metadata from the image", func() {
+			Expect(unpack()).To(Succeed())
+
+			_, err := getXattr(path.Join(targetPath, "a_dir", "ping"), "trusted.overlay.opaque")
+			Expect(err).To(Equal(unix.ENODATA))
+		})
+
+		Context("when the capabilities use the v1 format", func() {
+			BeforeEach(func() {
+				xattrs["security.capability"] = string([]byte{
+					0x01, 0x00, 0x00, 0x01,
+					0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				})
+			})
+
+			It("doesn't rewrite them and skips them when the kernel rejects them", func() {
+				Expect(unpack()).To(Succeed())
+
+				_, err := getXattr(path.Join(targetPath, "a_dir", "ping"), "security.capability")
+				Expect(err).To(Equal(unix.ENODATA))
+				Expect(logger.(*lagertest.TestLogger).LogMessages()).To(ContainElement("test-store.chroot.unpacking-with-tar.xattr-not-set"))
+			})
+		})
+
+		Context("when the capabilities are invalid", func() {
+			BeforeEach(func() {
+				xattrs["security.capability"] = "not-a-capability"
+			})
+
+			It("skips them", func() {
+				Expect(unpack()).To(Succeed())
+
+				_, err := getXattr(path.Join(targetPath, "a_dir", "ping"), "security.capability")
+				Expect(err).To(Equal(unix.ENODATA))
+				_, err = getXattr(path.Join(targetPath, "a_dir", "ping"), "user.groot")
+				Expect(err).NotTo(HaveOccurred())
+			})
+		})
+
+		Context("when id mappings are provided", func() {
+			BeforeEach(func() {
+				uidMappings = []groot.IDMappingSpec{
+					groot.IDMappingSpec{HostID: 1000, NamespaceID: 0, Size: 1},
+					groot.IDMappingSpec{HostID: 11, NamespaceID: 1, Size: 900},
+				}
+			})
+
+			It("only grants the capabilities to the namespace's root", func() {
+				Expect(unpack()).To(Succeed())
+
+				value, err := getXattr(path.Join(targetPath, "a_dir", "ping"), "security.capability")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(Equal(append([]byte{
+					0x01, 0x00, 0x00, 0x03,
+					0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+					0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				}, 0xe8, 0x03, 0x00, 0x00)))
+			})
+
+			Context("when the capabilities use the v1 format", func() {
+				BeforeEach(func() {
+					xattrs["security.capability"] = string([]byte{
+						0x01, 0x00, 0x00, 0x01,
+						0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+					})
+				})
+
+				It("rewrites them in the v3 format", func() {
+					Expect(unpack()).To(Succeed())
+
+					value, err := getXattr(path.Join(targetPath, "a_dir", "ping"), "security.capability")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(value).To(Equal(append([]byte{
+						0x01, 0x00, 0x00, 0x03,
+						0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+						0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+					}, 0xe8, 0x03, 0x00, 0x00)))
+				})
+			})
+
+			Context("when the capabilities are invalid", func() {
+				BeforeEach(func() {
+					xattrs["security.capability"] = "not-a-capability"
+				})
+
+				It("returns an error", func() {
+					Expect(unpack()).To(MatchError(ContainSubstring("rewriting the capabilities of `a_dir/ping`")))
+				})
+			})
+		})
+
+		Context("when namespaces are denied", func() {
+			BeforeEach(func() {
+				var err error
+				tarUnpacker, err = unpacker.NewTarUnpacker(unpacker.UnpackStrategy{
+					Name:   "defaultfs",
+					Xattrs: unpacker.XattrFilter{DeniedNamespaces: []string{"security.capability"}},
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("skips them", func() {
+				Expect(unpack()).To(Succeed())
+
+				_, err := getXattr(path.Join(targetPath, "a_dir", "ping"), "security.capability")
+				Expect(err).To(Equal(unix.ENODATA))
+				_, err = getXattr(path.Join(targetPath, "a_dir", "ping"), "user.groot")
+				Expect(err).NotTo(HaveOccurred())
+			})
+		})
+
+		Context("when only some namespaces are allowed", func() {
+			BeforeEach(func() {
+				var err error
+				tarUnpacker, err = unpacker.NewTarUnpacker(unpacker.UnpackStrategy{
+					Name:   "defaultfs",
+					Xattrs: unpacker.XattrFilter{AllowedNamespaces: []string{"security"}},
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("skips the others", func() {
+				Expect(unpack()).To(Succeed())
+
+				_, err := getXattr(path.Join(targetPath, "a_dir", "ping"), "user.groot")
+				Expect(err).To(Equal(unix.ENODATA))
+				_, err = getXattr(path.Join(targetPath, "a_dir", "ping"), "security.capability")
+				Expect(err).NotTo(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("sparse files", func() {
+		var tarFormat string
+
+		BeforeEach(func() {
+			tarFormat = "gnu"
+
+			file, err := os.Create(path.Join(baseImagePath, "sparse"))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = file.WriteAt([]byte("hello"), 0)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = file.WriteAt([]byte("world"), 32*1024*1024)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Truncate(64 * 1024 * 1024)).To(Succeed())
+			Expect(file.Close()).To(Succeed())
+		})
+
+		JustBeforeEach(func() {
+			stream = gbytes.NewBuffer()
+			sess, err := gexec.Start(exec.Command("tar", "-c", "--sparse", "--format", tarFormat, "-C", baseImagePath, "."), stream, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(sess).Should(gexec.Exit(0))
+		})
+
+		expectSparseFile := func() {
+			unpackOutput, err := tarUnpacker.Unpack(logger, base_image_puller.UnpackSpec{
+				Stream:     stream,
+				TargetPath: targetPath,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			filePath := path.Join(targetPath, "sparse")
+			stat, err := os.Stat(filePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stat.Size()).To(Equal(int64(64 * 1024 * 1024)))
+			allocated := stat.Sys().(*syscall.Stat_t).Blocks * 512
+			Expect(allocated).To(BeNumerically("<", 1024*1024))
+
+			contents, err := ioutil.ReadFile(filePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents[:5])).To(Equal("hello"))
+			Expect(string(contents[32*1024*1024 : 32*1024*1024+5])).To(Equal("world"))
+			Expect(contents[5 : 32*1024*1024]).To(Equal(make([]byte, 32*1024*1024-5)))
+
+			Expect(unpackOutput.BytesWritten).To(Equal(allocated))
+		}
+
+		It("recreates the holes of GNU sparse entries", func() {
+			expectSparseFile()
+		})
+
+		Context("when the entries are in the PAX sparse format", func() {
+			BeforeEach(func() {
+				tarFormat = "posix"
+			})
+
+			It("recreates the holes", func() {
+				expectSparseFile()
+			})
+		})
+	})
+
+	Describe("hostile layers", func() {
+		var parentPath string
+
+		BeforeEach(func() {
+			var err error
+			parentPath, err = ioutil.TempDir("", "hostile-")
+			Expect(err).NotTo(HaveOccurred())
+			targetPath = path.Join(parentPath, "rootfs")
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(parentPath)).To(Succeed())
+		})
+
+		hostileTar := func(headers ...*tar.Header) *gbytes.Buffer {
+			buffer := gbytes.NewBuffer()
+			tarWriter := tar.NewWriter(buffer)
+			for _, header := range headers {
+				if header.Typeflag == tar.TypeReg {
+					header.Size = int64(len("hostile"))
+				}
+				if header.Mode == 0 {
+					header.Mode = 0755
+				}
+				Expect(tarWriter.WriteHeader(header)).To(Succeed())
+				if header.Typeflag == tar.TypeReg {
+					_, err := tarWriter.Write([]byte("hostile"))
+					Expect(err).NotTo(HaveOccurred())
+				}
+			}
+			Expect(tarWriter.Close()).To(Succeed())
+			return buffer
+		}
+
+		unpack := func(stream *gbytes.Buffer) error {
+			_, err := tarUnpacker.Unpack(logger, base_image_puller.UnpackSpec{
+				Stream:     stream,
+				TargetPath: targetPath,
+			})
+			return err
+		}
+
+		expectNothingOutsideTarget := func() {
+			entries, err := ioutil.ReadDir(parentPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Name()).To(Equal("rootfs"))
+		}
+
+		It("rejects entries that go above the root", func() {
+			err := unpack(hostileTar(&tar.Header{Name: "../escape", Typeflag: tar.TypeReg}))
+			Expect(err).To(MatchError(ContainSubstring("entry `../escape` is outside of the layer")))
+
+			err = unpack(hostileTar(&tar.Header{Name: "a_dir/../../escape", Typeflag: tar.TypeReg}))
+			Expect(err).To(MatchError(ContainSubstring("entry `a_dir/../../escape` is outside of the layer")))
+
+			expectNothingOutsideTarget()
+		})
+
+		It("rejects hard links to files above the root", func() {
+			err := unpack(hostileTar(&tar.Header{
+				Name: "passwd", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd",
+			}))
+			Expect(err).To(MatchError(ContainSubstring("hard link `passwd` points to `../../etc/passwd`, outside of the layer")))
+
+			Expect(path.Join(targetPath, "passwd")).NotTo(BeAnExistingFile())
+			expectNothingOutsideTarget()
+		})
+
+		It("unpacks absolute entries inside the root", func() {
+			Expect(unpack(hostileTar(
+				&tar.Header{Name: "/abs/", Typeflag: tar.TypeDir},
+				&tar.Header{Name: "/abs/file", Typeflag: tar.TypeReg},
+			))).To(Succeed())
+
+			Expect(path.Join(targetPath, "abs", "file")).To(BeAnExistingFile())
+			expectNothingOutsideTarget()
+		})
+
+		It("resolves absolute symlinks in parent directories inside the root", func() {
+			Expect(unpack(hostileTar(
+				&tar.Header{Name: "usr/", Typeflag: tar.TypeDir},
+				&tar.Header{Name: "usr/lib/", Typeflag: tar.TypeDir},
+				&tar.Header{Name: "lib", Typeflag: tar.TypeSymlink, Linkname: "/usr/lib"},
+				&tar.Header{Name: "lib/file", Typeflag: tar.TypeReg},
+			))).To(Succeed())
+
+			Expect(path.Join(targetPath, "usr", "lib", "file")).To(BeAnExistingFile())
+			expectNothingOutsideTarget()
+		})
+
+		It("resolves relative symlinks above the root to the root", func() {
+			Expect(unpack(hostileTar(
+				&tar.Header{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "../../.."},
+				&tar.Header{Name: "up/file", Typeflag: tar.TypeReg},
+			))).To(Succeed())
+
+			Expect(path.Join(targetPath, "file")).To(BeAnExistingFile())
+			expectNothingOutsideTarget()
+		})
+
+		It("replaces symlinks with files instead of writing through them", func() {
+			Expect(unpack(hostileTar(
+				&tar.Header{Name: "target", Typeflag: tar.TypeReg},
+				&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "target"},
+				&tar.Header{Name: "link", Typeflag: tar.TypeReg, Mode: 0600},
+			))).To(Succeed())
+
+			stat, err := os.Lstat(path.Join(targetPath, "link"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stat.Mode().IsRegular()).To(BeTrue())
+
+			stat, err = os.Stat(path.Join(targetPath, "target"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stat.Mode().Perm()).To(Equal(os.FileMode(0755)))
+		})
+
+		It("replaces symlinks with directories", func() {
+			Expect(unpack(hostileTar(
+				&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/"},
+				&tar.Header{Name: "link/", Typeflag: tar.TypeDir},
+			))).To(Succeed())
+
+			stat, err := os.Lstat(path.Join(targetPath, "link"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stat.IsDir()).To(BeTrue())
+		})
+
+		It("fails on symlink loops", func() {
+			err := unpack(hostileTar(
+				&tar.Header{Name: "loop", Typeflag: tar.TypeSymlink, Linkname: "loop"},
+				&tar.Header{Name: "loop/file", Typeflag: tar.TypeReg},
+			))
+			Expect(err).To(MatchError(ContainSubstring("too many levels of symbolic links")))
+		})
+
+		It("never writes outside the root for a corpus of hostile layers", func() {
+			names := []string{
+				"file", "dir", "dir/file", "link", "link/file", "link/link",
+				"/abs", "./dot", "dir/../file", "../escape", "dir/../../escape",
+				"link/../../escape",
+			}
+			linknames := []string{
+				"/", "..", "../..", "../../..", "/..", "dir", "link", "../escape",
+				"/etc/passwd", "dir/../..",
+			}
+			types := []byte{tar.TypeReg, tar.TypeDir, tar.TypeSymlink, tar.TypeLink}
+
+			random := rand.New(rand.NewSource(GinkgoRandomSeed()))
+			for i := 0; i < 100; i++ {
+				headers := []*tar.Header{}
+				for j := 0; j < 1+random.Intn(6); j++ {
+					header := &tar.Header{
+						Name:     names[random.Intn(len(names))],
+						Typeflag: types[random.Intn(len(types))],
+					}
+					if header.Typeflag == tar.TypeSymlink || header.Typeflag == tar.TypeLink {
+						header.Linkname = linknames[random.Intn(len(linknames))]
+					}
+					headers = append(headers, header)
+				}
+
+				// hostile layers either fail or unpack inside the root
+				_ = unpack(hostileTar(headers...))
+				expectNothingOutsideTarget()
+
+				Expect(os.RemoveAll(targetPath)).To(Succeed())
+			}
+		})
+	})
 })
@@ -183,13 +183,13 @@ var _ = Describe("Tar unpacker", func() {
 						TargetPath: targetPath,
 						UIDMappings: []groot.IDMappingSpec{
 							groot.IDMappingSpec{HostID: 1000, NamespaceID: 0, Size: 1},
-							groot.IDMappingSpec{HostID: 11, NamespaceID: 1, Size: 900},
-							groot.IDMappingSpec{HostID: 2001, NamespaceID: 1001, Size: 900},
+							groot.IDMappingSpec{HostID: 100001, NamespaceID: 1, Size: 1000},
+							groot.IDMappingSpec{HostID: 200001, NamespaceID: 1001, Size: 900},
 						},
 						GIDMappings: []groot.IDMappingSpec{
 							groot.IDMappingSpec{HostID: 1000, NamespaceID: 0, Size: 1},
-							groot.IDMappingSpec{HostID: 11, NamespaceID: 1, Size: 900},
-							groot.IDMappingSpec{HostID: 2001, NamespaceID: 1001, Size: 900},
+							groot.IDMappingSpec{HostID: 100001, NamespaceID: 1, Size: 1000},
+							groot.IDMappingSpec{HostID: 200001, NamespaceID: 1001, Size: 900},
 						},
 					})
 					Expect(err).NotTo(HaveOccurred())
@@ -205,22 +205,76 @@ var _ = Describe("Tar unpacker", func() {
 					Expect(filePath).To(BeARegularFile())
 					stat, err = os.Stat(filePath)
 					Expect(err).NotTo(HaveOccurred())
-					Expect(stat.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(10 + 200)))
-					Expect(stat.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(10 + 200)))
+					Expect(stat.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(100001 + 200 - 1)))
+					Expect(stat.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(100001 + 200 - 1)))
 
 					filePath = path.Join(targetPath, "1200_file")
 					Expect(filePath).To(BeARegularFile())
 					stat, err = os.Stat(filePath)
 					Expect(err).NotTo(HaveOccurred())
-					Expect(stat.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(2000 + 1200)))
-					Expect(stat.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(2000 + 1200)))
+					Expect(stat.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(200001 + 1200 - 1001)))
+					Expect(stat.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(200001 + 1200 - 1001)))
 
 					filePath = path.Join(targetPath, "groot_file")
 					Expect(filePath).To(BeARegularFile())
 					stat, err = os.Stat(filePath)
 					Expect(err).NotTo(HaveOccurred())
-					Expect(stat.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(1000)))
-					Expect(stat.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(1000)))
+					Expect(stat.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(100001 + 1000 - 1)))
+					Expect(stat.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(100001 + 1000 - 1)))
+				})
+
+				It("maps them with a single range that includes root", func() {
+					mappings := []groot.IDMappingSpec{
+						groot.IDMappingSpec{HostID: 100000, NamespaceID: 0, Size: 65536},
+					}
+					_, err := tarUnpacker.Unpack(logger, base_image_puller.UnpackSpec{
+						Stream:      stream,
+						TargetPath:  targetPath,
+						UIDMappings: mappings,
+						GIDMappings: mappings,
+					})
+					Expect(err).NotTo(HaveOccurred())
+
+					stat, err := os.Stat(path.Join(targetPath, "a_file"))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(stat.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(100000)))
+					Expect(stat.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(100000)))
+
+					stat, err = os.Stat(path.Join(targetPath, "1200_file"))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(stat.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(101200)))
+					Expect(stat.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(101200)))
+				})
+
+				Context("when an owner is not mapped", func() {
+					It("returns an error", func() {
+						mappings := []groot.IDMappingSpec{
+							groot.IDMappingSpec{HostID: 1000, NamespaceID: 0, Size: 1},
+							groot.IDMappingSpec{HostID: 100001, NamespaceID: 1, Size: 1000},
+						}
+						_, err := tarUnpacker.Unpack(logger, base_image_puller.UnpackSpec{
+							Stream:      stream,
+							TargetPath:  targetPath,
+							UIDMappings: mappings,
+							GIDMappings: mappings,
+						})
+						Expect(err).To(MatchError(ContainSubstring("translating the owner of `./1200_file`: id 1200 is not mapped")))
+					})
+				})
+
+				Context("when the mappings overlap", func() {
+					It("returns an error", func() {
+						mappings := []groot.IDMappingSpec{
+							groot.IDMappingSpec{HostID: 1000, NamespaceID: 0, Size: 1},
+							groot.IDMappingSpec{HostID: 1000, NamespaceID: 1, Size: 1000},
+						}
+						_, err := tarUnpacker.Unpack(logger, base_image_puller.UnpackSpec{
+							Stream:      stream,
+							TargetPath:  targetPath,
+							UIDMappings: mappings,
+						})
+						Expect(err).To(MatchError(ContainSubstring("invalid uid mappings")))
+					})
 				})
 			})
 		})
@@ -283,13 +337,13 @@ var _ = Describe("Tar unpacker", func() {
 						TargetPath: targetPath,
 						UIDMappings: []groot.IDMappingSpec{
 							groot.IDMappingSpec{HostID: 1000, NamespaceID: 0, Size: 1},
-							groot.IDMappingSpec{HostID: 11, NamespaceID: 1, Size: 900},
-							groot.IDMappingSpec{HostID: 2001, NamespaceID: 1001, Size: 900},
+							groot.IDMappingSpec{HostID: 100001, NamespaceID: 1, Size: 1000},
+							groot.IDMappingSpec{HostID: 200001, NamespaceID: 1001, Size: 900},
 						},
 						GIDMappings: []groot.IDMappingSpec{
 							groot.IDMappingSpec{HostID: 1000, NamespaceID: 0, Size: 1},
-							groot.IDMappingSpec{HostID: 11, NamespaceID: 1, Size: 900},
-							groot.IDMappingSpec{HostID: 2001, NamespaceID: 1001, Size: 900},
+							groot.IDMappingSpec{HostID: 100001, NamespaceID: 1, Size: 1000},
+							groot.IDMappingSpec{HostID: 200001, NamespaceID: 1001, Size: 900},
 						},
 					})
 					Expect(err).NotTo(HaveOccurred())
@@ -298,22 +352,22 @@ var _ = Describe("Tar unpacker", func() {
 					Expect(filePath).To(BeADirectory())
 					stat, err := os.Stat(filePath)
 					Expect(err).NotTo(HaveOccurred())
-					Expect(stat.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(10 + 200)))
-					Expect(stat.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(10 + 200)))
+					Expect(stat.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(100001 + 200 - 1)))
+					Expect(stat.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(100001 + 200 - 1)))
 
 					filePath = path.Join(targetPath, "1200_dir")
 					Expect(filePath).To(BeADirectory())
 					stat, err = os.Stat(filePath)
 					Expect(err).NotTo(HaveOccurred())
-					Expect(stat.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(2000 + 1200)))
-					Expect(stat.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(2000 + 1200)))
+					Expect(stat.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(200001 + 1200 - 1001)))
+					Expect(stat.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(200001 + 1200 - 1001)))
 
 					filePath = path.Join(targetPath, "groot_dir")
 					Expect(filePath).To(BeADirectory())
 					stat, err = os.Stat(filePath)
 					Expect(err).NotTo(HaveOccurred())
-					Expect(stat.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(1000)))
-					Expect(stat.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(1000)))
+					Expect(stat.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(100001 + 1000 - 1)))
+					Expect(stat.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(100001 + 1000 - 1)))
 				})
 			})
 		})
@@ -467,13 +521,13 @@ var _ = Describe("Tar unpacker", func() {
 						TargetPath: targetPath,
 						UIDMappings: []groot.IDMappingSpec{
 							groot.IDMappingSpec{HostID: 1000, NamespaceID: 0, Size: 1},
-							groot.IDMappingSpec{HostID: 11, NamespaceID: 1, Size: 900},
-							groot.IDMappingSpec{HostID: 2001, NamespaceID: 1001, Size: 900},
+							groot.IDMappingSpec{HostID: 100001, NamespaceID: 1, Size: 1000},
+							groot.IDMappingSpec{HostID: 200001, NamespaceID: 1001, Size: 900},
 						},
 						GIDMappings: []groot.IDMappingSpec{
 							groot.IDMappingSpec{HostID: 1000, NamespaceID: 0, Size: 1},
-							groot.IDMappingSpec{HostID: 11, NamespaceID: 1, Size: 900},
-							groot.IDMappingSpec{HostID: 2001, NamespaceID: 1001, Size: 900},
+							groot.IDMappingSpec{HostID: 100001, NamespaceID: 1, Size: 1000},
+							groot.IDMappingSpec{HostID: 200001, NamespaceID: 1001, Size: 900},
 						},
 					})
 					Expect(err).NotTo(HaveOccurred())
@@ -482,22 +536,22 @@ var _ = Describe("Tar unpacker", func() {
 					Expect(filePath).To(BeAnExistingFile())
 					stat, err := os.Lstat(filePath)
 					Expect(err).NotTo(HaveOccurred())
-					Expect(stat.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(10 + 200)))
-					Expect(stat.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(10 + 200)))
+					Expect(stat.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(100001 + 200 - 1)))
+					Expect(stat.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(100001 + 200 - 1)))
 
 					filePath = path.Join(targetPath, "1200_link")
 					Expect(filePath).To(BeAnExistingFile())
 					stat, err = os.Lstat(filePath)
 					Expect(err).NotTo(HaveOccurred())
-					Expect(stat.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(2000 + 1200)))
-					Expect(stat.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(2000 + 1200)))
+					Expect(stat.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(200001 + 1200 - 1001)))
+					Expect(stat.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(200001 + 1200 - 1001)))
 
 					filePath = path.Join(targetPath, "groot_link")
 					Expect(filePath).To(BeAnExistingFile())
 					stat, err = os.Lstat(filePath)
 					Expect(err).NotTo(HaveOccurred())
-					Expect(stat.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(1000)))
-					Expect(stat.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(1000)))
+					Expect(stat.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(100001 + 1000 - 1)))
+					Expect(stat.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(100001 + 1000 - 1)))
 				})
 			})
 		})
@@ -745,24 +799,22 @@ var _ = Describe("Tar unpacker", func() {
 			Expect(err).NotTo(HaveOccurred())
 		})
 
-		It("doesn't create the file outside the target path", func() {
+		It("returns an error", func() {
 			_, err := tarUnpacker.Unpack(logger, base_image_puller.UnpackSpec{
 				Stream:     stream,
 				TargetPath: targetPath,
 			})
-			Expect(err).NotTo(HaveOccurred())
-
-			Expect(filepath.Join(targetPath, "../", "file_outside_root")).ToNot(BeAnExistingFile())
+			Expect(err).To(MatchError(ContainSubstring("entry `../file_outside_root` is outside of the layer")))
 		})
 
-		It("creates the file in the root of the target path", func() {
-			_, err := tarUnpacker.Unpack(logger, base_image_puller.UnpackSpec{
+		It("doesn't create the file", func() {
+			_, _ = tarUnpacker.Unpack(logger, base_image_puller.UnpackSpec{
 				Stream:     stream,
 				TargetPath: targetPath,
 			})
-			Expect(err).NotTo(HaveOccurred())
 
-			Expect(filepath.Join(targetPath, "file_outside_root")).To(BeAnExistingFile())
+			Expect(filepath.Join(targetPath, "../", "file_outside_root")).ToNot(BeAnExistingFile())
+			Expect(filepath.Join(targetPath, "file_outside_root")).ToNot(BeAnExistingFile())
 		})
 	})
 
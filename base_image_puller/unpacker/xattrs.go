@@ -0,0 +1,102 @@
+package unpacker // import "code.cloudfoundry.org/grootfs/base_image_puller/unpacker"
+
+import (
+	"encoding/binary"
+	"strings"
+
+	errorspkg "github.com/pkg/errors"
+)
+
+// DefaultXattrNamespaces are the extended attribute namespaces that are
+// preserved when no allowed namespaces are configured. `trusted` attributes
+// are left out, as overlayfs keeps its own metadata in them.
+var DefaultXattrNamespaces = []string{"user", "security", "system"}
+
+const (
+	capabilityXattr = "security.capability"
+
+	// overlayfs metadata is never taken from an image, as it could make
+	// overlayfs look up files outside of the layer
+	overlayXattrPrefix = "trusted.overlay."
+
+	vfsCapRevisionMask   = 0xFF000000
+	vfsCapFlagsEffective = 0x000001
+	vfsCapRevision1      = 0x01000000
+	vfsCapRevision2      = 0x02000000
+	vfsCapRevision3      = 0x03000000
+	vfsCapSizeRevision1  = 12
+	vfsCapSizeRevision2  = 20
+	vfsCapSizeRevision3  = 24
+)
+
+// XattrFilter decides which extended attributes of the layer entries are
+// preserved. The entries of both lists are either namespaces, like `user`, or
+// attribute names, like `security.selinux`. Denied entries win over allowed
+// ones.
+type XattrFilter struct {
+	AllowedNamespaces []string
+	DeniedNamespaces  []string
+}
+
+func (f XattrFilter) allows(name string) bool {
+	if strings.HasPrefix(name, overlayXattrPrefix) {
+		return false
+	}
+
+	for _, denied := range f.DeniedNamespaces {
+		if inXattrNamespace(name, denied) {
+			return false
+		}
+	}
+
+	allowed := f.AllowedNamespaces
+	if len(allowed) == 0 {
+		allowed = DefaultXattrNamespaces
+	}
+	for _, namespace := range allowed {
+		if inXattrNamespace(name, namespace) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func inXattrNamespace(name, namespace string) bool {
+	return name == namespace || strings.HasPrefix(name, namespace+".")
+}
+
+// namespacedCapability rewrites a `security.capability` value in the v3
+// format, which only grants the capabilities in user namespaces whose root
+// is rootID. Inside a user namespace rootID is the namespace's root, and the
+// kernel stores the host ID it maps to instead.
+func namespacedCapability(value []byte, rootID int) ([]byte, error) {
+	if len(value) < 4 {
+		return nil, errorspkg.New("file capability is too short")
+	}
+
+	magic := binary.LittleEndian.Uint32(value)
+	var expectedSize int
+	switch magic & vfsCapRevisionMask {
+	case vfsCapRevision1:
+		expectedSize = vfsCapSizeRevision1
+	case vfsCapRevision2:
+		expectedSize = vfsCapSizeRevision2
+	case vfsCapRevision3:
+		expectedSize = vfsCapSizeRevision3
+	default:
+		return nil, errorspkg.Errorf("unsupported file capability revision %#x", magic&vfsCapRevisionMask)
+	}
+	if len(value) != expectedSize {
+		return nil, errorspkg.Errorf("file capability has %d bytes, expected %d", len(value), expectedSize)
+	}
+
+	namespaced := make([]byte, vfsCapSizeRevision3)
+	binary.LittleEndian.PutUint32(namespaced, vfsCapRevision3|(magic&vfsCapFlagsEffective))
+	// the permitted and inheritable sets; revision 1 only has the lower 32 bits
+	// and revision 3 is followed by its own root ID, which is replaced
+	copy(namespaced[4:vfsCapSizeRevision2], value[4:])
+	binary.LittleEndian.PutUint32(namespaced[vfsCapSizeRevision2:], uint32(rootID))
+
+	return namespaced, nil
+}
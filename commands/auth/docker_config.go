@@ -0,0 +1,161 @@
+package auth // import "code.cloudfoundry.org/grootfs/commands/auth"
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	helperclient "github.com/docker/docker-credential-helpers/client"
+	"github.com/docker/docker-credential-helpers/credentials"
+	errorspkg "github.com/pkg/errors"
+)
+
+const (
+	dockerHubHost      = "docker.io"
+	dockerHubServerURL = "https://index.docker.io/v1/"
+	credentialHelper   = "docker-credential-%s"
+)
+
+type Credentials struct {
+	Username string
+	Password string
+}
+
+type authEntry struct {
+	Auth     string `json:"auth"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type dockerConfigFile struct {
+	Auths       map[string]authEntry `json:"auths"`
+	CredHelpers map[string]string    `json:"credHelpers"`
+	CredsStore  string               `json:"credsStore"`
+}
+
+type DockerConfig struct {
+	path string
+}
+
+// NewDockerConfig reads registry credentials from a docker `config.json`
+// file. A missing file is the same as a file without credentials.
+func NewDockerConfig(path string) *DockerConfig {
+	return &DockerConfig{path: path}
+}
+
+// DefaultDockerConfigPath follows the docker CLI: $DOCKER_CONFIG/config.json
+// or ~/.docker/config.json
+func DefaultDockerConfigPath() string {
+	if configDir := os.Getenv("DOCKER_CONFIG"); configDir != "" {
+		return filepath.Join(configDir, "config.json")
+	}
+
+	return filepath.Join(os.Getenv("HOME"), ".docker", "config.json")
+}
+
+// Credentials returns the credentials for the registry host. Registry
+// specific `credHelpers` take precedence over the `credsStore`, which takes
+// precedence over the `auths` entries.
+func (c *DockerConfig) Credentials(registryHost string) (Credentials, error) {
+	config, err := c.read()
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	registryHost = normalizeHost(registryHost)
+
+	for host, helper := range config.CredHelpers {
+		if normalizeHost(host) == registryHost {
+			return helperCredentials(helper, registryHost)
+		}
+	}
+
+	if config.CredsStore != "" {
+		creds, err := helperCredentials(config.CredsStore, registryHost)
+		if err != nil || creds.Username != "" {
+			return creds, err
+		}
+	}
+
+	for host, entry := range config.Auths {
+		if normalizeHost(host) == registryHost {
+			return entry.credentials(host)
+		}
+	}
+
+	return Credentials{}, nil
+}
+
+func (c *DockerConfig) read() (dockerConfigFile, error) {
+	var config dockerConfigFile
+
+	contents, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return config, errorspkg.Wrap(err, "reading docker config")
+	}
+
+	if err := json.Unmarshal(contents, &config); err != nil {
+		return config, errorspkg.Wrapf(err, "parsing docker config `%s`", c.path)
+	}
+
+	return config, nil
+}
+
+func (e authEntry) credentials(host string) (Credentials, error) {
+	if e.Auth == "" {
+		return Credentials{Username: e.Username, Password: e.Password}, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(e.Auth)
+	if err != nil {
+		return Credentials{}, errorspkg.Wrapf(err, "decoding auth for `%s`", host)
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return Credentials{}, errorspkg.Errorf("invalid auth for `%s`: expected username:password", host)
+	}
+
+	return Credentials{Username: parts[0], Password: strings.Trim(parts[1], "\x00")}, nil
+}
+
+// helperCredentials runs the `docker-credential-<helper>` binary from $PATH
+func helperCredentials(helper, registryHost string) (Credentials, error) {
+	serverURL := registryHost
+	if registryHost == dockerHubHost {
+		serverURL = dockerHubServerURL
+	}
+
+	program := helperclient.NewShellProgramFunc(fmt.Sprintf(credentialHelper, helper))
+	creds, err := helperclient.Get(program, serverURL)
+	if credentials.IsErrCredentialsNotFound(err) {
+		return Credentials{}, nil
+	}
+	if err != nil {
+		return Credentials{}, errorspkg.Wrapf(err, "getting credentials for `%s` from the `%s` credential helper", registryHost, helper)
+	}
+
+	return Credentials{Username: creds.Username, Password: creds.Secret}, nil
+}
+
+// normalizeHost strips the scheme and path that docker adds to some keys,
+// e.g. `https://index.docker.io/v1/`
+func normalizeHost(host string) string {
+	host = strings.TrimPrefix(host, "https://")
+	host = strings.TrimPrefix(host, "http://")
+	host = strings.SplitN(host, "/", 2)[0]
+
+	switch host {
+	case "", "index.docker.io", "registry-1.docker.io":
+		return dockerHubHost
+	}
+
+	return host
+}
@@ -0,0 +1,194 @@
+package auth_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/grootfs/commands/auth"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DockerConfig", func() {
+	var (
+		configDir    string
+		configPath   string
+		helpersDir   string
+		originalPath string
+		dockerConfig *auth.DockerConfig
+	)
+
+	BeforeEach(func() {
+		var err error
+		configDir, err = ioutil.TempDir("", "docker-config")
+		Expect(err).NotTo(HaveOccurred())
+		configPath = filepath.Join(configDir, "config.json")
+
+		helpersDir = filepath.Join(configDir, "bin")
+		Expect(os.Mkdir(helpersDir, 0755)).To(Succeed())
+		originalPath = os.Getenv("PATH")
+		Expect(os.Setenv("PATH", helpersDir+":"+originalPath)).To(Succeed())
+
+		dockerConfig = auth.NewDockerConfig(configPath)
+	})
+
+	AfterEach(func() {
+		Expect(os.Setenv("PATH", originalPath)).To(Succeed())
+		Expect(os.RemoveAll(configDir)).To(Succeed())
+	})
+
+	writeConfig := func(contents string) {
+		Expect(ioutil.WriteFile(configPath, []byte(contents), 0600)).To(Succeed())
+	}
+
+	// writeHelper creates a docker-credential-<name> binary that returns the
+	// given secret for any server URL, and records the server URL it was given
+	writeHelper := func(name, secret string) {
+		script := fmt.Sprintf(`#!/bin/sh
+cat > %s/%s.requested
+echo '{"Username": "%s-user", "Secret": "%s"}'
+`, configDir, name, name, secret)
+		Expect(ioutil.WriteFile(filepath.Join(helpersDir, "docker-credential-"+name), []byte(script), 0755)).To(Succeed())
+	}
+
+	requestedServerURL := func(helper string) string {
+		contents, err := ioutil.ReadFile(filepath.Join(configDir, helper+".requested"))
+		Expect(err).NotTo(HaveOccurred())
+		return string(contents)
+	}
+
+	encodedAuth := func(username, password string) string {
+		return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	}
+
+	It("returns the credentials from the auths entry of the registry", func() {
+		writeConfig(fmt.Sprintf(`{"auths": {"my-registry.example.com:5000": {"auth": "%s"}, "other.example.com": {"auth": "%s"}}}`,
+			encodedAuth("groot", "i-am-groot"), encodedAuth("other", "other")))
+
+		creds, err := dockerConfig.Credentials("my-registry.example.com:5000")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(creds).To(Equal(auth.Credentials{Username: "groot", Password: "i-am-groot"}))
+	})
+
+	It("supports username and password entries", func() {
+		writeConfig(`{"auths": {"my-registry.example.com": {"username": "groot", "password": "i-am-groot"}}}`)
+
+		creds, err := dockerConfig.Credentials("my-registry.example.com")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(creds).To(Equal(auth.Credentials{Username: "groot", Password: "i-am-groot"}))
+	})
+
+	It("matches the docker hub entry written by docker login", func() {
+		writeConfig(fmt.Sprintf(`{"auths": {"https://index.docker.io/v1/": {"auth": "%s"}}}`, encodedAuth("groot", "i-am-groot")))
+
+		creds, err := dockerConfig.Credentials("docker.io")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(creds).To(Equal(auth.Credentials{Username: "groot", Password: "i-am-groot"}))
+	})
+
+	It("returns empty credentials when the registry is not in the config", func() {
+		writeConfig(fmt.Sprintf(`{"auths": {"other.example.com": {"auth": "%s"}}}`, encodedAuth("other", "other")))
+
+		creds, err := dockerConfig.Credentials("my-registry.example.com")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(creds).To(Equal(auth.Credentials{}))
+	})
+
+	It("returns empty credentials when the config file does not exist", func() {
+		creds, err := dockerConfig.Credentials("my-registry.example.com")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(creds).To(Equal(auth.Credentials{}))
+	})
+
+	It("returns an error when the config file is invalid", func() {
+		writeConfig("{not json")
+
+		_, err := dockerConfig.Credentials("my-registry.example.com")
+		Expect(err).To(MatchError(ContainSubstring("parsing docker config")))
+	})
+
+	It("returns an error when the auth entry is invalid", func() {
+		writeConfig(fmt.Sprintf(`{"auths": {"my-registry.example.com": {"auth": "%s"}}}`, base64.StdEncoding.EncodeToString([]byte("no-colon"))))
+
+		_, err := dockerConfig.Credentials("my-registry.example.com")
+		Expect(err).To(MatchError(ContainSubstring("expected username:password")))
+	})
+
+	Context("when the registry has a credential helper", func() {
+		BeforeEach(func() {
+			writeHelper("registry-helper", "helper-secret")
+			writeHelper("store-helper", "store-secret")
+			writeConfig(fmt.Sprintf(`{
+				"auths": {"my-registry.example.com": {"auth": "%s"}},
+				"credHelpers": {"my-registry.example.com": "registry-helper"},
+				"credsStore": "store-helper"
+			}`, encodedAuth("groot", "i-am-groot")))
+		})
+
+		It("uses the credential helper", func() {
+			creds, err := dockerConfig.Credentials("my-registry.example.com")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(creds).To(Equal(auth.Credentials{Username: "registry-helper-user", Password: "helper-secret"}))
+			Expect(requestedServerURL("registry-helper")).To(Equal("my-registry.example.com"))
+		})
+	})
+
+	Context("when there is a credentials store", func() {
+		BeforeEach(func() {
+			writeHelper("store-helper", "store-secret")
+			writeConfig(`{"credsStore": "store-helper"}`)
+		})
+
+		It("uses the credentials store", func() {
+			creds, err := dockerConfig.Credentials("my-registry.example.com")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(creds).To(Equal(auth.Credentials{Username: "store-helper-user", Password: "store-secret"}))
+		})
+
+		It("asks for docker hub credentials using the docker hub server URL", func() {
+			_, err := dockerConfig.Credentials("docker.io")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(requestedServerURL("store-helper")).To(Equal("https://index.docker.io/v1/"))
+		})
+
+		Context("when the store does not have credentials for the registry", func() {
+			BeforeEach(func() {
+				script := "#!/bin/sh\necho 'credentials not found in native keychain'\nexit 1\n"
+				Expect(ioutil.WriteFile(filepath.Join(helpersDir, "docker-credential-store-helper"), []byte(script), 0755)).To(Succeed())
+				writeConfig(fmt.Sprintf(`{"credsStore": "store-helper", "auths": {"my-registry.example.com": {"auth": "%s"}}}`, encodedAuth("groot", "i-am-groot")))
+			})
+
+			It("falls back to the auths entries", func() {
+				creds, err := dockerConfig.Credentials("my-registry.example.com")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(creds).To(Equal(auth.Credentials{Username: "groot", Password: "i-am-groot"}))
+			})
+		})
+
+		Context("when the helper fails", func() {
+			BeforeEach(func() {
+				script := "#!/bin/sh\necho 'keychain is locked'\nexit 1\n"
+				Expect(ioutil.WriteFile(filepath.Join(helpersDir, "docker-credential-store-helper"), []byte(script), 0755)).To(Succeed())
+			})
+
+			It("returns an error", func() {
+				_, err := dockerConfig.Credentials("my-registry.example.com")
+				Expect(err).To(MatchError(ContainSubstring("from the `store-helper` credential helper")))
+			})
+		})
+	})
+
+	Context("when the credential helper is not installed", func() {
+		BeforeEach(func() {
+			writeConfig(`{"credHelpers": {"my-registry.example.com": "not-installed"}}`)
+		})
+
+		It("returns an error", func() {
+			_, err := dockerConfig.Credentials("my-registry.example.com")
+			Expect(err).To(MatchError(ContainSubstring("from the `not-installed` credential helper")))
+		})
+	})
+})
@@ -0,0 +1,192 @@
+package commands // import "code.cloudfoundry.org/grootfs/commands"
+
+import (
+	"errors"
+	"net/url"
+	"path/filepath"
+
+	"code.cloudfoundry.org/commandrunner/linux_command_runner"
+	"code.cloudfoundry.org/grootfs/base_image_puller"
+	"code.cloudfoundry.org/grootfs/commands/config"
+	"code.cloudfoundry.org/grootfs/fetcher/layer_fetcher/source"
+	"code.cloudfoundry.org/grootfs/groot"
+	"code.cloudfoundry.org/grootfs/metrics"
+	storepkg "code.cloudfoundry.org/grootfs/store"
+	"code.cloudfoundry.org/grootfs/store/dependency_manager"
+	"code.cloudfoundry.org/grootfs/store/filesystems/namespaced"
+	locksmithpkg "code.cloudfoundry.org/grootfs/store/locksmith"
+	"code.cloudfoundry.org/grootfs/store/manager"
+	"code.cloudfoundry.org/lager"
+	errorspkg "github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// fetchFlags are the flags of the commands that fetch base images into the
+// store, create and pull
+var fetchFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "insecure-registry",
+		Usage: "Whitelist a private registry",
+	},
+	cli.BoolFlag{
+		Name:  "skip-layer-validation",
+		Usage: "Do not validate checksums and sizes of image layers. (Can only be used with oci:/// protocol images.)",
+	},
+	cli.IntFlag{
+		Name:  "max-parallel-downloads",
+		Usage: "Maximum number of image layers to download at the same time",
+		Value: base_image_puller.DefaultMaxParallelDownloads,
+	},
+	cli.IntFlag{
+		Name:  "download-retries",
+		Usage: "Number of times to retry fetching the image and its layers, waiting exponentially longer between retries. Interrupted layer downloads are resumed",
+		Value: source.DefaultDownloadRetries,
+	},
+	cli.Int64Flag{
+		Name:  "blob-cache-size-bytes",
+		Usage: "Keep up to this many bytes of downloaded image layers to reuse in later creates (default: disabled)",
+	},
+	cli.Int64Flag{
+		Name:  "max-download-bytes-per-second",
+		Usage: "Limit the combined download rate of the image layers (default: unlimited)",
+	},
+	cli.BoolFlag{
+		Name:  "streaming-unpack",
+		Usage: "Unpack image layers as they are downloaded, without writing them to a temporary file first",
+	},
+	cli.BoolFlag{
+		Name:  "cache-registry-tokens",
+		Usage: "Share registry tokens with other creates in the store until they expire",
+	},
+	cli.IntFlag{
+		Name:  "progress-fd",
+		Usage: "File descriptor to write layer download progress events to, as JSON lines",
+	},
+	cli.StringFlag{
+		Name:  "platform",
+		Usage: "Platform to use when the image is a multi-platform image, in the os/arch[/variant] format",
+	},
+	cli.StringFlag{
+		Name:  "username",
+		Usage: "Username to authenticate in image registry",
+	},
+	cli.StringFlag{
+		Name:  "password",
+		Usage: "Password to authenticate in image registry",
+	},
+}
+
+// withFetchFlags applies the fetchFlags that were set to the config
+func withFetchFlags(configBuilder *config.Builder, ctx *cli.Context) *config.Builder {
+	return configBuilder.WithInsecureRegistries(ctx.StringSlice("insecure-registry")).
+		WithSkipLayerValidation(ctx.Bool("skip-layer-validation"),
+			ctx.IsSet("skip-layer-validation")).
+		WithMaxParallelDownloads(ctx.Int("max-parallel-downloads"), ctx.IsSet("max-parallel-downloads")).
+		WithDownloadRetries(ctx.Int("download-retries"), ctx.IsSet("download-retries")).
+		WithPlatform(ctx.String("platform"), ctx.IsSet("platform")).
+		WithBlobCacheSizeBytes(ctx.Int64("blob-cache-size-bytes"), ctx.IsSet("blob-cache-size-bytes")).
+		WithMaxDownloadBytesPerSecond(ctx.Int64("max-download-bytes-per-second"), ctx.IsSet("max-download-bytes-per-second")).
+		WithStreamingUnpack(ctx.Bool("streaming-unpack"), ctx.IsSet("streaming-unpack")).
+		WithCacheRegistryTokens(ctx.Bool("cache-registry-tokens"), ctx.IsSet("cache-registry-tokens"))
+}
+
+// storePuller is the base image puller of a store, with the parts of the
+// store that create and pull also use
+type storePuller struct {
+	baseImagePuller    *base_image_puller.BaseImagePuller
+	fetcher            base_image_puller.Fetcher
+	fsDriver           fileSystemDriver
+	nsFsDriver         *namespaced.Driver
+	metricsEmitter     *metrics.Emitter
+	sharedLocksmith    *locksmithpkg.FileSystem
+	exclusiveLocksmith *locksmithpkg.FileSystem
+	dependencyManager  *dependency_manager.DependencyManager
+	idMappings         groot.IDMappings
+}
+
+// createStorePuller builds the base image puller of the store for the image.
+// The fetcher of the puller must be closed once it is done.
+func createStorePuller(logger lager.Logger, ctx *cli.Context, cfg config.Config, createCfg config.Create, baseImageURL *url.URL) (*storePuller, error) {
+	storePath := cfg.StorePath
+
+	fsDriver, err := createFileSystemDriver(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	metricsEmitter := metrics.NewEmitter(logger, cfg.MetronEndpoint)
+
+	initLocksDir := filepath.Join("/", "var", "run")
+	storeLocksDir := filepath.Join(storePath, storepkg.LocksDirName)
+	sharedLocksmith := locksmithpkg.NewSharedFileSystem(storeLocksDir).WithMetrics(metricsEmitter)
+	exclusiveLocksmith := locksmithpkg.NewExclusiveFileSystem(storeLocksDir).WithMetrics(metricsEmitter)
+	initStoreLocksmith := locksmithpkg.NewExclusiveFileSystem(initLocksDir)
+
+	storeNamespacer := groot.NewStoreNamespacer(storePath)
+	manager := manager.New(storePath, storeNamespacer, fsDriver, fsDriver, fsDriver, initStoreLocksmith)
+	if !manager.IsStoreInitialized(logger) {
+		logger.Error("store-verification-failed", errors.New("store is not initialized"))
+		return nil, errorspkg.New("Store path is not initialized. Please run init-store.")
+	}
+
+	idMappings, err := storeNamespacer.Read()
+	if err != nil {
+		logger.Error("reading-namespace-file", err)
+		return nil, err
+	}
+
+	runner := linux_command_runner.New()
+	unpacker, idMapper, err := createUnpacker(cfg, runner)
+	if err != nil {
+		return nil, err
+	}
+
+	dependencyManager := dependency_manager.NewDependencyManager(
+		filepath.Join(storePath, storepkg.MetaDirName, "dependencies"),
+	)
+
+	nsFsDriver := namespaced.New(fsDriver, idMappings, idMapper, runner)
+
+	systemContext, err := createSystemContext(baseImageURL, createCfg, storePath, ctx.String("username"), ctx.String("password"))
+	if err != nil {
+		logger.Error("creating-system-context", err)
+		return nil, err
+	}
+
+	fetcher, err := createFetcher(logger, baseImageURL, systemContext, createCfg, storePath, metricsEmitter, progressReporter(ctx))
+	if err != nil {
+		logger.Error("creating-fetcher", err)
+		return nil, err
+	}
+	fetcher, err = cacheImageInfo(baseImageURL, fetcher, nsFsDriver, createCfg, storePath)
+	if err != nil {
+		logger.Error("creating-fetcher", err)
+		return nil, err
+	}
+
+	baseImagePuller := base_image_puller.NewBaseImagePuller(
+		fetcher,
+		unpacker,
+		nsFsDriver,
+		metricsEmitter,
+		exclusiveLocksmith,
+	).WithMaxParallelDownloads(createCfg.MaxParallelDownloads)
+
+	return &storePuller{
+		baseImagePuller:    baseImagePuller,
+		fetcher:            fetcher,
+		fsDriver:           fsDriver,
+		nsFsDriver:         nsFsDriver,
+		metricsEmitter:     metricsEmitter,
+		sharedLocksmith:    sharedLocksmith,
+		exclusiveLocksmith: exclusiveLocksmith,
+		dependencyManager:  dependencyManager,
+		idMappings:         idMappings,
+	}, nil
+}
+
+func (p *storePuller) close(logger lager.Logger) {
+	if err := p.fetcher.Close(); err != nil {
+		logger.Error("closing-fetcher", err)
+	}
+}
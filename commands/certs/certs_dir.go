@@ -0,0 +1,83 @@
+package certs // import "code.cloudfoundry.org/grootfs/commands/certs"
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/grootfs/commands/config"
+	errorspkg "github.com/pkg/errors"
+)
+
+const (
+	CABundleFileName          = "ca.crt"
+	ClientCertificateFileName = "client.cert"
+	ClientKeyFileName         = "client.key"
+)
+
+// Dir returns a directory in the layout that `types.SystemContext` expects
+// in DockerCertPath: a CA bundle ending with `.crt`, and a client certificate
+// and key ending with `.cert` and `.key`. The files are links to the
+// configured ones, so that changes to them are picked up by the next create.
+// Directories are shared by every create with the same configuration.
+func Dir(certsPath string, registryTLS config.RegistryTLS) (string, error) {
+	files := map[string]string{
+		CABundleFileName:          registryTLS.CABundle,
+		ClientCertificateFileName: registryTLS.ClientCertificate,
+		ClientKeyFileName:         registryTLS.ClientKey,
+	}
+
+	for _, path := range files {
+		if path == "" {
+			continue
+		}
+		if !filepath.IsAbs(path) {
+			return "", errorspkg.Errorf("certificate path `%s` is not absolute", path)
+		}
+		if _, err := os.Stat(path); err != nil {
+			return "", errorspkg.Wrap(err, "reading registry certificates")
+		}
+	}
+
+	key := sha256.Sum256([]byte(fmt.Sprintf("%s\n%s\n%s", registryTLS.CABundle, registryTLS.ClientCertificate, registryTLS.ClientKey)))
+	dirPath := filepath.Join(certsPath, hex.EncodeToString(key[:]))
+	if _, err := os.Stat(dirPath); err == nil {
+		return dirPath, nil
+	}
+
+	if err := os.MkdirAll(certsPath, 0755); err != nil {
+		return "", errorspkg.Wrap(err, "creating certificates directory")
+	}
+
+	tempDirPath, err := ioutil.TempDir(certsPath, ".incomplete-")
+	if err != nil {
+		return "", errorspkg.Wrap(err, "creating certificates directory")
+	}
+	defer os.RemoveAll(tempDirPath)
+
+	for name, path := range files {
+		if path == "" {
+			continue
+		}
+		if err := os.Symlink(path, filepath.Join(tempDirPath, name)); err != nil {
+			return "", errorspkg.Wrap(err, "linking registry certificate")
+		}
+	}
+
+	if err := os.Chmod(tempDirPath, 0755); err != nil {
+		return "", errorspkg.Wrap(err, "creating certificates directory")
+	}
+
+	// Another create with the same configuration may have won the race
+	if err := os.Rename(tempDirPath, dirPath); err != nil {
+		if _, statErr := os.Stat(dirPath); statErr == nil {
+			return dirPath, nil
+		}
+		return "", errorspkg.Wrap(err, "creating certificates directory")
+	}
+
+	return dirPath, nil
+}
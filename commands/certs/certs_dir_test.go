@@ -0,0 +1,102 @@
+package certs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/grootfs/commands/certs"
+	"code.cloudfoundry.org/grootfs/commands/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Dir", func() {
+	var (
+		tmpDir      string
+		certsPath   string
+		registryTLS config.RegistryTLS
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "certs")
+		Expect(err).NotTo(HaveOccurred())
+		certsPath = filepath.Join(tmpDir, "registry-certs")
+
+		for _, name := range []string{"ca.pem", "client.pem", "client-key.pem"} {
+			Expect(ioutil.WriteFile(filepath.Join(tmpDir, name), []byte(name), 0600)).To(Succeed())
+		}
+
+		registryTLS = config.RegistryTLS{
+			CABundle:          filepath.Join(tmpDir, "ca.pem"),
+			ClientCertificate: filepath.Join(tmpDir, "client.pem"),
+			ClientKey:         filepath.Join(tmpDir, "client-key.pem"),
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("links the certificates with the names the registry client expects", func() {
+		dirPath, err := certs.Dir(certsPath, registryTLS)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(filepath.Dir(dirPath)).To(Equal(certsPath))
+
+		Expect(os.Readlink(filepath.Join(dirPath, "ca.crt"))).To(Equal(registryTLS.CABundle))
+		Expect(os.Readlink(filepath.Join(dirPath, "client.cert"))).To(Equal(registryTLS.ClientCertificate))
+		Expect(os.Readlink(filepath.Join(dirPath, "client.key"))).To(Equal(registryTLS.ClientKey))
+	})
+
+	It("reuses the directory for the same configuration", func() {
+		firstDirPath, err := certs.Dir(certsPath, registryTLS)
+		Expect(err).NotTo(HaveOccurred())
+		secondDirPath, err := certs.Dir(certsPath, registryTLS)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(secondDirPath).To(Equal(firstDirPath))
+
+		entries, err := ioutil.ReadDir(certsPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+	})
+
+	Context("when only a CA bundle is configured", func() {
+		BeforeEach(func() {
+			registryTLS.ClientCertificate = ""
+			registryTLS.ClientKey = ""
+		})
+
+		It("only links the CA bundle", func() {
+			dirPath, err := certs.Dir(certsPath, registryTLS)
+			Expect(err).NotTo(HaveOccurred())
+
+			entries, err := ioutil.ReadDir(dirPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Name()).To(Equal("ca.crt"))
+		})
+	})
+
+	Context("when a certificate doesn't exist", func() {
+		BeforeEach(func() {
+			registryTLS.CABundle = filepath.Join(tmpDir, "not-here.pem")
+		})
+
+		It("returns an error", func() {
+			_, err := certs.Dir(certsPath, registryTLS)
+			Expect(err).To(MatchError(ContainSubstring("reading registry certificates")))
+		})
+	})
+
+	Context("when a certificate path is relative", func() {
+		BeforeEach(func() {
+			registryTLS.CABundle = "ca.pem"
+		})
+
+		It("returns an error", func() {
+			_, err := certs.Dir(certsPath, registryTLS)
+			Expect(err).To(MatchError(ContainSubstring("certificate path `ca.pem` is not absolute")))
+		})
+	})
+})
@@ -2,6 +2,8 @@ package config
 
 import (
 	"io/ioutil"
+	"strconv"
+	"strings"
 
 	errorspkg "github.com/pkg/errors"
 
@@ -23,13 +25,66 @@ type Config struct {
 }
 
 type Create struct {
-	ExcludeImageFromQuota             bool     `yaml:"exclude_image_from_quota"`
-	SkipLayerValidation               bool     `yaml:"skip_layer_validation"`
-	WithClean                         bool     `yaml:"with_clean"`
-	WithoutMount                      bool     `yaml:"without_mount"`
-	DiskLimitSizeBytes                int64    `yaml:"disk_limit_size_bytes"`
-	InsecureRegistries                []string `yaml:"insecure_registries"`
-	RemoteLayerClientCertificatesPath string   `yaml:"remote_layer_client_certificates_path"`
+	ExcludeImageFromQuota             bool                   `yaml:"exclude_image_from_quota"`
+	SkipLayerValidation               bool                   `yaml:"skip_layer_validation"`
+	WithClean                         bool                   `yaml:"with_clean"`
+	WithoutMount                      bool                   `yaml:"without_mount"`
+	DiskLimitSizeBytes                int64                  `yaml:"disk_limit_size_bytes"`
+	InsecureRegistries                []string               `yaml:"insecure_registries"`
+	RemoteLayerClientCertificatesPath string                 `yaml:"remote_layer_client_certificates_path"`
+	MaxParallelDownloads              int                    `yaml:"max_parallel_downloads"`
+	ContentAddressedTarChainIDs       bool                   `yaml:"content_addressed_tar_chain_ids"`
+	Platform                          string                 `yaml:"platform"`
+	RegistryMirrors                   map[string][]string    `yaml:"registry_mirrors"`
+	DockerConfigPath                  string                 `yaml:"docker_config_path"`
+	BlobCacheSizeBytes                int64                  `yaml:"blob_cache_size_bytes"`
+	DownloadRetries                   *int                   `yaml:"download_retries"`
+	SignaturePolicyPath               string                 `yaml:"signature_policy_path"`
+	SignatureStorePath                string                 `yaml:"signature_store_path"`
+	PreferCache                       bool                   `yaml:"prefer_cache"`
+	Offline                           bool                   `yaml:"offline"`
+	RegistryTLS                       map[string]RegistryTLS `yaml:"registry_tls"`
+	// HTTPProxy, HTTPSProxy and NoProxy are rejected, as containers/image
+	// only takes proxies from the environment
+	HTTPProxy                 string        `yaml:"http_proxy"`
+	HTTPSProxy                string        `yaml:"https_proxy"`
+	NoProxy                   string        `yaml:"no_proxy"`
+	MaxDownloadBytesPerSecond int64         `yaml:"max_download_bytes_per_second"`
+	ForeignLayers             ForeignLayers `yaml:"foreign_layers"`
+	StreamingUnpack           bool          `yaml:"streaming_unpack"`
+	CacheRegistryTokens       bool          `yaml:"cache_registry_tokens"`
+	Xattrs                    Xattrs        `yaml:"xattrs"`
+	Devices                   Devices       `yaml:"devices"`
+}
+
+// Devices decides which device nodes of the image layers are created when
+// running as root. Allowed devices are `major:minor` pairs
+type Devices struct {
+	Skip    bool     `yaml:"skip"`
+	Allowed []string `yaml:"allowed"`
+}
+
+// Xattrs are the extended attribute namespaces, or attribute names, that
+// are preserved when unpacking layers
+type Xattrs struct {
+	AllowedNamespaces []string `yaml:"allowed_namespaces"`
+	DeniedNamespaces  []string `yaml:"denied_namespaces"`
+}
+
+// ForeignLayers is the policy for non-distributable layers, which are served
+// from the URLs in the image manifest instead of the registry
+type ForeignLayers struct {
+	Policy             string   `yaml:"policy"`
+	AllowedURLPrefixes []string `yaml:"allowed_url_prefixes"`
+}
+
+// RegistryTLS is the TLS configuration of a registry. The CA bundle is
+// trusted in addition to the system CAs, and replaces /etc/docker/certs.d
+// for that registry
+type RegistryTLS struct {
+	CABundle          string `yaml:"ca_bundle"`
+	ClientCertificate string `yaml:"client_certificate"`
+	ClientKey         string `yaml:"client_key"`
 }
 
 type Clean struct {
@@ -73,6 +128,44 @@ func (b *Builder) Build() (Config, error) {
 		return *b.config, errorspkg.New("invalid argument: clean threshold cannot be negative")
 	}
 
+	if b.config.Create.MaxParallelDownloads < 0 {
+		return *b.config, errorspkg.New("invalid argument: max parallel downloads cannot be negative")
+	}
+
+	if b.config.Create.BlobCacheSizeBytes < 0 {
+		return *b.config, errorspkg.New("invalid argument: blob cache size cannot be negative")
+	}
+
+	if b.config.Create.MaxDownloadBytesPerSecond < 0 {
+		return *b.config, errorspkg.New("invalid argument: max download rate cannot be negative")
+	}
+
+	if b.config.Create.DownloadRetries != nil && *b.config.Create.DownloadRetries < 0 {
+		return *b.config, errorspkg.New("invalid argument: download retries cannot be negative")
+	}
+
+	switch b.config.Create.ForeignLayers.Policy {
+	case "", "allow", "deny", "allowlist":
+	default:
+		return *b.config, errorspkg.Errorf("invalid argument: foreign layer policy `%s` must be one of allow, deny or allowlist", b.config.Create.ForeignLayers.Policy)
+	}
+
+	for _, device := range b.config.Create.Devices.Allowed {
+		if !validDeviceNumber(device) {
+			return *b.config, errorspkg.Errorf("invalid argument: device `%s` must be a major:minor pair", device)
+		}
+	}
+
+	if b.config.Create.HTTPProxy != "" || b.config.Create.HTTPSProxy != "" || b.config.Create.NoProxy != "" {
+		return *b.config, errorspkg.New("invalid argument: http_proxy, https_proxy and no_proxy are not supported, use the HTTP_PROXY, HTTPS_PROXY and NO_PROXY env vars instead")
+	}
+
+	for registry, registryTLS := range b.config.Create.RegistryTLS {
+		if (registryTLS.ClientCertificate == "") != (registryTLS.ClientKey == "") {
+			return *b.config, errorspkg.Errorf("invalid argument: client certificate and key for registry `%s` must be provided together", registry)
+		}
+	}
+
 	return *b.config, nil
 }
 
@@ -152,6 +245,78 @@ func (b *Builder) WithSkipLayerValidation(skip, isSet bool) *Builder {
 	return b
 }
 
+func (b *Builder) WithMaxParallelDownloads(maxParallelDownloads int, isSet bool) *Builder {
+	if isSet || b.config.Create.MaxParallelDownloads == 0 {
+		b.config.Create.MaxParallelDownloads = maxParallelDownloads
+	}
+	return b
+}
+
+// WithDownloadRetries only falls back to the flag's default when the config
+// has no download_retries, as 0 turns retries off
+func (b *Builder) WithDownloadRetries(downloadRetries int, isSet bool) *Builder {
+	if isSet || b.config.Create.DownloadRetries == nil {
+		b.config.Create.DownloadRetries = &downloadRetries
+	}
+	return b
+}
+
+func (b *Builder) WithContentAddressedTarChainIDs(contentAddressed, isSet bool) *Builder {
+	if isSet {
+		b.config.Create.ContentAddressedTarChainIDs = contentAddressed
+	}
+	return b
+}
+
+func (b *Builder) WithPreferCache(preferCache, isSet bool) *Builder {
+	if isSet {
+		b.config.Create.PreferCache = preferCache
+	}
+	return b
+}
+
+func (b *Builder) WithOffline(offline, isSet bool) *Builder {
+	if isSet {
+		b.config.Create.Offline = offline
+	}
+	return b
+}
+
+func (b *Builder) WithPlatform(platform string, isSet bool) *Builder {
+	if isSet {
+		b.config.Create.Platform = platform
+	}
+	return b
+}
+
+func (b *Builder) WithBlobCacheSizeBytes(size int64, isSet bool) *Builder {
+	if isSet {
+		b.config.Create.BlobCacheSizeBytes = size
+	}
+	return b
+}
+
+func (b *Builder) WithStreamingUnpack(streamingUnpack, isSet bool) *Builder {
+	if isSet {
+		b.config.Create.StreamingUnpack = streamingUnpack
+	}
+	return b
+}
+
+func (b *Builder) WithCacheRegistryTokens(cacheRegistryTokens, isSet bool) *Builder {
+	if isSet {
+		b.config.Create.CacheRegistryTokens = cacheRegistryTokens
+	}
+	return b
+}
+
+func (b *Builder) WithMaxDownloadBytesPerSecond(rate int64, isSet bool) *Builder {
+	if isSet {
+		b.config.Create.MaxDownloadBytesPerSecond = rate
+	}
+	return b
+}
+
 func (b *Builder) WithCleanThresholdBytes(threshold int64, isSet bool) *Builder {
 	if isSet {
 		b.config.Clean.ThresholdBytes = threshold
@@ -216,3 +381,18 @@ func load(configPath string) (Config, error) {
 
 	return config, nil
 }
+
+func validDeviceNumber(device string) bool {
+	numbers := strings.Split(device, ":")
+	if len(numbers) != 2 {
+		return false
+	}
+
+	for _, number := range numbers {
+		if _, err := strconv.ParseUint(number, 10, 32); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
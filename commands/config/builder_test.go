@@ -98,6 +98,52 @@ var _ = Describe("Builder", func() {
 			})
 		})
 
+		Context("when the foreign layer policy is unknown", func() {
+			BeforeEach(func() {
+				cfg.Create.ForeignLayers.Policy = "sometimes"
+			})
+
+			It("returns an error", func() {
+				_, err := builder.Build()
+				Expect(err).To(MatchError("invalid argument: foreign layer policy `sometimes` must be one of allow, deny or allowlist"))
+			})
+		})
+
+		Context("when an allowed device is not a major:minor pair", func() {
+			BeforeEach(func() {
+				cfg.Create.Devices.Allowed = []string{"1:3", "tty"}
+			})
+
+			It("returns an error", func() {
+				_, err := builder.Build()
+				Expect(err).To(MatchError("invalid argument: device `tty` must be a major:minor pair"))
+			})
+		})
+
+		Context("when a proxy is set", func() {
+			BeforeEach(func() {
+				cfg.Create.HTTPSProxy = "http://proxy.example.com:3128"
+			})
+
+			It("returns an error", func() {
+				_, err := builder.Build()
+				Expect(err).To(MatchError("invalid argument: http_proxy, https_proxy and no_proxy are not supported, use the HTTP_PROXY, HTTPS_PROXY and NO_PROXY env vars instead"))
+			})
+		})
+
+		Context("when a registry has a client certificate without a key", func() {
+			BeforeEach(func() {
+				cfg.Create.RegistryTLS = map[string]config.RegistryTLS{
+					"registry.example.com": config.RegistryTLS{ClientCertificate: "/certs/client.cert"},
+				}
+			})
+
+			It("returns an error", func() {
+				_, err := builder.Build()
+				Expect(err).To(MatchError("invalid argument: client certificate and key for registry `registry.example.com` must be provided together"))
+			})
+		})
+
 		Context("when config is invalid", func() {
 			JustBeforeEach(func() {
 				configFilePath = path.Join(configDir, "invalid_config.yaml")
@@ -376,6 +422,299 @@ var _ = Describe("Builder", func() {
 		})
 	})
 
+	Describe("WithMaxParallelDownloads", func() {
+		BeforeEach(func() {
+			cfg.Create.MaxParallelDownloads = 4
+		})
+
+		It("overrides the config's MaxParallelDownloads entry when the flag is set", func() {
+			builder = builder.WithMaxParallelDownloads(8, true)
+			config, err := builder.Build()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Create.MaxParallelDownloads).To(Equal(8))
+		})
+
+		Context("when flag is not set", func() {
+			It("uses the config entry", func() {
+				builder = builder.WithMaxParallelDownloads(8, false)
+				config, err := builder.Build()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(config.Create.MaxParallelDownloads).To(Equal(4))
+			})
+
+			Context("and max parallel downloads is not set in the config", func() {
+				BeforeEach(func() {
+					cfg.Create.MaxParallelDownloads = 0
+				})
+
+				It("uses the provided value", func() {
+					builder = builder.WithMaxParallelDownloads(8, false)
+					config, err := builder.Build()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(config.Create.MaxParallelDownloads).To(Equal(8))
+				})
+			})
+		})
+
+		Context("when negative", func() {
+			It("returns an error", func() {
+				builder = builder.WithMaxParallelDownloads(-1, true)
+				_, err := builder.Build()
+				Expect(err).To(MatchError("invalid argument: max parallel downloads cannot be negative"))
+			})
+		})
+	})
+
+	Describe("WithDownloadRetries", func() {
+		BeforeEach(func() {
+			downloadRetries := 4
+			cfg.Create.DownloadRetries = &downloadRetries
+		})
+
+		It("overrides the config's DownloadRetries entry when the flag is set", func() {
+			builder = builder.WithDownloadRetries(8, true)
+			config, err := builder.Build()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*config.Create.DownloadRetries).To(Equal(8))
+		})
+
+		Context("when flag is not set", func() {
+			It("uses the config entry", func() {
+				builder = builder.WithDownloadRetries(8, false)
+				config, err := builder.Build()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(*config.Create.DownloadRetries).To(Equal(4))
+			})
+
+			Context("and download retries is zero in the config", func() {
+				BeforeEach(func() {
+					downloadRetries := 0
+					cfg.Create.DownloadRetries = &downloadRetries
+				})
+
+				It("uses the config entry", func() {
+					builder = builder.WithDownloadRetries(2, false)
+					config, err := builder.Build()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(*config.Create.DownloadRetries).To(Equal(0))
+				})
+			})
+
+			Context("and download retries is not set in the config", func() {
+				BeforeEach(func() {
+					cfg.Create.DownloadRetries = nil
+				})
+
+				It("uses the provided value", func() {
+					builder = builder.WithDownloadRetries(2, false)
+					config, err := builder.Build()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(*config.Create.DownloadRetries).To(Equal(2))
+				})
+			})
+		})
+
+		Context("when negative", func() {
+			It("returns an error", func() {
+				builder = builder.WithDownloadRetries(-1, true)
+				_, err := builder.Build()
+				Expect(err).To(MatchError("invalid argument: download retries cannot be negative"))
+			})
+		})
+	})
+
+	Describe("WithContentAddressedTarChainIDs", func() {
+		It("overrides the config's ContentAddressedTarChainIDs when the flag is set", func() {
+			builder = builder.WithContentAddressedTarChainIDs(true, true)
+			config, err := builder.Build()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Create.ContentAddressedTarChainIDs).To(BeTrue())
+		})
+
+		Context("when flag is not set", func() {
+			BeforeEach(func() {
+				cfg.Create.ContentAddressedTarChainIDs = true
+			})
+
+			It("uses the config entry", func() {
+				builder = builder.WithContentAddressedTarChainIDs(false, false)
+				config, err := builder.Build()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(config.Create.ContentAddressedTarChainIDs).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("WithPreferCache", func() {
+		It("overrides the config's PreferCache when the flag is set", func() {
+			builder = builder.WithPreferCache(true, true)
+			config, err := builder.Build()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Create.PreferCache).To(BeTrue())
+		})
+
+		Context("when flag is not set", func() {
+			BeforeEach(func() {
+				cfg.Create.PreferCache = true
+			})
+
+			It("uses the config entry", func() {
+				builder = builder.WithPreferCache(false, false)
+				config, err := builder.Build()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(config.Create.PreferCache).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("WithOffline", func() {
+		It("overrides the config's Offline when the flag is set", func() {
+			builder = builder.WithOffline(true, true)
+			config, err := builder.Build()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Create.Offline).To(BeTrue())
+		})
+
+		Context("when flag is not set", func() {
+			BeforeEach(func() {
+				cfg.Create.Offline = true
+			})
+
+			It("uses the config entry", func() {
+				builder = builder.WithOffline(false, false)
+				config, err := builder.Build()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(config.Create.Offline).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("WithPlatform", func() {
+		It("overrides the config's Platform when the flag is set", func() {
+			builder = builder.WithPlatform("linux/arm64/v8", true)
+			config, err := builder.Build()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Create.Platform).To(Equal("linux/arm64/v8"))
+		})
+
+		Context("when flag is not set", func() {
+			BeforeEach(func() {
+				cfg.Create.Platform = "linux/arm/v7"
+			})
+
+			It("uses the config entry", func() {
+				builder = builder.WithPlatform("", false)
+				config, err := builder.Build()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(config.Create.Platform).To(Equal("linux/arm/v7"))
+			})
+		})
+	})
+
+	Describe("WithBlobCacheSizeBytes", func() {
+		It("overrides the config's BlobCacheSizeBytes when the flag is set", func() {
+			builder = builder.WithBlobCacheSizeBytes(1024, true)
+			config, err := builder.Build()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Create.BlobCacheSizeBytes).To(Equal(int64(1024)))
+		})
+
+		Context("when flag is not set", func() {
+			BeforeEach(func() {
+				cfg.Create.BlobCacheSizeBytes = 2048
+			})
+
+			It("uses the config entry", func() {
+				builder = builder.WithBlobCacheSizeBytes(0, false)
+				config, err := builder.Build()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(config.Create.BlobCacheSizeBytes).To(Equal(int64(2048)))
+			})
+		})
+
+		Context("when negative", func() {
+			It("returns an error", func() {
+				builder = builder.WithBlobCacheSizeBytes(-1, true)
+				_, err := builder.Build()
+				Expect(err).To(MatchError("invalid argument: blob cache size cannot be negative"))
+			})
+		})
+	})
+
+	Describe("WithStreamingUnpack", func() {
+		It("overrides the config's StreamingUnpack when the flag is set", func() {
+			builder = builder.WithStreamingUnpack(true, true)
+			config, err := builder.Build()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Create.StreamingUnpack).To(BeTrue())
+		})
+
+		Context("when flag is not set", func() {
+			BeforeEach(func() {
+				cfg.Create.StreamingUnpack = true
+			})
+
+			It("uses the config entry", func() {
+				builder = builder.WithStreamingUnpack(false, false)
+				config, err := builder.Build()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(config.Create.StreamingUnpack).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("WithCacheRegistryTokens", func() {
+		It("overrides the config's CacheRegistryTokens when the flag is set", func() {
+			builder = builder.WithCacheRegistryTokens(true, true)
+			config, err := builder.Build()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Create.CacheRegistryTokens).To(BeTrue())
+		})
+
+		Context("when flag is not set", func() {
+			BeforeEach(func() {
+				cfg.Create.CacheRegistryTokens = true
+			})
+
+			It("uses the config entry", func() {
+				builder = builder.WithCacheRegistryTokens(false, false)
+				config, err := builder.Build()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(config.Create.CacheRegistryTokens).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("WithMaxDownloadBytesPerSecond", func() {
+		It("overrides the config's MaxDownloadBytesPerSecond when the flag is set", func() {
+			builder = builder.WithMaxDownloadBytesPerSecond(1024, true)
+			config, err := builder.Build()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Create.MaxDownloadBytesPerSecond).To(Equal(int64(1024)))
+		})
+
+		Context("when flag is not set", func() {
+			BeforeEach(func() {
+				cfg.Create.MaxDownloadBytesPerSecond = 2048
+			})
+
+			It("uses the config entry", func() {
+				builder = builder.WithMaxDownloadBytesPerSecond(0, false)
+				config, err := builder.Build()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(config.Create.MaxDownloadBytesPerSecond).To(Equal(int64(2048)))
+			})
+		})
+
+		Context("when negative", func() {
+			It("returns an error", func() {
+				builder = builder.WithMaxDownloadBytesPerSecond(-1, true)
+				_, err := builder.Build()
+				Expect(err).To(MatchError("invalid argument: max download rate cannot be negative"))
+			})
+		})
+	})
+
 	Describe("WithCleanThresholdBytes", func() {
 		It("overrides the config's CleanThresholdBytes entry when the flag is set", func() {
 			builder = builder.WithCleanThresholdBytes(1024, true)
@@ -3,30 +3,34 @@ package commands // import "code.cloudfoundry.org/grootfs/commands"
 import (
 	"crypto/x509"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
 
-	"code.cloudfoundry.org/commandrunner/linux_command_runner"
 	"code.cloudfoundry.org/grootfs/base_image_puller"
-	unpackerpkg "code.cloudfoundry.org/grootfs/base_image_puller/unpacker"
+	"code.cloudfoundry.org/grootfs/commands/auth"
+	"code.cloudfoundry.org/grootfs/commands/certs"
 	"code.cloudfoundry.org/grootfs/commands/config"
+	"code.cloudfoundry.org/grootfs/fetcher/cached_fetcher"
+	"code.cloudfoundry.org/grootfs/fetcher/dir_fetcher"
+	"code.cloudfoundry.org/grootfs/fetcher/docker_archive_fetcher"
 	"code.cloudfoundry.org/grootfs/fetcher/layer_fetcher"
+	"code.cloudfoundry.org/grootfs/fetcher/layer_fetcher/signature"
 	"code.cloudfoundry.org/grootfs/fetcher/layer_fetcher/source"
+	"code.cloudfoundry.org/grootfs/fetcher/progress"
+	"code.cloudfoundry.org/grootfs/fetcher/ratelimit"
 	"code.cloudfoundry.org/grootfs/fetcher/tar_fetcher"
 	"code.cloudfoundry.org/grootfs/groot"
 	"code.cloudfoundry.org/grootfs/metrics"
 	storepkg "code.cloudfoundry.org/grootfs/store"
-	"code.cloudfoundry.org/grootfs/store/dependency_manager"
-	"code.cloudfoundry.org/grootfs/store/filesystems/namespaced"
-	"code.cloudfoundry.org/grootfs/store/filesystems/overlayxfs"
+	"code.cloudfoundry.org/grootfs/store/blob_cache"
+	"code.cloudfoundry.org/grootfs/store/digest_cache"
 	"code.cloudfoundry.org/grootfs/store/garbage_collector"
 	"code.cloudfoundry.org/grootfs/store/image_cloner"
 	locksmithpkg "code.cloudfoundry.org/grootfs/store/locksmith"
-	"code.cloudfoundry.org/grootfs/store/manager"
+	"code.cloudfoundry.org/grootfs/store/token_cache"
 	"code.cloudfoundry.org/lager"
 
 	"github.com/containers/image/types"
@@ -36,28 +40,27 @@ import (
 	"github.com/urfave/cli"
 )
 
+// createOutput is the container config spec of the image, along with the
+// digest of the base image manifest, when there is one
+type createOutput struct {
+	specs.Spec
+	ManifestDigest string `json:"manifest_digest,omitempty"`
+}
+
 var CreateCommand = cli.Command{
 	Name:        "create",
 	Usage:       "create [options] <image> <id>",
 	Description: "Creates a root filesystem for the provided image.",
 
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		cli.Int64Flag{
 			Name:  "disk-limit-size-bytes",
 			Usage: "Inclusive disk limit (i.e: includes all layers in the filesystem)",
 		},
-		cli.StringSliceFlag{
-			Name:  "insecure-registry",
-			Usage: "Whitelist a private registry",
-		},
 		cli.BoolFlag{
 			Name:  "exclude-image-from-quota",
 			Usage: "Set disk limit to be exclusive (i.e.: excluding image layers)",
 		},
-		cli.BoolFlag{
-			Name:  "skip-layer-validation",
-			Usage: "Do not validate checksums and sizes of image layers. (Can only be used with oci:/// protocol images.)",
-		},
 		cli.BoolFlag{
 			Name:  "with-clean",
 			Usage: "Clean up unused layers before creating rootfs",
@@ -78,15 +81,19 @@ var CreateCommand = cli.Command{
 			Name:  "without-mount",
 			Usage: "Do not mount the root filesystem.",
 		},
-		cli.StringFlag{
-			Name:  "username",
-			Usage: "Username to authenticate in image registry",
+		cli.BoolFlag{
+			Name:  "content-addressed-tar-chain-ids",
+			Usage: "Identify local tar images by the sha256 of their contents instead of their path and modification time",
 		},
-		cli.StringFlag{
-			Name:  "password",
-			Usage: "Password to authenticate in image registry",
+		cli.BoolFlag{
+			Name:  "prefer-cache",
+			Usage: "Create registry and OCI images from the metadata recorded when they were last pulled, if all of their layers are in the store",
 		},
-	},
+		cli.BoolFlag{
+			Name:  "offline",
+			Usage: "Create registry and OCI images from the metadata recorded when they were last pulled, without contacting the registry",
+		},
+	}, fetchFlags...),
 
 	Action: func(ctx *cli.Context) error {
 		logger := ctx.App.Metadata["logger"].(lager.Logger)
@@ -98,14 +105,16 @@ var CreateCommand = cli.Command{
 		}
 
 		configBuilder := ctx.App.Metadata["configBuilder"].(*config.Builder)
-		configBuilder.WithInsecureRegistries(ctx.StringSlice("insecure-registry")).
+		withFetchFlags(configBuilder, ctx).
 			WithDiskLimitSizeBytes(ctx.Int64("disk-limit-size-bytes"),
 				ctx.IsSet("disk-limit-size-bytes")).
 			WithExcludeImageFromQuota(ctx.Bool("exclude-image-from-quota"),
 				ctx.IsSet("exclude-image-from-quota")).
-			WithSkipLayerValidation(ctx.Bool("skip-layer-validation"),
-				ctx.IsSet("skip-layer-validation")).
 			WithCleanThresholdBytes(ctx.Int64("threshold-bytes"), ctx.IsSet("threshold-bytes")).
+			WithContentAddressedTarChainIDs(ctx.Bool("content-addressed-tar-chain-ids"),
+				ctx.IsSet("content-addressed-tar-chain-ids")).
+			WithPreferCache(ctx.Bool("prefer-cache"), ctx.IsSet("prefer-cache")).
+			WithOffline(ctx.Bool("offline"), ctx.IsSet("offline")).
 			WithClean(ctx.IsSet("with-clean"), ctx.IsSet("without-clean")).
 			WithMount(ctx.IsSet("with-mount"), ctx.IsSet("without-mount"))
 
@@ -129,83 +138,20 @@ var CreateCommand = cli.Command{
 			return cli.NewExitError(err.Error(), 1)
 		}
 
-		fsDriver, err := createFileSystemDriver(cfg)
-		if err != nil {
-			return cli.NewExitError(err.Error(), 1)
-		}
-
-		metricsEmitter := metrics.NewEmitter(logger, cfg.MetronEndpoint)
-
-		initLocksDir := filepath.Join("/", "var", "run")
-		storeLocksDir := filepath.Join(storePath, storepkg.LocksDirName)
-		sharedLocksmith := locksmithpkg.NewSharedFileSystem(storeLocksDir).WithMetrics(metricsEmitter)
-		exclusiveLocksmith := locksmithpkg.NewExclusiveFileSystem(storeLocksDir).WithMetrics(metricsEmitter)
-		initStoreLocksmith := locksmithpkg.NewExclusiveFileSystem(initLocksDir)
-
-		imageCloner := image_cloner.NewImageCloner(fsDriver, storePath)
-		storeNamespacer := groot.NewStoreNamespacer(storePath)
-
-		manager := manager.New(storePath, storeNamespacer, fsDriver, fsDriver, fsDriver, initStoreLocksmith)
-		if !manager.IsStoreInitialized(logger) {
-			logger.Error("store-verification-failed", errors.New("store is not initialized"))
-			return cli.NewExitError("Store path is not initialized. Please run init-store.", 1)
-		}
-
-		idMappings, err := storeNamespacer.Read()
+		storePuller, err := createStorePuller(logger, ctx, cfg, cfg.Create, baseImageURL)
 		if err != nil {
-			logger.Error("reading-namespace-file", err)
 			return cli.NewExitError(err.Error(), 1)
 		}
+		defer storePuller.close(logger)
 
-		runner := linux_command_runner.New()
-		var unpacker base_image_puller.Unpacker
-		unpackerStrategy := unpackerpkg.UnpackStrategy{
-			Name:               cfg.FSDriver,
-			WhiteoutDevicePath: filepath.Join(storePath, overlayxfs.WhiteoutDevice),
-		}
-
-		var idMapper unpackerpkg.IDMapper
-		if os.Getuid() == 0 {
-			unpacker, err = unpackerpkg.NewTarUnpacker(unpackerStrategy)
-			if err != nil {
-				return cli.NewExitError(err.Error(), 1)
-			}
-		} else {
-			idMapper = unpackerpkg.NewIDMapper(cfg.NewuidmapBin, cfg.NewgidmapBin, runner)
-			unpacker = unpackerpkg.NewNSIdMapperUnpacker(runner, idMapper, unpackerStrategy)
-		}
-
-		dependencyManager := dependency_manager.NewDependencyManager(
-			filepath.Join(storePath, storepkg.MetaDirName, "dependencies"),
-		)
-
-		nsFsDriver := namespaced.New(fsDriver, idMappings, idMapper, runner)
-
-		systemContext := createSystemContext(baseImageURL, cfg.Create, ctx.String("username"), ctx.String("password"))
-
-		fetcher := createFetcher(baseImageURL, systemContext, cfg.Create)
-		defer func() {
-			err := fetcher.Close()
-			if err != nil {
-				logger.Error("closing-fetcher", err)
-			}
-		}()
-
-		baseImagePuller := base_image_puller.NewBaseImagePuller(
-			fetcher,
-			unpacker,
-			nsFsDriver,
-			metricsEmitter,
-			exclusiveLocksmith,
-		)
-
-		gc := garbage_collector.NewGC(nsFsDriver, imageCloner, dependencyManager)
-		sm := storepkg.NewStoreMeasurer(storePath, fsDriver, gc)
-		cleaner := groot.IamCleaner(exclusiveLocksmith, sm, gc, metricsEmitter)
+		imageCloner := image_cloner.NewImageCloner(storePuller.fsDriver, storePath)
+		gc := garbage_collector.NewGC(storePuller.nsFsDriver, imageCloner, storePuller.dependencyManager)
+		sm := storepkg.NewStoreMeasurer(storePath, storePuller.fsDriver, gc)
+		cleaner := groot.IamCleaner(storePuller.exclusiveLocksmith, sm, gc, storePuller.metricsEmitter)
 
 		creator := groot.IamCreator(
-			imageCloner, baseImagePuller, sharedLocksmith,
-			dependencyManager, metricsEmitter, cleaner,
+			imageCloner, storePuller.baseImagePuller, storePuller.sharedLocksmith,
+			storePuller.dependencyManager, storePuller.metricsEmitter, cleaner,
 		)
 
 		createSpec := groot.CreateSpec{
@@ -214,8 +160,8 @@ var CreateCommand = cli.Command{
 			BaseImageURL:                baseImageURL,
 			DiskLimit:                   cfg.Create.DiskLimitSizeBytes,
 			ExcludeBaseImageFromQuota:   cfg.Create.ExcludeImageFromQuota,
-			UIDMappings:                 idMappings.UIDMappings,
-			GIDMappings:                 idMappings.GIDMappings,
+			UIDMappings:                 storePuller.idMappings.UIDMappings,
+			GIDMappings:                 storePuller.idMappings.GIDMappings,
 			CleanOnCreate:               cfg.Create.WithClean,
 			CleanOnCreateThresholdBytes: cfg.Clean.ThresholdBytes,
 		}
@@ -245,14 +191,14 @@ var CreateCommand = cli.Command{
 			})
 		}
 
-		jsonBytes, err := json.Marshal(containerSpec)
+		jsonBytes, err := json.Marshal(createOutput{Spec: containerSpec, ManifestDigest: image.ManifestDigest})
 		if err != nil {
 			logger.Error("formatting output", err)
 			return cli.NewExitError(err.Error(), 1)
 		}
 		fmt.Println(string(jsonBytes))
 
-		emitMetrics(logger, metricsEmitter, sm)
+		emitMetrics(logger, storePuller.metricsEmitter, sm)
 
 		return nil
 	},
@@ -278,39 +224,219 @@ func emitMetrics(logger lager.Logger, metricsEmitter *metrics.Emitter, sm *store
 	metricsEmitter.TryEmitUsage(logger, "CommittedQuotaInBytes", commitedQuota, "bytes")
 }
 
-func createFetcher(baseImageUrl *url.URL, systemContext types.SystemContext, createCfg config.Create) base_image_puller.Fetcher {
-	if baseImageUrl.Scheme == "" {
-		return tar_fetcher.NewTarFetcher(baseImageUrl)
+func createFetcher(logger lager.Logger, baseImageUrl *url.URL, systemContext types.SystemContext, createCfg config.Create, storePath string, metricsEmitter *metrics.Emitter, progressReporter source.ProgressReporter) (base_image_puller.Fetcher, error) {
+	verifier, err := signatureVerifier(createCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch baseImageUrl.Scheme {
+	case "", "docker-archive", "dir":
+		if verifier != nil {
+			if err := verifier.VerifyUnsigned(logger, baseImageUrl); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	switch baseImageUrl.Scheme {
+	case "":
+		tarFetcher := tar_fetcher.NewTarFetcher(baseImageUrl)
+		if createCfg.ContentAddressedTarChainIDs {
+			digestCache := digest_cache.NewDigestCache(filepath.Join(storePath, storepkg.MetaDirName, "tar-digests"), digest_cache.DefaultMaxEntries)
+			tarFetcher = tarFetcher.WithContentChainIDs(digestCache)
+		}
+		return tarFetcher, nil
+	case "docker-archive":
+		return docker_archive_fetcher.NewDockerArchiveFetcher(baseImageUrl), nil
+	case "dir":
+		digestCache := digest_cache.NewDigestCache(filepath.Join(storePath, storepkg.MetaDirName, "dir-digests"), digest_cache.DefaultMaxEntries)
+		return dir_fetcher.NewDirFetcher(baseImageUrl).WithDigestCache(digestCache), nil
+	}
+
+	platform, err := source.ParsePlatform(createCfg.Platform)
+	if err != nil {
+		return nil, err
+	}
+
+	mirrors, err := createMirrors(baseImageUrl, createCfg, storePath)
+	if err != nil {
+		return nil, err
 	}
 
 	skipOCILayerValidation := createCfg.SkipLayerValidation && baseImageUrl.Scheme == "oci"
-	layerSource := source.NewLayerSource(systemContext, skipOCILayerValidation, shouldSkipImageQuotaValidation(createCfg), createCfg.DiskLimitSizeBytes, baseImageUrl)
-	return layer_fetcher.NewLayerFetcher(&layerSource)
+	layerSource := source.NewLayerSource(systemContext, skipOCILayerValidation, shouldSkipImageQuotaValidation(createCfg), createCfg.DiskLimitSizeBytes, baseImageUrl).
+		WithPlatform(platform).
+		WithMirrors(mirrors).
+		WithMetricsEmitter(metricsEmitter).
+		WithProgressReporter(progressReporter).
+		WithDownloadRetries(*createCfg.DownloadRetries, source.DefaultRetryBackoff)
+	if createCfg.MaxDownloadBytesPerSecond > 0 {
+		layerSource = layerSource.WithRateLimiter(ratelimit.NewLimiter(createCfg.MaxDownloadBytesPerSecond))
+	}
+	if verifier != nil {
+		layerSource = layerSource.WithSignatureVerifier(verifier)
+	}
+	if createCfg.BlobCacheSizeBytes > 0 && baseImageUrl.Scheme == "docker" {
+		layerSource = layerSource.WithBlobCache(blob_cache.NewBlobCache(
+			filepath.Join(storePath, storepkg.BlobCacheDirName), createCfg.BlobCacheSizeBytes,
+		))
+	}
+	if createCfg.CacheRegistryTokens {
+		layerSource = layerSource.WithTokenCache(token_cache.NewTokenCache(
+			filepath.Join(storePath, storepkg.MetaDirName, "registry-tokens"),
+			locksmithpkg.NewExclusiveFileSystem(filepath.Join(storePath, storepkg.LocksDirName)),
+		))
+	}
+	return layer_fetcher.NewLayerFetcher(&layerSource).
+		WithStreaming(createCfg.StreamingUnpack).
+		WithForeignLayerPolicy(layer_fetcher.ForeignLayerPolicy{
+			Policy:             createCfg.ForeignLayers.Policy,
+			AllowedURLPrefixes: createCfg.ForeignLayers.AllowedURLPrefixes,
+		}), nil
+}
+
+// progressReporter logs the progress of layer downloads, and writes it to the
+// file descriptor given with --progress-fd
+func progressReporter(ctx *cli.Context) *progress.Reporter {
+	if !ctx.IsSet("progress-fd") {
+		return progress.NewReporter(nil)
+	}
+
+	return progress.NewReporter(os.NewFile(uintptr(ctx.Int("progress-fd")), "progress"))
+}
+
+// signatureVerifier returns nil when no signature policy is configured
+func signatureVerifier(createCfg config.Create) (*signature.Verifier, error) {
+	if createCfg.SignaturePolicyPath == "" {
+		return nil, nil
+	}
+
+	policy, err := signature.NewPolicyFromFile(createCfg.SignaturePolicyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return signature.NewVerifier(policy, createCfg.SignatureStorePath), nil
+}
+
+// cacheImageInfo records the metadata of registry and OCI images in the
+// store, so that they can be created again without their source. Recorded
+// images are checked against the signature policy again when they are used.
+func cacheImageInfo(baseImageURL *url.URL, fetcher base_image_puller.Fetcher, volumeDriver cached_fetcher.VolumeDriver, createCfg config.Create, storePath string) (base_image_puller.Fetcher, error) {
+	switch baseImageURL.Scheme {
+	case "", "docker-archive", "dir":
+		return fetcher, nil
+	}
+
+	platform, err := source.ParsePlatform(createCfg.Platform)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := cached_fetcher.ModeRefresh
+	if createCfg.Offline {
+		mode = cached_fetcher.ModeOffline
+	} else if createCfg.PreferCache {
+		mode = cached_fetcher.ModePreferCache
+	}
+
+	cachePath := filepath.Join(storePath, storepkg.MetaDirName, "image-info")
+	cachedFetcher := cached_fetcher.NewCachedFetcher(fetcher, volumeDriver, cachePath, baseImageURL).
+		WithMode(mode).
+		WithPlatform(platform.String())
+
+	verifier, err := signatureVerifier(createCfg)
+	if err != nil {
+		return nil, err
+	}
+	if verifier != nil {
+		cachedFetcher = cachedFetcher.WithSignatureVerifier(verifier)
+	}
+
+	return cachedFetcher, nil
+}
+
+func createMirrors(baseImageURL *url.URL, createConfig config.Create, storePath string) ([]source.Endpoint, error) {
+	if baseImageURL.Scheme != "docker" {
+		return nil, nil
+	}
+
+	mirrors := []source.Endpoint{}
+	for _, mirrorHost := range createConfig.RegistryMirrors[source.RegistryHost(baseImageURL)] {
+		mirrorURL := *baseImageURL
+		mirrorURL.Host = mirrorHost
+		systemContext, err := createSystemContext(&mirrorURL, createConfig, storePath, "", "")
+		if err != nil {
+			return nil, err
+		}
+
+		mirrors = append(mirrors, source.Endpoint{
+			Host:          mirrorHost,
+			SystemContext: systemContext,
+		})
+	}
+
+	return mirrors, nil
 }
 
 func shouldSkipImageQuotaValidation(createCfg config.Create) bool {
 	return createCfg.ExcludeImageFromQuota || createCfg.DiskLimitSizeBytes == 0
 }
 
-func createSystemContext(baseImageURL *url.URL, createConfig config.Create, username, password string) types.SystemContext {
+func createSystemContext(baseImageURL *url.URL, createConfig config.Create, storePath, username, password string) (types.SystemContext, error) {
 	scheme := baseImageURL.Scheme
 	switch scheme {
 	case "docker":
+		if username == "" && password == "" {
+			creds, err := registryCredentials(baseImageURL, createConfig)
+			if err != nil {
+				return types.SystemContext{}, err
+			}
+			username, password = creds.Username, creds.Password
+		}
+
+		var certPath string
+		if registryTLS, ok := createConfig.RegistryTLS[source.RegistryHost(baseImageURL)]; ok {
+			var err error
+			certPath, err = certs.Dir(filepath.Join(storePath, storepkg.MetaDirName, "registry-certs"), registryTLS)
+			if err != nil {
+				return types.SystemContext{}, err
+			}
+		}
+
 		return types.SystemContext{
 			DockerInsecureSkipTLSVerify: skipTLSValidation(baseImageURL, createConfig.InsecureRegistries),
+			DockerCertPath:              certPath,
 			DockerAuthConfig: &types.DockerAuthConfig{
 				Username: username,
 				Password: password,
 			},
-		}
+		}, nil
 	case "oci":
 		return types.SystemContext{
 			OCICertPath: createConfig.RemoteLayerClientCertificatesPath,
-		}
+		}, nil
 	default:
-		return types.SystemContext{}
+		return types.SystemContext{}, nil
+	}
+
+}
+
+// registryCredentials looks up the credentials for the registry of the image
+// in the docker config.json
+func registryCredentials(baseImageURL *url.URL, createConfig config.Create) (auth.Credentials, error) {
+	dockerConfigPath := createConfig.DockerConfigPath
+	if dockerConfigPath == "" {
+		dockerConfigPath = auth.DefaultDockerConfigPath()
+	}
+
+	creds, err := auth.NewDockerConfig(dockerConfigPath).Credentials(source.RegistryHost(baseImageURL))
+	if err != nil {
+		return auth.Credentials{}, errorspkg.Wrap(err, "reading registry credentials")
 	}
 
+	return creds, nil
 }
 
 func skipTLSValidation(baseImageURL *url.URL, trustedRegistries []string) bool {
@@ -3,9 +3,12 @@ package commands
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
+	"code.cloudfoundry.org/commandrunner"
 	"code.cloudfoundry.org/commandrunner/linux_command_runner"
 	"code.cloudfoundry.org/grootfs/base_image_puller"
 	unpackerpkg "code.cloudfoundry.org/grootfs/base_image_puller/unpacker"
@@ -63,10 +66,55 @@ func createImageDriver(cfg config.Config, fsDriver fileSystemDriver) (image_clon
 	return namespaced.New(fsDriver, idMappings, idMapper, runner), nil
 }
 
+// createUnpacker returns an unpacker that maps the owners of the files with
+// newuidmap and newgidmap, unless grootfs runs as root
+func createUnpacker(cfg config.Config, runner commandrunner.CommandRunner) (base_image_puller.Unpacker, unpackerpkg.IDMapper, error) {
+	allowedDevices, err := parseDeviceNumbers(cfg.Create.Devices.Allowed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	unpackerStrategy := unpackerpkg.UnpackStrategy{
+		Name:               cfg.FSDriver,
+		WhiteoutDevicePath: filepath.Join(cfg.StorePath, overlayxfs.WhiteoutDevice),
+		Xattrs: unpackerpkg.XattrFilter{
+			AllowedNamespaces: cfg.Create.Xattrs.AllowedNamespaces,
+			DeniedNamespaces:  cfg.Create.Xattrs.DeniedNamespaces,
+		},
+		Devices: unpackerpkg.DeviceFilter{
+			Skip:           cfg.Create.Devices.Skip,
+			AllowedDevices: allowedDevices,
+		},
+	}
+
+	if os.Getuid() == 0 {
+		unpacker, err := unpackerpkg.NewTarUnpacker(unpackerStrategy)
+		return unpacker, nil, err
+	}
+
+	idMapper := unpackerpkg.NewIDMapper(cfg.NewuidmapBin, cfg.NewgidmapBin, runner)
+	return unpackerpkg.NewNSIdMapperUnpacker(runner, idMapper, unpackerStrategy), idMapper, nil
+}
+
 func nsImageDriverRequired(cfg config.Config) bool {
 	return cfg.FSDriver == "overlay-xfs"
 }
 
+func parseDeviceNumbers(args []string) ([]unpackerpkg.DeviceNumber, error) {
+	devices := []unpackerpkg.DeviceNumber{}
+
+	for _, v := range args {
+		var device unpackerpkg.DeviceNumber
+		_, err := fmt.Sscanf(v, "%d:%d", &device.Major, &device.Minor)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+
+	return devices, nil
+}
+
 func parseIDMappings(args []string) ([]groot.IDMappingSpec, error) {
 	mappings := []groot.IDMappingSpec{}
 
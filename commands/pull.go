@@ -0,0 +1,93 @@
+package commands // import "code.cloudfoundry.org/grootfs/commands"
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"code.cloudfoundry.org/grootfs/commands/config"
+	"code.cloudfoundry.org/grootfs/groot"
+	"code.cloudfoundry.org/lager"
+	errorspkg "github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+type pullOutput struct {
+	Name     string   `json:"name"`
+	ChainIDs []string `json:"chain_ids"`
+}
+
+var PullCommand = cli.Command{
+	Name:        "pull",
+	Usage:       "pull [options] <image> [<name>]",
+	Description: "Fetches the layers of an image into the store without creating an image. The layers are kept until `unpull <name>` is run. The name defaults to the image.",
+
+	Flags: fetchFlags,
+
+	Action: func(ctx *cli.Context) error {
+		logger := ctx.App.Metadata["logger"].(lager.Logger)
+		logger = logger.Session("pull")
+
+		if ctx.NArg() != 1 && ctx.NArg() != 2 {
+			logger.Error("parsing-command", errorspkg.New("invalid arguments"), lager.Data{"args": ctx.Args()})
+			return cli.NewExitError(fmt.Sprintf("invalid arguments - usage: %s", ctx.Command.Usage), 1)
+		}
+
+		configBuilder := ctx.App.Metadata["configBuilder"].(*config.Builder)
+		withFetchFlags(configBuilder, ctx)
+
+		cfg, err := configBuilder.Build()
+		logger.Debug("pull-config", lager.Data{"currentConfig": cfg})
+		if err != nil {
+			logger.Error("config-builder-failed", err)
+			return cli.NewExitError(err.Error(), 1)
+		}
+
+		baseImage := ctx.Args().First()
+		baseImageURL, err := url.Parse(baseImage)
+		if err != nil {
+			logger.Error("base-image-url-parsing-failed", err)
+			return cli.NewExitError(err.Error(), 1)
+		}
+
+		name := baseImage
+		if ctx.NArg() == 2 {
+			name = ctx.Args().Get(1)
+		}
+
+		// Pulled layers don't belong to any image, so there is no image quota
+		// to check them against
+		pullCfg := cfg.Create
+		pullCfg.DiskLimitSizeBytes = 0
+
+		storePuller, err := createStorePuller(logger, ctx, cfg, pullCfg, baseImageURL)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		defer storePuller.close(logger)
+
+		puller := groot.IamPuller(storePuller.baseImagePuller, storePuller.sharedLocksmith, storePuller.dependencyManager)
+
+		pullSpec := groot.PullSpec{
+			Name:         name,
+			BaseImageURL: baseImageURL,
+			UIDMappings:  storePuller.idMappings.UIDMappings,
+			GIDMappings:  storePuller.idMappings.GIDMappings,
+		}
+		chainIDs, err := puller.Pull(logger, pullSpec)
+		if err != nil {
+			logger.Error("pulling", err)
+			humanizedError := tryHumanize(err, groot.CreateSpec{BaseImageURL: baseImageURL})
+			return cli.NewExitError(humanizedError, 1)
+		}
+
+		jsonBytes, err := json.Marshal(pullOutput{Name: name, ChainIDs: chainIDs})
+		if err != nil {
+			logger.Error("formatting output", err)
+			return cli.NewExitError(err.Error(), 1)
+		}
+		fmt.Println(string(jsonBytes))
+
+		return nil
+	},
+}
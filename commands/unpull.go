@@ -0,0 +1,52 @@
+package commands // import "code.cloudfoundry.org/grootfs/commands"
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"code.cloudfoundry.org/grootfs/commands/config"
+	"code.cloudfoundry.org/grootfs/groot"
+	storepkg "code.cloudfoundry.org/grootfs/store"
+	"code.cloudfoundry.org/grootfs/store/dependency_manager"
+	"code.cloudfoundry.org/lager"
+	errorspkg "github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var UnpullCommand = cli.Command{
+	Name:        "unpull",
+	Usage:       "unpull <name>",
+	Description: "Allows the layers of a pulled image to be cleaned up once no image uses them",
+
+	Action: func(ctx *cli.Context) error {
+		logger := ctx.App.Metadata["logger"].(lager.Logger)
+		logger = logger.Session("unpull")
+
+		if ctx.NArg() != 1 {
+			logger.Error("parsing-command", errorspkg.New("name was not specified"))
+			return cli.NewExitError("name was not specified", 1)
+		}
+
+		configBuilder := ctx.App.Metadata["configBuilder"].(*config.Builder)
+		cfg, err := configBuilder.Build()
+		logger.Debug("unpull-config", lager.Data{"currentConfig": cfg})
+		if err != nil {
+			logger.Error("config-builder-failed", err)
+			return cli.NewExitError(err.Error(), 1)
+		}
+
+		dependencyManager := dependency_manager.NewDependencyManager(
+			filepath.Join(cfg.StorePath, storepkg.MetaDirName, "dependencies"),
+		)
+		unpuller := groot.IamUnpuller(dependencyManager)
+
+		name := ctx.Args().First()
+		if err := unpuller.Unpull(logger, name); err != nil {
+			logger.Error("unpulling-failed", err)
+			return cli.NewExitError(err.Error(), 1)
+		}
+
+		fmt.Printf("Pull %s removed\n", name)
+		return nil
+	},
+}
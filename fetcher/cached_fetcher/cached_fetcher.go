@@ -0,0 +1,209 @@
+package cached_fetcher // import "code.cloudfoundry.org/grootfs/fetcher/cached_fetcher"
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/grootfs/base_image_puller"
+	"code.cloudfoundry.org/grootfs/groot"
+	"code.cloudfoundry.org/grootfs/store/cache_dir"
+	"code.cloudfoundry.org/lager"
+	errorspkg "github.com/pkg/errors"
+)
+
+type Mode int
+
+const (
+	// ModeRefresh always fetches the image metadata, and records it for later
+	// creates
+	ModeRefresh Mode = iota
+	// ModePreferCache uses the recorded metadata when all the layers of the
+	// image are in the store, and fetches it otherwise
+	ModePreferCache
+	// ModeOffline never contacts the image source
+	ModeOffline
+)
+
+// DefaultMaxEntries is how many images are recorded unless configured
+// otherwise
+const DefaultMaxEntries = 1024
+
+type VolumeDriver interface {
+	VolumePath(logger lager.Logger, id string) (string, error)
+}
+
+// SignatureVerifier decides whether an image can be used from the signatures
+// of its manifest
+type SignatureVerifier interface {
+	Verify(logger lager.Logger, baseImageURL *url.URL, manifest []byte) error
+}
+
+// CachedFetcher records the metadata of the images it fetches in the store,
+// so that images whose layers were already pulled can be created again
+// without their registry. Only the maxEntries most recently used images are
+// kept.
+type CachedFetcher struct {
+	fetcher           base_image_puller.Fetcher
+	volumeDriver      VolumeDriver
+	cachePath         string
+	baseImageURL      *url.URL
+	platform          string
+	signatureVerifier SignatureVerifier
+	maxEntries        int
+	mode              Mode
+}
+
+type cacheEntry struct {
+	BaseImageURL  string              `json:"base_image_url"`
+	Platform      string              `json:"platform"`
+	BaseImageInfo groot.BaseImageInfo `json:"base_image_info"`
+}
+
+func NewCachedFetcher(fetcher base_image_puller.Fetcher, volumeDriver VolumeDriver, cachePath string, baseImageURL *url.URL) *CachedFetcher {
+	return &CachedFetcher{
+		fetcher:      fetcher,
+		volumeDriver: volumeDriver,
+		cachePath:    cachePath,
+		baseImageURL: baseImageURL,
+		maxEntries:   DefaultMaxEntries,
+		mode:         ModeRefresh,
+	}
+}
+
+func (f *CachedFetcher) WithMode(mode Mode) *CachedFetcher {
+	f.mode = mode
+	return f
+}
+
+// WithPlatform records the image for the platform it was resolved for, as
+// multi-platform images resolve to different layers on each one
+func (f *CachedFetcher) WithPlatform(platform string) *CachedFetcher {
+	f.platform = platform
+	return f
+}
+
+// WithSignatureVerifier checks the recorded manifest against the signature
+// policy before the recorded metadata is used
+func (f *CachedFetcher) WithSignatureVerifier(signatureVerifier SignatureVerifier) *CachedFetcher {
+	f.signatureVerifier = signatureVerifier
+	return f
+}
+
+func (f *CachedFetcher) WithMaxEntries(maxEntries int) *CachedFetcher {
+	f.maxEntries = maxEntries
+	return f
+}
+
+func (f *CachedFetcher) BaseImageInfo(logger lager.Logger) (groot.BaseImageInfo, error) {
+	logger = logger.Session("cached-base-image-info", lager.Data{"baseImageURL": f.baseImageURL.String(), "mode": f.mode})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	if f.mode != ModeRefresh {
+		baseImageInfo, err := f.cachedBaseImageInfo(logger)
+		if err == nil {
+			logger.Debug("using-cached-image-info")
+			return baseImageInfo, nil
+		}
+
+		if f.mode == ModeOffline {
+			return groot.BaseImageInfo{}, errorspkg.Wrap(err, "creating the image offline")
+		}
+		logger.Debug("cached-image-info-unusable", lager.Data{"reason": err.Error()})
+	}
+
+	baseImageInfo, err := f.fetcher.BaseImageInfo(logger)
+	if err != nil {
+		return groot.BaseImageInfo{}, err
+	}
+
+	if err := f.writeCacheEntry(baseImageInfo); err != nil {
+		logger.Error("caching-image-info-failed", err)
+	}
+	cache_dir.Evict(logger, f.cachePath, f.maxEntries)
+
+	return baseImageInfo, nil
+}
+
+func (f *CachedFetcher) StreamBlob(logger lager.Logger, layerInfo groot.LayerInfo) (io.ReadCloser, int64, error) {
+	if f.mode == ModeOffline {
+		return nil, 0, errorspkg.Errorf("volume for layer `%s` is missing from the store and cannot be fetched offline", layerInfo.ChainID)
+	}
+
+	return f.fetcher.StreamBlob(logger, layerInfo)
+}
+
+func (f *CachedFetcher) Close() error {
+	return f.fetcher.Close()
+}
+
+// cachedBaseImageInfo returns the recorded metadata of the image, as long as
+// every layer of the image has a volume in the store and its manifest still
+// satisfies the signature policy.
+func (f *CachedFetcher) cachedBaseImageInfo(logger lager.Logger) (groot.BaseImageInfo, error) {
+	entryPath := f.cacheEntryPath()
+	contents, err := ioutil.ReadFile(entryPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return groot.BaseImageInfo{}, errorspkg.Errorf("image `%s` was never pulled", f.baseImageURL)
+		}
+		return groot.BaseImageInfo{}, errorspkg.Wrap(err, "reading cached image metadata")
+	}
+
+	var entry cacheEntry
+	if err := json.Unmarshal(contents, &entry); err != nil {
+		return groot.BaseImageInfo{}, errorspkg.Wrap(err, "parsing cached image metadata")
+	}
+	if entry.BaseImageURL != f.baseImageURL.String() || entry.Platform != f.platform {
+		return groot.BaseImageInfo{}, errorspkg.Errorf("cached image metadata is for image `%s` on platform `%s`", entry.BaseImageURL, entry.Platform)
+	}
+
+	if f.signatureVerifier != nil {
+		if len(entry.BaseImageInfo.Manifest) == 0 {
+			return groot.BaseImageInfo{}, errorspkg.Errorf("no manifest was recorded for image `%s` to verify its signatures", f.baseImageURL)
+		}
+		if err := f.signatureVerifier.Verify(logger, f.baseImageURL, entry.BaseImageInfo.Manifest); err != nil {
+			return groot.BaseImageInfo{}, errorspkg.Wrap(err, "verifying image signatures")
+		}
+	}
+
+	for _, layerInfo := range entry.BaseImageInfo.LayerInfos {
+		if _, err := f.volumeDriver.VolumePath(logger, layerInfo.ChainID); err != nil {
+			return groot.BaseImageInfo{}, errorspkg.Errorf("volume for layer `%s` of image `%s` is missing from the store", layerInfo.ChainID, f.baseImageURL)
+		}
+	}
+
+	if err := cache_dir.Touch(entryPath); err != nil {
+		logger.Error("touching-cached-image-info-failed", err)
+	}
+
+	return entry.BaseImageInfo, nil
+}
+
+// writeCacheEntry writes the entry atomically, so that concurrent creates
+// never read partially written metadata.
+func (f *CachedFetcher) writeCacheEntry(baseImageInfo groot.BaseImageInfo) error {
+	contents, err := json.Marshal(cacheEntry{
+		BaseImageURL:  f.baseImageURL.String(),
+		Platform:      f.platform,
+		BaseImageInfo: baseImageInfo,
+	})
+	if err != nil {
+		return err
+	}
+
+	return cache_dir.WriteFile(f.cacheEntryPath(), contents, 0755)
+}
+
+// cacheEntryPath is keyed by the image URL, which includes the manifest digest
+// of pinned references, and the platform
+func (f *CachedFetcher) cacheEntryPath() string {
+	key := sha256.Sum256([]byte(f.baseImageURL.String() + "\n" + f.platform))
+	return filepath.Join(f.cachePath, hex.EncodeToString(key[:]))
+}
@@ -0,0 +1,299 @@
+package cached_fetcher_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/grootfs/base_image_puller/base_image_pullerfakes"
+	"code.cloudfoundry.org/grootfs/fetcher/cached_fetcher"
+	"code.cloudfoundry.org/grootfs/fetcher/layer_fetcher/signature"
+	"code.cloudfoundry.org/grootfs/groot"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	specsv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("CachedFetcher", func() {
+	var (
+		logger        *lagertest.TestLogger
+		cachePath     string
+		baseImageURL  *url.URL
+		fakeFetcher   *base_image_pullerfakes.FakeFetcher
+		fakeVolumes   *base_image_pullerfakes.FakeVolumeDriver
+		baseImageInfo groot.BaseImageInfo
+		storeVolumes  map[string]bool
+	)
+
+	newFetcher := func(mode cached_fetcher.Mode) *cached_fetcher.CachedFetcher {
+		return cached_fetcher.NewCachedFetcher(fakeFetcher, fakeVolumes, cachePath, baseImageURL).WithMode(mode)
+	}
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("cached-fetcher")
+
+		var err error
+		cachePath, err = ioutil.TempDir("", "image-info")
+		Expect(err).NotTo(HaveOccurred())
+		baseImageURL, err = url.Parse("docker:///cfgarden/empty:v0.1.1")
+		Expect(err).NotTo(HaveOccurred())
+
+		baseImageInfo = groot.BaseImageInfo{
+			LayerInfos: []groot.LayerInfo{
+				{BlobID: "sha256:layer-1", ChainID: "chain-1", DiffID: "diff-1", Size: 100},
+				{BlobID: "sha256:layer-2", ChainID: "chain-2", DiffID: "diff-2", ParentChainID: "chain-1", Size: 200},
+			},
+			Config:         specsv1.Image{Author: "groot"},
+			ManifestDigest: "sha256:manifest",
+			Manifest:       []byte(`{"schemaVersion": 2}`),
+		}
+		fakeFetcher = new(base_image_pullerfakes.FakeFetcher)
+		fakeFetcher.BaseImageInfoReturns(baseImageInfo, nil)
+
+		storeVolumes = map[string]bool{"chain-1": true, "chain-2": true}
+		fakeVolumes = new(base_image_pullerfakes.FakeVolumeDriver)
+		fakeVolumes.VolumePathStub = func(_ lager.Logger, id string) (string, error) {
+			if storeVolumes[id] {
+				return filepath.Join("/volumes", id), nil
+			}
+			return "", errors.New("volume does not exist")
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(cachePath)).To(Succeed())
+	})
+
+	Describe("BaseImageInfo", func() {
+		It("fetches the image info", func() {
+			info, err := newFetcher(cached_fetcher.ModeRefresh).BaseImageInfo(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info).To(Equal(baseImageInfo))
+			Expect(fakeFetcher.BaseImageInfoCallCount()).To(Equal(1))
+		})
+
+		It("records the image info", func() {
+			_, err := newFetcher(cached_fetcher.ModeRefresh).BaseImageInfo(logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			entries, err := ioutil.ReadDir(cachePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+		})
+
+		Context("when fetching fails", func() {
+			BeforeEach(func() {
+				fakeFetcher.BaseImageInfoReturns(groot.BaseImageInfo{}, errors.New("registry is down"))
+			})
+
+			It("returns the error", func() {
+				_, err := newFetcher(cached_fetcher.ModeRefresh).BaseImageInfo(logger)
+				Expect(err).To(MatchError("registry is down"))
+			})
+		})
+
+		Context("when the image was pulled before", func() {
+			BeforeEach(func() {
+				_, err := newFetcher(cached_fetcher.ModeRefresh).BaseImageInfo(logger)
+				Expect(err).NotTo(HaveOccurred())
+				fakeFetcher.BaseImageInfoReturns(groot.BaseImageInfo{}, errors.New("registry is down"))
+			})
+
+			Context("and the mode prefers the cache", func() {
+				It("returns the recorded image info without fetching it", func() {
+					info, err := newFetcher(cached_fetcher.ModePreferCache).BaseImageInfo(logger)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(info).To(Equal(baseImageInfo))
+					Expect(fakeFetcher.BaseImageInfoCallCount()).To(Equal(1))
+				})
+
+				Context("and a layer volume is missing", func() {
+					BeforeEach(func() {
+						delete(storeVolumes, "chain-2")
+						fakeFetcher.BaseImageInfoReturns(baseImageInfo, nil)
+					})
+
+					It("fetches the image info", func() {
+						_, err := newFetcher(cached_fetcher.ModePreferCache).BaseImageInfo(logger)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(fakeFetcher.BaseImageInfoCallCount()).To(Equal(2))
+					})
+				})
+			})
+
+			Context("and the mode is offline", func() {
+				It("returns the recorded image info", func() {
+					info, err := newFetcher(cached_fetcher.ModeOffline).BaseImageInfo(logger)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(info).To(Equal(baseImageInfo))
+					Expect(fakeFetcher.BaseImageInfoCallCount()).To(Equal(1))
+				})
+
+				Context("and a layer volume is missing", func() {
+					BeforeEach(func() {
+						delete(storeVolumes, "chain-2")
+					})
+
+					It("returns an error without fetching the image info", func() {
+						_, err := newFetcher(cached_fetcher.ModeOffline).BaseImageInfo(logger)
+						Expect(err).To(MatchError(ContainSubstring("volume for layer `chain-2` of image `docker:///cfgarden/empty:v0.1.1` is missing from the store")))
+						Expect(fakeFetcher.BaseImageInfoCallCount()).To(Equal(1))
+					})
+				})
+			})
+		})
+
+		Context("when the image was never pulled", func() {
+			Context("and the mode is offline", func() {
+				It("returns an error without fetching the image info", func() {
+					_, err := newFetcher(cached_fetcher.ModeOffline).BaseImageInfo(logger)
+					Expect(err).To(MatchError(ContainSubstring("image `docker:///cfgarden/empty:v0.1.1` was never pulled")))
+					Expect(fakeFetcher.BaseImageInfoCallCount()).To(BeZero())
+				})
+			})
+
+			Context("and the image was pulled for another platform", func() {
+				BeforeEach(func() {
+					_, err := newFetcher(cached_fetcher.ModeRefresh).WithPlatform("linux/arm64").BaseImageInfo(logger)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("doesn't use its image info", func() {
+					_, err := newFetcher(cached_fetcher.ModeOffline).WithPlatform("linux/amd64").BaseImageInfo(logger)
+					Expect(err).To(MatchError(ContainSubstring("was never pulled")))
+				})
+			})
+
+			Context("and another image was pulled", func() {
+				BeforeEach(func() {
+					otherURL, err := url.Parse("docker:///cfgarden/empty:v0.2.0")
+					Expect(err).NotTo(HaveOccurred())
+					_, err = cached_fetcher.NewCachedFetcher(fakeFetcher, fakeVolumes, cachePath, otherURL).BaseImageInfo(logger)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("doesn't use its image info", func() {
+					_, err := newFetcher(cached_fetcher.ModeOffline).BaseImageInfo(logger)
+					Expect(err).To(MatchError(ContainSubstring("was never pulled")))
+				})
+			})
+		})
+	})
+
+	Describe("signature verification", func() {
+		var policyPath string
+
+		verifier := func(policy string) *signature.Verifier {
+			Expect(ioutil.WriteFile(policyPath, []byte(policy), 0644)).To(Succeed())
+			loadedPolicy, err := signature.NewPolicyFromFile(policyPath)
+			Expect(err).NotTo(HaveOccurred())
+			return signature.NewVerifier(loadedPolicy, "")
+		}
+
+		BeforeEach(func() {
+			policyPath = filepath.Join(cachePath, "..", filepath.Base(cachePath)+"-policy.json")
+
+			_, err := newFetcher(cached_fetcher.ModeRefresh).BaseImageInfo(logger)
+			Expect(err).NotTo(HaveOccurred())
+			fakeFetcher.BaseImageInfoReturns(groot.BaseImageInfo{}, errors.New("registry is down"))
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(policyPath)).To(Succeed())
+		})
+
+		It("uses the recorded image info when the policy accepts the image", func() {
+			info, err := newFetcher(cached_fetcher.ModeOffline).
+				WithSignatureVerifier(verifier(`{"default": [{"type": "insecureAcceptAnything"}]}`)).
+				BaseImageInfo(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info).To(Equal(baseImageInfo))
+		})
+
+		It("rejects the recorded image info when the policy rejects the image", func() {
+			_, err := newFetcher(cached_fetcher.ModeOffline).
+				WithSignatureVerifier(verifier(`{"default": [{"type": "reject"}]}`)).
+				BaseImageInfo(logger)
+			Expect(err).To(MatchError(ContainSubstring("is rejected by the signature policy")))
+		})
+
+		Context("when no manifest was recorded", func() {
+			BeforeEach(func() {
+				baseImageInfo.Manifest = nil
+				fakeFetcher.BaseImageInfoReturns(baseImageInfo, nil)
+				_, err := newFetcher(cached_fetcher.ModeRefresh).BaseImageInfo(logger)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("doesn't use the recorded image info", func() {
+				_, err := newFetcher(cached_fetcher.ModeOffline).
+					WithSignatureVerifier(verifier(`{"default": [{"type": "insecureAcceptAnything"}]}`)).
+					BaseImageInfo(logger)
+				Expect(err).To(MatchError(ContainSubstring("no manifest was recorded")))
+			})
+		})
+	})
+
+	Describe("eviction", func() {
+		It("keeps the most recently used images", func() {
+			urls := []string{"docker:///first", "docker:///second", "docker:///third"}
+			for i, rawURL := range urls[:2] {
+				imageURL, err := url.Parse(rawURL)
+				Expect(err).NotTo(HaveOccurred())
+				_, err = cached_fetcher.NewCachedFetcher(fakeFetcher, fakeVolumes, cachePath, imageURL).WithMaxEntries(2).BaseImageInfo(logger)
+				Expect(err).NotTo(HaveOccurred())
+
+				entries, err := ioutil.ReadDir(cachePath)
+				Expect(err).NotTo(HaveOccurred())
+				past := time.Now().Add(time.Duration(i-10) * time.Minute)
+				for _, entry := range entries {
+					if entry.ModTime().After(time.Now().Add(-time.Minute)) {
+						Expect(os.Chtimes(filepath.Join(cachePath, entry.Name()), past, past)).To(Succeed())
+					}
+				}
+			}
+
+			firstURL, err := url.Parse(urls[0])
+			Expect(err).NotTo(HaveOccurred())
+			_, err = cached_fetcher.NewCachedFetcher(fakeFetcher, fakeVolumes, cachePath, firstURL).WithMode(cached_fetcher.ModeOffline).BaseImageInfo(logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			thirdURL, err := url.Parse(urls[2])
+			Expect(err).NotTo(HaveOccurred())
+			_, err = cached_fetcher.NewCachedFetcher(fakeFetcher, fakeVolumes, cachePath, thirdURL).WithMaxEntries(2).BaseImageInfo(logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			entries, err := ioutil.ReadDir(cachePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(HaveLen(2))
+
+			secondURL, err := url.Parse(urls[1])
+			Expect(err).NotTo(HaveOccurred())
+			_, err = cached_fetcher.NewCachedFetcher(fakeFetcher, fakeVolumes, cachePath, secondURL).WithMode(cached_fetcher.ModeOffline).BaseImageInfo(logger)
+			Expect(err).To(MatchError(ContainSubstring("was never pulled")))
+			_, err = cached_fetcher.NewCachedFetcher(fakeFetcher, fakeVolumes, cachePath, firstURL).WithMode(cached_fetcher.ModeOffline).BaseImageInfo(logger)
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("StreamBlob", func() {
+		It("streams the blob from the fetcher", func() {
+			_, _, err := newFetcher(cached_fetcher.ModePreferCache).StreamBlob(logger, baseImageInfo.LayerInfos[0])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeFetcher.StreamBlobCallCount()).To(Equal(1))
+		})
+
+		Context("when the mode is offline", func() {
+			It("returns an error", func() {
+				_, _, err := newFetcher(cached_fetcher.ModeOffline).StreamBlob(logger, baseImageInfo.LayerInfos[0])
+				Expect(err).To(MatchError(ContainSubstring("volume for layer `chain-1` is missing from the store and cannot be fetched offline")))
+				Expect(fakeFetcher.StreamBlobCallCount()).To(BeZero())
+			})
+		})
+	})
+})
@@ -0,0 +1,257 @@
+package dir_fetcher // import "code.cloudfoundry.org/grootfs/fetcher/dir_fetcher"
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/grootfs/groot"
+	"code.cloudfoundry.org/grootfs/store/digest_cache"
+	"code.cloudfoundry.org/lager"
+	errorspkg "github.com/pkg/errors"
+)
+
+type DirFetcher struct {
+	rootfsPath  string
+	version     string
+	digestCache *digest_cache.DigestCache
+}
+
+// NewDirFetcher creates a fetcher for `dir:///path/to/rootfs` URLs. The
+// directory is streamed as a single tar layer. The URL fragment, e.g.
+// `dir:///rootfs#1.2.3`, is the version of the rootfs: the chain ID derives
+// from the path and the version when set, and from the contents otherwise.
+func NewDirFetcher(baseImageURL *url.URL) *DirFetcher {
+	return &DirFetcher{
+		rootfsPath: baseImageURL.Path,
+		version:    baseImageURL.Fragment,
+	}
+}
+
+// WithDigestCache keeps the content digests of rootfs directories without a
+// version in digestCache, keyed by the path, inode, size, mode, owner and
+// mtime of every entry of the directory. Unchanged directories are then only
+// walked, not read.
+func (f *DirFetcher) WithDigestCache(digestCache *digest_cache.DigestCache) *DirFetcher {
+	f.digestCache = digestCache
+	return f
+}
+
+func (f *DirFetcher) BaseImageInfo(logger lager.Logger) (groot.BaseImageInfo, error) {
+	logger = logger.Session("layers-digest", lager.Data{"rootfsPath": f.rootfsPath, "version": f.version})
+	logger.Info("starting")
+	defer logger.Info("ending")
+
+	if err := f.validateRootfs(); err != nil {
+		return groot.BaseImageInfo{}, err
+	}
+
+	if f.version != "" {
+		chainID := sha256.Sum256([]byte(fmt.Sprintf("%s@%s", f.rootfsPath, f.version)))
+		return groot.BaseImageInfo{
+			LayerInfos: []groot.LayerInfo{
+				groot.LayerInfo{
+					BlobID:  f.rootfsPath,
+					ChainID: hex.EncodeToString(chainID[:]),
+				},
+			},
+		}, nil
+	}
+
+	contentDigest, err := f.contentDigest(logger)
+	if err != nil {
+		return groot.BaseImageInfo{}, errorspkg.Wrap(err, "hashing rootfs directory")
+	}
+
+	return groot.BaseImageInfo{
+		LayerInfos: []groot.LayerInfo{
+			groot.LayerInfo{
+				BlobID:  f.rootfsPath,
+				ChainID: contentDigest,
+				DiffID:  contentDigest,
+			},
+		},
+	}, nil
+}
+
+func (f *DirFetcher) StreamBlob(logger lager.Logger, layerInfo groot.LayerInfo) (io.ReadCloser, int64, error) {
+	logger = logger.Session("stream-blob", lager.Data{"rootfsPath": f.rootfsPath})
+	logger.Info("starting")
+	defer logger.Info("ending")
+
+	if err := f.validateRootfs(); err != nil {
+		return nil, 0, err
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeTar(writer, f.rootfsPath))
+	}()
+
+	return reader, 0, nil
+}
+
+func (f *DirFetcher) Close() error {
+	return nil
+}
+
+func (f *DirFetcher) contentDigest(logger lager.Logger) (string, error) {
+	var cacheKey string
+	if f.digestCache != nil {
+		var err error
+		if cacheKey, err = digestCacheKey(f.rootfsPath); err != nil {
+			return "", err
+		}
+
+		if cachedDigest, ok := f.digestCache.Get(logger, cacheKey); ok {
+			logger.Debug("using-cached-digest", lager.Data{"digest": cachedDigest})
+			return cachedDigest, nil
+		}
+	}
+
+	logger.Debug("hashing-rootfs")
+	contentHash := sha256.New()
+	if err := writeTar(contentHash, f.rootfsPath); err != nil {
+		return "", err
+	}
+	digest := hex.EncodeToString(contentHash.Sum(nil))
+
+	if f.digestCache != nil {
+		if err := f.digestCache.Put(logger, cacheKey, digest); err != nil {
+			logger.Error("caching-digest-failed", err)
+		}
+	}
+
+	return digest, nil
+}
+
+// digestCacheKey hashes the metadata of every entry of the directory, which
+// changes along with the tar stream of the directory unless files are
+// modified without changing their size and mtime.
+func digestCacheKey(rootfsPath string) (string, error) {
+	treeHash := sha256.New()
+	err := filepath.Walk(rootfsPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		var device, number uint64
+		var uid, gid uint32
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			device, number = uint64(stat.Dev), uint64(stat.Ino)
+			uid, gid = stat.Uid, stat.Gid
+		}
+
+		_, err = fmt.Fprintf(treeHash, "%q %d %d %d %d %d %d %d\n",
+			path, device, number, info.Size(), info.Mode(), uid, gid, info.ModTime().UnixNano())
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return "dir-" + hex.EncodeToString(treeHash.Sum(nil)), nil
+}
+
+func (f *DirFetcher) validateRootfs() error {
+	stat, err := os.Stat(f.rootfsPath)
+	if err != nil {
+		return errorspkg.Wrapf(err, "local image not found in `%s`", f.rootfsPath)
+	}
+
+	if !stat.IsDir() {
+		return errorspkg.Errorf("invalid base image: `%s` is not a directory", f.rootfsPath)
+	}
+
+	return nil
+}
+
+type inode struct {
+	device uint64
+	number uint64
+}
+
+// writeTar writes the contents of the directory as a tar stream. Entries are
+// written in lexical order, and without access and change times or owner
+// names, so that the stream of an unchanged directory is always the same.
+func writeTar(w io.Writer, rootfsPath string) error {
+	tarWriter := tar.NewWriter(w)
+	hardlinks := map[inode]string{}
+
+	err := filepath.Walk(rootfsPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relativePath, err := filepath.Rel(rootfsPath, path)
+		if err != nil {
+			return err
+		}
+		name := "./" + filepath.ToSlash(relativePath)
+		if relativePath == "." {
+			name = "./"
+		}
+
+		if info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+
+		var linkTarget string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if linkTarget, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, linkTarget)
+		if err != nil {
+			return errorspkg.Wrapf(err, "creating tar header for `%s`", path)
+		}
+		header.Name = name
+		if info.IsDir() && relativePath != "." {
+			header.Name += "/"
+		}
+		header.Uname, header.Gname = "", ""
+		header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && stat.Nlink > 1 {
+			key := inode{device: uint64(stat.Dev), number: uint64(stat.Ino)}
+			if firstName, ok := hardlinks[key]; ok {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = firstName
+				header.Size = 0
+			} else {
+				hardlinks[key] = name
+			}
+		}
+
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = io.CopyN(tarWriter, file, header.Size)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tarWriter.Close()
+}
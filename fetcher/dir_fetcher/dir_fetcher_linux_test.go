@@ -0,0 +1,211 @@
+package dir_fetcher_test
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	fetcherpkg "code.cloudfoundry.org/grootfs/fetcher/dir_fetcher"
+	"code.cloudfoundry.org/grootfs/groot"
+	"code.cloudfoundry.org/grootfs/store/digest_cache"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DirFetcher", func() {
+	var (
+		logger       lager.Logger
+		rootfsPath   string
+		baseImageURL *url.URL
+	)
+
+	fetcher := func() *fetcherpkg.DirFetcher {
+		return fetcherpkg.NewDirFetcher(baseImageURL)
+	}
+
+	chainID := func() string {
+		baseImageInfo, err := fetcher().BaseImageInfo(logger)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(baseImageInfo.LayerInfos).To(HaveLen(1))
+		return baseImageInfo.LayerInfos[0].ChainID
+	}
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("dir-fetcher")
+
+		var err error
+		rootfsPath, err = ioutil.TempDir("", "rootfs")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.MkdirAll(filepath.Join(rootfsPath, "etc"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(rootfsPath, "etc", "hostname"), []byte("groot"), 0600)).To(Succeed())
+		Expect(os.Symlink("hostname", filepath.Join(rootfsPath, "etc", "symlink"))).To(Succeed())
+		Expect(os.Link(filepath.Join(rootfsPath, "etc", "hostname"), filepath.Join(rootfsPath, "etc", "hostname-link"))).To(Succeed())
+
+		baseImageURL, err = url.Parse("dir://" + rootfsPath)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(rootfsPath)).To(Succeed())
+	})
+
+	Describe("StreamBlob", func() {
+		It("streams the contents of the directory as a tar", func() {
+			stream, _, err := fetcher().StreamBlob(logger, groot.LayerInfo{})
+			Expect(err).NotTo(HaveOccurred())
+			defer stream.Close()
+
+			headers := map[string]*tar.Header{}
+			contents := map[string]string{}
+			tarReader := tar.NewReader(stream)
+			for {
+				header, err := tarReader.Next()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).NotTo(HaveOccurred())
+				headers[header.Name] = header
+				fileContents, err := ioutil.ReadAll(tarReader)
+				Expect(err).NotTo(HaveOccurred())
+				contents[header.Name] = string(fileContents)
+			}
+
+			Expect(headers).To(HaveLen(5))
+			Expect(headers).To(HaveKey("./"))
+			Expect(headers["./etc/"].Typeflag).To(Equal(byte(tar.TypeDir)))
+			Expect(headers["./etc/hostname"].Mode).To(Equal(int64(0600)))
+			Expect(contents["./etc/hostname"]).To(Equal("groot"))
+			Expect(headers["./etc/hostname-link"].Typeflag).To(Equal(byte(tar.TypeLink)))
+			Expect(headers["./etc/hostname-link"].Linkname).To(Equal("./etc/hostname"))
+			Expect(headers["./etc/symlink"].Typeflag).To(Equal(byte(tar.TypeSymlink)))
+			Expect(headers["./etc/symlink"].Linkname).To(Equal("hostname"))
+		})
+
+		Context("when the directory does not exist", func() {
+			BeforeEach(func() {
+				baseImageURL, _ = url.Parse("dir:///not/here")
+			})
+
+			It("returns an error", func() {
+				_, _, err := fetcher().StreamBlob(logger, groot.LayerInfo{})
+				Expect(err).To(MatchError(ContainSubstring("local image not found in `/not/here`")))
+			})
+		})
+	})
+
+	Describe("BaseImageInfo", func() {
+		It("uses the digest of the tar stream as the chain ID", func() {
+			stream, _, err := fetcher().StreamBlob(logger, groot.LayerInfo{})
+			Expect(err).NotTo(HaveOccurred())
+			streamHash := sha256.New()
+			_, err = io.Copy(streamHash, stream)
+			Expect(err).NotTo(HaveOccurred())
+
+			baseImageInfo, err := fetcher().BaseImageInfo(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(baseImageInfo.LayerInfos).To(Equal([]groot.LayerInfo{
+				groot.LayerInfo{
+					BlobID:  rootfsPath,
+					ChainID: hex.EncodeToString(streamHash.Sum(nil)),
+					DiffID:  hex.EncodeToString(streamHash.Sum(nil)),
+				},
+			}))
+		})
+
+		It("returns the same chain ID while the directory doesn't change", func() {
+			Expect(chainID()).To(Equal(chainID()))
+		})
+
+		It("returns another chain ID when the contents change", func() {
+			firstChainID := chainID()
+			Expect(ioutil.WriteFile(filepath.Join(rootfsPath, "etc", "motd"), []byte("hello"), 0644)).To(Succeed())
+			Expect(chainID()).NotTo(Equal(firstChainID))
+		})
+
+		Context("when a digest cache is used", func() {
+			var (
+				digestCachePath string
+				digestCache     *digest_cache.DigestCache
+			)
+
+			BeforeEach(func() {
+				var err error
+				digestCachePath, err = ioutil.TempDir("", "dir-digests")
+				Expect(err).NotTo(HaveOccurred())
+				digestCache = digest_cache.NewDigestCache(digestCachePath, digest_cache.DefaultMaxEntries)
+			})
+
+			AfterEach(func() {
+				Expect(os.RemoveAll(digestCachePath)).To(Succeed())
+			})
+
+			cachedChainID := func() string {
+				baseImageInfo, err := fetcher().WithDigestCache(digestCache).BaseImageInfo(logger)
+				Expect(err).NotTo(HaveOccurred())
+				return baseImageInfo.LayerInfos[0].ChainID
+			}
+
+			It("returns the same chain ID as without the cache", func() {
+				Expect(cachedChainID()).To(Equal(chainID()))
+			})
+
+			It("uses the cached digest while the directory doesn't change", func() {
+				cachedChainID()
+
+				cacheEntries, err := ioutil.ReadDir(digestCachePath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cacheEntries).To(HaveLen(1))
+				Expect(ioutil.WriteFile(filepath.Join(digestCachePath, cacheEntries[0].Name()), []byte("cached-digest"), 0644)).To(Succeed())
+
+				Expect(cachedChainID()).To(Equal("cached-digest"))
+			})
+
+			It("hashes the directory again when an entry changes", func() {
+				firstChainID := cachedChainID()
+
+				Expect(ioutil.WriteFile(filepath.Join(rootfsPath, "etc", "motd"), []byte("hello"), 0644)).To(Succeed())
+				Expect(cachedChainID()).NotTo(Equal(firstChainID))
+
+				Expect(os.Chmod(filepath.Join(rootfsPath, "etc", "motd"), 0600)).To(Succeed())
+				Expect(cachedChainID()).To(Equal(chainID()))
+
+				cacheEntries, err := ioutil.ReadDir(digestCachePath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cacheEntries).To(HaveLen(3))
+			})
+		})
+
+		Context("when a version is provided", func() {
+			BeforeEach(func() {
+				baseImageURL.Fragment = "1.2.3"
+			})
+
+			It("derives the chain ID from the path and the version only", func() {
+				firstChainID := chainID()
+				Expect(ioutil.WriteFile(filepath.Join(rootfsPath, "etc", "motd"), []byte("hello"), 0644)).To(Succeed())
+				Expect(chainID()).To(Equal(firstChainID))
+
+				baseImageURL.Fragment = "1.2.4"
+				Expect(chainID()).NotTo(Equal(firstChainID))
+			})
+		})
+
+		Context("when the path is a file", func() {
+			BeforeEach(func() {
+				baseImageURL, _ = url.Parse("dir://" + filepath.Join(rootfsPath, "etc", "hostname"))
+			})
+
+			It("returns an error", func() {
+				_, err := fetcher().BaseImageInfo(logger)
+				Expect(err).To(MatchError(ContainSubstring("is not a directory")))
+			})
+		})
+	})
+})
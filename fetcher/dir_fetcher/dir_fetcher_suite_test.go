@@ -0,0 +1,13 @@
+package dir_fetcher_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestDirFetcher(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Dir Fetcher Suite")
+}
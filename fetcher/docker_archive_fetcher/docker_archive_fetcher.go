@@ -0,0 +1,352 @@
+package docker_archive_fetcher // import "code.cloudfoundry.org/grootfs/fetcher/docker_archive_fetcher"
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/grootfs/fetcher/layer_fetcher"
+	"code.cloudfoundry.org/grootfs/groot"
+	"code.cloudfoundry.org/lager"
+	specsv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	errorspkg "github.com/pkg/errors"
+)
+
+const manifestFileName = "manifest.json"
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// imageManifest is an entry of the manifest.json file written by `docker save`
+type imageManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// archiveEntry is where the contents of an archive member are
+type archiveEntry struct {
+	offset int64
+	size   int64
+}
+
+type DockerArchiveFetcher struct {
+	archivePath string
+	repoTag     string
+
+	entriesMutex sync.Mutex
+	entries      map[string]archiveEntry
+}
+
+// NewDockerArchiveFetcher creates a fetcher for `docker-archive:///path.tar`
+// URLs. When the archive contains more than one image, the image to use must
+// be given as the URL fragment, e.g. `docker-archive:///path.tar#busybox:latest`.
+func NewDockerArchiveFetcher(baseImageURL *url.URL) *DockerArchiveFetcher {
+	return &DockerArchiveFetcher{
+		archivePath: baseImageURL.Path,
+		repoTag:     baseImageURL.Fragment,
+	}
+}
+
+func (f *DockerArchiveFetcher) BaseImageInfo(logger lager.Logger) (groot.BaseImageInfo, error) {
+	logger = logger.Session("layers-digest", lager.Data{"archivePath": f.archivePath, "repoTag": f.repoTag})
+	logger.Info("starting")
+	defer logger.Info("ending")
+
+	manifest, err := f.imageManifest(logger)
+	if err != nil {
+		return groot.BaseImageInfo{}, err
+	}
+
+	logger.Debug("reading-image-config", lager.Data{"config": manifest.Config})
+	configContents, err := f.readFile(manifest.Config)
+	if err != nil {
+		return groot.BaseImageInfo{}, errorspkg.Wrap(err, "reading image config")
+	}
+
+	var config specsv1.Image
+	if err := json.Unmarshal(configContents, &config); err != nil {
+		return groot.BaseImageInfo{}, errorspkg.Wrap(err, "parsing image config")
+	}
+
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return groot.BaseImageInfo{}, errorspkg.Errorf("image config has %d diff ids but the manifest lists %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+
+	layerInfos := []groot.LayerInfo{}
+	var parentChainID string
+	for i, layerPath := range manifest.Layers {
+		size, err := f.uncompressedSize(layerPath)
+		if err != nil {
+			return groot.BaseImageInfo{}, err
+		}
+
+		diffID := config.RootFS.DiffIDs[i]
+		chainID := layer_fetcher.ChainID(diffID.String(), parentChainID)
+		layerInfos = append(layerInfos, groot.LayerInfo{
+			BlobID:        layerPath,
+			Size:          size,
+			ChainID:       chainID,
+			DiffID:        diffID.Hex(),
+			ParentChainID: parentChainID,
+		})
+		parentChainID = chainID
+	}
+
+	return groot.BaseImageInfo{
+		LayerInfos: layerInfos,
+		Config:     config,
+	}, nil
+}
+
+// StreamBlob returns the uncompressed layer. It is checked against its DiffID
+// while it is read, and only verified once the caller calls Verify.
+func (f *DockerArchiveFetcher) StreamBlob(logger lager.Logger, layerInfo groot.LayerInfo) (io.ReadCloser, int64, error) {
+	logger = logger.Session("stream-blob", lager.Data{
+		"archivePath": f.archivePath,
+		"layerPath":   layerInfo.BlobID,
+	})
+	logger.Info("starting")
+	defer logger.Info("ending")
+
+	archive, layerStream, size, err := f.openLayer(layerInfo.BlobID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	diffIDHash := sha256.New()
+	return &layerReader{
+		Reader:     io.TeeReader(layerStream, diffIDHash),
+		archive:    archive,
+		logger:     logger,
+		layerInfo:  layerInfo,
+		diffIDHash: diffIDHash,
+	}, size, nil
+}
+
+func (f *DockerArchiveFetcher) openLayer(layerPath string) (*os.File, io.Reader, int64, error) {
+	archive, entryStream, size, err := f.openEntry(layerPath)
+	if err != nil {
+		return nil, nil, 0, errorspkg.Wrapf(err, "finding layer `%s`", layerPath)
+	}
+
+	layerStream, err := uncompressedStream(entryStream)
+	if err != nil {
+		archive.Close()
+		return nil, nil, 0, errorspkg.Wrapf(err, "reading layer `%s`", layerPath)
+	}
+
+	return archive, layerStream, size, nil
+}
+
+// uncompressedSize returns the size of a layer once uncompressed. The size of
+// gzipped layers is read from the gzip trailer, which only holds it modulo
+// 4GiB.
+func (f *DockerArchiveFetcher) uncompressedSize(layerPath string) (int64, error) {
+	archive, entryStream, size, err := f.openEntry(layerPath)
+	if err != nil {
+		return 0, errorspkg.Wrapf(err, "finding layer `%s`", layerPath)
+	}
+	defer archive.Close()
+
+	magic := make([]byte, 2)
+	if _, err := io.ReadFull(entryStream, magic); err != nil || !bytes.Equal(magic, gzipMagic) {
+		return size, nil
+	}
+
+	trailer := make([]byte, 4)
+	if _, err := entryStream.ReadAt(trailer, size-4); err != nil {
+		return 0, errorspkg.Wrapf(err, "reading layer `%s`", layerPath)
+	}
+
+	return int64(binary.LittleEndian.Uint32(trailer)), nil
+}
+
+func (f *DockerArchiveFetcher) Close() error {
+	return nil
+}
+
+func (f *DockerArchiveFetcher) imageManifest(logger lager.Logger) (imageManifest, error) {
+	logger.Debug("reading-manifest")
+	contents, err := f.readFile(manifestFileName)
+	if err != nil {
+		return imageManifest{}, errorspkg.Wrap(err, "reading archive manifest")
+	}
+
+	var manifests []imageManifest
+	if err := json.Unmarshal(contents, &manifests); err != nil {
+		return imageManifest{}, errorspkg.Wrap(err, "parsing archive manifest")
+	}
+
+	if len(manifests) == 0 {
+		return imageManifest{}, errorspkg.New("archive manifest does not contain any image")
+	}
+
+	if f.repoTag == "" {
+		if len(manifests) > 1 {
+			return imageManifest{}, errorspkg.Errorf("archive contains %d images, please select one with `#<repo:tag>`: %s", len(manifests), strings.Join(repoTags(manifests), ", "))
+		}
+		return manifests[0], nil
+	}
+
+	for _, manifest := range manifests {
+		for _, repoTag := range manifest.RepoTags {
+			if repoTag == f.repoTag {
+				return manifest, nil
+			}
+		}
+	}
+
+	return imageManifest{}, errorspkg.Errorf("image `%s` not found in archive, available images: %s", f.repoTag, strings.Join(repoTags(manifests), ", "))
+}
+
+func (f *DockerArchiveFetcher) openArchive() (*os.File, error) {
+	archive, err := os.Open(f.archivePath)
+	if err != nil {
+		return nil, errorspkg.Wrapf(err, "local image not found in `%s`", f.archivePath)
+	}
+
+	return archive, nil
+}
+
+func (f *DockerArchiveFetcher) readFile(name string) ([]byte, error) {
+	archive, entryStream, _, err := f.openEntry(name)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	return ioutil.ReadAll(entryStream)
+}
+
+// openEntry opens the archive and returns the contents of one of its members
+func (f *DockerArchiveFetcher) openEntry(name string) (*os.File, *io.SectionReader, int64, error) {
+	entries, err := f.archiveEntries()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	entry, ok := entries[cleanEntryName(name)]
+	if !ok {
+		return nil, nil, 0, errorspkg.Errorf("`%s` not found in archive", cleanEntryName(name))
+	}
+
+	archive, err := f.openArchive()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	return archive, io.NewSectionReader(archive, entry.offset, entry.size), entry.size, nil
+}
+
+// archiveEntries scans the archive once, recording where each member is, so
+// that members can be read without going through the archive again
+func (f *DockerArchiveFetcher) archiveEntries() (map[string]archiveEntry, error) {
+	f.entriesMutex.Lock()
+	defer f.entriesMutex.Unlock()
+
+	if f.entries != nil {
+		return f.entries, nil
+	}
+
+	archive, err := f.openArchive()
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	entries := map[string]archiveEntry{}
+	tarReader := tar.NewReader(archive)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errorspkg.Wrap(err, "reading archive")
+		}
+
+		// the tar reader doesn't read ahead, the member starts where the
+		// archive is after its header
+		offset, err := archive.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, errorspkg.Wrap(err, "reading archive")
+		}
+
+		entries[cleanEntryName(header.Name)] = archiveEntry{offset: offset, size: header.Size}
+	}
+
+	f.entries = entries
+	return entries, nil
+}
+
+// uncompressedStream returns the layer tar. `docker save` writes layers
+// uncompressed, but other tools producing the same layout gzip them.
+func uncompressedStream(stream io.Reader) (io.Reader, error) {
+	bufferedStream := bufio.NewReader(stream)
+	magic, err := bufferedStream.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if bytes.Equal(magic, gzipMagic) {
+		return gzip.NewReader(bufferedStream)
+	}
+
+	return bufferedStream, nil
+}
+
+func cleanEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func repoTags(manifests []imageManifest) []string {
+	tags := []string{}
+	for _, manifest := range manifests {
+		tags = append(tags, manifest.RepoTags...)
+	}
+	return tags
+}
+
+// layerReader hashes the layer as it is read. The layer is checked against
+// its DiffID by Verify, once it has been read to the end.
+type layerReader struct {
+	io.Reader
+	archive    *os.File
+	logger     lager.Logger
+	layerInfo  groot.LayerInfo
+	diffIDHash hash.Hash
+}
+
+func (r *layerReader) Verify() error {
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return errorspkg.Wrapf(err, "reading layer `%s`", r.layerInfo.BlobID)
+	}
+
+	actualDiffID := hex.EncodeToString(r.diffIDHash.Sum(nil))
+	r.logger.Debug("checking-checksum", lager.Data{
+		"diffID":             r.layerInfo.DiffID,
+		"calculatedChecksum": actualDiffID,
+	})
+	if actualDiffID != r.layerInfo.DiffID {
+		return errorspkg.Errorf("diffID digest mismatch: expected: %s, actual: %s", r.layerInfo.DiffID, actualDiffID)
+	}
+
+	return nil
+}
+
+func (r *layerReader) Close() error {
+	return r.archive.Close()
+}
@@ -0,0 +1,13 @@
+package docker_archive_fetcher_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestDockerArchiveFetcher(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Docker Archive Fetcher Suite")
+}
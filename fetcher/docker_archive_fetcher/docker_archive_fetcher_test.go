@@ -0,0 +1,297 @@
+package docker_archive_fetcher_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/grootfs/base_image_puller"
+	fetcherpkg "code.cloudfoundry.org/grootfs/fetcher/docker_archive_fetcher"
+	"code.cloudfoundry.org/grootfs/fetcher/layer_fetcher"
+	"code.cloudfoundry.org/grootfs/groot"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	digestpkg "github.com/opencontainers/go-digest"
+	specsv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("DockerArchiveFetcher", func() {
+	var (
+		fetcher      *fetcherpkg.DockerArchiveFetcher
+		logger       lager.Logger
+		archiveDir   string
+		archivePath  string
+		baseImageURL *url.URL
+
+		layers   [][]byte
+		manifest []map[string]interface{}
+		config   specsv1.Image
+	)
+
+	BeforeEach(func() {
+		var err error
+		archiveDir, err = ioutil.TempDir("", "docker-archive")
+		Expect(err).NotTo(HaveOccurred())
+		archivePath = filepath.Join(archiveDir, "image.tar")
+		logger = lagertest.NewTestLogger("docker-archive-fetcher")
+
+		layers = [][]byte{
+			tarWithFile("a_file", "hello"),
+			tarWithFile("another_file", "world"),
+		}
+		config = specsv1.Image{
+			Author: "groot",
+			RootFS: specsv1.RootFS{
+				Type:    "layers",
+				DiffIDs: []digestpkg.Digest{digestpkg.FromBytes(layers[0]), digestpkg.FromBytes(layers[1])},
+			},
+		}
+		manifest = []map[string]interface{}{
+			{
+				"Config":   "config.json",
+				"RepoTags": []string{"groot:latest"},
+				"Layers":   []string{"layer-1/layer.tar", "layer-2/layer.tar"},
+			},
+		}
+	})
+
+	JustBeforeEach(func() {
+		configContents, err := json.Marshal(config)
+		Expect(err).NotTo(HaveOccurred())
+		manifestContents, err := json.Marshal(manifest)
+		Expect(err).NotTo(HaveOccurred())
+
+		writeArchive(archivePath, map[string][]byte{
+			"manifest.json":     manifestContents,
+			"config.json":       configContents,
+			"layer-1/layer.tar": layers[0],
+			"layer-2/layer.tar": layers[1],
+		})
+
+		if baseImageURL == nil {
+			baseImageURL, err = url.Parse("docker-archive://" + archivePath)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		fetcher = fetcherpkg.NewDockerArchiveFetcher(baseImageURL)
+	})
+
+	AfterEach(func() {
+		baseImageURL = nil
+		Expect(os.RemoveAll(archiveDir)).To(Succeed())
+	})
+
+	Describe("BaseImageInfo", func() {
+		It("returns the image config", func() {
+			baseImageInfo, err := fetcher.BaseImageInfo(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(baseImageInfo.Config.Author).To(Equal("groot"))
+		})
+
+		It("returns a layer info for each layer in the manifest", func() {
+			baseImageInfo, err := fetcher.BaseImageInfo(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(baseImageInfo.LayerInfos).To(HaveLen(2))
+
+			firstDiffID := sha256Hex(layers[0])
+			secondDiffID := sha256Hex(layers[1])
+			firstChainID := layer_fetcher.ChainID("sha256:"+firstDiffID, "")
+
+			Expect(baseImageInfo.LayerInfos[0]).To(Equal(groot.LayerInfo{
+				BlobID:  "layer-1/layer.tar",
+				DiffID:  firstDiffID,
+				ChainID: firstDiffID,
+				Size:    int64(len(layers[0])),
+			}))
+			Expect(baseImageInfo.LayerInfos[1]).To(Equal(groot.LayerInfo{
+				BlobID:        "layer-2/layer.tar",
+				DiffID:        secondDiffID,
+				ChainID:       layer_fetcher.ChainID("sha256:"+secondDiffID, firstChainID),
+				ParentChainID: firstChainID,
+				Size:          int64(len(layers[1])),
+			}))
+		})
+
+		Context("when the archive does not exist", func() {
+			BeforeEach(func() {
+				baseImageURL = &url.URL{Scheme: "docker-archive", Path: "/not/here.tar"}
+			})
+
+			It("returns an error", func() {
+				_, err := fetcher.BaseImageInfo(logger)
+				Expect(err).To(MatchError(ContainSubstring("local image not found in `/not/here.tar`")))
+			})
+		})
+
+		Context("when the number of diff ids does not match the layers", func() {
+			BeforeEach(func() {
+				config.RootFS.DiffIDs = config.RootFS.DiffIDs[:1]
+			})
+
+			It("returns an error", func() {
+				_, err := fetcher.BaseImageInfo(logger)
+				Expect(err).To(MatchError(ContainSubstring("image config has 1 diff ids but the manifest lists 2 layers")))
+			})
+		})
+
+		Context("when the archive contains multiple images", func() {
+			BeforeEach(func() {
+				manifest = append(manifest, map[string]interface{}{
+					"Config":   "config.json",
+					"RepoTags": []string{"other:latest"},
+					"Layers":   []string{"layer-1/layer.tar"},
+				})
+			})
+
+			It("returns an error listing the available images", func() {
+				_, err := fetcher.BaseImageInfo(logger)
+				Expect(err).To(MatchError(ContainSubstring("groot:latest, other:latest")))
+			})
+
+			Context("and the image is selected in the URL fragment", func() {
+				BeforeEach(func() {
+					config.RootFS.DiffIDs = config.RootFS.DiffIDs[:1]
+					baseImageURL = &url.URL{Scheme: "docker-archive", Path: archivePath, Fragment: "other:latest"}
+				})
+
+				It("uses the selected image", func() {
+					baseImageInfo, err := fetcher.BaseImageInfo(logger)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(baseImageInfo.LayerInfos).To(HaveLen(1))
+				})
+			})
+		})
+	})
+
+	Describe("StreamBlob", func() {
+		It("returns the layer contents", func() {
+			baseImageInfo, err := fetcher.BaseImageInfo(logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			stream, size, err := fetcher.StreamBlob(logger, baseImageInfo.LayerInfos[1])
+			Expect(err).NotTo(HaveOccurred())
+			defer stream.Close()
+
+			Expect(size).To(Equal(int64(len(layers[1]))))
+			contents, err := ioutil.ReadAll(stream)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contents).To(Equal(layers[1]))
+		})
+
+		Context("when the layer does not match its diff id", func() {
+			It("returns an error", func() {
+				baseImageInfo, err := fetcher.BaseImageInfo(logger)
+				Expect(err).NotTo(HaveOccurred())
+
+				layerInfo := baseImageInfo.LayerInfos[0]
+				layerInfo.DiffID = sha256Hex([]byte("something else"))
+				stream, _, err := fetcher.StreamBlob(logger, layerInfo)
+				Expect(err).NotTo(HaveOccurred())
+				defer stream.Close()
+
+				verifiableStream, ok := stream.(base_image_puller.VerifiableStream)
+				Expect(ok).To(BeTrue())
+				Expect(verifiableStream.Verify()).To(MatchError(ContainSubstring("diffID digest mismatch")))
+			})
+		})
+
+		It("verifies the layer it streamed without reading it again", func() {
+			baseImageInfo, err := fetcher.BaseImageInfo(logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			stream, _, err := fetcher.StreamBlob(logger, baseImageInfo.LayerInfos[0])
+			Expect(err).NotTo(HaveOccurred())
+			defer stream.Close()
+
+			contents, err := ioutil.ReadAll(stream)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contents).To(Equal(layers[0]))
+
+			// the archive changing after the layer was read doesn't matter
+			Expect(os.Remove(archivePath)).To(Succeed())
+			Expect(stream.(base_image_puller.VerifiableStream).Verify()).To(Succeed())
+		})
+
+		Context("when the layer is gzipped", func() {
+			var uncompressedLayer []byte
+
+			BeforeEach(func() {
+				uncompressedLayer = layers[1]
+				layers[1] = gzipped(uncompressedLayer)
+			})
+
+			It("returns the uncompressed contents", func() {
+				baseImageInfo, err := fetcher.BaseImageInfo(logger)
+				Expect(err).NotTo(HaveOccurred())
+
+				stream, _, err := fetcher.StreamBlob(logger, baseImageInfo.LayerInfos[1])
+				Expect(err).NotTo(HaveOccurred())
+				defer stream.Close()
+
+				contents, err := ioutil.ReadAll(stream)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(contents).To(Equal(uncompressedLayer))
+				Expect(stream.(base_image_puller.VerifiableStream).Verify()).To(Succeed())
+			})
+
+			It("reports the uncompressed size of the layer", func() {
+				baseImageInfo, err := fetcher.BaseImageInfo(logger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(baseImageInfo.LayerInfos[1].Size).To(Equal(int64(len(uncompressedLayer))))
+			})
+		})
+
+		Context("when the layer is not in the archive", func() {
+			It("returns an error", func() {
+				_, _, err := fetcher.StreamBlob(logger, groot.LayerInfo{BlobID: "not-here/layer.tar"})
+				Expect(err).To(MatchError(ContainSubstring("finding layer `not-here/layer.tar`")))
+			})
+		})
+	})
+})
+
+func tarWithFile(name, contents string) []byte {
+	buffer := bytes.NewBuffer([]byte{})
+	tarWriter := tar.NewWriter(buffer)
+	Expect(tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents))})).To(Succeed())
+	_, err := tarWriter.Write([]byte(contents))
+	Expect(err).NotTo(HaveOccurred())
+	Expect(tarWriter.Close()).To(Succeed())
+	return buffer.Bytes()
+}
+
+func writeArchive(archivePath string, entries map[string][]byte) {
+	archive, err := os.Create(archivePath)
+	Expect(err).NotTo(HaveOccurred())
+	defer archive.Close()
+
+	tarWriter := tar.NewWriter(archive)
+	for name, contents := range entries {
+		Expect(tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents))})).To(Succeed())
+		_, err := tarWriter.Write(contents)
+		Expect(err).NotTo(HaveOccurred())
+	}
+	Expect(tarWriter.Close()).To(Succeed())
+}
+
+func gzipped(contents []byte) []byte {
+	buffer := bytes.NewBuffer([]byte{})
+	gzipWriter := gzip.NewWriter(buffer)
+	_, err := gzipWriter.Write(contents)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(gzipWriter.Close()).To(Succeed())
+	return buffer.Bytes()
+}
+
+func sha256Hex(contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,67 @@
+package layer_fetcher // import "code.cloudfoundry.org/grootfs/fetcher/layer_fetcher"
+
+import (
+	"strings"
+
+	"code.cloudfoundry.org/grootfs/groot"
+	errorspkg "github.com/pkg/errors"
+)
+
+const (
+	ForeignLayersAllow     = "allow"
+	ForeignLayersDeny      = "deny"
+	ForeignLayersAllowlist = "allowlist"
+)
+
+// ForeignLayerPolicy decides whether non-distributable layers, which are
+// served from the URLs in the manifest instead of the registry, can be
+// fetched. An empty policy allows them.
+type ForeignLayerPolicy struct {
+	Policy             string
+	AllowedURLPrefixes []string
+}
+
+// apply returns the layer with only the URLs the policy allows it to be
+// fetched from. It fails when none of its URLs are allowed.
+func (p ForeignLayerPolicy) apply(layerInfo groot.LayerInfo) (groot.LayerInfo, error) {
+	if len(layerInfo.URLs) == 0 {
+		return layerInfo, nil
+	}
+
+	switch p.Policy {
+	case "", ForeignLayersAllow:
+		return layerInfo, nil
+	case ForeignLayersDeny:
+		return groot.LayerInfo{}, errorspkg.Errorf("non-distributable layer `%s` is served from `%s`, and the foreign layer policy denies all URLs", layerInfo.BlobID, layerInfo.URLs[0])
+	case ForeignLayersAllowlist:
+		allowedURLs := []string{}
+		for _, layerURL := range layerInfo.URLs {
+			if p.allows(layerURL) {
+				allowedURLs = append(allowedURLs, layerURL)
+			}
+		}
+		if len(allowedURLs) == 0 {
+			return groot.LayerInfo{}, errorspkg.Errorf("non-distributable layer `%s` is served from `%s`, which is not in the foreign layer allowlist", layerInfo.BlobID, layerInfo.URLs[0])
+		}
+		layerInfo.URLs = allowedURLs
+		return layerInfo, nil
+	default:
+		return groot.LayerInfo{}, errorspkg.Errorf("unknown foreign layer policy `%s`", p.Policy)
+	}
+}
+
+// allows only matches prefixes at a path boundary, so that
+// `https://example.com` doesn't allow `https://example.com.evil.org`
+func (p ForeignLayerPolicy) allows(layerURL string) bool {
+	for _, prefix := range p.AllowedURLPrefixes {
+		if !strings.HasPrefix(layerURL, prefix) {
+			continue
+		}
+
+		if strings.HasSuffix(prefix, "/") || len(layerURL) == len(prefix) || strings.ContainsAny(layerURL[len(prefix):len(prefix)+1], "/?#") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -12,6 +12,7 @@ import (
 	"code.cloudfoundry.org/lager"
 
 	"github.com/containers/image/types"
+	digestpkg "github.com/opencontainers/go-digest"
 	specsv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	errorspkg "github.com/pkg/errors"
 )
@@ -27,14 +28,34 @@ type Manifest interface {
 	types.Image
 }
 
+// DigestedManifest is a manifest that knows the manifest the image reference
+// resolved to, which is the manifest list for multi-platform images, and its
+// digest.
+type DigestedManifest interface {
+	Manifest
+	ManifestDigest() digestpkg.Digest
+	ReferencedManifest() []byte
+}
+
+// BlobStream is an uncompressed blob that is hashed as it is read. Verify
+// reads the rest of the blob and checks its digests; the contents of the
+// blob can't be trusted until it succeeds.
+type BlobStream interface {
+	io.ReadCloser
+	Verify() error
+}
+
 type Source interface {
 	Manifest(logger lager.Logger) (types.Image, error)
 	Blob(logger lager.Logger, layerInfo groot.LayerInfo) (string, int64, error)
+	BlobStream(logger lager.Logger, layerInfo groot.LayerInfo) (BlobStream, int64, error)
 	Close() error
 }
 
 type LayerFetcher struct {
-	source Source
+	source             Source
+	foreignLayerPolicy ForeignLayerPolicy
+	streaming          bool
 }
 
 func NewLayerFetcher(source Source) *LayerFetcher {
@@ -43,6 +64,21 @@ func NewLayerFetcher(source Source) *LayerFetcher {
 	}
 }
 
+// WithForeignLayerPolicy restricts the URLs that non-distributable layers
+// can be fetched from.
+func (f *LayerFetcher) WithForeignLayerPolicy(policy ForeignLayerPolicy) *LayerFetcher {
+	f.foreignLayerPolicy = policy
+	return f
+}
+
+// WithStreaming makes StreamBlob return the uncompressed blobs as they are
+// downloaded, instead of writing them to disk first. Streamed blobs are only
+// verified by their Verify method, once they have been unpacked.
+func (f *LayerFetcher) WithStreaming(streaming bool) *LayerFetcher {
+	f.streaming = streaming
+	return f
+}
+
 func (f *LayerFetcher) BaseImageInfo(logger lager.Logger) (groot.BaseImageInfo, error) {
 	logger = logger.Session("layers-digest")
 	logger.Info("starting")
@@ -61,9 +97,25 @@ func (f *LayerFetcher) BaseImageInfo(logger lager.Logger) (groot.BaseImageInfo,
 		return groot.BaseImageInfo{}, err
 	}
 
+	var (
+		manifestDigest     string
+		referencedManifest []byte
+	)
+	if digestedManifest, ok := manifest.(DigestedManifest); ok {
+		manifestDigest = digestedManifest.ManifestDigest().String()
+		referencedManifest = digestedManifest.ReferencedManifest()
+	}
+
+	layerInfos, err := f.createLayerInfos(logger, manifest, config)
+	if err != nil {
+		return groot.BaseImageInfo{}, err
+	}
+
 	return groot.BaseImageInfo{
-		LayerInfos: f.createLayerInfos(logger, manifest, config),
-		Config:     *config,
+		LayerInfos:     layerInfos,
+		Config:         *config,
+		ManifestDigest: manifestDigest,
+		Manifest:       referencedManifest,
 	}, nil
 }
 
@@ -72,7 +124,23 @@ func (f *LayerFetcher) StreamBlob(logger lager.Logger, layerInfo groot.LayerInfo
 	logger.Info("starting")
 	defer logger.Info("ending")
 
-	blobFilePath, size, err := f.source.Blob(logger, layerInfo)
+	// layer infos can come from the store, which may predate the policy
+	allowedLayerInfo, err := f.foreignLayerPolicy.apply(layerInfo)
+	if err != nil {
+		logger.Error("foreign-layer-policy-failed", err, lager.Data{"blobId": layerInfo.BlobID, "URL": layerInfo.URLs})
+		return nil, 0, err
+	}
+
+	if f.streaming {
+		return &lazyBlobStream{
+			open: func() (BlobStream, error) {
+				stream, _, err := f.source.BlobStream(logger, allowedLayerInfo)
+				return stream, err
+			},
+		}, allowedLayerInfo.Size, nil
+	}
+
+	blobFilePath, size, err := f.source.Blob(logger, allowedLayerInfo)
 	if err != nil {
 		logger.Error("source-blob-failed", err, lager.Data{"blobId": layerInfo.BlobID, "URL": layerInfo.URLs})
 		return nil, 0, err
@@ -91,7 +159,7 @@ func (f *LayerFetcher) Close() error {
 	return f.source.Close()
 }
 
-func (f *LayerFetcher) createLayerInfos(logger lager.Logger, image Manifest, config *specsv1.Image) []groot.LayerInfo {
+func (f *LayerFetcher) createLayerInfos(logger lager.Logger, image Manifest, config *specsv1.Image) ([]groot.LayerInfo, error) {
 	layerInfos := []groot.LayerInfo{}
 
 	var parentChainID string
@@ -101,8 +169,8 @@ func (f *LayerFetcher) createLayerInfos(logger lager.Logger, image Manifest, con
 		}
 
 		diffID := config.RootFS.DiffIDs[i]
-		chainID := f.chainID(diffID.String(), parentChainID)
-		layerInfos = append(layerInfos, groot.LayerInfo{
+		chainID := ChainID(diffID.String(), parentChainID)
+		layerInfo, err := f.foreignLayerPolicy.apply(groot.LayerInfo{
 			BlobID:        layer.Digest.String(),
 			Size:          layer.Size,
 			ChainID:       chainID,
@@ -112,13 +180,19 @@ func (f *LayerFetcher) createLayerInfos(logger lager.Logger, image Manifest, con
 			URLs:          layer.URLs,
 			MediaType:     layer.MediaType,
 		})
+		if err != nil {
+			return nil, err
+		}
+		layerInfos = append(layerInfos, layerInfo)
 		parentChainID = chainID
 	}
 
-	return layerInfos
+	return layerInfos, nil
 }
 
-func (f *LayerFetcher) chainID(diffID string, parentChainID string) string {
+// ChainID computes the chain ID of a layer from its `sha256:`-prefixed
+// DiffID and the chain ID of its parent, as described in the OCI image spec.
+func ChainID(diffID string, parentChainID string) string {
 	if diffID != "" {
 		diffID = strings.Split(diffID, ":")[1]
 	}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"errors"
+	"io"
 	"io/ioutil"
 	"time"
 
@@ -147,6 +148,88 @@ var _ = Describe("LayerFetcher", func() {
 
 			Expect(baseImageInfo.Config).To(Equal(expectedConfig))
 		})
+
+		Context("when a layer is non-distributable", func() {
+			BeforeEach(func() {
+				fakeManifest := new(layer_fetcherfakes.FakeManifest)
+				fakeManifest.OCIConfigReturns(&specsv1.Image{
+					RootFS: specsv1.RootFS{
+						DiffIDs: []digestpkg.Digest{
+							digestpkg.NewDigestFromHex("sha256", "afe200c63655576eaa5cabe036a2c09920d6aee67653ae75a9d35e0ec27205a5"),
+						},
+					},
+				}, nil)
+				fakeManifest.LayerInfosReturns([]types.BlobInfo{
+					types.BlobInfo{
+						Digest: digestpkg.NewDigestFromHex("sha256", "47e3dd80d678c83c50cb133f4cf20e94d088f890679716c8b763418f55827a58"),
+						URLs: []string{
+							"https://foreign.example.com.evil.org/layer",
+							"https://foreign.example.com/layers/layer",
+						},
+					},
+				})
+				fakeSource.ManifestReturns(fakeManifest, nil)
+			})
+
+			It("keeps the layer URLs by default", func() {
+				baseImageInfo, err := fetcher.BaseImageInfo(logger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(baseImageInfo.LayerInfos[0].URLs).To(HaveLen(2))
+			})
+
+			Context("and the policy denies foreign layers", func() {
+				BeforeEach(func() {
+					fetcher = fetcher.WithForeignLayerPolicy(layer_fetcher.ForeignLayerPolicy{Policy: layer_fetcher.ForeignLayersDeny})
+				})
+
+				It("returns an error naming the URL", func() {
+					_, err := fetcher.BaseImageInfo(logger)
+					Expect(err).To(MatchError(ContainSubstring("served from `https://foreign.example.com.evil.org/layer`")))
+				})
+			})
+
+			Context("and the policy has an allowlist", func() {
+				BeforeEach(func() {
+					fetcher = fetcher.WithForeignLayerPolicy(layer_fetcher.ForeignLayerPolicy{
+						Policy:             layer_fetcher.ForeignLayersAllowlist,
+						AllowedURLPrefixes: []string{"https://foreign.example.com"},
+					})
+				})
+
+				It("only keeps the allowed URLs", func() {
+					baseImageInfo, err := fetcher.BaseImageInfo(logger)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(baseImageInfo.LayerInfos[0].URLs).To(Equal([]string{"https://foreign.example.com/layers/layer"}))
+				})
+
+				Context("when none of the URLs is allowed", func() {
+					BeforeEach(func() {
+						fetcher = fetcher.WithForeignLayerPolicy(layer_fetcher.ForeignLayerPolicy{
+							Policy:             layer_fetcher.ForeignLayersAllowlist,
+							AllowedURLPrefixes: []string{"https://mirror.example.com/"},
+						})
+					})
+
+					It("returns an error naming the URL", func() {
+						_, err := fetcher.BaseImageInfo(logger)
+						Expect(err).To(MatchError(ContainSubstring("`https://foreign.example.com.evil.org/layer`, which is not in the foreign layer allowlist")))
+					})
+				})
+			})
+		})
+
+		Context("when the manifest knows its digest", func() {
+			It("returns the manifest and its digest", func() {
+				fakeManifest := new(layer_fetcherfakes.FakeManifest)
+				fakeManifest.OCIConfigReturns(&specsv1.Image{}, nil)
+				fakeSource.ManifestReturns(digestedManifest{FakeManifest: fakeManifest, digest: "sha256:manifest-digest", manifest: []byte("manifest")}, nil)
+
+				baseImageInfo, err := fetcher.BaseImageInfo(logger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(baseImageInfo.ManifestDigest).To(Equal("sha256:manifest-digest"))
+				Expect(baseImageInfo.Manifest).To(Equal([]byte("manifest")))
+			})
+		})
 	})
 
 	Describe("StreamBlob", func() {
@@ -200,6 +283,76 @@ var _ = Describe("LayerFetcher", func() {
 			Expect(size).To(Equal(int64(1024)))
 		})
 
+		Context("when streaming", func() {
+			var blobStream *fakeBlobStream
+
+			BeforeEach(func() {
+				blobStream = &fakeBlobStream{Reader: bytes.NewReader([]byte("hello-world"))}
+				fakeSource.BlobStreamReturns(blobStream, 11, nil)
+				fetcher = fetcher.WithStreaming(true)
+			})
+
+			It("only opens the stream when it is read", func() {
+				stream, _, err := fetcher.StreamBlob(logger, layerInfo)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeSource.BlobStreamCallCount()).To(BeZero())
+
+				contents, err := ioutil.ReadAll(stream)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(contents)).To(Equal("hello-world"))
+				Expect(fakeSource.BlobStreamCallCount()).To(Equal(1))
+				Expect(fakeSource.BlobCallCount()).To(BeZero())
+
+				Expect(stream.Close()).To(Succeed())
+				Expect(blobStream.closed).To(BeTrue())
+			})
+
+			It("verifies the stream through the source", func() {
+				blobStream.verifyErr = errors.New("diffID digest mismatch")
+
+				stream, _, err := fetcher.StreamBlob(logger, layerInfo)
+				Expect(err).NotTo(HaveOccurred())
+				verifiableStream, ok := stream.(interface {
+					Verify() error
+				})
+				Expect(ok).To(BeTrue())
+				Expect(verifiableStream.Verify()).To(MatchError("diffID digest mismatch"))
+			})
+
+			Context("when the source fails to open the stream", func() {
+				BeforeEach(func() {
+					fakeSource.BlobStreamReturns(nil, 0, errors.New("failed to stream blob"))
+				})
+
+				It("returns the error when the stream is read", func() {
+					stream, _, err := fetcher.StreamBlob(logger, layerInfo)
+					Expect(err).NotTo(HaveOccurred())
+
+					_, err = ioutil.ReadAll(stream)
+					Expect(err).To(MatchError("failed to stream blob"))
+					Expect(stream.Close()).To(Succeed())
+				})
+			})
+		})
+
+		Context("when the layer is served from a URL the foreign layer policy blocks", func() {
+			BeforeEach(func() {
+				fetcher = fetcher.WithForeignLayerPolicy(layer_fetcher.ForeignLayerPolicy{
+					Policy:             layer_fetcher.ForeignLayersAllowlist,
+					AllowedURLPrefixes: []string{"https://mirror.example.com/"},
+				})
+			})
+
+			It("returns an error without using the source", func() {
+				_, _, err := fetcher.StreamBlob(logger, groot.LayerInfo{
+					BlobID: "sha256:layer-digest",
+					URLs:   []string{"https://foreign.example.com/layer"},
+				})
+				Expect(err).To(MatchError(ContainSubstring("`https://foreign.example.com/layer`")))
+				Expect(fakeSource.BlobCallCount()).To(BeZero())
+			})
+		})
+
 		Context("when the source fails to stream the blob", func() {
 			It("returns an error", func() {
 				fakeSource.BlobReturns("", 0, errors.New("failed to stream blob"))
@@ -217,3 +370,32 @@ var _ = Describe("LayerFetcher", func() {
 	})
 
 })
+
+type digestedManifest struct {
+	*layer_fetcherfakes.FakeManifest
+	digest   digestpkg.Digest
+	manifest []byte
+}
+
+func (m digestedManifest) ManifestDigest() digestpkg.Digest {
+	return m.digest
+}
+
+func (m digestedManifest) ReferencedManifest() []byte {
+	return m.manifest
+}
+
+type fakeBlobStream struct {
+	io.Reader
+	verifyErr error
+	closed    bool
+}
+
+func (s *fakeBlobStream) Verify() error {
+	return s.verifyErr
+}
+
+func (s *fakeBlobStream) Close() error {
+	s.closed = true
+	return nil
+}
@@ -40,6 +40,22 @@ type FakeSource struct {
 		result2 int64
 		result3 error
 	}
+	BlobStreamStub        func(logger lager.Logger, layerInfo groot.LayerInfo) (layer_fetcher.BlobStream, int64, error)
+	blobStreamMutex       sync.RWMutex
+	blobStreamArgsForCall []struct {
+		logger    lager.Logger
+		layerInfo groot.LayerInfo
+	}
+	blobStreamReturns struct {
+		result1 layer_fetcher.BlobStream
+		result2 int64
+		result3 error
+	}
+	blobStreamReturnsOnCall map[int]struct {
+		result1 layer_fetcher.BlobStream
+		result2 int64
+		result3 error
+	}
 	CloseStub        func() error
 	closeMutex       sync.RWMutex
 	closeArgsForCall []struct{}
@@ -159,6 +175,61 @@ func (fake *FakeSource) BlobReturnsOnCall(i int, result1 string, result2 int64,
 	}{result1, result2, result3}
 }
 
+func (fake *FakeSource) BlobStream(logger lager.Logger, layerInfo groot.LayerInfo) (layer_fetcher.BlobStream, int64, error) {
+	fake.blobStreamMutex.Lock()
+	ret, specificReturn := fake.blobStreamReturnsOnCall[len(fake.blobStreamArgsForCall)]
+	fake.blobStreamArgsForCall = append(fake.blobStreamArgsForCall, struct {
+		logger    lager.Logger
+		layerInfo groot.LayerInfo
+	}{logger, layerInfo})
+	fake.recordInvocation("BlobStream", []interface{}{logger, layerInfo})
+	fake.blobStreamMutex.Unlock()
+	if fake.BlobStreamStub != nil {
+		return fake.BlobStreamStub(logger, layerInfo)
+	}
+	if specificReturn {
+		return ret.result1, ret.result2, ret.result3
+	}
+	return fake.blobStreamReturns.result1, fake.blobStreamReturns.result2, fake.blobStreamReturns.result3
+}
+
+func (fake *FakeSource) BlobStreamCallCount() int {
+	fake.blobStreamMutex.RLock()
+	defer fake.blobStreamMutex.RUnlock()
+	return len(fake.blobStreamArgsForCall)
+}
+
+func (fake *FakeSource) BlobStreamArgsForCall(i int) (lager.Logger, groot.LayerInfo) {
+	fake.blobStreamMutex.RLock()
+	defer fake.blobStreamMutex.RUnlock()
+	return fake.blobStreamArgsForCall[i].logger, fake.blobStreamArgsForCall[i].layerInfo
+}
+
+func (fake *FakeSource) BlobStreamReturns(result1 layer_fetcher.BlobStream, result2 int64, result3 error) {
+	fake.BlobStreamStub = nil
+	fake.blobStreamReturns = struct {
+		result1 layer_fetcher.BlobStream
+		result2 int64
+		result3 error
+	}{result1, result2, result3}
+}
+
+func (fake *FakeSource) BlobStreamReturnsOnCall(i int, result1 layer_fetcher.BlobStream, result2 int64, result3 error) {
+	fake.BlobStreamStub = nil
+	if fake.blobStreamReturnsOnCall == nil {
+		fake.blobStreamReturnsOnCall = make(map[int]struct {
+			result1 layer_fetcher.BlobStream
+			result2 int64
+			result3 error
+		})
+	}
+	fake.blobStreamReturnsOnCall[i] = struct {
+		result1 layer_fetcher.BlobStream
+		result2 int64
+		result3 error
+	}{result1, result2, result3}
+}
+
 func (fake *FakeSource) Close() error {
 	fake.closeMutex.Lock()
 	ret, specificReturn := fake.closeReturnsOnCall[len(fake.closeArgsForCall)]
@@ -206,6 +277,8 @@ func (fake *FakeSource) Invocations() map[string][][]interface{} {
 	defer fake.manifestMutex.RUnlock()
 	fake.blobMutex.RLock()
 	defer fake.blobMutex.RUnlock()
+	fake.blobStreamMutex.RLock()
+	defer fake.blobStreamMutex.RUnlock()
 	fake.closeMutex.RLock()
 	defer fake.closeMutex.RUnlock()
 	copiedInvocations := map[string][][]interface{}{}
@@ -0,0 +1,43 @@
+package layer_fetcher // import "code.cloudfoundry.org/grootfs/fetcher/layer_fetcher"
+
+// lazyBlobStream only opens the blob stream when it is first read, so that
+// streamed layers are downloaded as they are unpacked
+type lazyBlobStream struct {
+	open   func() (BlobStream, error)
+	stream BlobStream
+	err    error
+}
+
+func (l *lazyBlobStream) get() (BlobStream, error) {
+	if l.stream == nil && l.err == nil {
+		l.stream, l.err = l.open()
+	}
+
+	return l.stream, l.err
+}
+
+func (l *lazyBlobStream) Read(p []byte) (int, error) {
+	stream, err := l.get()
+	if err != nil {
+		return 0, err
+	}
+
+	return stream.Read(p)
+}
+
+func (l *lazyBlobStream) Verify() error {
+	stream, err := l.get()
+	if err != nil {
+		return err
+	}
+
+	return stream.Verify()
+}
+
+func (l *lazyBlobStream) Close() error {
+	if l.stream == nil {
+		return nil
+	}
+
+	return l.stream.Close()
+}
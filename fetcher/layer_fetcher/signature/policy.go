@@ -0,0 +1,171 @@
+package signature // import "code.cloudfoundry.org/grootfs/fetcher/layer_fetcher/signature"
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	errorspkg "github.com/pkg/errors"
+)
+
+const (
+	TypeInsecureAcceptAnything = "insecureAcceptAnything"
+	TypeReject                 = "reject"
+	TypeSignedBy               = "signedBy"
+
+	KeyTypeGPGKeys = "GPGKeys"
+
+	IdentityMatchRepoDigestOrExact = "matchRepoDigestOrExact"
+	IdentityMatchExact             = "matchExact"
+	IdentityMatchRepository        = "matchRepository"
+)
+
+// Policy is a subset of the containers-policy.json(5) format. The
+// requirements for an image are the ones of its most specific scope in the
+// image transport, or the default ones.
+type Policy struct {
+	Default    []Requirement                       `json:"default"`
+	Transports map[string]map[string][]Requirement `json:"transports"`
+}
+
+// Requirement must be satisfied for an image to be used. All the
+// requirements of a scope must be satisfied.
+type Requirement struct {
+	Type           string          `json:"type"`
+	KeyType        string          `json:"keyType,omitempty"`
+	KeyPath        string          `json:"keyPath,omitempty"`
+	SignedIdentity *SignedIdentity `json:"signedIdentity,omitempty"`
+}
+
+// SignedIdentity is how the identity in the signature is matched against
+// the image reference
+type SignedIdentity struct {
+	Type string `json:"type"`
+}
+
+func NewPolicyFromFile(path string) (Policy, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Policy{}, errorspkg.Wrap(err, "reading signature policy")
+	}
+
+	var policy Policy
+	if err := json.Unmarshal(contents, &policy); err != nil {
+		return Policy{}, errorspkg.Wrapf(err, "parsing signature policy `%s`", path)
+	}
+
+	if err := policy.validate(); err != nil {
+		return Policy{}, errorspkg.Wrapf(err, "invalid signature policy `%s`", path)
+	}
+
+	return policy, nil
+}
+
+func (p Policy) validate() error {
+	if len(p.Default) == 0 {
+		return errorspkg.New("default requirements are missing")
+	}
+	if err := validateRequirements(p.Default); err != nil {
+		return err
+	}
+
+	for transport, scopes := range p.Transports {
+		for scope, requirements := range scopes {
+			if len(requirements) == 0 {
+				return errorspkg.Errorf("requirements for `%s` in the `%s` transport are missing", scope, transport)
+			}
+			if err := validateRequirements(requirements); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func validateRequirements(requirements []Requirement) error {
+	for _, requirement := range requirements {
+		switch requirement.Type {
+		case TypeInsecureAcceptAnything, TypeReject:
+		case TypeSignedBy:
+			if requirement.KeyType != KeyTypeGPGKeys {
+				return errorspkg.Errorf("unsupported key type `%s`", requirement.KeyType)
+			}
+			if !filepath.IsAbs(requirement.KeyPath) {
+				return errorspkg.Errorf("key path `%s` is not absolute", requirement.KeyPath)
+			}
+			if requirement.SignedIdentity != nil {
+				switch requirement.SignedIdentity.Type {
+				case IdentityMatchRepoDigestOrExact, IdentityMatchExact, IdentityMatchRepository:
+				default:
+					return errorspkg.Errorf("unsupported signed identity type `%s`", requirement.SignedIdentity.Type)
+				}
+			}
+		default:
+			return errorspkg.Errorf("unsupported requirement type `%s`", requirement.Type)
+		}
+	}
+
+	return nil
+}
+
+// requirementsFor returns the requirements of the first scope that is
+// configured for the transport, or the default requirements. Scopes are
+// ordered from the most to the least specific.
+func (p Policy) requirementsFor(transport string, scopes []string) []Requirement {
+	transportScopes, ok := p.Transports[transport]
+	if !ok {
+		return p.Default
+	}
+
+	for _, scope := range append(scopes, "") {
+		if requirements, ok := transportScopes[scope]; ok {
+			return requirements
+		}
+	}
+
+	return p.Default
+}
+
+// dockerScopes returns `host/repo:tag`, `host/repo` and every namespace of
+// the repository down to the host.
+func dockerScopes(reference string) []string {
+	scopes := []string{reference}
+
+	name := reference
+	if i := strings.IndexAny(name, "@"); i != -1 {
+		name = name[:i]
+	} else if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+
+	for name != "" {
+		if name != reference {
+			scopes = append(scopes, name)
+		}
+
+		i := strings.LastIndex(name, "/")
+		if i == -1 {
+			break
+		}
+		name = name[:i]
+	}
+
+	return scopes
+}
+
+// pathScopes returns `/path:ref`, `/path` and every parent directory of the
+// path.
+func pathScopes(path, ref string) []string {
+	scopes := []string{}
+	if ref != "" {
+		scopes = append(scopes, path+":"+ref)
+	}
+
+	for dir := path; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		scopes = append(scopes, dir)
+	}
+
+	return scopes
+}
@@ -0,0 +1,47 @@
+package signature_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+
+	"testing"
+)
+
+var (
+	GPGHome     string
+	KeyringPath string
+)
+
+func TestSignature(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	BeforeSuite(func() {
+		var err error
+		GPGHome, err = ioutil.TempDir("", "signature-gpg-home")
+		Expect(err).NotTo(HaveOccurred())
+
+		gpg("--quick-gen-key", "groot <groot@example.com>", "ed25519", "sign", "never")
+
+		KeyringPath = filepath.Join(GPGHome, "keyring.gpg")
+		gpg("--output", KeyringPath, "--export")
+	})
+
+	AfterSuite(func() {
+		Expect(os.RemoveAll(GPGHome)).To(Succeed())
+	})
+
+	RunSpecs(t, "Signature Suite")
+}
+
+func gpg(args ...string) {
+	cmd := exec.Command("gpg", append([]string{"--homedir", GPGHome, "--batch", "--passphrase", ""}, args...)...)
+	sess, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+	Expect(err).NotTo(HaveOccurred())
+	Eventually(sess, "10s").Should(gexec.Exit(0))
+}
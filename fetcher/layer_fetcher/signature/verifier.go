@@ -0,0 +1,296 @@
+package signature // import "code.cloudfoundry.org/grootfs/fetcher/layer_fetcher/signature"
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/containers/image/docker/reference"
+	manifestpkg "github.com/containers/image/manifest"
+	digestpkg "github.com/opencontainers/go-digest"
+	errorspkg "github.com/pkg/errors"
+)
+
+const (
+	GpgvBin = "gpgv"
+
+	signatureType = "atomic container signature"
+)
+
+// Verifier checks image manifests against a signature policy. Signatures are
+// read from a local signature store, laid out like a containers-registries.d
+// lookaside store: `<store>/<repository>@sha256=<digest>/signature-<n>`.
+type Verifier struct {
+	policy             Policy
+	signatureStorePath string
+}
+
+func NewVerifier(policy Policy, signatureStorePath string) *Verifier {
+	return &Verifier{
+		policy:             policy,
+		signatureStorePath: signatureStorePath,
+	}
+}
+
+type imageIdentity struct {
+	transport string
+	reference string
+	// named is only set for the docker transport
+	named     reference.Named
+	storePath string
+	scopes    []string
+}
+
+// payload is the signed JSON document of the `simple signing` format
+type payload struct {
+	Critical struct {
+		Type  string `json:"type"`
+		Image struct {
+			DockerManifestDigest digestpkg.Digest `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+	} `json:"critical"`
+}
+
+// Verify returns an error unless the manifest of the image satisfies every
+// requirement of the policy for it.
+func (v *Verifier) Verify(logger lager.Logger, baseImageURL *url.URL, manifest []byte) error {
+	logger = logger.Session("verifying-signatures", lager.Data{"baseImageURL": baseImageURL.String()})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	image, err := newImageIdentity(baseImageURL)
+	if err != nil {
+		return err
+	}
+
+	manifestDigest, err := manifestpkg.Digest(manifest)
+	if err != nil {
+		return errorspkg.Wrap(err, "calculating manifest digest")
+	}
+
+	for _, requirement := range v.policy.requirementsFor(image.transport, image.scopes) {
+		switch requirement.Type {
+		case TypeInsecureAcceptAnything:
+			continue
+
+		case TypeReject:
+			return errorspkg.Errorf("image `%s` is rejected by the signature policy", image.reference)
+
+		case TypeSignedBy:
+			if err := v.verifySignedBy(logger, image, manifestDigest, requirement); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// VerifyUnsigned returns an error unless the policy accepts the image without
+// a signature. Tarballs, docker archives and rootfs directories have no
+// manifest to sign, so they can only satisfy insecureAcceptAnything.
+func (v *Verifier) VerifyUnsigned(logger lager.Logger, baseImageURL *url.URL) error {
+	logger = logger.Session("verifying-unsigned-image", lager.Data{"baseImageURL": baseImageURL.String()})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	image, err := newImageIdentity(baseImageURL)
+	if err != nil {
+		return err
+	}
+
+	for _, requirement := range v.policy.requirementsFor(image.transport, image.scopes) {
+		switch requirement.Type {
+		case TypeInsecureAcceptAnything:
+			continue
+
+		case TypeReject:
+			return errorspkg.Errorf("image `%s` is rejected by the signature policy", image.reference)
+
+		default:
+			return errorspkg.Errorf("image `%s` can't be signed, but the signature policy requires `%s`", image.reference, requirement.Type)
+		}
+	}
+
+	return nil
+}
+
+func (v *Verifier) verifySignedBy(logger lager.Logger, image imageIdentity, manifestDigest digestpkg.Digest, requirement Requirement) error {
+	signaturePaths, err := v.signaturePaths(image, manifestDigest)
+	if err != nil {
+		return err
+	}
+	if len(signaturePaths) == 0 {
+		return errorspkg.Errorf("image `%s` is not signed: no signatures found for manifest %s", image.reference, manifestDigest)
+	}
+
+	reasons := []string{}
+	for _, signaturePath := range signaturePaths {
+		err := verifySignature(signaturePath, image, manifestDigest, requirement)
+		if err == nil {
+			logger.Debug("signature-accepted", lager.Data{"signature": signaturePath, "keyPath": requirement.KeyPath})
+			return nil
+		}
+
+		logger.Debug("signature-rejected", lager.Data{"signature": signaturePath, "reason": err.Error()})
+		reasons = append(reasons, fmt.Sprintf("%s: %s", filepath.Base(signaturePath), err))
+	}
+
+	return errorspkg.Errorf("image `%s` is not signed by a key in `%s`: %s", image.reference, requirement.KeyPath, strings.Join(reasons, "; "))
+}
+
+func (v *Verifier) signaturePaths(image imageIdentity, manifestDigest digestpkg.Digest) ([]string, error) {
+	if v.signatureStorePath == "" {
+		return nil, errorspkg.New("the signature policy requires signatures but no signature store is configured")
+	}
+
+	signaturesDir := filepath.Join(
+		v.signatureStorePath,
+		fmt.Sprintf("%s@%s=%s", image.storePath, manifestDigest.Algorithm(), manifestDigest.Hex()),
+	)
+
+	paths := []string{}
+	for i := 1; ; i++ {
+		path := filepath.Join(signaturesDir, fmt.Sprintf("signature-%d", i))
+		if _, err := os.Stat(path); err != nil {
+			if os.IsNotExist(err) {
+				return paths, nil
+			}
+			return nil, errorspkg.Wrap(err, "reading signature store")
+		}
+		paths = append(paths, path)
+	}
+}
+
+func verifySignature(signaturePath string, image imageIdentity, manifestDigest digestpkg.Digest, requirement Requirement) error {
+	contents, err := verifyGPG(requirement.KeyPath, signaturePath)
+	if err != nil {
+		return err
+	}
+
+	var signed payload
+	if err := json.Unmarshal(contents, &signed); err != nil {
+		return errorspkg.Wrap(err, "parsing signature payload")
+	}
+
+	if signed.Critical.Type != signatureType {
+		return errorspkg.Errorf("unsupported signature type `%s`", signed.Critical.Type)
+	}
+
+	if signed.Critical.Image.DockerManifestDigest != manifestDigest {
+		return errorspkg.Errorf("signature is for manifest %s", signed.Critical.Image.DockerManifestDigest)
+	}
+
+	return matchIdentity(image, signed.Critical.Identity.DockerReference, requirement.SignedIdentity)
+}
+
+// verifyGPG runs gpgv against the keyring only, and returns the signed
+// contents. It doesn't use the keys or the trust database of the user.
+func verifyGPG(keyringPath, signaturePath string) ([]byte, error) {
+	homeDir, err := ioutil.TempDir("", "gpgv-home")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(homeDir)
+
+	outputPath := filepath.Join(homeDir, "payload")
+	cmd := exec.Command(GpgvBin,
+		"--homedir", homeDir,
+		"--status-fd", "1",
+		"--keyring", keyringPath,
+		"--output", outputPath,
+		signaturePath,
+	)
+
+	stdoutBuffer := bytes.NewBuffer([]byte{})
+	stderrBuffer := bytes.NewBuffer([]byte{})
+	cmd.Stdout = stdoutBuffer
+	cmd.Stderr = stderrBuffer
+	if err := cmd.Run(); err != nil {
+		return nil, errorspkg.Wrapf(err, "gpgv failed: %s", strings.TrimSpace(stderrBuffer.String()))
+	}
+
+	if !strings.Contains(stdoutBuffer.String(), "[GNUPG:] VALIDSIG ") {
+		return nil, errorspkg.New("gpgv did not report a valid signature")
+	}
+
+	return ioutil.ReadFile(outputPath)
+}
+
+// matchIdentity only applies to the docker transport, other transports don't
+// have a registry identity to match.
+func matchIdentity(image imageIdentity, signedReference string, signedIdentity *SignedIdentity) error {
+	if image.named == nil {
+		return nil
+	}
+
+	identityType := IdentityMatchRepoDigestOrExact
+	if signedIdentity != nil {
+		identityType = signedIdentity.Type
+	}
+
+	signed, err := reference.ParseNormalizedNamed(signedReference)
+	if err != nil {
+		return errorspkg.Wrapf(err, "parsing signed identity `%s`", signedReference)
+	}
+
+	_, isDigested := image.named.(reference.Digested)
+	sameRepository := signed.Name() == image.named.Name()
+	switch {
+	case identityType == IdentityMatchRepository && sameRepository:
+		return nil
+	case identityType == IdentityMatchRepoDigestOrExact && isDigested && sameRepository:
+		return nil
+	case identityType != IdentityMatchRepository && signed.String() == image.named.String():
+		return nil
+	}
+
+	return errorspkg.Errorf("signature is for `%s`", signed.String())
+}
+
+func newImageIdentity(baseImageURL *url.URL) (imageIdentity, error) {
+	if baseImageURL.Scheme == "docker" {
+		named, err := reference.ParseNormalizedNamed(strings.TrimPrefix(baseImageURL.Host+baseImageURL.Path, "/"))
+		if err != nil {
+			return imageIdentity{}, errorspkg.Wrapf(err, "parsing image reference `%s`", baseImageURL)
+		}
+		named = reference.TagNameOnly(named)
+
+		return imageIdentity{
+			transport: baseImageURL.Scheme,
+			reference: named.String(),
+			named:     named,
+			storePath: reference.Path(named),
+			scopes:    dockerScopes(named.String()),
+		}, nil
+	}
+
+	path, ref := baseImageURL.Path, ""
+	if i := strings.LastIndex(path, ":"); i > strings.LastIndex(path, "/") {
+		path, ref = path[:i], path[i+1:]
+	}
+
+	// tarballs have no scheme, their transport is named like in
+	// containers-policy.json(5)
+	transport := baseImageURL.Scheme
+	if transport == "" {
+		transport = "tarball"
+	}
+
+	return imageIdentity{
+		transport: transport,
+		reference: baseImageURL.Path,
+		storePath: strings.TrimPrefix(path, "/"),
+		scopes:    pathScopes(path, ref),
+	}, nil
+}
@@ -0,0 +1,336 @@
+package signature_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/grootfs/fetcher/layer_fetcher/signature"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	digestpkg "github.com/opencontainers/go-digest"
+)
+
+var _ = Describe("Verifier", func() {
+	var (
+		logger         *lagertest.TestLogger
+		workDir        string
+		policyPath     string
+		storePath      string
+		policy         map[string]interface{}
+		manifest       []byte
+		manifestDigest digestpkg.Digest
+		baseImageURL   *url.URL
+	)
+
+	signedBy := func(identityType string) map[string]interface{} {
+		requirement := map[string]interface{}{
+			"type":    "signedBy",
+			"keyType": "GPGKeys",
+			"keyPath": KeyringPath,
+		}
+		if identityType != "" {
+			requirement["signedIdentity"] = map[string]string{"type": identityType}
+		}
+		return requirement
+	}
+
+	accept := []interface{}{map[string]string{"type": "insecureAcceptAnything"}}
+	reject := []interface{}{map[string]string{"type": "reject"}}
+
+	writeSignature := func(repository string, digest digestpkg.Digest, dockerReference string, n int) {
+		payload, err := json.Marshal(map[string]interface{}{
+			"critical": map[string]interface{}{
+				"type":     "atomic container signature",
+				"image":    map[string]string{"docker-manifest-digest": digest.String()},
+				"identity": map[string]string{"docker-reference": dockerReference},
+			},
+			"optional": map[string]interface{}{},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		payloadPath := filepath.Join(workDir, "payload")
+		Expect(ioutil.WriteFile(payloadPath, payload, 0644)).To(Succeed())
+
+		signaturesDir := filepath.Join(storePath, fmt.Sprintf("%s@sha256=%s", repository, digest.Hex()))
+		Expect(os.MkdirAll(signaturesDir, 0755)).To(Succeed())
+		gpg("--yes", "--output", filepath.Join(signaturesDir, fmt.Sprintf("signature-%d", n)), "--sign", payloadPath)
+	}
+
+	verify := func() error {
+		contents, err := json.Marshal(policy)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(policyPath, contents, 0644)).To(Succeed())
+
+		loadedPolicy, err := signature.NewPolicyFromFile(policyPath)
+		Expect(err).NotTo(HaveOccurred())
+		return signature.NewVerifier(loadedPolicy, storePath).Verify(logger, baseImageURL, manifest)
+	}
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("verifier")
+
+		var err error
+		workDir, err = ioutil.TempDir("", "signature-verifier")
+		Expect(err).NotTo(HaveOccurred())
+		policyPath = filepath.Join(workDir, "policy.json")
+		storePath = filepath.Join(workDir, "sigstore")
+
+		manifest = []byte(`{"schemaVersion": 2, "layers": []}`)
+		manifestDigest = digestpkg.FromBytes(manifest)
+		baseImageURL, err = url.Parse("docker:///library/busybox:1.27")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(workDir)).To(Succeed())
+	})
+
+	Context("when the policy accepts anything", func() {
+		BeforeEach(func() {
+			policy = map[string]interface{}{"default": accept}
+		})
+
+		It("accepts the image", func() {
+			Expect(verify()).To(Succeed())
+		})
+	})
+
+	Context("when the policy rejects the image", func() {
+		BeforeEach(func() {
+			policy = map[string]interface{}{"default": reject}
+		})
+
+		It("returns an error", func() {
+			Expect(verify()).To(MatchError("image `docker.io/library/busybox:1.27` is rejected by the signature policy"))
+		})
+	})
+
+	Context("when the transport has scopes", func() {
+		BeforeEach(func() {
+			policy = map[string]interface{}{
+				"default": reject,
+				"transports": map[string]interface{}{
+					"docker": map[string]interface{}{
+						"docker.io/library":         accept,
+						"docker.io/library/busybox": reject,
+					},
+				},
+			}
+		})
+
+		It("uses the most specific scope", func() {
+			Expect(verify()).To(MatchError(ContainSubstring("rejected")))
+
+			baseImageURL, _ = url.Parse("docker:///library/alpine")
+			Expect(verify()).To(Succeed())
+
+			baseImageURL, _ = url.Parse("docker:///cfgarden/empty")
+			Expect(verify()).To(MatchError(ContainSubstring("rejected")))
+		})
+	})
+
+	Context("when the policy requires a signature", func() {
+		BeforeEach(func() {
+			policy = map[string]interface{}{"default": []interface{}{signedBy("")}}
+		})
+
+		Context("and the image is signed", func() {
+			BeforeEach(func() {
+				writeSignature("library/busybox", manifestDigest, "docker.io/library/busybox:1.27", 1)
+			})
+
+			It("accepts the image", func() {
+				Expect(verify()).To(Succeed())
+			})
+		})
+
+		Context("and one of the signatures is valid", func() {
+			BeforeEach(func() {
+				writeSignature("library/busybox", manifestDigest, "docker.io/library/busybox:other", 1)
+				writeSignature("library/busybox", manifestDigest, "docker.io/library/busybox:1.27", 2)
+			})
+
+			It("accepts the image", func() {
+				Expect(verify()).To(Succeed())
+			})
+		})
+
+		Context("and there are no signatures", func() {
+			It("returns an error", func() {
+				Expect(verify()).To(MatchError(ContainSubstring("image `docker.io/library/busybox:1.27` is not signed")))
+			})
+		})
+
+		Context("and the signature is for another manifest", func() {
+			BeforeEach(func() {
+				otherDigest := digestpkg.FromString("another manifest")
+				writeSignature("library/busybox", otherDigest, "docker.io/library/busybox:1.27", 1)
+				Expect(os.Rename(
+					filepath.Join(storePath, "library/busybox@sha256="+otherDigest.Hex()),
+					filepath.Join(storePath, "library/busybox@sha256="+manifestDigest.Hex()),
+				)).To(Succeed())
+			})
+
+			It("returns an error", func() {
+				Expect(verify()).To(MatchError(ContainSubstring("signature is for manifest " + digestpkg.FromString("another manifest").String())))
+			})
+		})
+
+		Context("and the signature is for another image", func() {
+			BeforeEach(func() {
+				writeSignature("library/busybox", manifestDigest, "docker.io/library/busybox:latest", 1)
+			})
+
+			It("returns an error", func() {
+				Expect(verify()).To(MatchError(ContainSubstring("signature is for `docker.io/library/busybox:latest`")))
+			})
+
+			Context("and the identity only has to match the repository", func() {
+				BeforeEach(func() {
+					policy = map[string]interface{}{"default": []interface{}{signedBy("matchRepository")}}
+				})
+
+				It("accepts the image", func() {
+					Expect(verify()).To(Succeed())
+				})
+			})
+		})
+
+		Context("and the image is referenced by digest", func() {
+			BeforeEach(func() {
+				baseImageURL, _ = url.Parse("docker:///library/busybox@" + manifestDigest.String())
+				writeSignature("library/busybox", manifestDigest, "docker.io/library/busybox:1.27", 1)
+			})
+
+			It("accepts signatures for any tag of the repository", func() {
+				Expect(verify()).To(Succeed())
+			})
+
+			Context("and the identity has to match exactly", func() {
+				BeforeEach(func() {
+					policy = map[string]interface{}{"default": []interface{}{signedBy("matchExact")}}
+				})
+
+				It("returns an error", func() {
+					Expect(verify()).To(MatchError(ContainSubstring("signature is for `docker.io/library/busybox:1.27`")))
+				})
+			})
+		})
+
+		Context("and the signing key is not in the keyring", func() {
+			BeforeEach(func() {
+				writeSignature("library/busybox", manifestDigest, "docker.io/library/busybox:1.27", 1)
+
+				emptyKeyring := filepath.Join(workDir, "empty.gpg")
+				Expect(ioutil.WriteFile(emptyKeyring, []byte{}, 0644)).To(Succeed())
+				requirement := signedBy("")
+				requirement["keyPath"] = emptyKeyring
+				policy = map[string]interface{}{"default": []interface{}{requirement}}
+			})
+
+			It("returns an error", func() {
+				Expect(verify()).To(MatchError(ContainSubstring("is not signed by a key in")))
+			})
+		})
+
+		Context("and the image is an OCI image", func() {
+			BeforeEach(func() {
+				baseImageURL, _ = url.Parse("oci:///images/busybox:latest")
+				writeSignature("images/busybox", manifestDigest, "busybox", 1)
+			})
+
+			It("only checks the manifest digest", func() {
+				Expect(verify()).To(Succeed())
+			})
+		})
+	})
+
+	Describe("VerifyUnsigned", func() {
+		verifyUnsigned := func() error {
+			contents, err := json.Marshal(policy)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(policyPath, contents, 0644)).To(Succeed())
+
+			loadedPolicy, err := signature.NewPolicyFromFile(policyPath)
+			Expect(err).NotTo(HaveOccurred())
+			return signature.NewVerifier(loadedPolicy, storePath).VerifyUnsigned(logger, baseImageURL)
+		}
+
+		BeforeEach(func() {
+			baseImageURL, _ = url.Parse("/images/rootfs.tar")
+		})
+
+		Context("when the policy accepts anything", func() {
+			BeforeEach(func() {
+				policy = map[string]interface{}{"default": accept}
+			})
+
+			It("accepts the image", func() {
+				Expect(verifyUnsigned()).To(Succeed())
+			})
+		})
+
+		Context("when the policy rejects the image by default", func() {
+			BeforeEach(func() {
+				policy = map[string]interface{}{"default": reject}
+			})
+
+			It("returns an error", func() {
+				Expect(verifyUnsigned()).To(MatchError("image `/images/rootfs.tar` is rejected by the signature policy"))
+			})
+
+			Context("and the transport of the image accepts it", func() {
+				BeforeEach(func() {
+					policy["transports"] = map[string]interface{}{
+						"tarball": map[string]interface{}{"/images": accept},
+						"dir":     map[string]interface{}{"": accept},
+					}
+				})
+
+				It("accepts the image", func() {
+					Expect(verifyUnsigned()).To(Succeed())
+
+					baseImageURL, _ = url.Parse("dir:///rootfs")
+					Expect(verifyUnsigned()).To(Succeed())
+
+					baseImageURL, _ = url.Parse("docker-archive:///images/busybox.tar")
+					Expect(verifyUnsigned()).To(MatchError(ContainSubstring("rejected")))
+				})
+			})
+		})
+
+		Context("when the policy requires a signature", func() {
+			BeforeEach(func() {
+				policy = map[string]interface{}{"default": []interface{}{signedBy("")}}
+			})
+
+			It("returns an error", func() {
+				Expect(verifyUnsigned()).To(MatchError("image `/images/rootfs.tar` can't be signed, but the signature policy requires `signedBy`"))
+			})
+		})
+	})
+
+	Describe("NewPolicyFromFile", func() {
+		It("rejects unknown requirement types", func() {
+			Expect(ioutil.WriteFile(policyPath, []byte(`{"default": [{"type": "signedByAnyone"}]}`), 0644)).To(Succeed())
+			_, err := signature.NewPolicyFromFile(policyPath)
+			Expect(err).To(MatchError(ContainSubstring("unsupported requirement type `signedByAnyone`")))
+		})
+
+		It("requires default requirements", func() {
+			Expect(ioutil.WriteFile(policyPath, []byte(`{"transports": {}}`), 0644)).To(Succeed())
+			_, err := signature.NewPolicyFromFile(policyPath)
+			Expect(err).To(MatchError(ContainSubstring("default requirements are missing")))
+		})
+
+		It("requires absolute key paths", func() {
+			Expect(ioutil.WriteFile(policyPath, []byte(`{"default": [{"type": "signedBy", "keyType": "GPGKeys", "keyPath": "keyring.gpg"}]}`), 0644)).To(Succeed())
+			_, err := signature.NewPolicyFromFile(policyPath)
+			Expect(err).To(MatchError(ContainSubstring("key path `keyring.gpg` is not absolute")))
+		})
+	})
+})
@@ -0,0 +1,273 @@
+package source // import "code.cloudfoundry.org/grootfs/fetcher/layer_fetcher/source"
+
+import (
+	"crypto/sha256"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"code.cloudfoundry.org/grootfs/fetcher/layer_fetcher"
+	"code.cloudfoundry.org/grootfs/groot"
+	"code.cloudfoundry.org/grootfs/store/blob_cache"
+	"code.cloudfoundry.org/lager"
+	"github.com/containers/image/types"
+	digestpkg "github.com/opencontainers/go-digest"
+	errorspkg "github.com/pkg/errors"
+)
+
+// blobStream uncompresses a blob while hashing it. Its digest and DiffID can
+// only be checked once it has been read to the end, by verify.
+type blobStream struct {
+	source    *LayerSource
+	logger    lager.Logger
+	layerInfo groot.LayerInfo
+
+	// blob is the compressed blob, which decompressors can stop reading
+	// before its end
+	blob             io.Reader
+	uncompressed     io.ReadCloser
+	reader           io.Reader
+	blobIDHash       hash.Hash
+	diffIDHash       hash.Hash
+	uncompressedSize int64
+}
+
+func (s *LayerSource) newBlobStream(logger lager.Logger, layerInfo groot.LayerInfo, blob io.Reader, size int64, decompressor Decompressor, cacheEntry *blob_cache.Entry) (*blobStream, error) {
+	if err := s.validateLayerSize(layerInfo, size); err != nil {
+		return nil, err
+	}
+
+	blobIDHash := sha256.New()
+	var blobWriter io.Writer = blobIDHash
+	if cacheEntry != nil {
+		blobWriter = io.MultiWriter(blobIDHash, cacheEntry)
+	}
+	blobReader := &compressedReader{Reader: io.TeeReader(blob, blobWriter)}
+
+	logger.Debug("uncompressing-blob")
+	decompressed, err := decompressor(blobReader)
+	if err != nil {
+		if blobReader.err == nil {
+			err = &corruptBlobError{err}
+		}
+		return nil, errorspkg.Wrapf(err, "expected blob to be of type %s", layerInfo.MediaType)
+	}
+	uncompressed := &uncompressedReader{ReadCloser: decompressed, compressed: blobReader}
+
+	var reader io.Reader = uncompressed
+	if s.shouldEnforceImageQuotaValidation() {
+		reader = layer_fetcher.NewQuotaedReader(uncompressed, s.remainingImageQuota(), "uncompressed layer size exceeds quota")
+	}
+
+	diffIDHash := sha256.New()
+	return &blobStream{
+		source:       s,
+		logger:       logger,
+		layerInfo:    layerInfo,
+		blob:         blobReader,
+		uncompressed: uncompressed,
+		reader:       io.TeeReader(reader, diffIDHash),
+		blobIDHash:   blobIDHash,
+		diffIDHash:   diffIDHash,
+	}, nil
+}
+
+func (b *blobStream) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	b.uncompressedSize += int64(n)
+	return n, err
+}
+
+func (b *blobStream) Close() error {
+	return b.uncompressed.Close()
+}
+
+// verify reads what is left of the blob and checks its digest, its DiffID
+// and the image quota
+func (b *blobStream) verify() error {
+	if _, err := io.Copy(ioutil.Discard, b); err != nil {
+		return errorspkg.Wrap(err, "reading blob")
+	}
+
+	// decompressors can stop before the end of the blob
+	if _, err := io.Copy(ioutil.Discard, b.blob); err != nil {
+		return errorspkg.Wrap(err, "reading blob")
+	}
+
+	blobIDHex := strings.Split(b.layerInfo.BlobID, ":")[1]
+	if err := b.source.checkCheckSum(b.logger, b.blobIDHash, blobIDHex); err != nil {
+		return &corruptBlobError{errorspkg.Wrap(err, "layerID digest mismatch")}
+	}
+
+	if err := b.source.checkCheckSum(b.logger, b.diffIDHash, b.layerInfo.DiffID); err != nil {
+		return &corruptBlobError{errorspkg.Wrap(err, "diffID digest mismatch")}
+	}
+
+	return b.source.consumeImageQuota(b.uncompressedSize)
+}
+
+// corruptBlobError is an error of a blob that doesn't match its digests or
+// can't be uncompressed, as opposed to the errors reading or writing it
+type corruptBlobError struct {
+	error
+}
+
+func (e *corruptBlobError) Cause() error {
+	return e.error
+}
+
+func isCorruptBlob(err error) bool {
+	for err != nil {
+		if _, ok := err.(*corruptBlobError); ok {
+			return true
+		}
+
+		causer, ok := err.(interface{ Cause() error })
+		if !ok {
+			return false
+		}
+		err = causer.Cause()
+	}
+
+	return false
+}
+
+// compressedReader keeps the error reading the compressed blob, so that the
+// errors uncompressing it can be told apart
+type compressedReader struct {
+	io.Reader
+	err error
+}
+
+func (r *compressedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// uncompressedReader marks the errors of the decompressor that weren't
+// caused by reading the compressed blob as corrupt blob errors
+type uncompressedReader struct {
+	io.ReadCloser
+	compressed *compressedReader
+}
+
+func (r *uncompressedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && r.compressed.err == nil {
+		err = &corruptBlobError{err}
+	}
+	return n, err
+}
+
+// BlobStream returns the uncompressed blob without writing it to disk. The
+// blob is verified by the Verify method of the stream, once the caller is
+// done reading it; its contents can't be trusted before then. Interrupted
+// downloads of streamed blobs are not resumed.
+func (s *LayerSource) BlobStream(logger lager.Logger, layerInfo groot.LayerInfo) (layer_fetcher.BlobStream, int64, error) {
+	logger = logger.Session("streaming-blob", lager.Data{
+		"baseImageURL":             s.baseImageURL,
+		"digest":                   layerInfo.BlobID,
+		"imageQuota":               s.remainingImageQuota(),
+		"skipImageQuotaValidation": s.skipImageQuotaValidation,
+		"streaming":                true,
+	})
+	logger.Info("starting")
+	defer logger.Info("ending")
+
+	decompressor, err := decompressorFor(layerInfo.MediaType)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if s.blobCache != nil {
+		blob, size, ok, err := s.blobCache.Open(layerInfo.BlobID)
+		if err != nil {
+			logger.Error("reading-cached-blob-failed", err)
+		} else if ok {
+			logger.Debug("got-cached-blob", lager.Data{"digest": layerInfo.BlobID, "size": size})
+			stream, err := s.newBlobStream(logger, layerInfo, blob, size, decompressor, nil)
+			if err != nil {
+				blob.Close()
+				return nil, 0, err
+			}
+			if s.progressReporter != nil {
+				s.progressReporter.LayerProgress(logger, layerInfo.BlobID, size, size, true)
+			}
+			return &streamedBlob{blobStream: stream, compressed: blob, cached: true}, size, nil
+		}
+	}
+
+	blobInfo := types.BlobInfo{
+		Digest: digestpkg.Digest(layerInfo.BlobID),
+		Size:   layerInfo.Size,
+		URLs:   layerInfo.URLs,
+	}
+
+	blob, size, err := s.getBlobFromEndpoints(logger, blobInfo, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	logger.Debug("got-blob-stream", lager.Data{"digest": layerInfo.BlobID, "size": size, "mediaType": layerInfo.MediaType})
+
+	var cacheEntry *blob_cache.Entry
+	if s.blobCache != nil {
+		cacheEntry, err = s.blobCache.NewEntry(layerInfo.BlobID)
+		if err != nil {
+			logger.Error("creating-blob-cache-entry-failed", err)
+		}
+	}
+
+	stream, err := s.newBlobStream(logger, layerInfo, blob, size, decompressor, cacheEntry)
+	if err != nil {
+		blob.Close()
+		if cacheEntry != nil {
+			cacheEntry.Discard()
+		}
+		return nil, 0, err
+	}
+
+	return &streamedBlob{blobStream: stream, compressed: blob, cacheEntry: cacheEntry}, size, nil
+}
+
+// streamedBlob is the blob stream returned by BlobStream. The compressed
+// blob is only added to the blob cache once it is verified.
+type streamedBlob struct {
+	*blobStream
+	compressed io.Closer
+	cacheEntry *blob_cache.Entry
+	// cached blobs are removed from the cache when they fail verification
+	cached bool
+}
+
+func (b *streamedBlob) Verify() error {
+	if err := b.verify(); err != nil {
+		if b.cached && isCorruptBlob(err) {
+			if err := b.source.blobCache.Remove(b.layerInfo.BlobID); err != nil {
+				b.logger.Error("removing-cached-blob-failed", err)
+			}
+		}
+		return err
+	}
+
+	if b.cacheEntry != nil {
+		if err := b.cacheEntry.Commit(b.logger); err != nil {
+			b.logger.Error("caching-blob-failed", err)
+		}
+		b.cacheEntry = nil
+	}
+
+	return nil
+}
+
+func (b *streamedBlob) Close() error {
+	if b.cacheEntry != nil {
+		b.cacheEntry.Discard()
+	}
+
+	b.blobStream.Close()
+	return b.compressed.Close()
+}
@@ -0,0 +1,68 @@
+package source // import "code.cloudfoundry.org/grootfs/fetcher/layer_fetcher/source"
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/containers/image/types"
+)
+
+const (
+	DockerHubHost = "docker.io"
+
+	MetricsBlobEndpointNameFormat = "DownloadedBlobBytes.%s"
+)
+
+// Endpoint is a registry that images can be fetched from. It is either the
+// registry in the base image URL or one of its mirrors.
+type Endpoint struct {
+	Host          string
+	SystemContext types.SystemContext
+}
+
+// RegistryHost returns the registry of a docker:// URL, which is docker.io
+// when the URL doesn't have a host.
+func RegistryHost(baseImageURL *url.URL) string {
+	if baseImageURL.Scheme == "docker" && isDockerHub(baseImageURL.Host) {
+		return DockerHubHost
+	}
+
+	return baseImageURL.Host
+}
+
+func isDockerHub(host string) bool {
+	switch host {
+	case "", DockerHubHost, "index.docker.io", "registry-1.docker.io":
+		return true
+	}
+
+	return false
+}
+
+// repositoryPath returns the path of the image in the endpoint. Docker Hub
+// implicitly adds `library/` to official images, but mirrors don't.
+func (s *LayerSource) repositoryPath(endpoint Endpoint) string {
+	path := s.baseImageURL.Path
+	if endpoint.Host == s.baseImageURL.Host || !isDockerHub(s.baseImageURL.Host) {
+		return path
+	}
+
+	if strings.Contains(strings.TrimPrefix(path, "/"), "/") {
+		return path
+	}
+
+	return "/library" + path
+}
+
+func (s *LayerSource) endpoints() []Endpoint {
+	endpoints := append([]Endpoint{}, s.mirrors...)
+	return append(endpoints, Endpoint{Host: s.baseImageURL.Host, SystemContext: s.systemContext})
+}
+
+func (s *LayerSource) endpointName(endpoint Endpoint) string {
+	if endpoint.Host == s.baseImageURL.Host {
+		return RegistryHost(s.baseImageURL)
+	}
+
+	return endpoint.Host
+}
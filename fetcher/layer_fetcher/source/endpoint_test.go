@@ -0,0 +1,29 @@
+package source_test
+
+import (
+	"net/url"
+
+	"code.cloudfoundry.org/grootfs/fetcher/layer_fetcher/source"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RegistryHost", func() {
+	It("returns the host of the image URL", func() {
+		baseImageURL, err := url.Parse("docker://my-registry.example.com:5000/busybox")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(source.RegistryHost(baseImageURL)).To(Equal("my-registry.example.com:5000"))
+	})
+
+	It("returns docker.io when the image URL has no host", func() {
+		baseImageURL, err := url.Parse("docker:///busybox")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(source.RegistryHost(baseImageURL)).To(Equal("docker.io"))
+	})
+
+	It("returns docker.io for the Docker Hub registry aliases", func() {
+		baseImageURL, err := url.Parse("docker://registry-1.docker.io/busybox")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(source.RegistryHost(baseImageURL)).To(Equal("docker.io"))
+	})
+})
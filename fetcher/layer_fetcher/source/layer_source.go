@@ -12,10 +12,14 @@ import (
 	"io/ioutil"
 	"net/url"
 	"os"
-	"strings"
+	"runtime"
+	"sync"
+	"time"
 
-	"code.cloudfoundry.org/grootfs/fetcher/layer_fetcher"
+	"code.cloudfoundry.org/grootfs/fetcher/ratelimit"
 	"code.cloudfoundry.org/grootfs/groot"
+	"code.cloudfoundry.org/grootfs/store/blob_cache"
+	"code.cloudfoundry.org/grootfs/store/token_cache"
 	"code.cloudfoundry.org/lager"
 	_ "github.com/containers/image/docker"
 	"github.com/containers/image/image"
@@ -29,16 +33,34 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-const MAX_DOCKER_RETRIES = 3
+// SignatureVerifier decides whether an image can be used from the signatures
+// of its manifest
+type SignatureVerifier interface {
+	Verify(logger lager.Logger, baseImageURL *url.URL, manifest []byte) error
+}
 
 type LayerSource struct {
 	skipOCILayerValidation bool
 	systemContext          types.SystemContext
 	baseImageURL           *url.URL
-	// imageSource needs to be a singleton that is initialised on demand in createImageSource. DO NOT use the field directly, use getImageSource instead
-	imageSource              types.ImageSource
+	mirrors                []Endpoint
+	metricsEmitter         groot.MetricsEmitter
+	blobCache              *blob_cache.BlobCache
+	signatureVerifier      SignatureVerifier
+	rateLimiter            *ratelimit.Limiter
+	progressReporter       ProgressReporter
+	tokenCache             *token_cache.TokenCache
+	// imageSources hold a singleton per endpoint that is initialised on demand in createImageSource. DO NOT use the field directly, use getImageSource instead
+	imageSources map[string]types.ImageSource
+	// registryClients are initialised on demand like imageSources. DO NOT use the field directly, use getRegistryClient instead
+	registryClients          map[string]*registryClient
 	imageQuota               int64
 	skipImageQuotaValidation bool
+	platform                 Platform
+	downloadRetries          int
+	retryBackoff             time.Duration
+	// mutex guards imageSources, registryClients and imageQuota, as blobs can be fetched concurrently
+	mutex *sync.Mutex
 }
 
 func NewLayerSource(systemContext types.SystemContext, skipOCILayerValidation, skipImageQuotaValidation bool, diskLimit int64, baseImageURL *url.URL) LayerSource {
@@ -48,38 +70,119 @@ func NewLayerSource(systemContext types.SystemContext, skipOCILayerValidation, s
 		baseImageURL:             baseImageURL,
 		imageQuota:               diskLimit,
 		skipImageQuotaValidation: skipImageQuotaValidation,
+		platform:                 Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH},
+		downloadRetries:          DefaultDownloadRetries,
+		retryBackoff:             DefaultRetryBackoff,
+		imageSources:             map[string]types.ImageSource{},
+		registryClients:          map[string]*registryClient{},
+		mutex:                    &sync.Mutex{},
 	}
 }
 
+// WithMirrors makes the source try the mirrors in order before falling back
+// to the registry in the base image URL.
+func (s LayerSource) WithMirrors(mirrors []Endpoint) LayerSource {
+	s.mirrors = mirrors
+	return s
+}
+
+// WithBlobCache makes the source keep downloaded blobs in the cache and
+// read them from it instead of the registry.
+func (s LayerSource) WithBlobCache(blobCache *blob_cache.BlobCache) LayerSource {
+	s.blobCache = blobCache
+	return s
+}
+
+// WithSignatureVerifier makes the source check the image manifest against a
+// signature policy before anything else is fetched.
+func (s LayerSource) WithSignatureVerifier(signatureVerifier SignatureVerifier) LayerSource {
+	s.signatureVerifier = signatureVerifier
+	return s
+}
+
+// WithRateLimiter caps the rate at which blobs are downloaded. The limiter
+// can be shared with other sources.
+func (s LayerSource) WithRateLimiter(rateLimiter *ratelimit.Limiter) LayerSource {
+	s.rateLimiter = rateLimiter
+	return s
+}
+
+// WithProgressReporter makes the source report how much of each blob has
+// been downloaded.
+func (s LayerSource) WithProgressReporter(progressReporter ProgressReporter) LayerSource {
+	s.progressReporter = progressReporter
+	return s
+}
+
+// WithTokenCache makes the source share registry tokens with other
+// processes through the cache.
+func (s LayerSource) WithTokenCache(tokenCache *token_cache.TokenCache) LayerSource {
+	s.tokenCache = tokenCache
+	return s
+}
+
+func (s LayerSource) WithMetricsEmitter(metricsEmitter groot.MetricsEmitter) LayerSource {
+	s.metricsEmitter = metricsEmitter
+	return s
+}
+
+// WithPlatform selects the image to use when the base image is a manifest
+// list or an OCI image index. It defaults to the platform grootfs runs on.
+func (s LayerSource) WithPlatform(platform Platform) LayerSource {
+	s.platform = platform
+	return s
+}
+
+// WithDownloadRetries sets how many times fetching the manifest, the config
+// and the blobs is retried, and how long to wait before the first retry.
+func (s LayerSource) WithDownloadRetries(retries int, backoff time.Duration) LayerSource {
+	s.downloadRetries = retries
+	s.retryBackoff = backoff
+	return s
+}
+
 func (s *LayerSource) Manifest(logger lager.Logger) (types.Image, error) {
 	logger = logger.Session("fetching-image-manifest", lager.Data{"baseImageURL": s.baseImageURL})
 	logger.Info("starting")
 	defer logger.Info("ending")
 
-	img, err := s.getImageWithRetries(logger)
+	// the manifest is fetched once per create, unlike blobs
+	if s.baseImageURL.Scheme == "docker" {
+		prunePartialBlobs(logger)
+	}
+
+	img, manifest, endpoint, err := s.getImageFromEndpoints(logger)
 	if err != nil {
 		logger.Error("fetching-image-reference-failed", err)
 		return nil, errorspkg.Wrap(err, "fetching image reference")
 	}
+	logger.Info("manifest-resolved", lager.Data{"manifestDigest": img.manifestDigest})
 
-	img, err = s.convertImage(logger, img)
+	if s.signatureVerifier != nil {
+		if err := s.signatureVerifier.Verify(logger, s.baseImageURL, manifest); err != nil {
+			logger.Error("verifying-signatures-failed", err)
+			return nil, errorspkg.Wrap(err, "verifying image signatures")
+		}
+	}
+
+	img.Image, err = s.convertImage(logger, img.Image, endpoint)
 	if err != nil {
 		logger.Error("converting-image-failed", err)
 		return nil, err
 	}
 
-	for i := 0; i < MAX_DOCKER_RETRIES; i++ {
-		logger.Debug("attempt-get-config", lager.Data{"attempt": i + 1})
-		_, e := img.ConfigBlob(context.TODO())
-		if e == nil {
-			return img, nil
+	err = s.withRetries(logger, "get-config", func() error {
+		_, err := img.ConfigBlob(context.TODO())
+		if err != nil {
+			logger.Error("fetching-image-config-failed", err)
 		}
-
-		logger.Error("fetching-image-config-failed", e, lager.Data{"attempt": i + 1})
-		err = e
+		return err
+	})
+	if err != nil {
+		return nil, errorspkg.Wrap(err, "fetching image configuration")
 	}
 
-	return nil, errorspkg.Wrap(err, "fetching image configuration")
+	return img, nil
 }
 
 func (s *LayerSource) Blob(logger lager.Logger, layerInfo groot.LayerInfo) (string, int64, error) {
@@ -87,56 +190,105 @@ func (s *LayerSource) Blob(logger lager.Logger, layerInfo groot.LayerInfo) (stri
 	logger = logger.Session("streaming-blob", lager.Data{
 		"baseImageURL":             s.baseImageURL,
 		"digest":                   layerInfo.BlobID,
-		"imageQuota":               s.imageQuota,
+		"imageQuota":               s.remainingImageQuota(),
 		"skipImageQuotaValidation": s.skipImageQuotaValidation,
 	})
 	logger.Info("starting")
 	defer logger.Info("ending")
 
-	imgSrc, err := s.getImageSource(logger)
+	decompressor, err := decompressorFor(layerInfo.MediaType)
 	if err != nil {
 		return "", 0, err
 	}
 
+	if s.blobCache != nil {
+		blobPath, size, ok, err := s.cachedBlob(logger, layerInfo, decompressor)
+		if err != nil {
+			logger.Error("reading-cached-blob-failed", err)
+			// errors writing the blob to tmp say nothing about the cached blob
+			if isCorruptBlob(err) {
+				if err := s.blobCache.Remove(layerInfo.BlobID); err != nil {
+					logger.Error("removing-cached-blob-failed", err)
+				}
+			}
+		} else if ok {
+			if s.progressReporter != nil {
+				s.progressReporter.LayerProgress(logger, layerInfo.BlobID, size, size, true)
+			}
+			return blobPath, size, nil
+		}
+	}
+
 	blobInfo := types.BlobInfo{
 		Digest: digestpkg.Digest(layerInfo.BlobID),
+		Size:   layerInfo.Size,
 		URLs:   layerInfo.URLs,
 	}
 
-	blob, size, err := s.getBlobWithRetries(logger, imgSrc, blobInfo)
+	blob, size, err := s.getBlobFromEndpoints(logger, blobInfo, true)
 	if err != nil {
 		return "", 0, err
 	}
+	defer blob.Close()
 	logger.Debug("got-blob-stream", lager.Data{"digest": layerInfo.BlobID, "size": size, "mediaType": layerInfo.MediaType})
 
-	if err = s.validateLayerSize(layerInfo, size); err != nil {
-		return "", 0, err
+	var cacheEntry *blob_cache.Entry
+	if s.blobCache != nil {
+		cacheEntry, err = s.blobCache.NewEntry(layerInfo.BlobID)
+		if err != nil {
+			logger.Error("creating-blob-cache-entry-failed", err)
+		}
 	}
 
-	blobTempFile, err := ioutil.TempFile("", fmt.Sprintf("blob-%s", layerInfo.BlobID))
+	blobPath, err := s.writeBlob(logger, layerInfo, blob, size, decompressor, cacheEntry)
+	if cacheEntry != nil {
+		if err != nil {
+			cacheEntry.Discard()
+		} else if err := cacheEntry.Commit(logger); err != nil {
+			logger.Error("caching-blob-failed", err)
+		}
+	}
 	if err != nil {
 		return "", 0, err
 	}
 
-	blobIDHash := sha256.New()
-	digestReader := ioutil.NopCloser(io.TeeReader(blob, blobIDHash))
-	if layerInfo.MediaType == "" || strings.Contains(layerInfo.MediaType, "gzip") {
-		logger.Debug("uncompressing-blob")
+	return blobPath, size, nil
+}
+
+// cachedBlob returns the blob from the blob cache. Cached blobs are verified
+// like downloaded ones.
+func (s *LayerSource) cachedBlob(logger lager.Logger, layerInfo groot.LayerInfo, decompressor Decompressor) (string, int64, bool, error) {
+	blob, size, ok, err := s.blobCache.Open(layerInfo.BlobID)
+	if err != nil || !ok {
+		return "", 0, false, err
+	}
+	defer blob.Close()
+	logger.Debug("got-cached-blob", lager.Data{"digest": layerInfo.BlobID, "size": size})
+
+	blobPath, err := s.writeBlob(logger, layerInfo, blob, size, decompressor, nil)
+	if err != nil {
+		return "", 0, false, err
+	}
 
-		digestReader, err = gzip.NewReader(digestReader)
-		if err != nil {
-			return "", 0, errorspkg.Wrapf(err, "expected blob to be of type %s", layerInfo.MediaType)
-		}
-		defer digestReader.Close()
+	return blobPath, size, true, nil
+}
 
+// writeBlob uncompresses the blob into a temporary file, verifying its
+// digest and DiffID. The compressed blob is also written to the cache entry,
+// when there is one.
+func (s *LayerSource) writeBlob(logger lager.Logger, layerInfo groot.LayerInfo, blob io.Reader, size int64, decompressor Decompressor, cacheEntry *blob_cache.Entry) (_ string, err error) {
+	stream, err := s.newBlobStream(logger, layerInfo, blob, size, decompressor, cacheEntry)
+	if err != nil {
+		return "", err
 	}
+	defer stream.Close()
 
-	if s.shouldEnforceImageQuotaValidation() {
-		digestReader = layer_fetcher.NewQuotaedReader(digestReader, s.imageQuota, "uncompressed layer size exceeds quota")
+	blobTempFile, err := ioutil.TempFile("", fmt.Sprintf("blob-%s", layerInfo.BlobID))
+	if err != nil {
+		return "", err
 	}
 
 	defer func() {
-		blob.Close()
 		blobTempFile.Close()
 
 		if err != nil {
@@ -144,27 +296,35 @@ func (s *LayerSource) Blob(logger lager.Logger, layerInfo groot.LayerInfo) (stri
 		}
 	}()
 
-	diffIDHash := sha256.New()
-	digestReader = ioutil.NopCloser(io.TeeReader(digestReader, diffIDHash))
-
-	uncompressedSize, err := io.Copy(blobTempFile, digestReader)
-	if err != nil {
+	if _, err = io.Copy(blobTempFile, stream); err != nil {
 		logger.Error("writing-blob-to-file", err)
-		return "", 0, errorspkg.Wrap(err, "writing blob to tempfile")
+		return "", errorspkg.Wrap(err, "writing blob to tempfile")
 	}
 
-	blobIDHex := strings.Split(layerInfo.BlobID, ":")[1]
-	if err = s.checkCheckSum(logger, blobIDHash, blobIDHex); err != nil {
-		return "", 0, errorspkg.Wrap(err, "layerID digest mismatch")
+	if err = stream.verify(); err != nil {
+		return "", err
 	}
 
-	if err = s.checkCheckSum(logger, diffIDHash, layerInfo.DiffID); err != nil {
-		return "", 0, errorspkg.Wrap(err, "diffID digest mismatch")
-	}
+	return blobTempFile.Name(), nil
+}
 
-	s.imageQuota -= uncompressedSize
+func (s *LayerSource) remainingImageQuota() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	return blobTempFile.Name(), size, nil
+	return s.imageQuota
+}
+
+func (s *LayerSource) consumeImageQuota(size int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.imageQuota -= size
+	if s.shouldEnforceImageQuotaValidation() && s.imageQuota < 0 {
+		return errors.New("uncompressed layer size exceeds quota")
+	}
+
+	return nil
 }
 
 func (s *LayerSource) shouldEnforceImageQuotaValidation() bool {
@@ -184,28 +344,161 @@ func isV1Image(layerInfo groot.LayerInfo) bool {
 }
 
 func (s *LayerSource) Close() error {
-	if s.imageSource != nil {
-		return s.imageSource.Close()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var err error
+	for _, imageSource := range s.imageSources {
+		if e := imageSource.Close(); e != nil {
+			err = e
+		}
 	}
-	return nil
+
+	return err
 }
 
-func (s *LayerSource) getBlobWithRetries(logger lager.Logger, imgSrc types.ImageSource, blobInfo types.BlobInfo) (io.ReadCloser, int64, error) {
+func (s *LayerSource) getBlobFromEndpoints(logger lager.Logger, blobInfo types.BlobInfo, resumable bool) (io.ReadCloser, int64, error) {
 	var err error
-	for i := 0; i < MAX_DOCKER_RETRIES; i++ {
-		logger.Debug(fmt.Sprintf("attempt-get-blob-%d", i+1))
-		blob, size, e := imgSrc.GetBlob(context.TODO(), blobInfo)
-		if e == nil {
-			logger.Debug("attempt-get-blob-success")
-			return blob, size, nil
+	for _, endpoint := range s.endpoints() {
+		endpointName := s.endpointName(endpoint)
+
+		blob, size, e := s.getBlobFromEndpoint(logger, endpoint, blobInfo, resumable)
+		if e != nil {
+			err = e
+			logger.Error("fetching-blob-from-endpoint-failed", err, lager.Data{"endpoint": endpointName})
+			continue
 		}
-		err = e
-		logger.Error("attempt-get-blob-failed", err)
+
+		logger.Info("blob-served", lager.Data{"endpoint": endpointName, "size": size})
+		if s.metricsEmitter != nil && endpointName != "" {
+			s.metricsEmitter.TryEmitUsage(logger, fmt.Sprintf(MetricsBlobEndpointNameFormat, endpointName), size, "bytes")
+		}
+		return blob, size, nil
 	}
 
 	return nil, 0, err
 }
 
+// getBlobFromEndpoint downloads blobs served by docker registries into the
+// store's tmp dir when they are resumable, so that failed downloads can be
+// resumed. Other blobs, and the blobs of insecure registries, which might not
+// serve https, are streamed by containers/image.
+func (s *LayerSource) getBlobFromEndpoint(logger lager.Logger, endpoint Endpoint, blobInfo types.BlobInfo, resumable bool) (io.ReadCloser, int64, error) {
+	if !resumable || s.baseImageURL.Scheme != "docker" || len(blobInfo.URLs) > 0 || endpoint.SystemContext.DockerInsecureSkipTLSVerify {
+		imgSrc, err := s.getImageSource(logger, endpoint)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return s.getBlobWithRetries(logger, imgSrc, blobInfo)
+	}
+
+	client, err := s.getRegistryClient(logger, endpoint)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	partial, err := openPartialBlob(blobInfo.Digest.String())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	err = s.withRetries(logger, "get-blob", func() error {
+		err := s.resumeBlobDownload(logger, client, partial, blobInfo)
+		if err != nil {
+			logger.Error("attempt-get-blob-failed", err)
+		}
+		return err
+	})
+	if err != nil {
+		partial.release()
+		return nil, 0, err
+	}
+
+	size, err := partial.size()
+	if err != nil {
+		partial.release()
+		return nil, 0, err
+	}
+	if _, err := partial.Seek(0, io.SeekStart); err != nil {
+		partial.release()
+		return nil, 0, err
+	}
+
+	return downloadedBlob{partialBlob: partial}, size, nil
+}
+
+// resumeBlobDownload appends the rest of the blob to the partial blob
+func (s *LayerSource) resumeBlobDownload(logger lager.Logger, client *registryClient, partial *partialBlob, blobInfo types.BlobInfo) error {
+	offset, err := partial.size()
+	if err != nil {
+		return err
+	}
+
+	if blobInfo.Size > 0 && offset >= blobInfo.Size {
+		if offset == blobInfo.Size {
+			return nil
+		}
+		offset = 0
+		if err := partial.restart(); err != nil {
+			return err
+		}
+	}
+
+	blobRange, err := client.GetBlobRange(logger, blobInfo.Digest.String(), offset)
+	if err == errRangeNotSatisfiable {
+		if restartErr := partial.restart(); restartErr != nil {
+			return restartErr
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	defer blobRange.body.Close()
+
+	if blobRange.offset != offset {
+		if err := partial.restart(); err != nil {
+			return err
+		}
+	}
+
+	logger.Debug("downloading-blob", lager.Data{"offset": blobRange.offset})
+	written, err := io.Copy(partial, s.meterBlob(logger, blobInfo, blobRange.offset, blobRange.body))
+	if err != nil {
+		return errorspkg.Wrap(err, "downloading blob")
+	}
+
+	if blobInfo.Size > 0 && blobRange.offset+written < blobInfo.Size {
+		return errorspkg.Wrapf(io.ErrUnexpectedEOF, "downloading blob: got %d of %d bytes", blobRange.offset+written, blobInfo.Size)
+	}
+
+	return nil
+}
+
+func (s *LayerSource) getBlobWithRetries(logger lager.Logger, imgSrc types.ImageSource, blobInfo types.BlobInfo) (io.ReadCloser, int64, error) {
+	var (
+		blob io.ReadCloser
+		size int64
+	)
+	err := s.withRetries(logger, "get-blob", func() error {
+		var err error
+		blob, size, err = imgSrc.GetBlob(context.TODO(), blobInfo)
+		if err != nil {
+			logger.Error("attempt-get-blob-failed", err)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if size > 0 {
+		blobInfo.Size = size
+	}
+	return meteredBlob{Reader: s.meterBlob(logger, blobInfo, 0, blob), Closer: blob}, size, nil
+}
+
 func (s *LayerSource) checkCheckSum(logger lager.Logger, hash hash.Hash, digest string) error {
 	if s.skipOCILayerValidation && s.baseImageURL.Scheme == "oci" {
 		return nil
@@ -223,12 +516,12 @@ func (s *LayerSource) checkCheckSum(logger lager.Logger, hash hash.Hash, digest
 	return nil
 }
 
-func (s *LayerSource) reference(logger lager.Logger) (types.ImageReference, error) {
+func (s *LayerSource) reference(logger lager.Logger, endpoint Endpoint) (types.ImageReference, error) {
 	refString := "/"
-	if s.baseImageURL.Host != "" {
-		refString += "/" + s.baseImageURL.Host
+	if endpoint.Host != "" {
+		refString += "/" + endpoint.Host
 	}
-	refString += s.baseImageURL.Path
+	refString += s.repositoryPath(endpoint)
 
 	logger.Debug("parsing-reference", lager.Data{"refString": refString})
 	transport := transports.Get(s.baseImageURL.Scheme)
@@ -240,45 +533,104 @@ func (s *LayerSource) reference(logger lager.Logger) (types.ImageReference, erro
 	return ref, nil
 }
 
-func (s *LayerSource) getImageWithRetries(logger lager.Logger) (types.Image, error) {
-	var imgErr error
-	var img types.Image
-	for i := 0; i < MAX_DOCKER_RETRIES; i++ {
-		logger.Debug(fmt.Sprintf("attempt-get-image-%d", i+1))
+// getImageFromEndpoints returns the image and the manifest its reference
+// points to, which is the manifest list for multi-platform images.
+// Signatures and pinned digests are for this manifest.
+func (s *LayerSource) getImageFromEndpoints(logger lager.Logger) (digestedImage, []byte, Endpoint, error) {
+	var err error
+	for _, endpoint := range s.endpoints() {
+		img, manifest, e := s.getImageWithRetries(logger, endpoint)
+		if e != nil {
+			err = e
+			logger.Error("fetching-image-from-endpoint-failed", err, lager.Data{"endpoint": s.endpointName(endpoint)})
+			continue
+		}
+
+		logger.Info("manifest-served", lager.Data{"endpoint": s.endpointName(endpoint)})
+		return img, manifest, endpoint, nil
+	}
 
-		imageSource, err := s.getImageSource(logger)
-		if err == nil {
-			img, err = image.FromUnparsedImage(context.TODO(), &s.systemContext, image.UnparsedInstance(imageSource, nil))
-			if err == nil {
-				logger.Debug("attempt-get-image-success")
-				return img, nil
-			}
+	return digestedImage{}, nil, Endpoint{}, err
+}
+
+func (s *LayerSource) getImageWithRetries(logger lager.Logger, endpoint Endpoint) (digestedImage, []byte, error) {
+	var (
+		img      digestedImage
+		manifest []byte
+	)
+	err := s.withRetries(logger, "get-image", func() error {
+		imageSource, err := s.getImageSource(logger, endpoint)
+		if err != nil {
+			return err
 		}
-		imgErr = err
+
+		var mimeType string
+		manifest, mimeType, err = imageSource.GetManifest(context.TODO(), nil)
+		if err != nil {
+			return err
+		}
+
+		img.manifestDigest, err = resolveManifestDigest(s.baseImageURL, manifest)
+		if err != nil {
+			return err
+		}
+		img.referencedManifest = manifest
+
+		instanceDigest, err := s.platformInstance(logger, manifest, mimeType)
+		if err != nil {
+			return err
+		}
+
+		img.Image, err = image.FromUnparsedImage(context.TODO(), &endpoint.SystemContext, image.UnparsedInstance(imageSource, instanceDigest))
+		return err
+	})
+	if err != nil {
+		return digestedImage{}, nil, errorspkg.Wrap(err, "creating image")
 	}
 
-	return nil, errorspkg.Wrap(imgErr, "creating image")
+	return img, manifest, nil
 }
 
-func (s *LayerSource) getImageSource(logger lager.Logger) (types.ImageSource, error) {
-	if s.imageSource == nil {
+// platformInstance returns the digest of the manifest to use when the image
+// is a manifest list or an OCI image index, and nil otherwise.
+func (s *LayerSource) platformInstance(logger lager.Logger, manifest []byte, mimeType string) (*digestpkg.Digest, error) {
+	if !isManifestList(mimeType) {
+		return nil, nil
+	}
+
+	instanceDigest, err := chooseInstance(manifest, s.platform)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug("platform-manifest-chosen", lager.Data{"platform": s.platform.String(), "digest": instanceDigest})
+
+	return &instanceDigest, nil
+}
+
+func (s *LayerSource) getImageSource(logger lager.Logger, endpoint Endpoint) (types.ImageSource, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	imageSource, ok := s.imageSources[endpoint.Host]
+	if !ok {
 		var err error
-		s.imageSource, err = s.createImageSource(logger)
+		imageSource, err = s.createImageSource(logger, endpoint)
 		if err != nil {
 			return nil, err
 		}
+		s.imageSources[endpoint.Host] = imageSource
 	}
 
-	return s.imageSource, nil
+	return imageSource, nil
 }
 
-func (s *LayerSource) createImageSource(logger lager.Logger) (types.ImageSource, error) {
-	ref, err := s.reference(logger)
+func (s *LayerSource) createImageSource(logger lager.Logger, endpoint Endpoint) (types.ImageSource, error) {
+	ref, err := s.reference(logger, endpoint)
 	if err != nil {
 		return nil, err
 	}
 
-	imgSrc, err := ref.NewImageSource(context.TODO(), &s.systemContext)
+	imgSrc, err := ref.NewImageSource(context.TODO(), &endpoint.SystemContext)
 	if err != nil {
 		return nil, errorspkg.Wrap(err, "creating image source")
 	}
@@ -286,7 +638,30 @@ func (s *LayerSource) createImageSource(logger lager.Logger) (types.ImageSource,
 	return imgSrc, nil
 }
 
-func (s *LayerSource) convertImage(logger lager.Logger, originalImage types.Image) (types.Image, error) {
+func (s *LayerSource) getRegistryClient(logger lager.Logger, endpoint Endpoint) (*registryClient, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	client, ok := s.registryClients[endpoint.Host]
+	if ok {
+		return client, nil
+	}
+
+	ref, err := s.reference(logger, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err = newRegistryClient(endpoint, ref.DockerReference(), s.tokenCache)
+	if err != nil {
+		return nil, errorspkg.Wrap(err, "creating registry client")
+	}
+	s.registryClients[endpoint.Host] = client
+
+	return client, nil
+}
+
+func (s *LayerSource) convertImage(logger lager.Logger, originalImage types.Image, endpoint Endpoint) (types.Image, error) {
 	_, mimetype, err := originalImage.Manifest(context.TODO())
 	if err != nil {
 		return nil, err
@@ -300,7 +675,7 @@ func (s *LayerSource) convertImage(logger lager.Logger, originalImage types.Imag
 	logger.Info("starting")
 	defer logger.Info("ending")
 
-	imgSrc, err := s.getImageSource(logger)
+	imgSrc, err := s.getImageSource(logger, endpoint)
 	if err != nil {
 		return nil, err
 	}
@@ -14,6 +14,7 @@ import (
 	"code.cloudfoundry.org/grootfs/fetcher/layer_fetcher"
 	"code.cloudfoundry.org/grootfs/fetcher/layer_fetcher/source"
 	"code.cloudfoundry.org/grootfs/groot"
+	"code.cloudfoundry.org/grootfs/groot/grootfakes"
 	"code.cloudfoundry.org/grootfs/integration"
 	"code.cloudfoundry.org/grootfs/testhelpers"
 	"code.cloudfoundry.org/lager/lagertest"
@@ -320,7 +321,7 @@ var _ = Describe("Layer source: Docker", func() {
 
 		It("retries fetching the config blob twice", func() {
 			fakeRegistry.WhenGettingBlob(configBlob, 1, func(resp http.ResponseWriter, req *http.Request) {
-				resp.WriteHeader(http.StatusTeapot)
+				resp.WriteHeader(http.StatusServiceUnavailable)
 				_, _ = resp.Write([]byte("null"))
 				return
 			})
@@ -335,6 +336,88 @@ var _ = Describe("Layer source: Docker", func() {
 		})
 	})
 
+	Context("when registry mirrors are configured", func() {
+		var (
+			mirrorRegistry *testhelpers.FakeRegistry
+			mirrors        []source.Endpoint
+			metricsEmitter *grootfakes.FakeMetricsEmitter
+		)
+
+		BeforeEach(func() {
+			dockerHubUrl, err := url.Parse("https://registry-1.docker.io")
+			Expect(err).NotTo(HaveOccurred())
+			mirrorRegistry = testhelpers.NewFakeRegistry(dockerHubUrl)
+			mirrorRegistry.Start()
+
+			mirrors = []source.Endpoint{
+				{
+					Host:          mirrorRegistry.Addr(),
+					SystemContext: types.SystemContext{DockerInsecureSkipTLSVerify: true},
+				},
+			}
+			metricsEmitter = new(grootfakes.FakeMetricsEmitter)
+		})
+
+		JustBeforeEach(func() {
+			layerSource = layerSource.WithMirrors(mirrors).WithMetricsEmitter(metricsEmitter)
+		})
+
+		AfterEach(func() {
+			mirrorRegistry.Stop()
+		})
+
+		It("fetches the manifest from the mirror", func() {
+			manifest, err := layerSource.Manifest(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(manifest.ConfigInfo().Digest.String()).To(Equal(configBlob))
+
+			Expect(mirrorRegistry.RequestedBlobs()).To(ContainElement(configBlob))
+			Expect(logger).To(gbytes.Say(`manifest-served.*"endpoint":"%s"`, mirrorRegistry.Addr()))
+		})
+
+		It("fetches blobs from the mirror", func() {
+			_, _, err := layerSource.Blob(logger, layerInfos[0])
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(mirrorRegistry.RequestedBlobs()).To(ConsistOf(layerInfos[0].BlobID))
+			Expect(logger).To(gbytes.Say(`blob-served.*"endpoint":"%s"`, mirrorRegistry.Addr()))
+		})
+
+		It("emits a metric for the endpoint that served the blob", func() {
+			_, size, err := layerSource.Blob(logger, layerInfos[0])
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(metricsEmitter.TryEmitUsageCallCount()).To(Equal(1))
+			_, name, usage, units := metricsEmitter.TryEmitUsageArgsForCall(0)
+			Expect(name).To(Equal(fmt.Sprintf("DownloadedBlobBytes.%s", mirrorRegistry.Addr())))
+			Expect(usage).To(Equal(size))
+			Expect(units).To(Equal("bytes"))
+		})
+
+		Context("when the mirrors are not available", func() {
+			BeforeEach(func() {
+				mirrors = append([]source.Endpoint{{Host: "127.0.0.1:1"}}, mirrors...)
+				mirrorRegistry.FailNextRequests(100)
+			})
+
+			It("falls back to the upstream registry for the manifest", func() {
+				_, err := layerSource.Manifest(logger)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(logger).To(gbytes.Say(`manifest-served.*"endpoint":"docker.io"`))
+			})
+
+			It("falls back to the upstream registry for blobs", func() {
+				_, _, err := layerSource.Blob(logger, layerInfos[0])
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(logger.TestSink.LogMessages()).To(ContainElement("test-layer-source.streaming-blob.fetching-blob-from-endpoint-failed"))
+				_, name, _, _ := metricsEmitter.TryEmitUsageArgsForCall(0)
+				Expect(name).To(Equal("DownloadedBlobBytes.docker.io"))
+			})
+		})
+	})
+
 	Context("when a private registry is used", func() {
 		var fakeRegistry *testhelpers.FakeRegistry
 
@@ -504,7 +587,7 @@ var _ = Describe("Layer source: Docker", func() {
 			})
 
 			It("returns an error", func() {
-				layerInfos[0].MediaType = "gzip"
+				layerInfos[0].MediaType = "application/vnd.docker.image.rootfs.diff.tar.gzip"
 				_, _, err := layerSource.Blob(logger, layerInfos[0])
 				Expect(err).To(MatchError(ContainSubstring("layer size is different from the value in the manifest")))
 			})
@@ -588,7 +671,7 @@ var _ = Describe("Layer source: Docker", func() {
 		Context("when the blob does not exist", func() {
 			It("returns an error", func() {
 				_, _, err := layerSource.Blob(logger, groot.LayerInfo{BlobID: "sha256:steamed-blob"})
-				Expect(err).To(MatchError(ContainSubstring("fetching blob 400")))
+				Expect(err).To(MatchError(ContainSubstring("unexpected http code 400")))
 			})
 		})
 
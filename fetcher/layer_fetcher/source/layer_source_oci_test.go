@@ -1,20 +1,32 @@
 package source_test
 
 import (
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 
+	"code.cloudfoundry.org/grootfs/fetcher/layer_fetcher"
+	"code.cloudfoundry.org/grootfs/fetcher/layer_fetcher/signature"
 	"code.cloudfoundry.org/grootfs/fetcher/layer_fetcher/source"
 	"code.cloudfoundry.org/grootfs/groot"
+	"code.cloudfoundry.org/grootfs/store/blob_cache"
 	"code.cloudfoundry.org/lager/lagertest"
 	"github.com/containers/image/types"
+	"github.com/klauspost/compress/zstd"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gbytes"
 	"github.com/onsi/gomega/gexec"
+	digestpkg "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	specsv1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 var _ = Describe("Layer source: OCI", func() {
@@ -81,6 +93,15 @@ var _ = Describe("Layer source: OCI", func() {
 			Expect(manifest.LayerInfos()[1].Size).To(Equal(layerInfos[1].Size))
 		})
 
+		It("returns the manifest digest", func() {
+			manifest, err := layerSource.Manifest(logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			digestedManifest, ok := manifest.(layer_fetcher.DigestedManifest)
+			Expect(ok).To(BeTrue())
+			Expect(digestedManifest.ManifestDigest().String()).To(Equal("sha256:a68a8bf77d0e1c0630dec7f829889a4d607bc151fe31827cf589558560336c46"))
+		})
+
 		It("contains the config", func() {
 			manifest, err := layerSource.Manifest(logger)
 			Expect(err).NotTo(HaveOccurred())
@@ -93,6 +114,151 @@ var _ = Describe("Layer source: OCI", func() {
 			Expect(config.RootFS.DiffIDs[1].Hex()).To(Equal(layerInfos[1].DiffID))
 		})
 
+		Context("when a signature policy is configured", func() {
+			var policyPath string
+
+			BeforeEach(func() {
+				policyFile, err := ioutil.TempFile("", "policy.json")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(policyFile.Close()).To(Succeed())
+				policyPath = policyFile.Name()
+			})
+
+			AfterEach(func() {
+				Expect(os.Remove(policyPath)).To(Succeed())
+			})
+
+			withPolicy := func(policy string) {
+				Expect(ioutil.WriteFile(policyPath, []byte(policy), 0644)).To(Succeed())
+				loadedPolicy, err := signature.NewPolicyFromFile(policyPath)
+				Expect(err).NotTo(HaveOccurred())
+				layerSource = layerSource.WithSignatureVerifier(signature.NewVerifier(loadedPolicy, ""))
+			}
+
+			It("fetches the manifest when the policy accepts the image", func() {
+				withPolicy(`{"default": [{"type": "reject"}], "transports": {"oci": {"": [{"type": "insecureAcceptAnything"}]}}}`)
+
+				_, err := layerSource.Manifest(logger)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("returns an error when the policy rejects the image", func() {
+				withPolicy(`{"default": [{"type": "insecureAcceptAnything"}], "transports": {"oci": {"": [{"type": "reject"}]}}}`)
+
+				_, err := layerSource.Manifest(logger)
+				Expect(err).To(MatchError(ContainSubstring("rejected by the signature policy")))
+			})
+		})
+
+		Context("when the image is an OCI image index", func() {
+			var (
+				imageDir      string
+				armManifest   []byte
+				indexPlatform source.Platform
+			)
+
+			BeforeEach(func() {
+				var err error
+				imageDir, err = ioutil.TempDir("", "oci-index")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(exec.Command("cp", "-r", fmt.Sprintf("%s/../../../integration/assets/oci-test-image/opq-whiteouts-busybox/.", workDir), imageDir).Run()).To(Succeed())
+
+				amdManifestDigest := digestpkg.Digest("sha256:a68a8bf77d0e1c0630dec7f829889a4d607bc151fe31827cf589558560336c46")
+				amdManifest, err := ioutil.ReadFile(filepath.Join(imageDir, "blobs", "sha256", amdManifestDigest.Hex()))
+				Expect(err).NotTo(HaveOccurred())
+
+				var manifest specsv1.Manifest
+				Expect(json.Unmarshal(amdManifest, &manifest)).To(Succeed())
+				manifest.Annotations = map[string]string{"platform": "arm"}
+				armManifest, err = json.Marshal(manifest)
+				Expect(err).NotTo(HaveOccurred())
+				armManifestDigest := writeBlob(imageDir, armManifest)
+
+				index := specsv1.Index{
+					Versioned: specs.Versioned{SchemaVersion: 2},
+					Manifests: []specsv1.Descriptor{
+						{
+							MediaType: specsv1.MediaTypeImageManifest,
+							Digest:    amdManifestDigest,
+							Size:      int64(len(amdManifest)),
+							Platform:  &specsv1.Platform{OS: "linux", Architecture: "amd64"},
+						},
+						{
+							MediaType: specsv1.MediaTypeImageManifest,
+							Digest:    armManifestDigest,
+							Size:      int64(len(armManifest)),
+							Platform:  &specsv1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+						},
+					},
+				}
+				indexContents, err := json.Marshal(index)
+				Expect(err).NotTo(HaveOccurred())
+				indexDigest := writeBlob(imageDir, indexContents)
+
+				layout := specsv1.Index{
+					Versioned: specs.Versioned{SchemaVersion: 2},
+					Manifests: []specsv1.Descriptor{
+						{
+							MediaType: specsv1.MediaTypeImageIndex,
+							Digest:    indexDigest,
+							Size:      int64(len(indexContents)),
+						},
+					},
+				}
+				layoutContents, err := json.Marshal(layout)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ioutil.WriteFile(filepath.Join(imageDir, "index.json"), layoutContents, 0644)).To(Succeed())
+
+				baseImageURL, err = url.Parse(fmt.Sprintf("oci:///%s", imageDir))
+				Expect(err).NotTo(HaveOccurred())
+				indexPlatform = source.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+			})
+
+			JustBeforeEach(func() {
+				layerSource = layerSource.WithPlatform(indexPlatform)
+			})
+
+			AfterEach(func() {
+				Expect(os.RemoveAll(imageDir)).To(Succeed())
+			})
+
+			It("fetches the manifest for the platform", func() {
+				manifest, err := layerSource.Manifest(logger)
+				Expect(err).NotTo(HaveOccurred())
+
+				contents, _, err := manifest.Manifest(context.TODO())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(contents).To(Equal(armManifest))
+				Expect(manifest.LayerInfos()).To(HaveLen(2))
+			})
+
+			Context("when the platform has no variant", func() {
+				BeforeEach(func() {
+					indexPlatform = source.Platform{OS: "linux", Architecture: "arm"}
+				})
+
+				It("matches any variant", func() {
+					manifest, err := layerSource.Manifest(logger)
+					Expect(err).NotTo(HaveOccurred())
+
+					contents, _, err := manifest.Manifest(context.TODO())
+					Expect(err).NotTo(HaveOccurred())
+					Expect(contents).To(Equal(armManifest))
+				})
+			})
+
+			Context("when no image matches the platform", func() {
+				BeforeEach(func() {
+					indexPlatform = source.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+				})
+
+				It("returns an error listing the available platforms", func() {
+					_, err := layerSource.Manifest(logger)
+					Expect(err).To(MatchError(ContainSubstring("no image found for platform linux/arm64/v8, available platforms: linux/amd64, linux/arm/v7")))
+				})
+			})
+		})
+
 		Context("when the image url is invalid", func() {
 			BeforeEach(func() {
 				var err error
@@ -160,6 +326,278 @@ var _ = Describe("Layer source: OCI", func() {
 			Expect(string(buffer.Contents())).To(ContainSubstring("etc/localtime"))
 		})
 
+		Context("when the layer is not gzip compressed", func() {
+			var (
+				imageDir      string
+				uncompressed  []byte
+				layerInfo     groot.LayerInfo
+				compressLayer func([]byte) []byte
+			)
+
+			BeforeEach(func() {
+				var err error
+				imageDir, err = ioutil.TempDir("", "oci-image")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(exec.Command("cp", "-r", fmt.Sprintf("%s/../../../integration/assets/oci-test-image/opq-whiteouts-busybox/.", workDir), imageDir).Run()).To(Succeed())
+				baseImageURL, err = url.Parse(fmt.Sprintf("oci:///%s:latest", imageDir))
+				Expect(err).NotTo(HaveOccurred())
+
+				gzipBlob, err := os.Open(filepath.Join(imageDir, "blobs", "sha256", strings.TrimPrefix(layerInfos[0].BlobID, "sha256:")))
+				Expect(err).NotTo(HaveOccurred())
+				defer gzipBlob.Close()
+				gzipReader, err := gzip.NewReader(gzipBlob)
+				Expect(err).NotTo(HaveOccurred())
+				uncompressed, err = ioutil.ReadAll(gzipReader)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			JustBeforeEach(func() {
+				blob := compressLayer(uncompressed)
+				blobDigest := writeBlob(imageDir, blob)
+
+				layerInfo.BlobID = blobDigest.String()
+				layerInfo.Size = int64(len(blob))
+			})
+
+			AfterEach(func() {
+				Expect(os.RemoveAll(imageDir)).To(Succeed())
+			})
+
+			Context("when the layer is zstd compressed", func() {
+				BeforeEach(func() {
+					layerInfo = groot.LayerInfo{
+						DiffID:    layerInfos[0].DiffID,
+						MediaType: source.MediaTypeImageLayerZstd,
+					}
+					compressLayer = func(contents []byte) []byte {
+						encoder, err := zstd.NewWriter(nil)
+						Expect(err).NotTo(HaveOccurred())
+						defer encoder.Close()
+						return encoder.EncodeAll(contents, nil)
+					}
+				})
+
+				It("decompresses the blob", func() {
+					blobPath, _, err := layerSource.Blob(logger, layerInfo)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(ioutil.ReadFile(blobPath)).To(Equal(uncompressed))
+				})
+
+				Context("when the blob doesn't match the diffID", func() {
+					BeforeEach(func() {
+						layerInfo.DiffID = "0000000000000000000000000000000000000000000000000000000000000000"
+					})
+
+					It("returns an error", func() {
+						_, _, err := layerSource.Blob(logger, layerInfo)
+						Expect(err).To(MatchError(ContainSubstring("diffID digest mismatch")))
+					})
+				})
+
+				Context("when the blob is not zstd compressed", func() {
+					BeforeEach(func() {
+						compressLayer = func(contents []byte) []byte {
+							return contents
+						}
+					})
+
+					It("returns an error", func() {
+						_, _, err := layerSource.Blob(logger, layerInfo)
+						Expect(err).To(HaveOccurred())
+					})
+				})
+			})
+
+			Context("when the layer is an uncompressed tar", func() {
+				BeforeEach(func() {
+					layerInfo = groot.LayerInfo{
+						DiffID:    layerInfos[0].DiffID,
+						MediaType: "application/vnd.oci.image.layer.v1.tar",
+					}
+					compressLayer = func(contents []byte) []byte {
+						return contents
+					}
+				})
+
+				It("copies the blob as it is", func() {
+					blobPath, _, err := layerSource.Blob(logger, layerInfo)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(ioutil.ReadFile(blobPath)).To(Equal(uncompressed))
+				})
+
+				Context("when the blob doesn't match the diffID", func() {
+					BeforeEach(func() {
+						layerInfo.DiffID = "0000000000000000000000000000000000000000000000000000000000000000"
+					})
+
+					It("returns an error", func() {
+						_, _, err := layerSource.Blob(logger, layerInfo)
+						Expect(err).To(MatchError(ContainSubstring("diffID digest mismatch")))
+					})
+				})
+			})
+		})
+
+		Context("when a blob cache is used", func() {
+			var (
+				imageDir  string
+				cacheDir  string
+				blobCache *blob_cache.BlobCache
+			)
+
+			BeforeEach(func() {
+				var err error
+				imageDir, err = ioutil.TempDir("", "oci-image")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(exec.Command("cp", "-r", fmt.Sprintf("%s/../../../integration/assets/oci-test-image/opq-whiteouts-busybox/.", workDir), imageDir).Run()).To(Succeed())
+				baseImageURL, err = url.Parse(fmt.Sprintf("oci:///%s:latest", imageDir))
+				Expect(err).NotTo(HaveOccurred())
+
+				cacheDir, err = ioutil.TempDir("", "blob-cache")
+				Expect(err).NotTo(HaveOccurred())
+				blobCache = blob_cache.NewBlobCache(cacheDir, 10*1024*1024)
+			})
+
+			JustBeforeEach(func() {
+				layerSource = layerSource.WithBlobCache(blobCache)
+			})
+
+			AfterEach(func() {
+				Expect(os.RemoveAll(imageDir)).To(Succeed())
+				Expect(os.RemoveAll(cacheDir)).To(Succeed())
+			})
+
+			It("adds downloaded blobs to the cache", func() {
+				_, _, err := layerSource.Blob(logger, layerInfos[0])
+				Expect(err).NotTo(HaveOccurred())
+
+				_, size, ok, err := blobCache.Open(layerInfos[0].BlobID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ok).To(BeTrue())
+				Expect(size).To(Equal(layerInfos[0].Size))
+			})
+
+			Context("when the blob is in the cache", func() {
+				JustBeforeEach(func() {
+					_, _, err := layerSource.Blob(logger, layerInfos[0])
+					Expect(err).NotTo(HaveOccurred())
+					Expect(os.Remove(filepath.Join(imageDir, "blobs", "sha256", strings.TrimPrefix(layerInfos[0].BlobID, "sha256:")))).To(Succeed())
+				})
+
+				It("does not fetch it from the image source", func() {
+					blobPath, size, err := layerSource.Blob(logger, layerInfos[0])
+					Expect(err).NotTo(HaveOccurred())
+					Expect(size).To(Equal(layerInfos[0].Size))
+
+					blobContents, err := ioutil.ReadFile(blobPath)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(digestpkg.FromBytes(blobContents).Hex()).To(Equal(layerInfos[0].DiffID))
+				})
+			})
+
+			Context("when the cached blob is corrupted", func() {
+				JustBeforeEach(func() {
+					entry, err := blobCache.NewEntry(layerInfos[0].BlobID)
+					Expect(err).NotTo(HaveOccurred())
+					gzipWriter := gzip.NewWriter(entry)
+					_, err = gzipWriter.Write([]byte("not the layer"))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(gzipWriter.Close()).To(Succeed())
+					Expect(entry.Commit(logger)).To(Succeed())
+				})
+
+				It("fetches the blob from the image source and replaces the cached one", func() {
+					_, _, err := layerSource.Blob(logger, layerInfos[0])
+					Expect(err).NotTo(HaveOccurred())
+					Expect(logger).To(gbytes.Say("reading-cached-blob-failed"))
+
+					cachedBlob, _, ok, err := blobCache.Open(layerInfos[0].BlobID)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(ok).To(BeTrue())
+					defer cachedBlob.Close()
+					cachedContents, err := ioutil.ReadAll(cachedBlob)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(digestpkg.FromBytes(cachedContents).String()).To(Equal(layerInfos[0].BlobID))
+				})
+			})
+
+			Context("when the cached blob can't be uncompressed", func() {
+				JustBeforeEach(func() {
+					entry, err := blobCache.NewEntry(layerInfos[0].BlobID)
+					Expect(err).NotTo(HaveOccurred())
+					_, err = entry.Write([]byte{0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x01, 0x02})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(entry.Commit(logger)).To(Succeed())
+				})
+
+				It("fetches the blob from the image source and replaces the cached one", func() {
+					_, _, err := layerSource.Blob(logger, layerInfos[0])
+					Expect(err).NotTo(HaveOccurred())
+					Expect(logger).To(gbytes.Say("reading-cached-blob-failed"))
+
+					_, size, ok, err := blobCache.Open(layerInfos[0].BlobID)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(ok).To(BeTrue())
+					Expect(size).To(Equal(layerInfos[0].Size))
+				})
+			})
+
+			Context("when the cached blob can't be written to the temporary directory", func() {
+				var tmpDir string
+
+				JustBeforeEach(func() {
+					_, _, err := layerSource.Blob(logger, layerInfos[0])
+					Expect(err).NotTo(HaveOccurred())
+
+					tmpDir = os.Getenv("TMPDIR")
+					Expect(os.Setenv("TMPDIR", filepath.Join(cacheDir, "not-a-directory"))).To(Succeed())
+				})
+
+				AfterEach(func() {
+					Expect(os.Setenv("TMPDIR", tmpDir)).To(Succeed())
+				})
+
+				It("keeps the cached blob", func() {
+					_, _, err := layerSource.Blob(logger, layerInfos[0])
+					Expect(err).To(HaveOccurred())
+					Expect(logger).To(gbytes.Say("reading-cached-blob-failed"))
+
+					_, _, ok, err := blobCache.Open(layerInfos[0].BlobID)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(ok).To(BeTrue())
+				})
+			})
+
+			Context("when the downloaded blob is corrupted", func() {
+				BeforeEach(func() {
+					var err error
+					baseImageURL, err = url.Parse(fmt.Sprintf("oci:///%s/../../../integration/assets/oci-test-image/corrupted:latest", workDir))
+					Expect(err).NotTo(HaveOccurred())
+					layerInfos[0].Size = 668551
+				})
+
+				It("does not add it to the cache", func() {
+					_, _, err := layerSource.Blob(logger, layerInfos[0])
+					Expect(err).To(MatchError(ContainSubstring("layerID digest mismatch")))
+
+					_, _, ok, err := blobCache.Open(layerInfos[0].BlobID)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(ok).To(BeFalse())
+				})
+			})
+		})
+
+		Context("when the layer media type is not supported", func() {
+			BeforeEach(func() {
+				layerInfos[0].MediaType = "application/vnd.oci.image.layer.v1.tar+lz4"
+			})
+
+			It("returns an error", func() {
+				_, _, err := layerSource.Blob(logger, layerInfos[0])
+				Expect(err).To(MatchError("unsupported layer media type `application/vnd.oci.image.layer.v1.tar+lz4`"))
+			})
+		})
+
 		Context("when the blob has an invalid checksum", func() {
 			It("returns an error", func() {
 				_, _, err := layerSource.Blob(logger, groot.LayerInfo{BlobID: "sha256:steamed-blob"})
@@ -274,3 +712,9 @@ var _ = Describe("Layer source: OCI", func() {
 		})
 	})
 })
+
+func writeBlob(imageDir string, contents []byte) digestpkg.Digest {
+	blobDigest := digestpkg.FromBytes(contents)
+	Expect(ioutil.WriteFile(filepath.Join(imageDir, "blobs", "sha256", blobDigest.Hex()), contents, 0644)).To(Succeed())
+	return blobDigest
+}
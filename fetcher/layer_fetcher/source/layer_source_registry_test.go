@@ -0,0 +1,189 @@
+package source_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/grootfs/fetcher/layer_fetcher/source"
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/containers/image/types"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	digestpkg "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	specsv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ = Describe("Layer source: registry", func() {
+	var (
+		logger   *lagertest.TestLogger
+		registry *httptest.Server
+
+		blobs        map[digestpkg.Digest][]byte
+		armManifest  []byte
+		platform     source.Platform
+		requestsLock *sync.Mutex
+		requests     []*http.Request
+	)
+
+	newLayerSource := func() source.LayerSource {
+		baseImageURL, err := url.Parse(fmt.Sprintf("docker://%s/groot/multi-arch:latest", strings.TrimPrefix(registry.URL, "https://")))
+		Expect(err).NotTo(HaveOccurred())
+
+		systemContext := types.SystemContext{DockerInsecureSkipTLSVerify: true}
+		return source.NewLayerSource(systemContext, false, true, 0, baseImageURL).
+			WithPlatform(platform).
+			WithDownloadRetries(3, time.Millisecond)
+	}
+
+	manifestRequests := func() []*http.Request {
+		requestsLock.Lock()
+		defer requestsLock.Unlock()
+
+		manifestRequests := []*http.Request{}
+		for _, req := range requests {
+			if strings.Contains(req.URL.Path, "/manifests/") {
+				manifestRequests = append(manifestRequests, req)
+			}
+		}
+		return manifestRequests
+	}
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test-layer-source")
+		platform = source.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+
+		blobs = map[digestpkg.Digest][]byte{}
+		addBlob := func(contents []byte) specsv1.Descriptor {
+			blobDigest := digestpkg.FromBytes(contents)
+			blobs[blobDigest] = contents
+			return specsv1.Descriptor{Digest: blobDigest, Size: int64(len(contents))}
+		}
+
+		imageManifest := func(architecture string) []byte {
+			blob, layer := randomLayer(1024)
+			layerDescriptor := addBlob(blob)
+			layerDescriptor.MediaType = specsv1.MediaTypeImageLayerGzip
+
+			config, err := json.Marshal(specsv1.Image{
+				OS:           "linux",
+				Architecture: architecture,
+				RootFS:       specsv1.RootFS{Type: "layers", DiffIDs: []digestpkg.Digest{digestpkg.FromBytes(layer)}},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			configDescriptor := addBlob(config)
+			configDescriptor.MediaType = specsv1.MediaTypeImageConfig
+
+			manifest, err := json.Marshal(specsv1.Manifest{
+				Versioned: specs.Versioned{SchemaVersion: 2},
+				Config:    configDescriptor,
+				Layers:    []specsv1.Descriptor{layerDescriptor},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return manifest
+		}
+
+		amdManifest := imageManifest("amd64")
+		armManifest = imageManifest("arm")
+
+		index, err := json.Marshal(specsv1.Index{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			Manifests: []specsv1.Descriptor{
+				{
+					MediaType: specsv1.MediaTypeImageManifest,
+					Digest:    digestpkg.FromBytes(amdManifest),
+					Size:      int64(len(amdManifest)),
+					Platform:  &specsv1.Platform{OS: "linux", Architecture: "amd64"},
+				},
+				{
+					MediaType: specsv1.MediaTypeImageManifest,
+					Digest:    digestpkg.FromBytes(armManifest),
+					Size:      int64(len(armManifest)),
+					Platform:  &specsv1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+				},
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		manifests := map[string][]byte{
+			"latest": index,
+			digestpkg.FromBytes(amdManifest).String(): amdManifest,
+			digestpkg.FromBytes(armManifest).String(): armManifest,
+		}
+
+		requestsLock = &sync.Mutex{}
+		requests = []*http.Request{}
+		registry = httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			requestsLock.Lock()
+			requests = append(requests, req)
+			requestsLock.Unlock()
+
+			const repositoryPath = "/v2/groot/multi-arch/"
+			switch {
+			case req.URL.Path == "/v2/":
+				rw.WriteHeader(http.StatusOK)
+
+			case strings.HasPrefix(req.URL.Path, repositoryPath+"manifests/"):
+				manifest, ok := manifests[strings.TrimPrefix(req.URL.Path, repositoryPath+"manifests/")]
+				if !ok {
+					rw.WriteHeader(http.StatusNotFound)
+					return
+				}
+
+				mediaType := specsv1.MediaTypeImageManifest
+				if strings.HasSuffix(req.URL.Path, "/latest") {
+					mediaType = specsv1.MediaTypeImageIndex
+				}
+				rw.Header().Set("Content-Type", mediaType)
+				_, _ = rw.Write(manifest)
+
+			case strings.HasPrefix(req.URL.Path, repositoryPath+"blobs/"):
+				blob, ok := blobs[digestpkg.Digest(strings.TrimPrefix(req.URL.Path, repositoryPath+"blobs/"))]
+				if !ok {
+					rw.WriteHeader(http.StatusNotFound)
+					return
+				}
+				serveRange(rw, req, blob)
+
+			default:
+				rw.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	})
+
+	AfterEach(func() {
+		registry.Close()
+	})
+
+	It("fetches the manifest for the platform from the OCI image index", func() {
+		layerSource := newLayerSource()
+		manifest, err := layerSource.Manifest(logger)
+		Expect(err).NotTo(HaveOccurred())
+
+		contents, _, err := manifest.Manifest(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(contents).To(Equal(armManifest))
+	})
+
+	Context("when no image matches the platform", func() {
+		BeforeEach(func() {
+			platform = source.Platform{OS: "linux", Architecture: "s390x"}
+		})
+
+		It("fails without retrying", func() {
+			layerSource := newLayerSource()
+			_, err := layerSource.Manifest(logger)
+			Expect(err).To(MatchError(ContainSubstring("no image found for platform linux/s390x, available platforms: linux/amd64, linux/arm/v7")))
+
+			Expect(manifestRequests()).To(HaveLen(1))
+			Expect(logger.LogMessages()).NotTo(ContainElement("test-layer-source.fetching-image-manifest.backing-off-get-image"))
+		})
+	})
+})
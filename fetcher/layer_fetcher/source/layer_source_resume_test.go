@@ -0,0 +1,526 @@
+package source_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/grootfs/fetcher/layer_fetcher/source"
+	"code.cloudfoundry.org/grootfs/fetcher/progress"
+	"code.cloudfoundry.org/grootfs/fetcher/ratelimit"
+	"code.cloudfoundry.org/grootfs/groot"
+	"code.cloudfoundry.org/grootfs/store/locksmith"
+	"code.cloudfoundry.org/grootfs/store/token_cache"
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/containers/image/types"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	digestpkg "github.com/opencontainers/go-digest"
+)
+
+var _ = Describe("Layer source: resumable downloads", func() {
+	var (
+		logger    *lagertest.TestLogger
+		registry  *httptest.Server
+		tmpDir    string
+		oldTmpDir string
+
+		blob      []byte
+		layerInfo groot.LayerInfo
+
+		requestsMutex *sync.Mutex
+		rangeRequests []string
+		handleBlob    func(rw http.ResponseWriter, req *http.Request, attempt int)
+		handlePing    http.HandlerFunc
+	)
+
+	newLayerSourceWithContext := func(systemContext types.SystemContext, retries int) source.LayerSource {
+		baseImageURL, err := url.Parse(fmt.Sprintf("docker://%s/groot/resumable:latest", strings.TrimPrefix(registry.URL, "https://")))
+		Expect(err).NotTo(HaveOccurred())
+
+		return source.NewLayerSource(systemContext, false, true, 0, baseImageURL).
+			WithDownloadRetries(retries, time.Millisecond)
+	}
+
+	newLayerSource := func(retries int) source.LayerSource {
+		return newLayerSourceWithContext(types.SystemContext{DockerCertPath: registryCertsDir(registry, tmpDir)}, retries)
+	}
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test-layer-source")
+
+		var err error
+		tmpDir, err = ioutil.TempDir("", "resumable-downloads")
+		Expect(err).NotTo(HaveOccurred())
+		oldTmpDir = os.Getenv("TMPDIR")
+		Expect(os.Setenv("TMPDIR", tmpDir)).To(Succeed())
+
+		var layer []byte
+		blob, layer = randomLayer(256 * 1024)
+		layerInfo = groot.LayerInfo{
+			BlobID:    digestpkg.FromBytes(blob).String(),
+			DiffID:    digestpkg.FromBytes(layer).Hex(),
+			Size:      int64(len(blob)),
+			MediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip",
+		}
+
+		requestsMutex = &sync.Mutex{}
+		rangeRequests = []string{}
+		handleBlob = func(rw http.ResponseWriter, req *http.Request, attempt int) {
+			serveRange(rw, req, blob)
+		}
+		handlePing = func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(http.StatusOK)
+		}
+
+		registry = httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/v2/" {
+				handlePing(rw, req)
+				return
+			}
+
+			if !strings.HasPrefix(req.URL.Path, "/v2/groot/resumable/blobs/") {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			requestsMutex.Lock()
+			rangeRequests = append(rangeRequests, req.Header.Get("Range"))
+			attempt := len(rangeRequests)
+			requestsMutex.Unlock()
+
+			handleBlob(rw, req, attempt)
+		}))
+	})
+
+	AfterEach(func() {
+		registry.Close()
+		Expect(os.Setenv("TMPDIR", oldTmpDir)).To(Succeed())
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("downloads the blob", func() {
+		layerSource := newLayerSource(2)
+		blobPath, size, err := layerSource.Blob(logger, layerInfo)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(size).To(Equal(int64(len(blob))))
+		Expect(blobPath).To(BeAnExistingFile())
+		Expect(rangeRequests).To(Equal([]string{""}))
+	})
+
+	It("removes the partial blob once it is downloaded", func() {
+		layerSource := newLayerSource(2)
+		_, _, err := layerSource.Blob(logger, layerInfo)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(filepath.Glob(filepath.Join(tmpDir, source.PartialBlobPrefix+"*"))).To(BeEmpty())
+	})
+
+	It("reports the download progress", func() {
+		output := bytes.NewBuffer([]byte{})
+		layerSource := newLayerSource(2).WithProgressReporter(progress.NewReporter(output).WithInterval(0))
+		_, _, err := layerSource.Blob(logger, layerInfo)
+		Expect(err).NotTo(HaveOccurred())
+
+		events := progressEvents(output)
+		Expect(len(events)).To(BeNumerically(">", 2))
+		Expect(events[0]).To(Equal(progress.Event{Digest: layerInfo.BlobID, DownloadedBytes: 0, TotalBytes: int64(len(blob))}))
+		Expect(events[len(events)-1]).To(Equal(progress.Event{Digest: layerInfo.BlobID, DownloadedBytes: int64(len(blob)), TotalBytes: int64(len(blob)), Done: true}))
+	})
+
+	It("limits the download rate", func() {
+		layerSource := newLayerSource(2).WithRateLimiter(ratelimit.NewLimiter(128 * 1024))
+		start := time.Now()
+		_, _, err := layerSource.Blob(logger, layerInfo)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(time.Since(start)).To(BeNumerically(">=", 900*time.Millisecond))
+	})
+
+	Context("when the download is interrupted", func() {
+		BeforeEach(func() {
+			handleBlob = func(rw http.ResponseWriter, req *http.Request, attempt int) {
+				if attempt == 1 {
+					interruptedBlob(rw, blob, len(blob)/2)
+					return
+				}
+				serveRange(rw, req, blob)
+			}
+		})
+
+		It("resumes it from where it stopped", func() {
+			layerSource := newLayerSource(2)
+			_, _, err := layerSource.Blob(logger, layerInfo)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(rangeRequests).To(HaveLen(2))
+			Expect(rangeRequests[0]).To(BeEmpty())
+			Expect(rangeRequests[1]).To(MatchRegexp(`^bytes=[1-9][0-9]*-$`))
+		})
+
+		It("reports the progress from where it resumed", func() {
+			output := bytes.NewBuffer([]byte{})
+			layerSource := newLayerSource(2).WithProgressReporter(progress.NewReporter(output).WithInterval(0))
+			_, _, err := layerSource.Blob(logger, layerInfo)
+			Expect(err).NotTo(HaveOccurred())
+
+			events := progressEvents(output)
+			for i := 1; i < len(events); i++ {
+				Expect(events[i].DownloadedBytes).To(BeNumerically(">=", events[i-1].DownloadedBytes))
+			}
+			Expect(events[len(events)-1].Done).To(BeTrue())
+		})
+
+		Context("and there are no retries left", func() {
+			It("keeps the partial blob for the next create to resume", func() {
+				layerSource := newLayerSource(0)
+				_, _, err := layerSource.Blob(logger, layerInfo)
+				Expect(err).To(HaveOccurred())
+
+				partialBlobs, err := filepath.Glob(filepath.Join(tmpDir, source.PartialBlobPrefix+"*"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(partialBlobs).To(HaveLen(1))
+
+				layerSource = newLayerSource(0)
+				_, _, err = layerSource.Blob(logger, layerInfo)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(rangeRequests[1]).To(MatchRegexp(`^bytes=[1-9][0-9]*-$`))
+			})
+		})
+
+		Context("and the registry doesn't support range requests", func() {
+			BeforeEach(func() {
+				handleBlob = func(rw http.ResponseWriter, req *http.Request, attempt int) {
+					if attempt == 1 {
+						interruptedBlob(rw, blob, len(blob)/2)
+						return
+					}
+					rw.WriteHeader(http.StatusOK)
+					_, _ = rw.Write(blob)
+				}
+			})
+
+			It("downloads the whole blob again", func() {
+				layerSource := newLayerSource(2)
+				_, size, err := layerSource.Blob(logger, layerInfo)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(size).To(Equal(int64(len(blob))))
+				Expect(logger.LogMessages()).To(ContainElement(ContainSubstring("range-not-supported")))
+			})
+		})
+
+		Context("and the registry is insecure", func() {
+			It("doesn't resume it", func() {
+				layerSource := newLayerSourceWithContext(types.SystemContext{DockerInsecureSkipTLSVerify: true}, 2)
+				_, _, err := layerSource.Blob(logger, layerInfo)
+				Expect(err).To(HaveOccurred())
+
+				Expect(rangeRequests).To(Equal([]string{""}))
+				Expect(filepath.Glob(filepath.Join(tmpDir, source.PartialBlobPrefix+"*"))).To(BeEmpty())
+			})
+		})
+	})
+
+	Context("when the partial blob is corrupted", func() {
+		BeforeEach(func() {
+			partialPath := filepath.Join(tmpDir, source.PartialBlobPrefix+strings.Replace(layerInfo.BlobID, ":", "-", 1))
+			Expect(ioutil.WriteFile(partialPath, []byte("corrupted"), 0600)).To(Succeed())
+		})
+
+		It("fails and removes the partial blob", func() {
+			layerSource := newLayerSource(0)
+			_, _, err := layerSource.Blob(logger, layerInfo)
+			Expect(err).To(HaveOccurred())
+
+			Expect(filepath.Glob(filepath.Join(tmpDir, source.PartialBlobPrefix+"*"))).To(BeEmpty())
+		})
+	})
+
+	Context("when the registry keeps failing", func() {
+		BeforeEach(func() {
+			handleBlob = func(rw http.ResponseWriter, req *http.Request, attempt int) {
+				rw.WriteHeader(http.StatusServiceUnavailable)
+			}
+		})
+
+		It("retries the configured number of times", func() {
+			layerSource := newLayerSource(3)
+			_, _, err := layerSource.Blob(logger, layerInfo)
+			Expect(err).To(MatchError(ContainSubstring("unexpected http code 503")))
+
+			Expect(rangeRequests).To(HaveLen(4))
+			Expect(logger.LogMessages()).To(ContainElement("test-layer-source.streaming-blob.backing-off-get-blob"))
+		})
+	})
+
+	Context("when the registry is rate limiting", func() {
+		BeforeEach(func() {
+			handleBlob = func(rw http.ResponseWriter, req *http.Request, attempt int) {
+				if attempt == 1 {
+					rw.WriteHeader(http.StatusTooManyRequests)
+					return
+				}
+				serveRange(rw, req, blob)
+			}
+		})
+
+		It("retries", func() {
+			layerSource := newLayerSource(1)
+			_, _, err := layerSource.Blob(logger, layerInfo)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(rangeRequests).To(HaveLen(2))
+		})
+	})
+
+	Context("when the registry rejects the request", func() {
+		BeforeEach(func() {
+			handleBlob = func(rw http.ResponseWriter, req *http.Request, attempt int) {
+				rw.WriteHeader(http.StatusNotFound)
+			}
+		})
+
+		It("fails without retrying", func() {
+			layerSource := newLayerSource(3)
+			_, _, err := layerSource.Blob(logger, layerInfo)
+			Expect(err).To(MatchError(ContainSubstring("unexpected http code 404")))
+
+			Expect(rangeRequests).To(HaveLen(1))
+			Expect(logger.LogMessages()).NotTo(ContainElement("test-layer-source.streaming-blob.backing-off-get-blob"))
+		})
+	})
+
+	Context("when the downloaded blob is corrupted", func() {
+		BeforeEach(func() {
+			handleBlob = func(rw http.ResponseWriter, req *http.Request, attempt int) {
+				corrupted := append([]byte{}, blob...)
+				corrupted[len(corrupted)/2] ^= 0xff
+				serveRange(rw, req, corrupted)
+			}
+		})
+
+		It("fails without retrying", func() {
+			layerSource := newLayerSource(3)
+			_, _, err := layerSource.Blob(logger, layerInfo)
+			Expect(err).To(HaveOccurred())
+
+			Expect(rangeRequests).To(HaveLen(1))
+		})
+	})
+
+	Context("when there are abandoned partial blobs", func() {
+		var stalePath, recentPath string
+
+		BeforeEach(func() {
+			stalePath = filepath.Join(tmpDir, source.PartialBlobPrefix+"sha256-stale")
+			Expect(ioutil.WriteFile(stalePath, []byte("stale"), 0600)).To(Succeed())
+			past := time.Now().Add(-source.PartialBlobMaxAge - time.Hour)
+			Expect(os.Chtimes(stalePath, past, past)).To(Succeed())
+
+			recentPath = filepath.Join(tmpDir, source.PartialBlobPrefix+"sha256-recent")
+			Expect(ioutil.WriteFile(recentPath, []byte("recent"), 0600)).To(Succeed())
+		})
+
+		It("removes the old ones when fetching the manifest", func() {
+			layerSource := newLayerSource(0)
+			// the registry serves no manifests, which are only fetched once
+			// the partial blobs are pruned
+			_, err := layerSource.Manifest(logger)
+			Expect(err).To(HaveOccurred())
+
+			Expect(stalePath).NotTo(BeAnExistingFile())
+			Expect(recentPath).To(BeAnExistingFile())
+		})
+
+		It("doesn't look for them when downloading blobs", func() {
+			layerSource := newLayerSource(0)
+			_, _, err := layerSource.Blob(logger, layerInfo)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(stalePath).To(BeAnExistingFile())
+		})
+	})
+
+	Context("when the registry requires a token", func() {
+		var tokenRequests int
+
+		BeforeEach(func() {
+			tokenRequests = 0
+
+			challenge := func(rw http.ResponseWriter) {
+				rw.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="groot-registry"`, registry.URL))
+				rw.WriteHeader(http.StatusUnauthorized)
+			}
+			handlePing = func(rw http.ResponseWriter, req *http.Request) {
+				challenge(rw)
+			}
+			handleBlob = func(rw http.ResponseWriter, req *http.Request, attempt int) {
+				if req.Header.Get("Authorization") != "Bearer a-token" {
+					challenge(rw)
+					return
+				}
+				serveRange(rw, req, blob)
+			}
+
+			blobHandler := registry.Config.Handler
+			registry.Config.Handler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != "/token" {
+					blobHandler.ServeHTTP(rw, req)
+					return
+				}
+
+				query := req.URL.Query()
+				if query.Get("service") != "groot-registry" || query.Get("scope") != "repository:groot/resumable:pull" {
+					rw.WriteHeader(http.StatusBadRequest)
+					return
+				}
+
+				requestsMutex.Lock()
+				tokenRequests++
+				requestsMutex.Unlock()
+				_, _ = rw.Write([]byte(`{"token": "a-token", "expires_in": 300}`))
+			})
+		})
+
+		It("authenticates with the token", func() {
+			layerSource := newLayerSource(0)
+			_, _, err := layerSource.Blob(logger, layerInfo)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rangeRequests).To(HaveLen(1))
+		})
+
+		Context("when only the blob endpoint sends the challenge", func() {
+			BeforeEach(func() {
+				handlePing = func(rw http.ResponseWriter, req *http.Request) {
+					rw.WriteHeader(http.StatusOK)
+				}
+			})
+
+			It("authenticates with the token", func() {
+				layerSource := newLayerSource(0)
+				_, _, err := layerSource.Blob(logger, layerInfo)
+				Expect(err).NotTo(HaveOccurred())
+			})
+		})
+
+		Context("when the credentials are rejected", func() {
+			BeforeEach(func() {
+				tokenHandler := registry.Config.Handler
+				registry.Config.Handler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+					if req.URL.Path == "/token" {
+						rw.WriteHeader(http.StatusUnauthorized)
+						return
+					}
+					tokenHandler.ServeHTTP(rw, req)
+				})
+			})
+
+			It("returns an error", func() {
+				layerSource := newLayerSource(0)
+				_, _, err := layerSource.Blob(logger, layerInfo)
+				Expect(err).To(MatchError(ContainSubstring("unable to retrieve auth token: invalid username/password")))
+				Expect(rangeRequests).To(BeEmpty())
+			})
+		})
+
+		Context("when there is a token cache", func() {
+			var tokenCache *token_cache.TokenCache
+
+			BeforeEach(func() {
+				tokenCache = token_cache.NewTokenCache(
+					filepath.Join(tmpDir, "registry-tokens"),
+					locksmith.NewExclusiveFileSystem(filepath.Join(tmpDir, "locks")),
+				)
+			})
+
+			It("reuses the token in other layer sources", func() {
+				for i := 0; i < 2; i++ {
+					layerSource := newLayerSource(0).WithTokenCache(tokenCache)
+					_, _, err := layerSource.Blob(logger, layerInfo)
+					Expect(err).NotTo(HaveOccurred())
+				}
+
+				Expect(tokenRequests).To(Equal(1))
+			})
+		})
+	})
+})
+
+func progressEvents(output *bytes.Buffer) []progress.Event {
+	events := []progress.Event{}
+	decoder := json.NewDecoder(output)
+	for decoder.More() {
+		var event progress.Event
+		Expect(decoder.Decode(&event)).To(Succeed())
+		events = append(events, event)
+	}
+	return events
+}
+
+// randomLayer returns a gzipped layer and the layer tar
+func randomLayer(size int) ([]byte, []byte) {
+	contents := make([]byte, size)
+	_, err := rand.Read(contents)
+	Expect(err).NotTo(HaveOccurred())
+
+	layer := bytes.NewBuffer([]byte{})
+	tarWriter := tar.NewWriter(layer)
+	Expect(tarWriter.WriteHeader(&tar.Header{Name: "random", Mode: 0644, Size: int64(size)})).To(Succeed())
+	_, err = tarWriter.Write(contents)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(tarWriter.Close()).To(Succeed())
+
+	blob := bytes.NewBuffer([]byte{})
+	gzipWriter := gzip.NewWriter(blob)
+	_, err = gzipWriter.Write(layer.Bytes())
+	Expect(err).NotTo(HaveOccurred())
+	Expect(gzipWriter.Close()).To(Succeed())
+
+	return blob.Bytes(), layer.Bytes()
+}
+
+func serveRange(rw http.ResponseWriter, req *http.Request, blob []byte) {
+	var start int
+	if _, err := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-", &start); err != nil {
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write(blob)
+		return
+	}
+
+	rw.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(blob)-1, len(blob)))
+	rw.WriteHeader(http.StatusPartialContent)
+	_, _ = rw.Write(blob[start:])
+}
+
+// registryCertsDir writes the CA of the TLS registry to a certs directory
+// under the parent directory
+func registryCertsDir(registry *httptest.Server, parentDir string) string {
+	certsDir := filepath.Join(parentDir, "certs")
+	Expect(os.MkdirAll(certsDir, 0755)).To(Succeed())
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: registry.Certificate().Raw})
+	Expect(ioutil.WriteFile(filepath.Join(certsDir, "ca.crt"), ca, 0644)).To(Succeed())
+
+	return certsDir
+}
+
+// interruptedBlob drops the connection after writing part of the blob
+func interruptedBlob(rw http.ResponseWriter, blob []byte, written int) {
+	rw.Header().Set("Content-Length", fmt.Sprintf("%d", len(blob)))
+	rw.WriteHeader(http.StatusOK)
+	_, _ = rw.Write(blob[:written])
+	rw.(http.Flusher).Flush()
+	panic(http.ErrAbortHandler)
+}
@@ -0,0 +1,153 @@
+package source_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/grootfs/fetcher/layer_fetcher/source"
+	"code.cloudfoundry.org/grootfs/groot"
+	"code.cloudfoundry.org/grootfs/store/blob_cache"
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/containers/image/types"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	digestpkg "github.com/opencontainers/go-digest"
+)
+
+var _ = Describe("Layer source: streamed blobs", func() {
+	var (
+		logger    *lagertest.TestLogger
+		registry  *httptest.Server
+		tmpDir    string
+		oldTmpDir string
+
+		blob      []byte
+		layer     []byte
+		layerInfo groot.LayerInfo
+	)
+
+	newLayerSource := func() source.LayerSource {
+		baseImageURL, err := url.Parse(fmt.Sprintf("docker://%s/groot/streamed:latest", strings.TrimPrefix(registry.URL, "https://")))
+		Expect(err).NotTo(HaveOccurred())
+
+		systemContext := types.SystemContext{DockerInsecureSkipTLSVerify: true}
+		return source.NewLayerSource(systemContext, false, true, 0, baseImageURL).WithDownloadRetries(0, 0)
+	}
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test-layer-source")
+
+		var err error
+		tmpDir, err = ioutil.TempDir("", "streamed-blobs")
+		Expect(err).NotTo(HaveOccurred())
+		oldTmpDir = os.Getenv("TMPDIR")
+		Expect(os.Setenv("TMPDIR", tmpDir)).To(Succeed())
+
+		blob, layer = randomLayer(64 * 1024)
+		layerInfo = groot.LayerInfo{
+			BlobID:    digestpkg.FromBytes(blob).String(),
+			DiffID:    digestpkg.FromBytes(layer).Hex(),
+			Size:      int64(len(blob)),
+			MediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip",
+		}
+
+		registry = httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			switch {
+			case req.URL.Path == "/v2/":
+				rw.WriteHeader(http.StatusOK)
+			case strings.HasPrefix(req.URL.Path, "/v2/groot/streamed/blobs/"):
+				rw.Header().Set("Content-Length", fmt.Sprintf("%d", len(blob)))
+				_, _ = rw.Write(blob)
+			default:
+				rw.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	})
+
+	AfterEach(func() {
+		registry.Close()
+		Expect(os.Setenv("TMPDIR", oldTmpDir)).To(Succeed())
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("streams the uncompressed blob without writing it to disk", func() {
+		layerSource := newLayerSource()
+		stream, _, err := layerSource.BlobStream(logger, layerInfo)
+		Expect(err).NotTo(HaveOccurred())
+		defer stream.Close()
+
+		contents, err := ioutil.ReadAll(stream)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(contents).To(Equal(layer))
+		Expect(stream.Verify()).To(Succeed())
+
+		Expect(ioutil.ReadDir(tmpDir)).To(BeEmpty())
+	})
+
+	It("verifies blobs that were only partially read", func() {
+		layerSource := newLayerSource()
+		stream, _, err := layerSource.BlobStream(logger, layerInfo)
+		Expect(err).NotTo(HaveOccurred())
+		defer stream.Close()
+
+		_, err = stream.Read(make([]byte, 512))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stream.Verify()).To(Succeed())
+	})
+
+	Context("when the DiffID doesn't match", func() {
+		BeforeEach(func() {
+			layerInfo.DiffID = digestpkg.FromString("another layer").Hex()
+		})
+
+		It("fails verification at the end of the stream", func() {
+			layerSource := newLayerSource()
+			stream, _, err := layerSource.BlobStream(logger, layerInfo)
+			Expect(err).NotTo(HaveOccurred())
+			defer stream.Close()
+
+			_, err = ioutil.ReadAll(stream)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stream.Verify()).To(MatchError(ContainSubstring("diffID digest mismatch")))
+		})
+	})
+
+	Context("when there is a blob cache", func() {
+		var blobCache *blob_cache.BlobCache
+
+		BeforeEach(func() {
+			blobCache = blob_cache.NewBlobCache(filepath.Join(tmpDir, "blob-cache"), 1024*1024)
+		})
+
+		It("caches the blob once it is verified", func() {
+			layerSource := newLayerSource().WithBlobCache(blobCache)
+			stream, _, err := layerSource.BlobStream(logger, layerInfo)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stream.Verify()).To(Succeed())
+			Expect(stream.Close()).To(Succeed())
+
+			_, _, ok, err := blobCache.Open(layerInfo.BlobID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeTrue())
+		})
+
+		It("doesn't cache blobs that fail verification", func() {
+			layerInfo.DiffID = digestpkg.FromString("another layer").Hex()
+			layerSource := newLayerSource().WithBlobCache(blobCache)
+			stream, _, err := layerSource.BlobStream(logger, layerInfo)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stream.Verify()).NotTo(Succeed())
+			Expect(stream.Close()).To(Succeed())
+
+			_, _, ok, err := blobCache.Open(layerInfo.BlobID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeFalse())
+		})
+	})
+})
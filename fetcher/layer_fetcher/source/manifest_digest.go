@@ -0,0 +1,71 @@
+package source // import "code.cloudfoundry.org/grootfs/fetcher/layer_fetcher/source"
+
+import (
+	"net/url"
+	"strings"
+
+	manifestpkg "github.com/containers/image/manifest"
+	"github.com/containers/image/types"
+	digestpkg "github.com/opencontainers/go-digest"
+	errorspkg "github.com/pkg/errors"
+)
+
+// digestedImage is an image that knows the manifest its reference resolved
+// to, and its digest
+type digestedImage struct {
+	types.Image
+	manifestDigest     digestpkg.Digest
+	referencedManifest []byte
+}
+
+func (i digestedImage) ManifestDigest() digestpkg.Digest {
+	return i.manifestDigest
+}
+
+func (i digestedImage) ReferencedManifest() []byte {
+	return i.referencedManifest
+}
+
+// PinnedDigest returns the digest of a `docker://host/repo@sha256:...`
+// reference.
+func PinnedDigest(baseImageURL *url.URL) (digestpkg.Digest, bool, error) {
+	if baseImageURL.Scheme != "docker" {
+		return "", false, nil
+	}
+
+	i := strings.LastIndex(baseImageURL.Path, "@")
+	if i == -1 {
+		return "", false, nil
+	}
+
+	pinnedDigest, err := digestpkg.Parse(baseImageURL.Path[i+1:])
+	if err != nil {
+		return "", false, errorspkg.Wrapf(err, "invalid digest in image reference `%s`", baseImageURL)
+	}
+
+	return pinnedDigest, true, nil
+}
+
+// resolveManifestDigest returns the digest of the manifest, which must match the
+// digest the reference is pinned to, if any.
+func resolveManifestDigest(baseImageURL *url.URL, manifest []byte) (digestpkg.Digest, error) {
+	actualDigest, err := manifestpkg.Digest(manifest)
+	if err != nil {
+		return "", errorspkg.Wrap(err, "calculating manifest digest")
+	}
+
+	pinnedDigest, ok, err := PinnedDigest(baseImageURL)
+	if err != nil || !ok {
+		return actualDigest, err
+	}
+
+	matches, err := manifestpkg.MatchesDigest(manifest, pinnedDigest)
+	if err != nil {
+		return "", errorspkg.Wrap(err, "checking manifest digest")
+	}
+	if !matches {
+		return "", errorspkg.Errorf("manifest digest mismatch: expected %s, got %s", pinnedDigest, actualDigest)
+	}
+
+	return pinnedDigest, nil
+}
@@ -0,0 +1,133 @@
+package source_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	"code.cloudfoundry.org/grootfs/fetcher/layer_fetcher"
+	"code.cloudfoundry.org/grootfs/fetcher/layer_fetcher/source"
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/containers/image/types"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	digestpkg "github.com/opencontainers/go-digest"
+)
+
+var _ = Describe("Manifest digests", func() {
+	var (
+		logger         *lagertest.TestLogger
+		registry       *httptest.Server
+		manifest       []byte
+		manifestDigest digestpkg.Digest
+	)
+
+	manifestFor := func(reference string) (layer_fetcher.DigestedManifest, error) {
+		baseImageURL, err := url.Parse(fmt.Sprintf("docker://%s/groot/pinned%s", strings.TrimPrefix(registry.URL, "https://"), reference))
+		Expect(err).NotTo(HaveOccurred())
+
+		layerSource := source.NewLayerSource(types.SystemContext{DockerInsecureSkipTLSVerify: true}, false, true, 0, baseImageURL).
+			WithDownloadRetries(0, 0)
+		image, err := layerSource.Manifest(logger)
+		if err != nil {
+			return nil, err
+		}
+
+		digestedManifest, ok := image.(layer_fetcher.DigestedManifest)
+		Expect(ok).To(BeTrue(), "the manifest doesn't have a digest")
+		return digestedManifest, nil
+	}
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test-layer-source")
+
+		config := []byte(`{"architecture": "amd64", "os": "linux", "rootfs": {"type": "layers", "diff_ids": []}}`)
+		configDigest := digestpkg.FromBytes(config)
+
+		var err error
+		manifest, err = json.Marshal(map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     "application/vnd.docker.distribution.manifest.v2+json",
+			"config": map[string]interface{}{
+				"mediaType": "application/vnd.docker.container.image.v1+json",
+				"size":      len(config),
+				"digest":    configDigest,
+			},
+			"layers": []interface{}{},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		manifestDigest = digestpkg.FromBytes(manifest)
+
+		registry = httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			switch {
+			case req.URL.Path == "/v2/":
+				rw.WriteHeader(http.StatusOK)
+			case strings.HasPrefix(req.URL.Path, "/v2/groot/pinned/manifests/"):
+				rw.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+				_, _ = rw.Write(manifest)
+			case req.URL.Path == "/v2/groot/pinned/blobs/"+configDigest.String():
+				_, _ = rw.Write(config)
+			default:
+				rw.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	})
+
+	AfterEach(func() {
+		registry.Close()
+	})
+
+	It("returns the digest of the manifest", func() {
+		image, err := manifestFor(":latest")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(image.ManifestDigest()).To(Equal(manifestDigest))
+	})
+
+	Context("when the reference is pinned to a digest", func() {
+		It("returns the pinned digest", func() {
+			image, err := manifestFor("@" + manifestDigest.String())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(image.ManifestDigest()).To(Equal(manifestDigest))
+		})
+
+		Context("and the registry serves another manifest", func() {
+			It("returns an error", func() {
+				otherDigest := digestpkg.FromString("another manifest")
+				_, err := manifestFor("@" + otherDigest.String())
+				Expect(err).To(MatchError(ContainSubstring(fmt.Sprintf("manifest digest mismatch: expected %s, got %s", otherDigest, manifestDigest))))
+			})
+		})
+	})
+
+	Describe("PinnedDigest", func() {
+		It("returns the digest of digest references", func() {
+			baseImageURL, err := url.Parse("docker:///busybox@" + digestpkg.FromString("busybox").String())
+			Expect(err).NotTo(HaveOccurred())
+
+			pinnedDigest, ok, err := source.PinnedDigest(baseImageURL)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			Expect(pinnedDigest).To(Equal(digestpkg.FromString("busybox")))
+		})
+
+		It("returns false for tag references", func() {
+			baseImageURL, err := url.Parse("docker:///busybox:latest")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, ok, err := source.PinnedDigest(baseImageURL)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeFalse())
+		})
+
+		It("returns an error for invalid digests", func() {
+			baseImageURL, err := url.Parse("docker:///busybox@sha256:not-a-digest")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, err = source.PinnedDigest(baseImageURL)
+			Expect(err).To(MatchError(ContainSubstring("invalid digest in image reference")))
+		})
+	})
+})
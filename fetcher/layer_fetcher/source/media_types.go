@@ -0,0 +1,79 @@
+package source // import "code.cloudfoundry.org/grootfs/fetcher/layer_fetcher/source"
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	manifestpkg "github.com/containers/image/manifest"
+	"github.com/klauspost/compress/zstd"
+	specsv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	errorspkg "github.com/pkg/errors"
+)
+
+const (
+	MediaTypeImageLayerZstd                 = "application/vnd.oci.image.layer.v1.tar+zstd"
+	MediaTypeImageLayerNonDistributableZstd = "application/vnd.oci.image.layer.nondistributable.v1.tar+zstd"
+	DockerV2Schema2UncompressedLayerType    = "application/vnd.docker.image.rootfs.diff.tar"
+)
+
+// Decompressor turns a layer blob into the uncompressed layer tar
+type Decompressor func(blob io.Reader) (io.ReadCloser, error)
+
+var (
+	decompressorsMutex = &sync.RWMutex{}
+	decompressors      = map[string]Decompressor{
+		// V1 images don't have a media type and are always gzipped
+		"": GzipDecompressor,
+		manifestpkg.DockerV2Schema2LayerMediaType:        GzipDecompressor,
+		manifestpkg.DockerV2Schema2ForeignLayerMediaType: GzipDecompressor,
+		specsv1.MediaTypeImageLayerGzip:                  GzipDecompressor,
+		specsv1.MediaTypeImageLayerNonDistributableGzip:  GzipDecompressor,
+
+		MediaTypeImageLayerZstd:                 ZstdDecompressor,
+		MediaTypeImageLayerNonDistributableZstd: ZstdDecompressor,
+
+		DockerV2Schema2UncompressedLayerType:        UncompressedDecompressor,
+		specsv1.MediaTypeImageLayer:                 UncompressedDecompressor,
+		specsv1.MediaTypeImageLayerNonDistributable: UncompressedDecompressor,
+	}
+)
+
+// RegisterDecompressor makes blobs of the given media type fetchable,
+// replacing any decompressor previously registered for it.
+func RegisterDecompressor(mediaType string, decompressor Decompressor) {
+	decompressorsMutex.Lock()
+	defer decompressorsMutex.Unlock()
+
+	decompressors[mediaType] = decompressor
+}
+
+func decompressorFor(mediaType string) (Decompressor, error) {
+	decompressorsMutex.RLock()
+	defer decompressorsMutex.RUnlock()
+
+	decompressor, ok := decompressors[mediaType]
+	if !ok {
+		return nil, errorspkg.Errorf("unsupported layer media type `%s`", mediaType)
+	}
+
+	return decompressor, nil
+}
+
+func GzipDecompressor(blob io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(blob)
+}
+
+func ZstdDecompressor(blob io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(blob, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+
+	return decoder.IOReadCloser(), nil
+}
+
+func UncompressedDecompressor(blob io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(blob), nil
+}
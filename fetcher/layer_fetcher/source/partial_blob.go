@@ -0,0 +1,120 @@
+package source // import "code.cloudfoundry.org/grootfs/fetcher/layer_fetcher/source"
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	errorspkg "github.com/pkg/errors"
+)
+
+const PartialBlobPrefix = "blob-partial-"
+
+// PartialBlobMaxAge is how long an untouched partial blob is kept for a later
+// create to resume. Older ones are assumed to be abandoned, e.g. because the
+// image was deleted or the create was killed.
+const PartialBlobMaxAge = 24 * time.Hour
+
+// partialBlob is a blob being downloaded into the store's tmp dir. It is kept
+// on disk when the download fails, so that the next attempt, or the next
+// create, only fetches the rest of the blob.
+type partialBlob struct {
+	*os.File
+	// private partial blobs can't be resumed by other creates
+	private bool
+}
+
+func openPartialBlob(digest string) (*partialBlob, error) {
+	path := filepath.Join(os.TempDir(), PartialBlobPrefix+strings.Replace(digest, ":", "-", 1))
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errorspkg.Wrap(err, "opening partial blob")
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+
+		// another create is downloading the same blob, the download can't be
+		// shared with it
+		file, err = ioutil.TempFile("", PartialBlobPrefix)
+		if err != nil {
+			return nil, errorspkg.Wrap(err, "creating partial blob")
+		}
+		return &partialBlob{File: file, private: true}, nil
+	}
+
+	return &partialBlob{File: file}, nil
+}
+
+// prunePartialBlobs removes the abandoned partial blobs no create is
+// downloading, as they would otherwise stay in the tmp dir until the same blob
+// is downloaded again
+func prunePartialBlobs(logger lager.Logger) {
+	paths, err := filepath.Glob(filepath.Join(os.TempDir(), PartialBlobPrefix+"*"))
+	if err != nil {
+		logger.Error("listing-partial-blobs-failed", err)
+		return
+	}
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || time.Since(info.ModTime()) < PartialBlobMaxAge {
+			continue
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+
+		if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == nil {
+			logger.Debug("removing-stale-partial-blob", lager.Data{"path": path})
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				logger.Error("removing-stale-partial-blob-failed", err, lager.Data{"path": path})
+			}
+		}
+		file.Close()
+	}
+}
+
+func (p *partialBlob) size() (int64, error) {
+	return p.Seek(0, io.SeekEnd)
+}
+
+func (p *partialBlob) restart() error {
+	if err := p.Truncate(0); err != nil {
+		return errorspkg.Wrap(err, "truncating partial blob")
+	}
+
+	_, err := p.Seek(0, io.SeekStart)
+	return err
+}
+
+// release keeps the partial blob on disk for the next create to resume
+func (p *partialBlob) release() error {
+	if p.private {
+		return p.remove()
+	}
+
+	return p.File.Close()
+}
+
+// remove deletes the partial blob once it is complete or known to be corrupt
+func (p *partialBlob) remove() error {
+	p.File.Close()
+	return os.Remove(p.Name())
+}
+
+// downloadedBlob is a complete blob, removed from disk when it is closed
+type downloadedBlob struct {
+	*partialBlob
+}
+
+func (d downloadedBlob) Close() error {
+	return d.remove()
+}
@@ -0,0 +1,93 @@
+package source // import "code.cloudfoundry.org/grootfs/fetcher/layer_fetcher/source"
+
+import (
+	"encoding/json"
+	"runtime"
+	"strings"
+
+	manifestpkg "github.com/containers/image/manifest"
+	digestpkg "github.com/opencontainers/go-digest"
+	specsv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	errorspkg "github.com/pkg/errors"
+)
+
+type Platform struct {
+	OS           string
+	Architecture string
+	Variant      string
+}
+
+// ParsePlatform parses a platform in the `os/arch[/variant]` format. An
+// empty string is parsed as the platform grootfs is running on.
+func ParsePlatform(platform string) (Platform, error) {
+	if platform == "" {
+		return Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}, nil
+	}
+
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return Platform{}, errorspkg.Errorf("invalid platform `%s`: expected os/arch[/variant]", platform)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return Platform{}, errorspkg.Errorf("invalid platform `%s`: expected os/arch[/variant]", platform)
+		}
+	}
+
+	parsed := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		parsed.Variant = parts[2]
+	}
+
+	return parsed, nil
+}
+
+func (p Platform) String() string {
+	platform := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		platform += "/" + p.Variant
+	}
+
+	return platform
+}
+
+// matches ignores the variant of the candidate when none was requested
+func (p Platform) matches(candidate specsv1.Platform) bool {
+	if p.OS != candidate.OS || p.Architecture != candidate.Architecture {
+		return false
+	}
+
+	return p.Variant == "" || p.Variant == candidate.Variant
+}
+
+func isManifestList(mimeType string) bool {
+	return mimeType == manifestpkg.DockerV2ListMediaType || mimeType == specsv1.MediaTypeImageIndex
+}
+
+// chooseInstance returns the digest of the manifest for the platform from a
+// docker manifest list or an OCI image index. Both share the same layout.
+func chooseInstance(manifestList []byte, platform Platform) (digestpkg.Digest, error) {
+	var index specsv1.Index
+	if err := json.Unmarshal(manifestList, &index); err != nil {
+		return "", errorspkg.Wrap(err, "parsing manifest list")
+	}
+
+	availablePlatforms := []string{}
+	for _, descriptor := range index.Manifests {
+		if descriptor.Platform == nil {
+			continue
+		}
+
+		if platform.matches(*descriptor.Platform) {
+			return descriptor.Digest, nil
+		}
+
+		availablePlatforms = append(availablePlatforms, Platform{
+			OS:           descriptor.Platform.OS,
+			Architecture: descriptor.Platform.Architecture,
+			Variant:      descriptor.Platform.Variant,
+		}.String())
+	}
+
+	return "", errorspkg.Errorf("no image found for platform %s, available platforms: %s", platform, strings.Join(availablePlatforms, ", "))
+}
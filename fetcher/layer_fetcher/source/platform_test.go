@@ -0,0 +1,37 @@
+package source_test
+
+import (
+	"runtime"
+
+	"code.cloudfoundry.org/grootfs/fetcher/layer_fetcher/source"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParsePlatform", func() {
+	It("parses os/arch", func() {
+		platform, err := source.ParsePlatform("linux/amd64")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(platform).To(Equal(source.Platform{OS: "linux", Architecture: "amd64"}))
+	})
+
+	It("parses os/arch/variant", func() {
+		platform, err := source.ParsePlatform("linux/arm/v7")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(platform).To(Equal(source.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}))
+		Expect(platform.String()).To(Equal("linux/arm/v7"))
+	})
+
+	It("defaults to the current platform", func() {
+		platform, err := source.ParsePlatform("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(platform).To(Equal(source.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}))
+	})
+
+	It("rejects malformed platforms", func() {
+		for _, platform := range []string{"linux", "linux/", "/amd64", "linux/arm/v7/extra"} {
+			_, err := source.ParsePlatform(platform)
+			Expect(err).To(MatchError(ContainSubstring("expected os/arch[/variant]")), platform)
+		}
+	})
+})
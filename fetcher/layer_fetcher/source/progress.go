@@ -0,0 +1,58 @@
+package source // import "code.cloudfoundry.org/grootfs/fetcher/layer_fetcher/source"
+
+import (
+	"io"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/containers/image/types"
+)
+
+// ProgressReporter is told how much of each layer has been downloaded
+type ProgressReporter interface {
+	LayerProgress(logger lager.Logger, digest string, downloadedBytes, totalBytes int64, done bool)
+}
+
+// meterBlob applies the rate limit to the blob stream and reports its
+// progress. The stream starts at offset when resuming a download.
+func (s *LayerSource) meterBlob(logger lager.Logger, blobInfo types.BlobInfo, offset int64, blob io.Reader) io.Reader {
+	if s.rateLimiter != nil {
+		blob = s.rateLimiter.Reader(blob)
+	}
+
+	if s.progressReporter == nil {
+		return blob
+	}
+
+	s.progressReporter.LayerProgress(logger, blobInfo.Digest.String(), offset, blobInfo.Size, false)
+	return &progressReader{
+		reader:     blob,
+		logger:     logger,
+		reporter:   s.progressReporter,
+		digest:     blobInfo.Digest.String(),
+		downloaded: offset,
+		total:      blobInfo.Size,
+	}
+}
+
+type progressReader struct {
+	reader     io.Reader
+	logger     lager.Logger
+	reporter   ProgressReporter
+	digest     string
+	downloaded int64
+	total      int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.downloaded += int64(n)
+	if n > 0 || err == io.EOF {
+		r.reporter.LayerProgress(r.logger, r.digest, r.downloaded, r.total, err == io.EOF)
+	}
+	return n, err
+}
+
+type meteredBlob struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,381 @@
+package source // import "code.cloudfoundry.org/grootfs/fetcher/layer_fetcher/source"
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/grootfs/store/token_cache"
+	"code.cloudfoundry.org/lager"
+	"github.com/containers/image/docker/reference"
+	"github.com/containers/image/pkg/docker/config"
+	"github.com/containers/image/pkg/tlsclientconfig"
+	"github.com/containers/image/types"
+	"github.com/docker/distribution/registry/client/auth/challenge"
+	errorspkg "github.com/pkg/errors"
+)
+
+const (
+	dockerHubRegistry  = "registry-1.docker.io"
+	systemCertsDirPath = "/etc/docker/certs.d"
+	// defaultTokenExpiry is how long tokens without `expires_in` are valid for,
+	// as per the docker token spec
+	defaultTokenExpiry = 60 * time.Second
+)
+
+// registryClient downloads blobs from a docker registry with range requests,
+// which containers/image can't make. It only authenticates as far as these
+// requests need to. Manifests, configs and any other blobs are fetched by
+// containers/image.
+type registryClient struct {
+	registry      string
+	repository    string
+	systemContext types.SystemContext
+	httpClient    *http.Client
+	tokenCache    *token_cache.TokenCache
+
+	// mutex guards token and pinged, as blobs can be fetched concurrently
+	mutex  *sync.Mutex
+	token  string
+	pinged bool
+}
+
+// blobRange is the part of a blob returned by the registry
+type blobRange struct {
+	body io.ReadCloser
+	// offset is where the body starts in the blob. It is 0 when the registry
+	// ignored the Range header.
+	offset int64
+	// size is the length of the body, or -1 when it is unknown
+	size int64
+}
+
+func newRegistryClient(endpoint Endpoint, dockerReference reference.Named, tokenCache *token_cache.TokenCache) (*registryClient, error) {
+	registry := reference.Domain(dockerReference)
+	if isDockerHub(registry) {
+		registry = dockerHubRegistry
+	}
+
+	tlsConfig := &tls.Config{}
+	if err := tlsclientconfig.SetupCertificates(certsDir(endpoint.SystemContext, reference.Domain(dockerReference)), tlsConfig); err != nil {
+		return nil, errorspkg.Wrap(err, "loading registry certificates")
+	}
+	transport := tlsclientconfig.NewTransport()
+	transport.TLSClientConfig = tlsConfig
+
+	return &registryClient{
+		registry:      registry,
+		repository:    reference.Path(dockerReference),
+		systemContext: endpoint.SystemContext,
+		httpClient:    &http.Client{Transport: transport},
+		tokenCache:    tokenCache,
+		mutex:         &sync.Mutex{},
+	}, nil
+}
+
+func certsDir(systemContext types.SystemContext, registry string) string {
+	if systemContext.DockerCertPath != "" {
+		return systemContext.DockerCertPath
+	}
+
+	if systemContext.DockerPerHostCertDirPath != "" {
+		return filepath.Join(systemContext.DockerPerHostCertDirPath, registry)
+	}
+
+	return filepath.Join(systemCertsDirPath, registry)
+}
+
+// GetBlobRange returns the blob from the offset onwards. Registries that
+// don't support range requests return the whole blob instead.
+func (c *registryClient) GetBlobRange(logger lager.Logger, digest string, offset int64) (blobRange, error) {
+	logger = logger.Session("get-blob-range", lager.Data{"digest": digest, "offset": offset})
+
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := c.get(logger, fmt.Sprintf("/v2/%s/blobs/%s", c.repository, digest), header)
+	if err != nil {
+		return blobRange{}, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if offset > 0 {
+			logger.Info("range-not-supported")
+		}
+		return blobRange{body: resp.Body, size: resp.ContentLength}, nil
+
+	case http.StatusPartialContent:
+		start, err := rangeStart(resp.Header.Get("Content-Range"))
+		if err != nil || start != offset {
+			resp.Body.Close()
+			return blobRange{}, errorspkg.Errorf("registry returned unexpected range `%s` for offset %d", resp.Header.Get("Content-Range"), offset)
+		}
+		return blobRange{body: resp.Body, offset: offset, size: resp.ContentLength}, nil
+
+	case http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		return blobRange{}, errRangeNotSatisfiable
+
+	default:
+		resp.Body.Close()
+		return blobRange{}, statusError{message: fmt.Sprintf("fetching blob %s", digest), statusCode: resp.StatusCode}
+	}
+}
+
+var errRangeNotSatisfiable = errorspkg.New("requested blob range not satisfiable")
+
+func (c *registryClient) get(logger lager.Logger, path string, header http.Header) (*http.Response, error) {
+	if err := c.ping(logger); err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	usedToken := c.token
+	c.mutex.Unlock()
+
+	resp, err := c.do(path, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	challenges := challenge.ResponseChallenges(resp)
+	resp.Body.Close()
+
+	logger.Debug("authenticating")
+	if err := c.authenticate(logger, challenges, usedToken); err != nil {
+		return nil, errorspkg.Wrap(err, "authenticating with registry")
+	}
+
+	return c.do(path, header)
+}
+
+// ping checks the API version endpoint before the first request, like
+// containers/image does. Registries send their auth challenge from there,
+// which is not necessarily the case for the other endpoints.
+func (c *registryClient) ping(logger lager.Logger) error {
+	c.mutex.Lock()
+	pinged := c.pinged
+	c.mutex.Unlock()
+	if pinged {
+		return nil
+	}
+
+	logger.Debug("pinging-registry")
+	resp, err := c.do("/v2/", http.Header{})
+	if err != nil {
+		return errorspkg.Wrap(err, "pinging registry")
+	}
+	challenges := challenge.ResponseChallenges(resp)
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized && hasBearerChallenge(challenges) {
+		logger.Debug("authenticating")
+		if err := c.authenticate(logger, challenges, ""); err != nil {
+			return errorspkg.Wrap(err, "authenticating with registry")
+		}
+	}
+
+	c.mutex.Lock()
+	c.pinged = true
+	c.mutex.Unlock()
+
+	return nil
+}
+
+func hasBearerChallenge(challenges []challenge.Challenge) bool {
+	for _, ch := range challenges {
+		if ch.Scheme == "bearer" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *registryClient) do(path string, header http.Header) (*http.Response, error) {
+	c.mutex.Lock()
+	token := c.token
+	c.mutex.Unlock()
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s%s", c.registry, path), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Docker-Distribution-API-Version", "registry/2.0")
+	if c.systemContext.DockerRegistryUserAgent != "" {
+		req.Header.Set("User-Agent", c.systemContext.DockerRegistryUserAgent)
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if username, password, err := c.credentials(); err != nil {
+		return nil, err
+	} else if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+
+	return c.httpClient.Do(req)
+}
+
+// authenticate gets a new token from the bearer challenge. The rejected
+// token is the one the registry just refused, which must not be reused.
+func (c *registryClient) authenticate(logger lager.Logger, challenges []challenge.Challenge, rejectedToken string) error {
+	for _, ch := range challenges {
+		if ch.Scheme != "bearer" {
+			continue
+		}
+
+		token, err := c.cachedBearerToken(logger, ch.Parameters["realm"], ch.Parameters["service"], rejectedToken)
+		if err != nil {
+			return err
+		}
+
+		c.mutex.Lock()
+		c.token = token
+		c.mutex.Unlock()
+		return nil
+	}
+
+	// basic auth credentials are already sent with every request
+	return errorspkg.New("unauthorized")
+}
+
+// cachedBearerToken gets the token from the token cache, when there is one,
+// so that it is shared with other grootfs processes
+func (c *registryClient) cachedBearerToken(logger lager.Logger, realm, service, rejectedToken string) (string, error) {
+	if c.tokenCache == nil {
+		token, err := c.bearerToken(realm, service)
+		return token.Token, err
+	}
+
+	username, password, err := c.credentials()
+	if err != nil {
+		return "", err
+	}
+
+	key := token_cache.Key{
+		Registry:    c.registry,
+		Repository:  c.repository,
+		Scope:       c.scope(),
+		Credentials: username + ":" + password,
+	}
+	return c.tokenCache.Fetch(logger, key, rejectedToken, func() (token_cache.Token, error) {
+		return c.bearerToken(realm, service)
+	})
+}
+
+func (c *registryClient) scope() string {
+	return fmt.Sprintf("repository:%s:pull", c.repository)
+}
+
+func (c *registryClient) bearerToken(realm, service string) (token_cache.Token, error) {
+	if realm == "" {
+		return token_cache.Token{}, errorspkg.New("missing realm in bearer auth challenge")
+	}
+
+	req, err := http.NewRequest("GET", realm, nil)
+	if err != nil {
+		return token_cache.Token{}, err
+	}
+
+	params := req.URL.Query()
+	if service != "" {
+		params.Add("service", service)
+	}
+	params.Add("scope", c.scope())
+	req.URL.RawQuery = params.Encode()
+
+	username, password, err := c.credentials()
+	if err != nil {
+		return token_cache.Token{}, err
+	}
+	if username != "" && password != "" {
+		req.SetBasicAuth(username, password)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return token_cache.Token{}, err
+	}
+	defer resp.Body.Close()
+
+	// the errors match the ones of containers/image
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return token_cache.Token{}, errorspkg.New("unable to retrieve auth token: invalid username/password")
+	default:
+		return token_cache.Token{}, statusError{message: "unable to retrieve auth token", statusCode: resp.StatusCode}
+	}
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return token_cache.Token{}, errorspkg.Wrap(err, "reading token")
+	}
+
+	var token struct {
+		Token       string    `json:"token"`
+		AccessToken string    `json:"access_token"`
+		ExpiresIn   int       `json:"expires_in"`
+		IssuedAt    time.Time `json:"issued_at"`
+	}
+	if err := json.Unmarshal(contents, &token); err != nil {
+		return token_cache.Token{}, errorspkg.Wrap(err, "parsing token")
+	}
+
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+
+	expiresIn := defaultTokenExpiry
+	if token.ExpiresIn > 0 {
+		expiresIn = time.Duration(token.ExpiresIn) * time.Second
+	}
+	issuedAt := token.IssuedAt
+	if issuedAt.IsZero() || issuedAt.After(time.Now()) {
+		issuedAt = time.Now()
+	}
+
+	return token_cache.Token{Token: token.Token, ExpiresAt: issuedAt.Add(expiresIn)}, nil
+}
+
+func (c *registryClient) credentials() (string, string, error) {
+	registry := c.registry
+	if registry == dockerHubRegistry {
+		registry = DockerHubHost
+	}
+
+	return config.GetAuthentication(&c.systemContext, registry)
+}
+
+// rangeStart parses the start of a `bytes <start>-<end>/<size>` content range
+func rangeStart(contentRange string) (int64, error) {
+	if !strings.HasPrefix(contentRange, "bytes ") {
+		return 0, errorspkg.Errorf("invalid content range `%s`", contentRange)
+	}
+
+	dash := strings.Index(contentRange, "-")
+	if dash == -1 {
+		return 0, errorspkg.Errorf("invalid content range `%s`", contentRange)
+	}
+
+	return strconv.ParseInt(contentRange[len("bytes "):dash], 10, 64)
+}
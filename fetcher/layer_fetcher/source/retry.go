@@ -0,0 +1,124 @@
+package source // import "code.cloudfoundry.org/grootfs/fetcher/layer_fetcher/source"
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/client"
+	errorspkg "github.com/pkg/errors"
+)
+
+const (
+	DefaultDownloadRetries = 2
+	DefaultRetryBackoff    = 500 * time.Millisecond
+	MaxRetryBackoff        = 30 * time.Second
+)
+
+// withRetries calls the action until it succeeds, fails with an error that
+// retrying can't fix, or runs out of retries, doubling the wait between
+// attempts up to MaxRetryBackoff.
+func (s *LayerSource) withRetries(logger lager.Logger, name string, action func() error) error {
+	var err error
+	backoff := s.retryBackoff
+	for attempt := 1; attempt <= s.downloadRetries+1; attempt++ {
+		if attempt > 1 {
+			logger.Debug(fmt.Sprintf("backing-off-%s", name), lager.Data{"backoff": backoff.String()})
+			time.Sleep(backoff)
+			backoff = nextBackoff(backoff)
+		}
+
+		logger.Debug(fmt.Sprintf("attempt-%s-%d", name, attempt))
+		if err = action(); err == nil {
+			logger.Debug(fmt.Sprintf("attempt-%s-success", name))
+			return nil
+		}
+
+		if !isTransient(err) {
+			logger.Debug(fmt.Sprintf("not-retrying-%s", name), lager.Data{"error": err.Error()})
+			return err
+		}
+	}
+
+	return err
+}
+
+func nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > MaxRetryBackoff {
+		return MaxRetryBackoff
+	}
+
+	return backoff
+}
+
+// statusError is an unexpected status code returned by the registry
+type statusError struct {
+	message    string
+	statusCode int
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("%s: unexpected http code %d", e.message, e.statusCode)
+}
+
+// containers/image only reports the status code of some failed requests in
+// the error message
+var statusCodeMessage = regexp.MustCompile(`(?:fetching blob|fetching external blob from "[^"]*":) (\d{3})$`)
+
+// isTransient checks whether a failed request is worth retrying: network
+// errors, truncated downloads, server errors and rate limiting are, while
+// other client errors, digest mismatches and missing platforms fail the
+// same way every time.
+func isTransient(err error) bool {
+	switch cause := errorspkg.Cause(err).(type) {
+	case statusError:
+		return transientStatus(cause.statusCode)
+	case *client.UnexpectedHTTPStatusError:
+		statusCode, convErr := strconv.Atoi(strings.SplitN(cause.Status, " ", 2)[0])
+		return convErr == nil && transientStatus(statusCode)
+	case *client.UnexpectedHTTPResponseError:
+		return transientStatus(cause.StatusCode)
+	case errcode.Error:
+		return transientStatus(cause.ErrorCode().Descriptor().HTTPStatusCode)
+	case errcode.Errors:
+		for _, e := range cause {
+			if isTransient(e) {
+				return true
+			}
+		}
+		return false
+	case *url.Error:
+		// certificate errors are only worth retrying once they are fixed
+		return isTransient(cause.Err)
+	case net.Error:
+		return true
+	case syscall.Errno:
+		return cause == syscall.ECONNRESET || cause == syscall.ECONNREFUSED || cause == syscall.EPIPE || cause == syscall.ETIMEDOUT
+	}
+
+	cause := errorspkg.Cause(err)
+	if cause == io.ErrUnexpectedEOF || cause == io.EOF || cause == errRangeNotSatisfiable {
+		return true
+	}
+
+	if match := statusCodeMessage.FindStringSubmatch(cause.Error()); match != nil {
+		statusCode, _ := strconv.Atoi(match[1])
+		return transientStatus(statusCode)
+	}
+
+	return false
+}
+
+func transientStatus(statusCode int) bool {
+	return statusCode >= http.StatusInternalServerError || statusCode == http.StatusTooManyRequests
+}
@@ -0,0 +1,78 @@
+package progress // import "code.cloudfoundry.org/grootfs/fetcher/progress"
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const DefaultInterval = time.Second
+
+// Event is the progress of the download of a layer. TotalBytes is 0 when the
+// size of the layer is unknown.
+type Event struct {
+	Digest          string `json:"digest"`
+	DownloadedBytes int64  `json:"downloaded_bytes"`
+	TotalBytes      int64  `json:"total_bytes"`
+	Done            bool   `json:"done"`
+}
+
+// Reporter logs the progress of layer downloads and, when it has an output,
+// writes it there as a stream of JSON events, one per line. Events of a layer
+// are reported at most once per interval, except for the first and last ones.
+type Reporter struct {
+	output   io.Writer
+	interval time.Duration
+
+	mutex        *sync.Mutex
+	lastReported map[string]time.Time
+}
+
+func NewReporter(output io.Writer) *Reporter {
+	return &Reporter{
+		output:       output,
+		interval:     DefaultInterval,
+		mutex:        &sync.Mutex{},
+		lastReported: map[string]time.Time{},
+	}
+}
+
+func (r *Reporter) WithInterval(interval time.Duration) *Reporter {
+	r.interval = interval
+	return r
+}
+
+func (r *Reporter) LayerProgress(logger lager.Logger, digest string, downloadedBytes, totalBytes int64, done bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	lastReported, reported := r.lastReported[digest]
+	if reported && !done && time.Since(lastReported) < r.interval {
+		return
+	}
+	r.lastReported[digest] = time.Now()
+
+	event := Event{
+		Digest:          digest,
+		DownloadedBytes: downloadedBytes,
+		TotalBytes:      totalBytes,
+		Done:            done,
+	}
+	logger.Info("download-progress", lager.Data{"event": event})
+
+	if r.output == nil {
+		return
+	}
+
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		logger.Error("encoding-progress-event-failed", err)
+		return
+	}
+	if _, err := r.output.Write(append(eventJSON, '\n')); err != nil {
+		logger.Error("writing-progress-event-failed", err)
+	}
+}
@@ -0,0 +1,90 @@
+package progress_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/grootfs/fetcher/progress"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reporter", func() {
+	var (
+		logger   *lagertest.TestLogger
+		output   *bytes.Buffer
+		reporter *progress.Reporter
+	)
+
+	events := func() []progress.Event {
+		events := []progress.Event{}
+		for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+			var event progress.Event
+			Expect(json.Unmarshal([]byte(line), &event)).To(Succeed())
+			events = append(events, event)
+		}
+		return events
+	}
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("progress")
+		output = bytes.NewBuffer([]byte{})
+		reporter = progress.NewReporter(output).WithInterval(time.Hour)
+	})
+
+	It("writes the events as JSON lines", func() {
+		reporter.LayerProgress(logger, "sha256:layer-1", 0, 100, false)
+		reporter.LayerProgress(logger, "sha256:layer-2", 10, 0, false)
+
+		Expect(events()).To(Equal([]progress.Event{
+			{Digest: "sha256:layer-1", DownloadedBytes: 0, TotalBytes: 100},
+			{Digest: "sha256:layer-2", DownloadedBytes: 10, TotalBytes: 0},
+		}))
+	})
+
+	It("logs the events", func() {
+		reporter.LayerProgress(logger, "sha256:layer-1", 50, 100, false)
+
+		Expect(logger.LogMessages()).To(ContainElement("progress.download-progress"))
+		Expect(logger.Logs()[0].LogLevel).To(Equal(lager.INFO))
+	})
+
+	It("reports a layer at most once per interval until it is done", func() {
+		reporter.LayerProgress(logger, "sha256:layer-1", 0, 100, false)
+		reporter.LayerProgress(logger, "sha256:layer-1", 50, 100, false)
+		reporter.LayerProgress(logger, "sha256:layer-1", 100, 100, true)
+
+		Expect(events()).To(Equal([]progress.Event{
+			{Digest: "sha256:layer-1", DownloadedBytes: 0, TotalBytes: 100},
+			{Digest: "sha256:layer-1", DownloadedBytes: 100, TotalBytes: 100, Done: true},
+		}))
+	})
+
+	Context("when the interval has passed", func() {
+		BeforeEach(func() {
+			reporter = progress.NewReporter(output).WithInterval(0)
+		})
+
+		It("reports every event", func() {
+			reporter.LayerProgress(logger, "sha256:layer-1", 0, 100, false)
+			reporter.LayerProgress(logger, "sha256:layer-1", 50, 100, false)
+
+			Expect(events()).To(HaveLen(2))
+		})
+	})
+
+	Context("when there is no output", func() {
+		BeforeEach(func() {
+			reporter = progress.NewReporter(nil)
+		})
+
+		It("only logs the events", func() {
+			reporter.LayerProgress(logger, "sha256:layer-1", 0, 100, false)
+			Expect(logger.LogMessages()).To(ContainElement("progress.download-progress"))
+		})
+	})
+})
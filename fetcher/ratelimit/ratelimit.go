@@ -0,0 +1,63 @@
+package ratelimit // import "code.cloudfoundry.org/grootfs/fetcher/ratelimit"
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Limiter caps the combined rate of all the readers it wraps. Up to a second
+// worth of bytes can be read in a burst after the readers were idle.
+type Limiter struct {
+	bytesPerSecond int64
+
+	mutex *sync.Mutex
+	// next is when the bytes read so far will have been paid for
+	next time.Time
+}
+
+func NewLimiter(bytesPerSecond int64) *Limiter {
+	return &Limiter{
+		bytesPerSecond: bytesPerSecond,
+		mutex:          &sync.Mutex{},
+	}
+}
+
+// Reader returns a reader that blocks as needed to keep the reads of every
+// reader of the limiter under its rate.
+func (l *Limiter) Reader(reader io.Reader) io.Reader {
+	return &limitedReader{reader: reader, limiter: l}
+}
+
+func (l *Limiter) wait(n int) {
+	l.mutex.Lock()
+	now := time.Now()
+	if burstStart := now.Add(-time.Second); l.next.Before(burstStart) {
+		l.next = burstStart
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.bytesPerSecond))
+	delay := l.next.Sub(now)
+	l.mutex.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+type limitedReader struct {
+	reader  io.Reader
+	limiter *Limiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	// a single read can't take more than a second worth of bytes
+	if int64(len(p)) > r.limiter.bytesPerSecond {
+		p = p[:r.limiter.bytesPerSecond]
+	}
+
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.limiter.wait(n)
+	}
+	return n, err
+}
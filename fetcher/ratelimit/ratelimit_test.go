@@ -0,0 +1,65 @@
+package ratelimit_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/grootfs/fetcher/ratelimit"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Limiter", func() {
+	var limiter *ratelimit.Limiter
+
+	BeforeEach(func() {
+		limiter = ratelimit.NewLimiter(10 * 1024)
+	})
+
+	read := func(size int) {
+		defer GinkgoRecover()
+		contents, err := ioutil.ReadAll(limiter.Reader(bytes.NewReader(make([]byte, size))))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(contents).To(HaveLen(size))
+	}
+
+	It("reads a second worth of bytes without waiting", func() {
+		start := time.Now()
+		read(10 * 1024)
+		Expect(time.Since(start)).To(BeNumerically("<", 500*time.Millisecond))
+	})
+
+	It("limits the rate of a reader", func() {
+		start := time.Now()
+		read(25 * 1024)
+		Expect(time.Since(start)).To(BeNumerically(">=", 1400*time.Millisecond))
+	})
+
+	It("shares the rate between readers", func() {
+		start := time.Now()
+		wg := sync.WaitGroup{}
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				read(12 * 1024)
+			}()
+		}
+		wg.Wait()
+		Expect(time.Since(start)).To(BeNumerically(">=", 1300*time.Millisecond))
+	})
+
+	It("returns the errors of the underlying reader", func() {
+		_, err := limiter.Reader(errReader{}).Read(make([]byte, 10))
+		Expect(err).To(Equal(io.ErrUnexpectedEOF))
+	})
+})
+
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
@@ -0,0 +1,89 @@
+package tar_fetcher // import "code.cloudfoundry.org/grootfs/fetcher/tar_fetcher"
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	errorspkg "github.com/pkg/errors"
+	"github.com/ulikunitz/xz"
+)
+
+type compression struct {
+	name  string
+	magic []byte
+	// newReader is nil for formats that are recognised but not supported
+	newReader func(io.Reader) (io.ReadCloser, error)
+}
+
+var compressions = []compression{
+	{name: "gzip", magic: []byte{0x1f, 0x8b}, newReader: newGzipReader},
+	{name: "xz", magic: []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, newReader: newXZReader},
+	{name: "zstd", magic: []byte{0x28, 0xb5, 0x2f, 0xfd}, newReader: newZstdReader},
+	{name: "bzip2", magic: []byte{'B', 'Z', 'h'}},
+	{name: "lz4", magic: []byte{0x04, 0x22, 0x4d, 0x18}},
+}
+
+// decompressedStream sniffs the magic bytes at the start of the stream and
+// returns the decompressed tar, along with the name of the compression
+// format. Streams that are not compressed are returned as they are.
+func decompressedStream(stream io.Reader) (io.ReadCloser, string, error) {
+	bufferedStream := bufio.NewReader(stream)
+	header, err := bufferedStream.Peek(6)
+	if err != nil && err != io.EOF {
+		return nil, "", errorspkg.Wrap(err, "reading image header")
+	}
+
+	for _, c := range compressions {
+		if !bytes.HasPrefix(header, c.magic) {
+			continue
+		}
+
+		if c.newReader == nil {
+			return nil, c.name, errorspkg.Errorf("unsupported compression format: %s", c.name)
+		}
+
+		reader, err := c.newReader(bufferedStream)
+		if err != nil {
+			return nil, c.name, errorspkg.Wrapf(err, "reading %s compressed image", c.name)
+		}
+		return reader, c.name, nil
+	}
+
+	return ioutil.NopCloser(bufferedStream), "none", nil
+}
+
+func newGzipReader(stream io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(stream)
+}
+
+func newXZReader(stream io.Reader) (io.ReadCloser, error) {
+	reader, err := xz.NewReader(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(reader), nil
+}
+
+func newZstdReader(stream io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(stream, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+
+	return decoder.IOReadCloser(), nil
+}
+
+type decompressedFile struct {
+	io.ReadCloser
+	file io.Closer
+}
+
+func (d *decompressedFile) Close() error {
+	d.ReadCloser.Close()
+	return d.file.Close()
+}
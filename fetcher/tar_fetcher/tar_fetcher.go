@@ -4,23 +4,36 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"net/url"
 	"os"
+	"syscall"
 
 	"code.cloudfoundry.org/grootfs/groot"
+	"code.cloudfoundry.org/grootfs/store/digest_cache"
 	"code.cloudfoundry.org/lager"
 	errorspkg "github.com/pkg/errors"
 )
 
 type TarFetcher struct {
 	baseImagePath string
+	digestCache   *digest_cache.DigestCache
 }
 
 func NewTarFetcher(baseImageURL *url.URL) *TarFetcher {
 	return &TarFetcher{baseImagePath: baseImageURL.String()}
 }
 
+// WithContentChainIDs makes the chain ID derive from a sha256 of the tar
+// contents instead of its path and modification time. Digests are cached in
+// digestCache, keyed by the file's inode, size and mtime.
+func (l *TarFetcher) WithContentChainIDs(digestCache *digest_cache.DigestCache) *TarFetcher {
+	l.digestCache = digestCache
+	return l
+}
+
 func (l *TarFetcher) StreamBlob(logger lager.Logger, layerInfo groot.LayerInfo) (io.ReadCloser, int64, error) {
 	logger = logger.Session("stream-blob", lager.Data{
 		"baseImagePath": l.baseImagePath,
@@ -38,12 +51,41 @@ func (l *TarFetcher) StreamBlob(logger lager.Logger, layerInfo groot.LayerInfo)
 	}
 
 	logger.Debug("opening-tar", lager.Data{"baseImagePath": l.baseImagePath})
-	stream, err := os.Open(l.baseImagePath)
+	tarFile, err := os.Open(l.baseImagePath)
+	if err != nil {
+		return nil, 0, errorspkg.Wrap(err, "reading local image")
+	}
+
+	stream, compressionFormat, err := decompressedStream(tarFile)
+	if err != nil {
+		tarFile.Close()
+		return nil, 0, errorspkg.Wrap(err, "invalid base image")
+	}
+	logger.Debug("detected-compression", lager.Data{"compression": compressionFormat})
+
+	blob := &decompressedFile{ReadCloser: stream, file: tarFile}
+	if l.digestCache == nil || layerInfo.DiffID == "" {
+		return blob, 0, nil
+	}
+
+	// the digest might come from the cache, or the tar might have changed
+	// since it was hashed, so the tar is hashed again while it is read
+	stat, err := tarFile.Stat()
 	if err != nil {
+		blob.Close()
 		return nil, 0, errorspkg.Wrap(err, "reading local image")
 	}
 
-	return stream, 0, nil
+	contentHash := sha256.New()
+	return &verifiedFile{
+		Reader:      io.TeeReader(blob, contentHash),
+		file:        blob,
+		logger:      logger,
+		layerInfo:   layerInfo,
+		contentHash: contentHash,
+		digestCache: l.digestCache,
+		cacheKey:    digestCacheKey(stat),
+	}, 0, nil
 }
 
 func (l *TarFetcher) BaseImageInfo(logger lager.Logger) (groot.BaseImageInfo, error) {
@@ -57,12 +99,30 @@ func (l *TarFetcher) BaseImageInfo(logger lager.Logger) (groot.BaseImageInfo, er
 			errorspkg.Wrap(err, "fetching image timestamp")
 	}
 
+	if l.digestCache == nil {
+		return groot.BaseImageInfo{
+			LayerInfos: []groot.LayerInfo{
+				groot.LayerInfo{
+					BlobID:        l.baseImagePath,
+					ParentChainID: "",
+					ChainID:       l.generateChainID(stat.ModTime().UnixNano()),
+				},
+			},
+		}, nil
+	}
+
+	contentDigest, err := l.contentDigest(logger, stat)
+	if err != nil {
+		return groot.BaseImageInfo{}, errorspkg.Wrap(err, "calculating image digest")
+	}
+
 	return groot.BaseImageInfo{
 		LayerInfos: []groot.LayerInfo{
 			groot.LayerInfo{
 				BlobID:        l.baseImagePath,
 				ParentChainID: "",
-				ChainID:       l.generateChainID(stat.ModTime().UnixNano()),
+				ChainID:       contentDigest,
+				DiffID:        contentDigest,
 			},
 		},
 	}, nil
@@ -77,6 +137,89 @@ func (l *TarFetcher) generateChainID(timestamp int64) string {
 	return hex.EncodeToString(shaSum[:])
 }
 
+func (l *TarFetcher) contentDigest(logger lager.Logger, stat os.FileInfo) (string, error) {
+	cacheKey := digestCacheKey(stat)
+	if cachedDigest, ok := l.digestCache.Get(logger, cacheKey); ok {
+		logger.Debug("using-cached-digest", lager.Data{"digest": cachedDigest})
+		return cachedDigest, nil
+	}
+
+	logger.Debug("hashing-tar")
+	tarFile, err := os.Open(l.baseImagePath)
+	if err != nil {
+		return "", errorspkg.Wrap(err, "reading local image")
+	}
+	defer tarFile.Close()
+
+	// Hash the uncompressed tar, so that compressed and uncompressed copies
+	// of the same rootfs share a volume
+	stream, _, err := decompressedStream(tarFile)
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+
+	contentHash := sha256.New()
+	if _, err := io.Copy(contentHash, stream); err != nil {
+		return "", errorspkg.Wrap(err, "hashing local image")
+	}
+	digest := hex.EncodeToString(contentHash.Sum(nil))
+
+	if err := l.digestCache.Put(logger, cacheKey, digest); err != nil {
+		logger.Error("caching-digest-failed", err)
+	}
+
+	return digest, nil
+}
+
+func digestCacheKey(stat os.FileInfo) string {
+	var device, inode uint64
+	if stat_t, ok := stat.Sys().(*syscall.Stat_t); ok {
+		device, inode = uint64(stat_t.Dev), uint64(stat_t.Ino)
+	}
+
+	return fmt.Sprintf("%d-%d-%d-%d", device, inode, stat.Size(), stat.ModTime().UnixNano())
+}
+
+// verifiedFile is the uncompressed tar of a content addressed image, which
+// is only verified against its digest once it was read to the end
+type verifiedFile struct {
+	io.Reader
+	file        io.Closer
+	logger      lager.Logger
+	layerInfo   groot.LayerInfo
+	contentHash hash.Hash
+	digestCache *digest_cache.DigestCache
+	cacheKey    string
+}
+
+// Verify reads the rest of the tar and checks it against the digest the
+// chain ID was derived from. The cached digest is dropped when they don't
+// match, so that the next create hashes the tar again.
+func (f *verifiedFile) Verify() error {
+	if _, err := io.Copy(ioutil.Discard, f); err != nil {
+		return errorspkg.Wrap(err, "reading local image")
+	}
+
+	actualDigest := hex.EncodeToString(f.contentHash.Sum(nil))
+	f.logger.Debug("checking-checksum", lager.Data{
+		"digest":             f.layerInfo.DiffID,
+		"calculatedChecksum": actualDigest,
+	})
+	if actualDigest == f.layerInfo.DiffID {
+		return nil
+	}
+
+	if err := f.digestCache.Remove(f.logger, f.cacheKey); err != nil {
+		f.logger.Error("removing-cached-digest-failed", err)
+	}
+	return errorspkg.Errorf("local image changed while it was read: expected digest %s, actual: %s", f.layerInfo.DiffID, actualDigest)
+}
+
+func (f *verifiedFile) Close() error {
+	return f.file.Close()
+}
+
 func (l *TarFetcher) validateBaseImage() error {
 	stat, err := os.Stat(l.baseImagePath)
 	if err != nil {
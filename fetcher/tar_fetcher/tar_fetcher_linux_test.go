@@ -2,6 +2,10 @@ package tar_fetcher_test
 
 import (
 	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/url"
@@ -10,13 +14,17 @@ import (
 	"path/filepath"
 	"time"
 
+	"code.cloudfoundry.org/grootfs/base_image_puller"
 	fetcherpkg "code.cloudfoundry.org/grootfs/fetcher/tar_fetcher"
 	"code.cloudfoundry.org/grootfs/groot"
 	"code.cloudfoundry.org/grootfs/integration"
+	"code.cloudfoundry.org/grootfs/store/digest_cache"
+	"github.com/klauspost/compress/zstd"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/opencontainers/image-spec/specs-go/v1"
 	. "github.com/st3v/glager"
+	"github.com/ulikunitz/xz"
 )
 
 var _ = Describe("Tar Fetcher", func() {
@@ -88,6 +96,53 @@ var _ = Describe("Tar Fetcher", func() {
 			})
 		})
 
+		Context("when the source is compressed", func() {
+			compressors := map[string]func(io.Writer) io.WriteCloser{
+				"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+				"xz": func(w io.Writer) io.WriteCloser {
+					xzWriter, err := xz.NewWriter(w)
+					Expect(err).NotTo(HaveOccurred())
+					return xzWriter
+				},
+				"zstd": func(w io.Writer) io.WriteCloser {
+					zstdWriter, err := zstd.NewWriter(w)
+					Expect(err).NotTo(HaveOccurred())
+					return zstdWriter
+				},
+			}
+
+			for format, compress := range compressors {
+				compress := compress
+
+				It(fmt.Sprintf("decompresses %s images", format), func() {
+					compressedImagePath := compressFile(baseImagePath, compress)
+					defer os.Remove(compressedImagePath)
+					compressedImageURL, err := url.Parse(compressedImagePath)
+					Expect(err).NotTo(HaveOccurred())
+
+					stream, _, err := fetcherpkg.NewTarFetcher(compressedImageURL).StreamBlob(logger, groot.LayerInfo{})
+					Expect(err).ToNot(HaveOccurred())
+					defer stream.Close()
+
+					entries := streamTar(tar.NewReader(stream))
+					Expect(entries).To(HaveLen(2))
+					Expect(entries[1].header.Name).To(Equal("./a_file"))
+					Expect(string(entries[1].contents)).To(Equal("hello-world"))
+				})
+			}
+		})
+
+		Context("when the source uses an unsupported compression format", func() {
+			BeforeEach(func() {
+				Expect(ioutil.WriteFile(baseImagePath, []byte("BZh91AY&SY-not-really-bzip2"), 0600)).To(Succeed())
+			})
+
+			It("returns an error naming the format", func() {
+				_, _, err := fetcher.StreamBlob(logger, groot.LayerInfo{})
+				Expect(err).To(MatchError(ContainSubstring("unsupported compression format: bzip2")))
+			})
+		})
+
 		Context("when the source does not exist", func() {
 			BeforeEach(func() {
 				baseImageURL, _ = url.Parse("/nothing/here")
@@ -147,6 +202,157 @@ var _ = Describe("Tar Fetcher", func() {
 				Expect(imageInfoErr).To(MatchError(ContainSubstring("fetching image timestamp")))
 			})
 		})
+
+		Context("when content addressed chain ids are enabled", func() {
+			var digestCachePath string
+
+			BeforeEach(func() {
+				var err error
+				digestCachePath, err = ioutil.TempDir("", "tar-digests")
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			JustBeforeEach(func() {
+				fetcher = fetcherpkg.NewTarFetcher(baseImageURL).WithContentChainIDs(digest_cache.NewDigestCache(digestCachePath, digest_cache.DefaultMaxEntries))
+				baseImageInfo, imageInfoErr = fetcher.BaseImageInfo(logger)
+			})
+
+			AfterEach(func() {
+				Expect(os.RemoveAll(digestCachePath)).To(Succeed())
+			})
+
+			It("uses the sha256 of the tar contents as the chain id", func() {
+				Expect(imageInfoErr).NotTo(HaveOccurred())
+
+				contents, err := ioutil.ReadFile(baseImagePath)
+				Expect(err).NotTo(HaveOccurred())
+				sum := sha256.Sum256(contents)
+
+				Expect(baseImageInfo.LayerInfos[0].ChainID).To(Equal(hex.EncodeToString(sum[:])))
+				Expect(baseImageInfo.LayerInfos[0].DiffID).To(Equal(hex.EncodeToString(sum[:])))
+			})
+
+			It("caches the digest", func() {
+				Expect(imageInfoErr).NotTo(HaveOccurred())
+
+				cacheEntries, err := ioutil.ReadDir(digestCachePath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cacheEntries).To(HaveLen(1))
+
+				cacheEntryPath := filepath.Join(digestCachePath, cacheEntries[0].Name())
+				Expect(ioutil.WriteFile(cacheEntryPath, []byte("cached-digest"), 0644)).To(Succeed())
+
+				newBaseImageInfo, err := fetcher.BaseImageInfo(logger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(newBaseImageInfo.LayerInfos[0].ChainID).To(Equal("cached-digest"))
+			})
+
+			It("verifies the streamed tar against the digest", func() {
+				Expect(imageInfoErr).NotTo(HaveOccurred())
+
+				stream, _, err := fetcher.StreamBlob(logger, baseImageInfo.LayerInfos[0])
+				Expect(err).NotTo(HaveOccurred())
+				defer stream.Close()
+
+				_, err = io.Copy(ioutil.Discard, stream)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(stream.(base_image_puller.VerifiableStream).Verify()).To(Succeed())
+			})
+
+			Context("when the cached digest doesn't match the tar", func() {
+				var staleBaseImageInfo groot.BaseImageInfo
+
+				JustBeforeEach(func() {
+					cacheEntries, err := ioutil.ReadDir(digestCachePath)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(cacheEntries).To(HaveLen(1))
+					cacheEntryPath := filepath.Join(digestCachePath, cacheEntries[0].Name())
+					Expect(ioutil.WriteFile(cacheEntryPath, []byte("stale-digest"), 0644)).To(Succeed())
+
+					staleBaseImageInfo, err = fetcher.BaseImageInfo(logger)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(staleBaseImageInfo.LayerInfos[0].ChainID).To(Equal("stale-digest"))
+				})
+
+				It("fails to verify the streamed tar", func() {
+					stream, _, err := fetcher.StreamBlob(logger, staleBaseImageInfo.LayerInfos[0])
+					Expect(err).NotTo(HaveOccurred())
+					defer stream.Close()
+
+					err = stream.(base_image_puller.VerifiableStream).Verify()
+					Expect(err).To(MatchError(ContainSubstring("local image changed while it was read")))
+				})
+
+				It("drops the cached digest", func() {
+					stream, _, err := fetcher.StreamBlob(logger, staleBaseImageInfo.LayerInfos[0])
+					Expect(err).NotTo(HaveOccurred())
+					defer stream.Close()
+					Expect(stream.(base_image_puller.VerifiableStream).Verify()).NotTo(Succeed())
+
+					newBaseImageInfo, err := fetcher.BaseImageInfo(logger)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(newBaseImageInfo.LayerInfos[0].ChainID).To(Equal(baseImageInfo.LayerInfos[0].ChainID))
+				})
+			})
+
+			Context("when the image is compressed", func() {
+				It("generates the same chain id as the uncompressed image", func() {
+					compressedImagePath := compressFile(baseImagePath, func(w io.Writer) io.WriteCloser {
+						return gzip.NewWriter(w)
+					})
+					defer os.Remove(compressedImagePath)
+
+					compressedImageURL, err := url.Parse(compressedImagePath)
+					Expect(err).NotTo(HaveOccurred())
+					compressedFetcher := fetcherpkg.NewTarFetcher(compressedImageURL).WithContentChainIDs(digest_cache.NewDigestCache(digestCachePath, digest_cache.DefaultMaxEntries))
+
+					compressedBaseImageInfo, err := compressedFetcher.BaseImageInfo(logger)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(compressedBaseImageInfo.LayerInfos[0].ChainID).To(Equal(baseImageInfo.LayerInfos[0].ChainID))
+				})
+			})
+
+			Context("when the image is touched", func() {
+				It("keeps the same chain id", func() {
+					future := time.Now().Add(time.Hour)
+					Expect(os.Chtimes(baseImagePath, future, future)).To(Succeed())
+
+					newBaseImageInfo, err := fetcher.BaseImageInfo(logger)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(newBaseImageInfo.LayerInfos[0].ChainID).To(Equal(baseImageInfo.LayerInfos[0].ChainID))
+				})
+			})
+
+			Context("when the same image is in a different path", func() {
+				It("generates the same chain id", func() {
+					contents, err := ioutil.ReadFile(baseImagePath)
+					Expect(err).NotTo(HaveOccurred())
+					copyPath := baseImagePath + "-copy"
+					Expect(ioutil.WriteFile(copyPath, contents, 0644)).To(Succeed())
+					defer os.Remove(copyPath)
+
+					copyURL, err := url.Parse(copyPath)
+					Expect(err).NotTo(HaveOccurred())
+					copyFetcher := fetcherpkg.NewTarFetcher(copyURL).WithContentChainIDs(digest_cache.NewDigestCache(digestCachePath, digest_cache.DefaultMaxEntries))
+
+					copyBaseImageInfo, err := copyFetcher.BaseImageInfo(logger)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(copyBaseImageInfo.LayerInfos[0].ChainID).To(Equal(baseImageInfo.LayerInfos[0].ChainID))
+				})
+			})
+
+			Context("when image content gets updated", func() {
+				It("generates another chain id", func() {
+					time.Sleep(time.Millisecond * 10)
+					Expect(ioutil.WriteFile(filepath.Join(sourceImagePath, "foobar"), []byte("hello-world"), 0700)).To(Succeed())
+					integration.UpdateBaseImageTar(baseImagePath, sourceImagePath)
+
+					newBaseImageInfo, err := fetcher.BaseImageInfo(logger)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(newBaseImageInfo.LayerInfos[0].ChainID).NotTo(Equal(baseImageInfo.LayerInfos[0].ChainID))
+				})
+			})
+		})
 	})
 })
 
@@ -155,6 +361,23 @@ type tarEntry struct {
 	contents []byte
 }
 
+func compressFile(path string, compress func(io.Writer) io.WriteCloser) string {
+	source, err := os.Open(path)
+	Expect(err).NotTo(HaveOccurred())
+	defer source.Close()
+
+	compressedFile, err := ioutil.TempFile("", "compressed-image")
+	Expect(err).NotTo(HaveOccurred())
+	defer compressedFile.Close()
+
+	compressor := compress(compressedFile)
+	_, err = io.Copy(compressor, source)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(compressor.Close()).To(Succeed())
+
+	return compressedFile.Name()
+}
+
 func streamTar(r *tar.Reader) []tarEntry {
 	l := []tarEntry{}
 	for {
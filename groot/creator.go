@@ -1,6 +1,7 @@
 package groot
 
 import (
+	"encoding/base64"
 	"fmt"
 	"net/url"
 	"os"
@@ -11,7 +12,17 @@ import (
 	errorspkg "github.com/pkg/errors"
 )
 
-const ImageReferenceFormat = "image:%s"
+const (
+	ImageReferenceFormat = "image:%s"
+	PullReferencePrefix  = "pull:"
+)
+
+// pullReference is the dependency id of a pull. Pull names can be anything,
+// like image URLs, so they are base64 encoded to keep them distinct once
+// they are file names.
+func pullReference(name string) string {
+	return PullReferencePrefix + base64.RawURLEncoding.EncodeToString([]byte(name))
+}
 
 type CreateSpec struct {
 	ID                          string
@@ -67,7 +78,11 @@ func (c *Creator) Create(logger lager.Logger, spec CreateSpec) (info ImageInfo,
 		return ImageInfo{}, errorspkg.Errorf("image for id `%s` already exists", spec.ID)
 	}
 
-	ownerUid, ownerGid := c.parseOwner(spec.UIDMappings, spec.GIDMappings)
+	ownerUid, ownerGid, err := parseOwner(spec.UIDMappings, spec.GIDMappings)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+
 	baseImageSpec := BaseImageSpec{
 		DiskLimit:                 spec.DiskLimit,
 		ExcludeBaseImageFromQuota: spec.ExcludeBaseImageFromQuota,
@@ -109,6 +124,7 @@ func (c *Creator) Create(logger lager.Logger, spec CreateSpec) (info ImageInfo,
 		ExcludeBaseImageFromQuota: spec.ExcludeBaseImageFromQuota,
 		BaseVolumeIDs:             baseImageChainIDs,
 		BaseImage:                 baseImageInfo.Config,
+		ManifestDigest:            baseImageInfo.ManifestDigest,
 		OwnerUID:                  ownerUid,
 		OwnerGID:                  ownerGid,
 	}
@@ -138,23 +154,34 @@ func chainIDs(layerInfos []LayerInfo) []string {
 	return chainIDs
 }
 
-func (c *Creator) parseOwner(uidMappings, gidMappings []IDMappingSpec) (int, int) {
-	uid := os.Getuid()
-	gid := os.Getgid()
+// parseOwner returns the host IDs of the namespace root, which owns the
+// image. The caller owns it when the root is not mapped.
+func parseOwner(uidMappings, gidMappings []IDMappingSpec) (int, int, error) {
+	uid, err := rootOwner(uidMappings, os.Getuid())
+	if err != nil {
+		return 0, 0, errorspkg.Wrap(err, "invalid uid mappings")
+	}
+
+	gid, err := rootOwner(gidMappings, os.Getgid())
+	if err != nil {
+		return 0, 0, errorspkg.Wrap(err, "invalid gid mappings")
+	}
 
-	for _, mapping := range uidMappings {
-		if mapping.Size == 1 && mapping.NamespaceID == 0 {
-			uid = mapping.HostID
-			break
-		}
+	return uid, gid, nil
+}
+
+func rootOwner(mappings []IDMappingSpec, callerID int) (int, error) {
+	idMap, err := NewIDMap(mappings)
+	if err != nil {
+		return 0, err
 	}
 
-	for _, mapping := range gidMappings {
-		if mapping.Size == 1 && mapping.NamespaceID == 0 {
-			gid = mapping.HostID
-			break
-		}
+	if idMap.Empty() {
+		return callerID, nil
 	}
 
-	return uid, gid
+	if rootID, err := idMap.HostID(0); err == nil {
+		return rootID, nil
+	}
+	return callerID, nil
 }
@@ -67,6 +67,7 @@ var _ = Describe("Creator", func() {
 			Config: specsv1.Image{
 				Author: "Groot",
 			},
+			ManifestDigest: "sha256:some-manifest-digest",
 		}
 
 		pullError = nil
@@ -144,6 +145,37 @@ var _ = Describe("Creator", func() {
 			Expect(imageSpec.OwnerGID).To(Equal(3))
 		})
 
+		It("uses the host IDs of the namespace root as the owner", func() {
+			mappings := []groot.IDMappingSpec{groot.IDMappingSpec{HostID: 100000, NamespaceID: 0, Size: 65536}}
+
+			_, err := creator.Create(logger, groot.CreateSpec{
+				BaseImageURL: baseImageUrl,
+				UIDMappings:  mappings,
+				GIDMappings:  mappings,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, imageSpec := fakeBaseImagePuller.PullArgsForCall(0)
+			Expect(imageSpec.OwnerUID).To(Equal(100000))
+			Expect(imageSpec.OwnerGID).To(Equal(100000))
+		})
+
+		Context("when the id mappings overlap", func() {
+			It("returns an error", func() {
+				mappings := []groot.IDMappingSpec{
+					groot.IDMappingSpec{HostID: 100000, NamespaceID: 0, Size: 65536},
+					groot.IDMappingSpec{HostID: 200000, NamespaceID: 1, Size: 1},
+				}
+
+				_, err := creator.Create(logger, groot.CreateSpec{
+					BaseImageURL: baseImageUrl,
+					UIDMappings:  mappings,
+				})
+				Expect(err).To(MatchError(ContainSubstring("invalid uid mappings")))
+				Expect(fakeBaseImagePuller.PullCallCount()).To(BeZero())
+			})
+		})
+
 		It("makes an image", func() {
 
 			uidMappings := []groot.IDMappingSpec{groot.IDMappingSpec{HostID: 50, NamespaceID: 0, Size: 1}}
@@ -164,8 +196,9 @@ var _ = Describe("Creator", func() {
 				BaseImage: specsv1.Image{
 					Author: "Groot",
 				},
-				OwnerUID: 50,
-				OwnerGID: 60,
+				ManifestDigest: "sha256:some-manifest-digest",
+				OwnerUID:       50,
+				OwnerGID:       60,
 			}))
 		})
 
@@ -416,9 +449,10 @@ var _ = Describe("Creator", func() {
 					BaseImage: specsv1.Image{
 						Author: "Groot",
 					},
-					OwnerUID:  os.Getuid(),
-					OwnerGID:  os.Getgid(),
-					DiskLimit: int64(1024),
+					ManifestDigest: "sha256:some-manifest-digest",
+					OwnerUID:       os.Getuid(),
+					OwnerGID:       os.Getgid(),
+					DiskLimit:      int64(1024),
 				}))
 			})
 		})
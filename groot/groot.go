@@ -29,10 +29,11 @@ const (
 //go:generate counterfeiter . MetricsEmitter
 
 type ImageInfo struct {
-	Rootfs string        `json:"rootfs"`
-	Image  specsv1.Image `json:"image,omitempty"`
-	Mounts []MountInfo   `json:"mounts,omitempty"`
-	Path   string        `json:"-"`
+	Rootfs         string        `json:"rootfs"`
+	Image          specsv1.Image `json:"image,omitempty"`
+	Mounts         []MountInfo   `json:"mounts,omitempty"`
+	ManifestDigest string        `json:"manifest_digest,omitempty"`
+	Path           string        `json:"-"`
 }
 
 type MountInfo struct {
@@ -76,6 +77,11 @@ type LayerInfo struct {
 type BaseImageInfo struct {
 	LayerInfos []LayerInfo
 	Config     specsv1.Image
+	// ManifestDigest is empty for base images that don't have a manifest
+	ManifestDigest string
+	// Manifest is the manifest the base image reference resolved to, which
+	// signatures are for. It is empty for base images that don't have one
+	Manifest []byte
 }
 
 type BaseImagePuller interface {
@@ -90,6 +96,7 @@ type ImageSpec struct {
 	ExcludeBaseImageFromQuota bool
 	BaseVolumeIDs             []string
 	BaseImage                 specsv1.Image
+	ManifestDigest            string
 	OwnerUID                  int
 	OwnerGID                  int
 }
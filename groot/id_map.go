@@ -0,0 +1,74 @@
+package groot
+
+import (
+	"sort"
+
+	errorspkg "github.com/pkg/errors"
+)
+
+// IDMap translates user namespace IDs to host IDs, with the same semantics
+// as /proc/<pid>/uid_map: each mapping translates the Size IDs starting at
+// NamespaceID to the ones starting at HostID. An IDMap without mappings
+// doesn't translate IDs.
+type IDMap struct {
+	mappings []IDMappingSpec
+}
+
+func NewIDMap(mappings []IDMappingSpec) (IDMap, error) {
+	for _, mapping := range mappings {
+		if mapping.Size < 1 || mapping.NamespaceID < 0 || mapping.HostID < 0 {
+			return IDMap{}, errorspkg.Errorf("invalid id mapping %d:%d:%d", mapping.NamespaceID, mapping.HostID, mapping.Size)
+		}
+	}
+
+	if err := checkOverlaps(mappings, func(m IDMappingSpec) int { return m.NamespaceID }); err != nil {
+		return IDMap{}, errorspkg.Wrap(err, "namespace ids")
+	}
+	if err := checkOverlaps(mappings, func(m IDMappingSpec) int { return m.HostID }); err != nil {
+		return IDMap{}, errorspkg.Wrap(err, "host ids")
+	}
+
+	return IDMap{mappings: mappings}, nil
+}
+
+// Empty is true when the map doesn't translate IDs
+func (m IDMap) Empty() bool {
+	return len(m.mappings) == 0
+}
+
+// HostID returns the host ID of a namespace ID, or an error when it is not
+// mapped
+func (m IDMap) HostID(namespaceID int) (int, error) {
+	if m.Empty() {
+		return namespaceID, nil
+	}
+
+	for _, mapping := range m.mappings {
+		if namespaceID >= mapping.NamespaceID && namespaceID < mapping.NamespaceID+mapping.Size {
+			return mapping.HostID + namespaceID - mapping.NamespaceID, nil
+		}
+	}
+
+	return 0, errorspkg.Errorf("id %d is not mapped", namespaceID)
+}
+
+func checkOverlaps(mappings []IDMappingSpec, start func(IDMappingSpec) int) error {
+	sorted := make([]IDMappingSpec, len(mappings))
+	copy(sorted, mappings)
+	sort.Slice(sorted, func(i, j int) bool {
+		return start(sorted[i]) < start(sorted[j])
+	})
+
+	for i := 1; i < len(sorted); i++ {
+		previous, current := sorted[i-1], sorted[i]
+		if start(previous)+previous.Size > start(current) {
+			return errorspkg.Errorf(
+				"id mappings %d:%d:%d and %d:%d:%d overlap",
+				previous.NamespaceID, previous.HostID, previous.Size,
+				current.NamespaceID, current.HostID, current.Size,
+			)
+		}
+	}
+
+	return nil
+}
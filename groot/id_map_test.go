@@ -0,0 +1,93 @@
+package groot_test
+
+import (
+	"code.cloudfoundry.org/grootfs/groot"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("IDMap", func() {
+	var mappings []groot.IDMappingSpec
+
+	hostID := func(namespaceID int) (int, error) {
+		idMap, err := groot.NewIDMap(mappings)
+		Expect(err).NotTo(HaveOccurred())
+		return idMap.HostID(namespaceID)
+	}
+
+	BeforeEach(func() {
+		mappings = []groot.IDMappingSpec{
+			groot.IDMappingSpec{HostID: 1000, NamespaceID: 0, Size: 1},
+			groot.IDMappingSpec{HostID: 100000, NamespaceID: 1, Size: 65535},
+		}
+	})
+
+	It("translates IDs in any of the ranges", func() {
+		Expect(hostID(0)).To(Equal(1000))
+		Expect(hostID(1)).To(Equal(100000))
+		Expect(hostID(65535)).To(Equal(165534))
+	})
+
+	It("returns an error for IDs out of the ranges", func() {
+		_, err := hostID(65536)
+		Expect(err).To(MatchError("id 65536 is not mapped"))
+	})
+
+	Context("when a range doesn't start at namespace ID 0 or 1", func() {
+		BeforeEach(func() {
+			mappings = []groot.IDMappingSpec{
+				groot.IDMappingSpec{HostID: 200000, NamespaceID: 1000, Size: 10},
+				groot.IDMappingSpec{HostID: 100000, NamespaceID: 0, Size: 1000},
+			}
+		})
+
+		It("translates IDs relative to the start of the range", func() {
+			Expect(hostID(0)).To(Equal(100000))
+			Expect(hostID(999)).To(Equal(100999))
+			Expect(hostID(1005)).To(Equal(200005))
+		})
+	})
+
+	Context("when there are no mappings", func() {
+		BeforeEach(func() {
+			mappings = nil
+		})
+
+		It("doesn't translate IDs", func() {
+			Expect(hostID(1234)).To(Equal(1234))
+		})
+	})
+
+	Context("when namespace ID ranges overlap", func() {
+		BeforeEach(func() {
+			mappings = append(mappings, groot.IDMappingSpec{HostID: 300000, NamespaceID: 65535, Size: 10})
+		})
+
+		It("returns an error", func() {
+			_, err := groot.NewIDMap(mappings)
+			Expect(err).To(MatchError("namespace ids: id mappings 1:100000:65535 and 65535:300000:10 overlap"))
+		})
+	})
+
+	Context("when host ID ranges overlap", func() {
+		BeforeEach(func() {
+			mappings = append(mappings, groot.IDMappingSpec{HostID: 999, NamespaceID: 70000, Size: 2})
+		})
+
+		It("returns an error", func() {
+			_, err := groot.NewIDMap(mappings)
+			Expect(err).To(MatchError("host ids: id mappings 70000:999:2 and 0:1000:1 overlap"))
+		})
+	})
+
+	Context("when a mapping is empty", func() {
+		BeforeEach(func() {
+			mappings = append(mappings, groot.IDMappingSpec{HostID: 300000, NamespaceID: 70000, Size: 0})
+		})
+
+		It("returns an error", func() {
+			_, err := groot.NewIDMap(mappings)
+			Expect(err).To(MatchError("invalid id mapping 70000:300000:0"))
+		})
+	})
+})
@@ -0,0 +1,77 @@
+package groot
+
+import (
+	"net/url"
+
+	"code.cloudfoundry.org/lager"
+	errorspkg "github.com/pkg/errors"
+)
+
+type PullSpec struct {
+	// Name of the pull reference that keeps the layers from being cleaned up
+	Name         string
+	BaseImageURL *url.URL
+	UIDMappings  []IDMappingSpec
+	GIDMappings  []IDMappingSpec
+}
+
+type Puller struct {
+	baseImagePuller   BaseImagePuller
+	locksmith         Locksmith
+	dependencyManager DependencyManager
+}
+
+func IamPuller(baseImagePuller BaseImagePuller, locksmith Locksmith, dependencyManager DependencyManager) *Puller {
+	return &Puller{
+		baseImagePuller:   baseImagePuller,
+		locksmith:         locksmith,
+		dependencyManager: dependencyManager,
+	}
+}
+
+// Pull fetches the layers of the image into the store without creating an
+// image, and returns their chain IDs.
+func (p *Puller) Pull(logger lager.Logger, spec PullSpec) ([]string, error) {
+	logger = logger.Session("groot-pulling", lager.Data{"spec": spec})
+	logger.Info("starting")
+	defer logger.Info("ending")
+
+	ownerUid, ownerGid, err := parseOwner(spec.UIDMappings, spec.GIDMappings)
+	if err != nil {
+		return nil, err
+	}
+
+	baseImageSpec := BaseImageSpec{
+		UIDMappings: spec.UIDMappings,
+		GIDMappings: spec.GIDMappings,
+		OwnerUID:    ownerUid,
+		OwnerGID:    ownerGid,
+	}
+
+	baseImageInfo, err := p.baseImagePuller.FetchBaseImageInfo(logger)
+	if err != nil {
+		return nil, err
+	}
+	baseImageChainIDs := chainIDs(baseImageInfo.LayerInfos)
+
+	lockFile, err := p.locksmith.Lock(GlobalLockKey)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := p.locksmith.Unlock(lockFile); err != nil {
+			logger.Error("failed-to-unlock", err)
+		}
+	}()
+
+	if err := p.baseImagePuller.Pull(logger, baseImageInfo, baseImageSpec); err != nil {
+		return nil, errorspkg.Wrap(err, "pulling the image")
+	}
+
+	pullRefName := pullReference(spec.Name)
+	if err := p.dependencyManager.Register(pullRefName, baseImageChainIDs); err != nil {
+		return nil, errorspkg.Wrap(err, "registering the pull reference")
+	}
+
+	return baseImageChainIDs, nil
+}
@@ -0,0 +1,158 @@
+package groot_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+
+	"code.cloudfoundry.org/grootfs/groot"
+	"code.cloudfoundry.org/grootfs/groot/grootfakes"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Puller", func() {
+	var (
+		baseImageUrl          *url.URL
+		fakeBaseImagePuller   *grootfakes.FakeBaseImagePuller
+		fakeLocksmith         *grootfakes.FakeLocksmith
+		fakeDependencyManager *grootfakes.FakeDependencyManager
+		lockFile              *os.File
+
+		puller *groot.Puller
+		logger lager.Logger
+
+		baseImageInfo groot.BaseImageInfo
+	)
+
+	BeforeEach(func() {
+		baseImageUrl, _ = url.Parse("docker:///cfgarden/empty")
+
+		fakeBaseImagePuller = new(grootfakes.FakeBaseImagePuller)
+		fakeLocksmith = new(grootfakes.FakeLocksmith)
+		fakeDependencyManager = new(grootfakes.FakeDependencyManager)
+
+		var err error
+		lockFile, err = ioutil.TempFile("", "")
+		Expect(err).NotTo(HaveOccurred())
+		fakeLocksmith.LockReturns(lockFile, nil)
+
+		logger = lagertest.NewTestLogger("puller")
+
+		baseImageInfo = groot.BaseImageInfo{
+			LayerInfos: []groot.LayerInfo{
+				groot.LayerInfo{ChainID: "id-1"},
+				groot.LayerInfo{ChainID: "id-2"},
+			},
+		}
+		fakeBaseImagePuller.FetchBaseImageInfoReturns(baseImageInfo, nil)
+
+		puller = groot.IamPuller(fakeBaseImagePuller, fakeLocksmith, fakeDependencyManager)
+	})
+
+	AfterEach(func() {
+		Expect(os.Remove(lockFile.Name())).To(Succeed())
+	})
+
+	Describe("Pull", func() {
+		It("pulls the image while holding the global lock", func() {
+			uidMappings := []groot.IDMappingSpec{groot.IDMappingSpec{HostID: 2, NamespaceID: 0, Size: 1}}
+			gidMappings := []groot.IDMappingSpec{groot.IDMappingSpec{HostID: 3, NamespaceID: 0, Size: 1}}
+
+			_, err := puller.Pull(logger, groot.PullSpec{
+				Name:         "empty",
+				BaseImageURL: baseImageUrl,
+				UIDMappings:  uidMappings,
+				GIDMappings:  gidMappings,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeLocksmith.LockCallCount()).To(Equal(1))
+			Expect(fakeLocksmith.LockArgsForCall(0)).To(Equal(groot.GlobalLockKey))
+			Expect(fakeLocksmith.UnlockCallCount()).To(Equal(1))
+			Expect(fakeLocksmith.UnlockArgsForCall(0)).To(Equal(lockFile))
+
+			Expect(fakeBaseImagePuller.PullCallCount()).To(Equal(1))
+			_, actualBaseImageInfo, baseImageSpec := fakeBaseImagePuller.PullArgsForCall(0)
+			Expect(actualBaseImageInfo).To(Equal(baseImageInfo))
+			Expect(baseImageSpec).To(Equal(groot.BaseImageSpec{
+				UIDMappings: uidMappings,
+				GIDMappings: gidMappings,
+				OwnerUID:    2,
+				OwnerGID:    3,
+			}))
+		})
+
+		It("registers the layers under the pull reference", func() {
+			_, err := puller.Pull(logger, groot.PullSpec{Name: "empty", BaseImageURL: baseImageUrl})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeDependencyManager.RegisterCallCount()).To(Equal(1))
+			id, chainIDs := fakeDependencyManager.RegisterArgsForCall(0)
+			Expect(id).To(Equal("pull:ZW1wdHk"))
+			Expect(chainIDs).To(Equal([]string{"id-1", "id-2"}))
+		})
+
+		It("keeps the pull references of different names apart", func() {
+			for _, name := range []string{"a/b", "a__b", "docker:///busybox"} {
+				_, err := puller.Pull(logger, groot.PullSpec{Name: name, BaseImageURL: baseImageUrl})
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			ids := []string{}
+			for i := 0; i < fakeDependencyManager.RegisterCallCount(); i++ {
+				id, _ := fakeDependencyManager.RegisterArgsForCall(i)
+				Expect(id).To(HavePrefix("pull:"))
+				Expect(id).NotTo(ContainSubstring("/"))
+				ids = append(ids, id)
+			}
+			Expect(ids).To(Equal([]string{"pull:YS9i", "pull:YV9fYg", "pull:ZG9ja2VyOi8vL2J1c3lib3g"}))
+		})
+
+		It("returns the chain IDs", func() {
+			chainIDs, err := puller.Pull(logger, groot.PullSpec{Name: "empty", BaseImageURL: baseImageUrl})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(chainIDs).To(Equal([]string{"id-1", "id-2"}))
+		})
+
+		Context("when fetching the image info fails", func() {
+			BeforeEach(func() {
+				fakeBaseImagePuller.FetchBaseImageInfoReturns(groot.BaseImageInfo{}, errors.New("registry is down"))
+			})
+
+			It("returns the error without pulling", func() {
+				_, err := puller.Pull(logger, groot.PullSpec{Name: "empty", BaseImageURL: baseImageUrl})
+				Expect(err).To(MatchError("registry is down"))
+				Expect(fakeBaseImagePuller.PullCallCount()).To(BeZero())
+			})
+		})
+
+		Context("when pulling fails", func() {
+			BeforeEach(func() {
+				fakeBaseImagePuller.PullReturns(errors.New("failed to pull"))
+			})
+
+			It("doesn't register the pull reference", func() {
+				_, err := puller.Pull(logger, groot.PullSpec{Name: "empty", BaseImageURL: baseImageUrl})
+				Expect(err).To(MatchError(ContainSubstring("failed to pull")))
+				Expect(fakeDependencyManager.RegisterCallCount()).To(BeZero())
+				Expect(fakeLocksmith.UnlockCallCount()).To(Equal(1))
+			})
+		})
+
+		Context("when registering the pull reference fails", func() {
+			BeforeEach(func() {
+				fakeDependencyManager.RegisterReturns(errors.New("disk full"))
+			})
+
+			It("returns an error", func() {
+				_, err := puller.Pull(logger, groot.PullSpec{Name: "empty", BaseImageURL: baseImageUrl})
+				Expect(err).To(MatchError(ContainSubstring("disk full")))
+			})
+		})
+	})
+})
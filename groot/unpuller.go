@@ -0,0 +1,36 @@
+package groot
+
+import (
+	"os"
+
+	"code.cloudfoundry.org/lager"
+	errorspkg "github.com/pkg/errors"
+)
+
+type Unpuller struct {
+	dependencyManager DependencyManager
+}
+
+func IamUnpuller(dependencyManager DependencyManager) *Unpuller {
+	return &Unpuller{
+		dependencyManager: dependencyManager,
+	}
+}
+
+// Unpull drops the pull reference, so that its layers are cleaned up once
+// no image uses them.
+func (u *Unpuller) Unpull(logger lager.Logger, name string) error {
+	logger = logger.Session("groot-unpulling", lager.Data{"name": name})
+	logger.Info("starting")
+	defer logger.Info("ending")
+
+	pullRefName := pullReference(name)
+	if err := u.dependencyManager.Deregister(pullRefName); err != nil {
+		if os.IsNotExist(errorspkg.Cause(err)) {
+			return errorspkg.Errorf("pull reference `%s` not found", name)
+		}
+		return err
+	}
+
+	return nil
+}
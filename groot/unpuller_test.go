@@ -0,0 +1,47 @@
+package groot_test
+
+import (
+	"os"
+
+	"code.cloudfoundry.org/grootfs/groot"
+	"code.cloudfoundry.org/grootfs/groot/grootfakes"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	errorspkg "github.com/pkg/errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Unpuller", func() {
+	var (
+		fakeDependencyManager *grootfakes.FakeDependencyManager
+		unpuller              *groot.Unpuller
+		logger                lager.Logger
+	)
+
+	BeforeEach(func() {
+		fakeDependencyManager = new(grootfakes.FakeDependencyManager)
+		logger = lagertest.NewTestLogger("unpuller")
+		unpuller = groot.IamUnpuller(fakeDependencyManager)
+	})
+
+	Describe("Unpull", func() {
+		It("deregisters the pull reference", func() {
+			Expect(unpuller.Unpull(logger, "empty")).To(Succeed())
+
+			Expect(fakeDependencyManager.DeregisterCallCount()).To(Equal(1))
+			Expect(fakeDependencyManager.DeregisterArgsForCall(0)).To(Equal("pull:ZW1wdHk"))
+		})
+
+		Context("when the pull reference doesn't exist", func() {
+			BeforeEach(func() {
+				fakeDependencyManager.DeregisterReturns(errorspkg.Wrap(os.ErrNotExist, "removing"))
+			})
+
+			It("returns an error", func() {
+				Expect(unpuller.Unpull(logger, "empty")).To(MatchError("pull reference `empty` not found"))
+			})
+		})
+	})
+})
@@ -253,7 +253,7 @@ var _ = Describe("Create with local TAR images", func() {
 	})
 
 	Context("when the tar has files that point outside the root dir", func() {
-		It("doesn't leak the file", func() {
+		It("fails without leaking the file", func() {
 			workDir, err := os.Getwd()
 			Expect(err).NotTo(HaveOccurred())
 			baseImagePath := fmt.Sprintf("%s/assets/hacked.tar", workDir)
@@ -262,7 +262,7 @@ var _ = Describe("Create with local TAR images", func() {
 				ID:           "image-1",
 				BaseImageURL: integration.String2URL(baseImagePath),
 			})
-			Expect(err).NotTo(HaveOccurred())
+			Expect(err).To(MatchError(ContainSubstring("outside of the layer")))
 
 			Expect(filepath.Join(StorePath, store.VolumesDirName, "file_outside_root")).ToNot(BeAnExistingFile())
 		})
@@ -88,6 +88,8 @@ func main() {
 		commands.GenerateVolumeSizeMetadata,
 		commands.CreateCommand,
 		commands.DeleteCommand,
+		commands.PullCommand,
+		commands.UnpullCommand,
 		commands.StatsCommand,
 		commands.CleanCommand,
 		commands.ListCommand,
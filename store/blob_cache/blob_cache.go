@@ -0,0 +1,202 @@
+package blob_cache // import "code.cloudfoundry.org/grootfs/store/blob_cache"
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	errorspkg "github.com/pkg/errors"
+)
+
+const (
+	partialPrefix = ".partial-"
+	// partial entries older than this are left behind by crashed processes
+	stalePartialAge = 24 * time.Hour
+)
+
+// BlobCache keeps downloaded blobs in a directory, named after their
+// digest. Entries are evicted, least recently used first, when the cache
+// grows bigger than its maximum size. Writes are atomic, so the cache can be
+// shared by concurrent processes without locking.
+type BlobCache struct {
+	path         string
+	maxSizeBytes int64
+}
+
+func NewBlobCache(path string, maxSizeBytes int64) *BlobCache {
+	return &BlobCache{
+		path:         path,
+		maxSizeBytes: maxSizeBytes,
+	}
+}
+
+// Open returns the cached blob, or false when the blob is not in the cache.
+// The blob contents are not verified; that is up to the caller.
+func (c *BlobCache) Open(digest string) (io.ReadCloser, int64, bool, error) {
+	blobPath, err := c.blobPath(digest)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	blob, err := os.Open(blobPath)
+	if os.IsNotExist(err) {
+		return nil, 0, false, nil
+	}
+	if err != nil {
+		return nil, 0, false, errorspkg.Wrap(err, "opening cached blob")
+	}
+
+	stat, err := blob.Stat()
+	if err != nil {
+		blob.Close()
+		return nil, 0, false, errorspkg.Wrap(err, "reading cached blob size")
+	}
+
+	// the modification time tracks the last use of the entry
+	now := time.Now()
+	_ = os.Chtimes(blobPath, now, now)
+
+	return blob, stat.Size(), true, nil
+}
+
+// NewEntry returns a writer for a blob. The blob is only visible in the cache
+// once the entry is committed.
+func (c *BlobCache) NewEntry(digest string) (*Entry, error) {
+	if _, err := c.blobPath(digest); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(c.path, 0755); err != nil {
+		return nil, errorspkg.Wrap(err, "creating blob cache directory")
+	}
+
+	file, err := ioutil.TempFile(c.path, partialPrefix)
+	if err != nil {
+		return nil, errorspkg.Wrap(err, "creating blob cache entry")
+	}
+
+	return &Entry{
+		cache:  c,
+		digest: digest,
+		file:   file,
+	}, nil
+}
+
+func (c *BlobCache) Remove(digest string) error {
+	blobPath, err := c.blobPath(digest)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(blobPath); err != nil && !os.IsNotExist(err) {
+		return errorspkg.Wrap(err, "removing cached blob")
+	}
+
+	return nil
+}
+
+func (c *BlobCache) blobPath(digest string) (string, error) {
+	parts := strings.Split(digest, ":")
+	if len(parts) != 2 || parts[1] == "" || strings.ContainsAny(parts[1], "/.") {
+		return "", errorspkg.Errorf("invalid blob digest `%s`", digest)
+	}
+
+	return filepath.Join(c.path, parts[0]+"-"+parts[1]), nil
+}
+
+// evict removes the least recently used blobs until the cache fits in its
+// maximum size
+func (c *BlobCache) evict(logger lager.Logger) error {
+	entries, err := ioutil.ReadDir(c.path)
+	if err != nil {
+		return errorspkg.Wrap(err, "listing blob cache")
+	}
+
+	blobs := []os.FileInfo{}
+	var totalSize int64
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), partialPrefix) {
+			if time.Since(entry.ModTime()) > stalePartialAge {
+				_ = os.Remove(filepath.Join(c.path, entry.Name()))
+			}
+			continue
+		}
+
+		blobs = append(blobs, entry)
+		totalSize += entry.Size()
+	}
+
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].ModTime().Before(blobs[j].ModTime())
+	})
+
+	for _, blob := range blobs {
+		if totalSize <= c.maxSizeBytes {
+			break
+		}
+
+		logger.Debug("evicting-blob", lager.Data{"blob": blob.Name(), "size": blob.Size()})
+		if err := os.Remove(filepath.Join(c.path, blob.Name())); err != nil && !os.IsNotExist(err) {
+			return errorspkg.Wrap(err, "evicting cached blob")
+		}
+		totalSize -= blob.Size()
+	}
+
+	return nil
+}
+
+type Entry struct {
+	cache  *BlobCache
+	digest string
+	file   *os.File
+}
+
+func (e *Entry) Write(p []byte) (int, error) {
+	return e.file.Write(p)
+}
+
+// Commit adds the blob to the cache and evicts old blobs if needed. Blobs
+// bigger than the cache are discarded.
+func (e *Entry) Commit(logger lager.Logger) error {
+	logger = logger.Session("blob-cache-commit", lager.Data{"digest": e.digest})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	stat, err := e.file.Stat()
+	if err != nil {
+		e.Discard()
+		return errorspkg.Wrap(err, "reading blob cache entry size")
+	}
+
+	if stat.Size() > e.cache.maxSizeBytes {
+		logger.Debug("blob-bigger-than-cache", lager.Data{"size": stat.Size(), "maxSizeBytes": e.cache.maxSizeBytes})
+		return e.Discard()
+	}
+
+	if err := e.file.Close(); err != nil {
+		e.Discard()
+		return errorspkg.Wrap(err, "closing blob cache entry")
+	}
+
+	blobPath, _ := e.cache.blobPath(e.digest)
+	if err := os.Rename(e.file.Name(), blobPath); err != nil {
+		e.Discard()
+		return errorspkg.Wrap(err, "committing blob cache entry")
+	}
+
+	return e.cache.evict(logger)
+}
+
+func (e *Entry) Discard() error {
+	e.file.Close()
+	if err := os.Remove(e.file.Name()); err != nil && !os.IsNotExist(err) {
+		return errorspkg.Wrap(err, "discarding blob cache entry")
+	}
+
+	return nil
+}
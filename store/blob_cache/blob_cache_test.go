@@ -0,0 +1,158 @@
+package blob_cache_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/grootfs/store/blob_cache"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("BlobCache", func() {
+	var (
+		cachePath    string
+		maxSizeBytes int64
+		cache        *blob_cache.BlobCache
+		logger       lager.Logger
+	)
+
+	BeforeEach(func() {
+		var err error
+		cachePath, err = ioutil.TempDir("", "blob-cache")
+		Expect(err).NotTo(HaveOccurred())
+		cachePath = filepath.Join(cachePath, "blobs")
+		maxSizeBytes = 10
+		logger = lagertest.NewTestLogger("blob-cache")
+	})
+
+	JustBeforeEach(func() {
+		cache = blob_cache.NewBlobCache(cachePath, maxSizeBytes)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(filepath.Dir(cachePath))).To(Succeed())
+	})
+
+	put := func(digest, contents string) {
+		entry, err := cache.NewEntry(digest)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = entry.Write([]byte(contents))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entry.Commit(logger)).To(Succeed())
+	}
+
+	get := func(digest string) (string, bool) {
+		blob, size, ok, err := cache.Open(digest)
+		Expect(err).NotTo(HaveOccurred())
+		if !ok {
+			return "", false
+		}
+		defer blob.Close()
+
+		contents, err := ioutil.ReadAll(blob)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(size).To(Equal(int64(len(contents))))
+		return string(contents), true
+	}
+
+	It("returns committed blobs", func() {
+		put("sha256:aaa", "hello")
+
+		contents, ok := get("sha256:aaa")
+		Expect(ok).To(BeTrue())
+		Expect(contents).To(Equal("hello"))
+	})
+
+	It("reports blobs that are not in the cache", func() {
+		_, ok := get("sha256:aaa")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("does not return discarded entries", func() {
+		entry, err := cache.NewEntry("sha256:aaa")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = entry.Write([]byte("hello"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entry.Discard()).To(Succeed())
+
+		_, ok := get("sha256:aaa")
+		Expect(ok).To(BeFalse())
+		Expect(ioutil.ReadDir(cachePath)).To(BeEmpty())
+	})
+
+	It("removes blobs", func() {
+		put("sha256:aaa", "hello")
+		Expect(cache.Remove("sha256:aaa")).To(Succeed())
+
+		_, ok := get("sha256:aaa")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("rejects invalid digests", func() {
+		_, err := cache.NewEntry("sha256:../../etc")
+		Expect(err).To(MatchError(ContainSubstring("invalid blob digest")))
+
+		_, _, _, err = cache.Open("not-a-digest")
+		Expect(err).To(MatchError(ContainSubstring("invalid blob digest")))
+	})
+
+	Context("when the cache grows bigger than its maximum size", func() {
+		It("evicts the least recently used blobs", func() {
+			put("sha256:aaa", "1234")
+			put("sha256:bbb", "5678")
+			backdate(cachePath, "sha256-aaa", 2*time.Minute)
+			backdate(cachePath, "sha256-bbb", time.Minute)
+
+			_, ok := get("sha256:aaa")
+			Expect(ok).To(BeTrue())
+
+			put("sha256:ccc", "9012")
+
+			_, ok = get("sha256:bbb")
+			Expect(ok).To(BeFalse())
+			_, ok = get("sha256:aaa")
+			Expect(ok).To(BeTrue())
+			_, ok = get("sha256:ccc")
+			Expect(ok).To(BeTrue())
+		})
+	})
+
+	Context("when a blob is bigger than the cache", func() {
+		It("does not cache it", func() {
+			put("sha256:aaa", "hello")
+			put("sha256:bbb", "this is too big")
+
+			_, ok := get("sha256:bbb")
+			Expect(ok).To(BeFalse())
+			_, ok = get("sha256:aaa")
+			Expect(ok).To(BeTrue())
+		})
+	})
+
+	Context("when a process crashed while writing an entry", func() {
+		var stalePartial string
+
+		JustBeforeEach(func() {
+			Expect(os.MkdirAll(cachePath, 0755)).To(Succeed())
+			stalePartial = filepath.Join(cachePath, ".partial-123")
+			Expect(ioutil.WriteFile(stalePartial, []byte("half a blob"), 0644)).To(Succeed())
+			backdate(cachePath, ".partial-123", 48*time.Hour)
+		})
+
+		It("removes the partial entry during eviction", func() {
+			put("sha256:aaa", "hello")
+			Expect(stalePartial).NotTo(BeAnExistingFile())
+		})
+	})
+})
+
+func backdate(cachePath, name string, age time.Duration) {
+	past := time.Now().Add(-age)
+	Expect(os.Chtimes(filepath.Join(cachePath, name), past, past)).To(Succeed())
+}
@@ -0,0 +1,85 @@
+package cache_dir // import "code.cloudfoundry.org/grootfs/store/cache_dir"
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	errorspkg "github.com/pkg/errors"
+)
+
+// IncompletePrefix is the prefix of the files being written, which are not
+// entries of the directory yet
+const IncompletePrefix = ".incomplete-"
+
+// WriteFile replaces the file atomically, so that concurrent processes never
+// read it partially written. The directory of the file is created with the
+// given mode when it doesn't exist.
+func WriteFile(path string, contents []byte, dirMode os.FileMode) error {
+	dirPath := filepath.Dir(path)
+	if err := os.MkdirAll(dirPath, dirMode); err != nil {
+		return errorspkg.Wrap(err, "creating cache directory")
+	}
+
+	tempFile, err := ioutil.TempFile(dirPath, IncompletePrefix)
+	if err != nil {
+		return errorspkg.Wrap(err, "creating cache file")
+	}
+	defer os.Remove(tempFile.Name())
+
+	if _, err := tempFile.Write(contents); err != nil {
+		tempFile.Close()
+		return errorspkg.Wrap(err, "writing cache file")
+	}
+	if err := tempFile.Close(); err != nil {
+		return errorspkg.Wrap(err, "writing cache file")
+	}
+
+	return errorspkg.Wrap(os.Rename(tempFile.Name(), path), "writing cache file")
+}
+
+// Touch marks the file as used now. The mtime of an entry is when it was last
+// used.
+func Touch(path string) error {
+	now := time.Now()
+	return os.Chtimes(path, now, now)
+}
+
+// Evict removes the least recently used entries of the directory over
+// maxEntries. There is no limit when maxEntries is not positive.
+func Evict(logger lager.Logger, dirPath string, maxEntries int) {
+	if maxEntries <= 0 {
+		return
+	}
+
+	files, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		logger.Error("listing-cache-entries-failed", err, lager.Data{"path": dirPath})
+		return
+	}
+
+	entries := []os.FileInfo{}
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), IncompletePrefix) {
+			entries = append(entries, file)
+		}
+	}
+	if len(entries) <= maxEntries {
+		return
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+
+	for _, entry := range entries[:len(entries)-maxEntries] {
+		logger.Debug("evicting-cache-entry", lager.Data{"path": dirPath, "entry": entry.Name()})
+		if err := os.Remove(filepath.Join(dirPath, entry.Name())); err != nil && !os.IsNotExist(err) {
+			logger.Error("evicting-cache-entry-failed", err, lager.Data{"path": dirPath, "entry": entry.Name()})
+		}
+	}
+}
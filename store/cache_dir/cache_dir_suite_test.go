@@ -0,0 +1,13 @@
+package cache_dir_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestCacheDir(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CacheDir Suite")
+}
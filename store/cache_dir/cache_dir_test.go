@@ -0,0 +1,107 @@
+package cache_dir_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/grootfs/store/cache_dir"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CacheDir", func() {
+	var (
+		tmpDir  string
+		dirPath string
+		logger  lager.Logger
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "cache-dir")
+		Expect(err).NotTo(HaveOccurred())
+		dirPath = filepath.Join(tmpDir, "entries")
+
+		logger = lagertest.NewTestLogger("cache-dir")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	Describe("WriteFile", func() {
+		It("creates the directory and writes the file", func() {
+			Expect(cache_dir.WriteFile(filepath.Join(dirPath, "entry"), []byte("contents"), 0700)).To(Succeed())
+
+			stat, err := os.Stat(dirPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stat.Mode().Perm()).To(Equal(os.FileMode(0700)))
+			Expect(ioutil.ReadFile(filepath.Join(dirPath, "entry"))).To(Equal([]byte("contents")))
+		})
+
+		It("replaces the file without leaving incomplete files behind", func() {
+			Expect(cache_dir.WriteFile(filepath.Join(dirPath, "entry"), []byte("old"), 0755)).To(Succeed())
+			Expect(cache_dir.WriteFile(filepath.Join(dirPath, "entry"), []byte("new"), 0755)).To(Succeed())
+
+			Expect(ioutil.ReadFile(filepath.Join(dirPath, "entry"))).To(Equal([]byte("new")))
+			Expect(filepath.Glob(filepath.Join(dirPath, cache_dir.IncompletePrefix+"*"))).To(BeEmpty())
+		})
+	})
+
+	Describe("Evict", func() {
+		writeEntry := func(name string, age time.Duration) {
+			path := filepath.Join(dirPath, name)
+			Expect(cache_dir.WriteFile(path, []byte(name), 0755)).To(Succeed())
+			usedAt := time.Now().Add(-age)
+			Expect(os.Chtimes(path, usedAt, usedAt)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			writeEntry("oldest", 3*time.Hour)
+			writeEntry("older", 2*time.Hour)
+			writeEntry("newest", time.Hour)
+		})
+
+		It("removes the least recently used entries over the limit", func() {
+			cache_dir.Evict(logger, dirPath, 2)
+
+			Expect(filepath.Join(dirPath, "oldest")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(dirPath, "older")).To(BeAnExistingFile())
+			Expect(filepath.Join(dirPath, "newest")).To(BeAnExistingFile())
+		})
+
+		It("keeps touched entries", func() {
+			Expect(cache_dir.Touch(filepath.Join(dirPath, "oldest"))).To(Succeed())
+			cache_dir.Evict(logger, dirPath, 2)
+
+			Expect(filepath.Join(dirPath, "oldest")).To(BeAnExistingFile())
+			Expect(filepath.Join(dirPath, "older")).NotTo(BeAnExistingFile())
+		})
+
+		It("ignores the files being written", func() {
+			incompletePath := filepath.Join(dirPath, cache_dir.IncompletePrefix+"entry")
+			Expect(ioutil.WriteFile(incompletePath, []byte{}, 0600)).To(Succeed())
+			past := time.Now().Add(-4 * time.Hour)
+			Expect(os.Chtimes(incompletePath, past, past)).To(Succeed())
+
+			cache_dir.Evict(logger, dirPath, 3)
+
+			Expect(incompletePath).To(BeAnExistingFile())
+			Expect(filepath.Join(dirPath, "oldest")).To(BeAnExistingFile())
+		})
+
+		Context("when there is no limit", func() {
+			It("keeps every entry", func() {
+				cache_dir.Evict(logger, dirPath, 0)
+
+				entries, err := ioutil.ReadDir(dirPath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(entries).To(HaveLen(3))
+			})
+		})
+	})
+})
@@ -51,7 +51,38 @@ func (d *DependencyManager) Dependencies(id string) ([]string, error) {
 	return chainIDs, nil
 }
 
+// DependenciesWithPrefix returns the dependencies of every id that starts
+// with the prefix
+func (d *DependencyManager) DependenciesWithPrefix(prefix string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(d.dependenciesPath, escapeID(prefix)+"*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	chainIDs := []string{}
+	for _, path := range paths {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		var dependencies []string
+		if err := json.Unmarshal(contents, &dependencies); err != nil {
+			return nil, errorspkg.Wrapf(err, "parsing `%s`", path)
+		}
+		chainIDs = append(chainIDs, dependencies...)
+	}
+
+	return chainIDs, nil
+}
+
 func (d *DependencyManager) filePath(id string) string {
-	escapedId := strings.Replace(id, "/", "__", -1)
-	return filepath.Join(d.dependenciesPath, fmt.Sprintf("%s.json", escapedId))
+	return filepath.Join(d.dependenciesPath, fmt.Sprintf("%s.json", escapeID(id)))
+}
+
+func escapeID(id string) string {
+	return strings.Replace(id, "/", "__", -1)
 }
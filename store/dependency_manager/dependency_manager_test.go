@@ -88,4 +88,26 @@ var _ = Describe("DependencyManager", func() {
 			})
 		})
 	})
+
+	Describe("DependenciesWithPrefix", func() {
+		BeforeEach(func() {
+			Expect(manager.Register("pull:docker:///ubuntu", []string{"sha256:vol-1", "sha256:vol-2"})).To(Succeed())
+			Expect(manager.Register("pull:my-busybox", []string{"sha256:vol-3"})).To(Succeed())
+			Expect(manager.Register("image:my-image", []string{"sha256:vol-4"})).To(Succeed())
+		})
+
+		It("returns the dependencies of the ids with the prefix", func() {
+			dependencies, err := manager.DependenciesWithPrefix("pull:")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dependencies).To(ConsistOf("sha256:vol-1", "sha256:vol-2", "sha256:vol-3"))
+		})
+
+		Context("when no id has the prefix", func() {
+			It("returns no dependencies", func() {
+				dependencies, err := manager.DependenciesWithPrefix("baseimage:")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(dependencies).To(BeEmpty())
+			})
+		})
+	})
 })
@@ -0,0 +1,71 @@
+package digest_cache // import "code.cloudfoundry.org/grootfs/store/digest_cache"
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/grootfs/store/cache_dir"
+	"code.cloudfoundry.org/lager"
+	errorspkg "github.com/pkg/errors"
+)
+
+// DefaultMaxEntries is how many digests are kept unless configured otherwise
+const DefaultMaxEntries = 1024
+
+// DigestCache keeps the content digests of local base images in a directory,
+// keyed by what identifies an unchanged image, e.g. its inode, size and
+// mtime. Keys of changed images are never looked up again, so only the
+// maxEntries most recently used digests are kept.
+type DigestCache struct {
+	path       string
+	maxEntries int
+}
+
+func NewDigestCache(path string, maxEntries int) *DigestCache {
+	return &DigestCache{
+		path:       path,
+		maxEntries: maxEntries,
+	}
+}
+
+// Get returns the cached digest of the key, if there is one
+func (c *DigestCache) Get(logger lager.Logger, key string) (string, bool) {
+	entryPath := filepath.Join(c.path, key)
+	digest, err := ioutil.ReadFile(entryPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error("reading-cached-digest-failed", err, lager.Data{"key": key})
+		}
+		return "", false
+	}
+
+	if err := cache_dir.Touch(entryPath); err != nil {
+		logger.Error("touching-cached-digest-failed", err, lager.Data{"key": key})
+	}
+
+	return string(digest), true
+}
+
+// Remove drops the cached digest of the key, e.g. when it turns out to be
+// stale
+func (c *DigestCache) Remove(logger lager.Logger, key string) error {
+	logger.Debug("removing-cached-digest", lager.Data{"key": key})
+	if err := os.Remove(filepath.Join(c.path, key)); err != nil && !os.IsNotExist(err) {
+		return errorspkg.Wrap(err, "removing cached digest")
+	}
+
+	return nil
+}
+
+// Put caches the digest of the key atomically, so that concurrent creates
+// never read a partially written digest, and evicts the least recently used
+// digests over the limit.
+func (c *DigestCache) Put(logger lager.Logger, key, digest string) error {
+	if err := cache_dir.WriteFile(filepath.Join(c.path, key), []byte(digest), 0755); err != nil {
+		return errorspkg.Wrap(err, "caching digest")
+	}
+
+	cache_dir.Evict(logger, c.path, c.maxEntries)
+	return nil
+}
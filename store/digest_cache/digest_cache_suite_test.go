@@ -0,0 +1,13 @@
+package digest_cache_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestDigestCache(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "DigestCache Suite")
+}
@@ -0,0 +1,88 @@
+package digest_cache_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/grootfs/store/digest_cache"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DigestCache", func() {
+	var (
+		cachePath   string
+		digestCache *digest_cache.DigestCache
+		logger      lager.Logger
+	)
+
+	BeforeEach(func() {
+		var err error
+		cachePath, err = ioutil.TempDir("", "digest-cache")
+		Expect(err).NotTo(HaveOccurred())
+		cachePath = filepath.Join(cachePath, "digests")
+
+		digestCache = digest_cache.NewDigestCache(cachePath, 2)
+		logger = lagertest.NewTestLogger("digest-cache")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(filepath.Dir(cachePath))).To(Succeed())
+	})
+
+	It("returns the cached digests", func() {
+		Expect(digestCache.Put(logger, "key", "digest")).To(Succeed())
+
+		digest, ok := digestCache.Get(logger, "key")
+		Expect(ok).To(BeTrue())
+		Expect(digest).To(Equal("digest"))
+	})
+
+	It("removes cached digests", func() {
+		Expect(digestCache.Put(logger, "key", "digest")).To(Succeed())
+		Expect(digestCache.Remove(logger, "key")).To(Succeed())
+
+		_, ok := digestCache.Get(logger, "key")
+		Expect(ok).To(BeFalse())
+		Expect(digestCache.Remove(logger, "key")).To(Succeed())
+	})
+
+	Context("when the key is not cached", func() {
+		It("returns false", func() {
+			_, ok := digestCache.Get(logger, "key")
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Context("when there are more digests than the limit", func() {
+		BeforeEach(func() {
+			past := time.Now().Add(-time.Hour)
+			Expect(digestCache.Put(logger, "first", "digest-1")).To(Succeed())
+			Expect(os.Chtimes(filepath.Join(cachePath, "first"), past, past)).To(Succeed())
+			Expect(digestCache.Put(logger, "second", "digest-2")).To(Succeed())
+			Expect(os.Chtimes(filepath.Join(cachePath, "second"), past.Add(time.Minute), past.Add(time.Minute))).To(Succeed())
+		})
+
+		It("evicts the least recently used digests", func() {
+			_, ok := digestCache.Get(logger, "first")
+			Expect(ok).To(BeTrue())
+
+			Expect(digestCache.Put(logger, "third", "digest-3")).To(Succeed())
+
+			_, ok = digestCache.Get(logger, "second")
+			Expect(ok).To(BeFalse())
+			_, ok = digestCache.Get(logger, "first")
+			Expect(ok).To(BeTrue())
+			_, ok = digestCache.Get(logger, "third")
+			Expect(ok).To(BeTrue())
+
+			entries, err := ioutil.ReadDir(cachePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(HaveLen(2))
+		})
+	})
+})
@@ -21,6 +21,19 @@ type FakeDependencyManager struct {
 		result1 []string
 		result2 error
 	}
+	DependenciesWithPrefixStub        func(prefix string) ([]string, error)
+	dependenciesWithPrefixMutex       sync.RWMutex
+	dependenciesWithPrefixArgsForCall []struct {
+		prefix string
+	}
+	dependenciesWithPrefixReturns struct {
+		result1 []string
+		result2 error
+	}
+	dependenciesWithPrefixReturnsOnCall map[int]struct {
+		result1 []string
+		result2 error
+	}
 	invocations      map[string][][]interface{}
 	invocationsMutex sync.RWMutex
 }
@@ -76,11 +89,64 @@ func (fake *FakeDependencyManager) DependenciesReturnsOnCall(i int, result1 []st
 	}{result1, result2}
 }
 
+func (fake *FakeDependencyManager) DependenciesWithPrefix(prefix string) ([]string, error) {
+	fake.dependenciesWithPrefixMutex.Lock()
+	ret, specificReturn := fake.dependenciesWithPrefixReturnsOnCall[len(fake.dependenciesWithPrefixArgsForCall)]
+	fake.dependenciesWithPrefixArgsForCall = append(fake.dependenciesWithPrefixArgsForCall, struct {
+		prefix string
+	}{prefix})
+	fake.recordInvocation("DependenciesWithPrefix", []interface{}{prefix})
+	fake.dependenciesWithPrefixMutex.Unlock()
+	if fake.DependenciesWithPrefixStub != nil {
+		return fake.DependenciesWithPrefixStub(prefix)
+	}
+	if specificReturn {
+		return ret.result1, ret.result2
+	}
+	return fake.dependenciesWithPrefixReturns.result1, fake.dependenciesWithPrefixReturns.result2
+}
+
+func (fake *FakeDependencyManager) DependenciesWithPrefixCallCount() int {
+	fake.dependenciesWithPrefixMutex.RLock()
+	defer fake.dependenciesWithPrefixMutex.RUnlock()
+	return len(fake.dependenciesWithPrefixArgsForCall)
+}
+
+func (fake *FakeDependencyManager) DependenciesWithPrefixArgsForCall(i int) string {
+	fake.dependenciesWithPrefixMutex.RLock()
+	defer fake.dependenciesWithPrefixMutex.RUnlock()
+	return fake.dependenciesWithPrefixArgsForCall[i].prefix
+}
+
+func (fake *FakeDependencyManager) DependenciesWithPrefixReturns(result1 []string, result2 error) {
+	fake.DependenciesWithPrefixStub = nil
+	fake.dependenciesWithPrefixReturns = struct {
+		result1 []string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeDependencyManager) DependenciesWithPrefixReturnsOnCall(i int, result1 []string, result2 error) {
+	fake.DependenciesWithPrefixStub = nil
+	if fake.dependenciesWithPrefixReturnsOnCall == nil {
+		fake.dependenciesWithPrefixReturnsOnCall = make(map[int]struct {
+			result1 []string
+			result2 error
+		})
+	}
+	fake.dependenciesWithPrefixReturnsOnCall[i] = struct {
+		result1 []string
+		result2 error
+	}{result1, result2}
+}
+
 func (fake *FakeDependencyManager) Invocations() map[string][][]interface{} {
 	fake.invocationsMutex.RLock()
 	defer fake.invocationsMutex.RUnlock()
 	fake.dependenciesMutex.RLock()
 	defer fake.dependenciesMutex.RUnlock()
+	fake.dependenciesWithPrefixMutex.RLock()
+	defer fake.dependenciesWithPrefixMutex.RUnlock()
 	copiedInvocations := map[string][][]interface{}{}
 	for key, value := range fake.invocations {
 		copiedInvocations[key] = value
@@ -20,6 +20,7 @@ type ImageCloner interface {
 
 type DependencyManager interface {
 	Dependencies(id string) ([]string, error)
+	DependenciesWithPrefix(prefix string) ([]string, error)
 }
 
 type VolumeDriver interface {
@@ -162,6 +163,12 @@ func (g *GarbageCollector) UnusedVolumes(logger lager.Logger) ([]string, error)
 		g.removeDependencyFromOrphanList(orphanedVolumes, usedVolumes)
 	}
 
+	pulledVolumes, err := g.dependencyManager.DependenciesWithPrefix(groot.PullReferencePrefix)
+	if err != nil {
+		return nil, errorspkg.Wrap(err, "failed to retrieve pulled images")
+	}
+	g.removeDependencyFromOrphanList(orphanedVolumes, pulledVolumes)
+
 	orphanedVolumeIDs := []string{}
 	for id := range orphanedVolumes {
 		orphanedVolumeIDs = append(orphanedVolumeIDs, id)
@@ -73,6 +73,31 @@ var _ = Describe("Gc", func() {
 			Expect(unusedVolumes).To(ConsistOf("sha256ubuntu", "sha256privateubuntu", "unusedLayerVolume", "unusedLocalVolume-timestamp"))
 		})
 
+		Context("when images were pulled", func() {
+			BeforeEach(func() {
+				fakeDependencyManager.DependenciesWithPrefixReturns([]string{"sha256ubuntu", "volDocker2"}, nil)
+			})
+
+			It("doesn't return their volumes", func() {
+				unusedVolumes, err := garbageCollector.UnusedVolumes(logger)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(fakeDependencyManager.DependenciesWithPrefixArgsForCall(0)).To(Equal("pull:"))
+				Expect(unusedVolumes).To(ConsistOf("sha256privateubuntu", "unusedLayerVolume", "unusedLocalVolume-timestamp"))
+			})
+		})
+
+		Context("when getting the dependencies of pulled images fails", func() {
+			BeforeEach(func() {
+				fakeDependencyManager.DependenciesWithPrefixReturns(nil, errors.New("failed to list pulls"))
+			})
+
+			It("returns an error", func() {
+				_, err := garbageCollector.UnusedVolumes(logger)
+				Expect(err).To(MatchError(ContainSubstring("failed to list pulls")))
+			})
+		})
+
 		Context("when retrieving images fails", func() {
 			BeforeEach(func() {
 				fakeImageCloner.ImageIDsReturns(nil, errors.New("failed to retrieve images"))
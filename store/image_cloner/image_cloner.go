@@ -14,6 +14,10 @@ import (
 	errorspkg "github.com/pkg/errors"
 )
 
+// ManifestDigestFileName is the file in the image directory that records the
+// digest of the base image manifest
+const ManifestDigestFileName = "manifest-digest"
+
 type ImageDriverSpec struct {
 	BaseVolumeIDs      []string
 	Mount              bool
@@ -103,15 +107,22 @@ func (b *ImageCloner) Create(logger lager.Logger, spec groot.ImageSpec) (groot.I
 		return groot.ImageInfo{}, errorspkg.Wrap(err, "creating image")
 	}
 
-	if err := b.setOwnership(spec,
-		imagePath,
-		imageRootFSPath,
-	); err != nil {
+	ownedPaths := []string{imagePath, imageRootFSPath}
+	if spec.ManifestDigest != "" {
+		manifestDigestPath := filepath.Join(imagePath, ManifestDigestFileName)
+		if err = ioutil.WriteFile(manifestDigestPath, []byte(spec.ManifestDigest), 0644); err != nil {
+			logger.Error("writing-manifest-digest-failed", err)
+			return groot.ImageInfo{}, errorspkg.Wrap(err, "writing manifest digest")
+		}
+		ownedPaths = append(ownedPaths, manifestDigestPath)
+	}
+
+	if err := b.setOwnership(spec, ownedPaths...); err != nil {
 		logger.Error("setting-permission-failed", err, lager.Data{"imageDriverSpec": imageDriverSpec})
 		return groot.ImageInfo{}, err
 	}
 
-	imageInfo, err := b.imageInfo(imageRootFSPath, imagePath, spec.BaseImage, mountInfo, spec.Mount)
+	imageInfo, err := b.imageInfo(imageRootFSPath, imagePath, spec.BaseImage, spec.ManifestDigest, mountInfo, spec.Mount)
 	if err != nil {
 		logger.Error("creating-image-object", err)
 		return groot.ImageInfo{}, errorspkg.Wrap(err, "creating image object")
@@ -176,11 +187,12 @@ func (b *ImageCloner) Stats(logger lager.Logger, id string) (groot.VolumeStats,
 
 var OpenFile = os.OpenFile
 
-func (b *ImageCloner) imageInfo(rootfsPath, imagePath string, baseImage specsv1.Image, mountJson groot.MountInfo, mount bool) (groot.ImageInfo, error) {
+func (b *ImageCloner) imageInfo(rootfsPath, imagePath string, baseImage specsv1.Image, manifestDigest string, mountJson groot.MountInfo, mount bool) (groot.ImageInfo, error) {
 	imageInfo := groot.ImageInfo{
-		Path:   imagePath,
-		Rootfs: rootfsPath,
-		Image:  baseImage,
+		Path:           imagePath,
+		Rootfs:         rootfsPath,
+		Image:          baseImage,
+		ManifestDigest: manifestDigest,
 	}
 
 	if !mount {
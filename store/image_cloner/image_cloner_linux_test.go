@@ -94,6 +94,25 @@ var _ = Describe("Image", func() {
 			Expect(len(images)).To(Equal(2))
 		})
 
+		It("records the manifest digest", func() {
+			image, err := imageCloner.Create(logger, groot.ImageSpec{ID: "some-id", BaseImage: imageConfig, ManifestDigest: "sha256:some-digest"})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(image.ManifestDigest).To(Equal("sha256:some-digest"))
+			contents, err := ioutil.ReadFile(filepath.Join(image.Path, imageclonerpkg.ManifestDigestFileName))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal("sha256:some-digest"))
+		})
+
+		Context("when the base image doesn't have a manifest digest", func() {
+			It("doesn't record it", func() {
+				image, err := imageCloner.Create(logger, groot.ImageSpec{ID: "some-id", BaseImage: imageConfig})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(filepath.Join(image.Path, imageclonerpkg.ManifestDigestFileName)).NotTo(BeAnExistingFile())
+			})
+		})
+
 		It("creates the snapshot", func() {
 			imageSpec := groot.ImageSpec{
 				ID:            "some-id",
@@ -60,6 +60,12 @@ func (m *Manager) InitStore(logger lager.Logger, spec InitSpec) (err error) {
 	logger.Debug("starting")
 	defer logger.Debug("ending")
 
+	ownerUID, ownerGID, err := m.findStoreOwner(spec.UIDMappings, spec.GIDMappings)
+	if err != nil {
+		logger.Error("finding-store-owner-failed", err)
+		return err
+	}
+
 	validationPath := filepath.Dir(m.storePath)
 	stat, err := os.Stat(m.storePath)
 	if err == nil && stat.IsDir() {
@@ -105,7 +111,6 @@ func (m *Manager) InitStore(logger lager.Logger, spec InitSpec) (err error) {
 		return err
 	}
 
-	ownerUID, ownerGID := m.findStoreOwner(spec.UIDMappings, spec.GIDMappings)
 	if err := os.Chown(m.storePath, ownerUID, ownerGID); err != nil {
 		logger.Error("chowning-store-path-failed", err, lager.Data{"uid": ownerUID, "gid": ownerGID})
 		return errorspkg.Wrap(err, "chowing store")
@@ -290,27 +295,36 @@ func (m *Manager) createInternalDirectory(logger lager.Logger, folderName string
 	return nil
 }
 
-func (m *Manager) findStoreOwner(uidMappings, gidMappings []groot.IDMappingSpec) (int, int) {
-	uid := os.Getuid()
-	gid := os.Getgid()
+// findStoreOwner returns the host IDs of the namespace root. When there are
+// mappings without the root, the owner is left unchanged (-1).
+func (m *Manager) findStoreOwner(uidMappings, gidMappings []groot.IDMappingSpec) (int, int, error) {
+	uid, err := storeOwnerID(uidMappings, os.Getuid())
+	if err != nil {
+		return 0, 0, errorspkg.Wrap(err, "invalid uid mappings")
+	}
 
-	for _, mapping := range uidMappings {
-		if mapping.Size == 1 && mapping.NamespaceID == 0 {
-			uid = mapping.HostID
-			break
-		}
-		uid = -1
+	gid, err := storeOwnerID(gidMappings, os.Getgid())
+	if err != nil {
+		return 0, 0, errorspkg.Wrap(err, "invalid gid mappings")
 	}
 
-	for _, mapping := range gidMappings {
-		if mapping.Size == 1 && mapping.NamespaceID == 0 {
-			gid = mapping.HostID
-			break
-		}
-		gid = -1
+	return uid, gid, nil
+}
+
+func storeOwnerID(mappings []groot.IDMappingSpec, callerID int) (int, error) {
+	idMap, err := groot.NewIDMap(mappings)
+	if err != nil {
+		return 0, err
 	}
 
-	return uid, gid
+	if idMap.Empty() {
+		return callerID, nil
+	}
+
+	if rootID, err := idMap.HostID(0); err == nil {
+		return rootID, nil
+	}
+	return -1, nil
 }
 
 func isDirectory(requiredPath string) error {
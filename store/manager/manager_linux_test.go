@@ -353,6 +353,36 @@ var _ = Describe("Manager", func() {
 					Expect(stat.Gid).To(Equal(uint32(0)))
 				})
 			})
+
+			Context("when the root is mapped by a larger range", func() {
+				BeforeEach(func() {
+					spec.UIDMappings = []groot.IDMappingSpec{
+						groot.IDMappingSpec{HostID: int(GrootUID), NamespaceID: 0, Size: 10},
+					}
+					spec.GIDMappings = []groot.IDMappingSpec{
+						groot.IDMappingSpec{HostID: int(GrootGID), NamespaceID: 0, Size: 10},
+					}
+				})
+
+				It("sets the root mapping as the owner of the store", func() {
+					Expect(manager.InitStore(logger, spec)).To(Succeed())
+					var stat unix.Stat_t
+					Expect(unix.Stat(storePath, &stat)).To(Succeed())
+					Expect(stat.Uid).To(Equal(GrootUID))
+					Expect(stat.Gid).To(Equal(GrootGID))
+				})
+			})
+
+			Context("when the mappings overlap", func() {
+				BeforeEach(func() {
+					spec.UIDMappings = append(spec.UIDMappings, groot.IDMappingSpec{HostID: 10005, NamespaceID: 20, Size: 10})
+				})
+
+				It("returns an error without applying them", func() {
+					Expect(manager.InitStore(logger, spec)).To(MatchError(ContainSubstring("invalid uid mappings")))
+					Expect(namespacer.ApplyMappingsCallCount()).To(BeZero())
+				})
+			})
 		})
 
 		Context("when store size is provided", func() {
@@ -7,6 +7,7 @@ const (
 	LocksDirName     = "locks"
 	MetaDirName      = "meta"
 	TempDirName      = "tmp"
+	BlobCacheDirName = "blob-cache"
 	DefaultStorePath = "/var/lib/grootfs"
 )
 
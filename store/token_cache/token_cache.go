@@ -0,0 +1,193 @@
+package token_cache // import "code.cloudfoundry.org/grootfs/store/token_cache"
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/grootfs/groot"
+	"code.cloudfoundry.org/grootfs/store/cache_dir"
+	"code.cloudfoundry.org/lager"
+	errorspkg "github.com/pkg/errors"
+)
+
+// ExpiryMargin is how long before they expire tokens stop being handed out,
+// so that they don't expire while they are being used
+const ExpiryMargin = 10 * time.Second
+
+// secretFileName is the file in the cache directory with the secret the keys
+// are hashed with
+const secretFileName = "secret"
+
+// Key identifies the tokens that can be used for a request. Tokens are only
+// shared by requests made with the same credentials.
+type Key struct {
+	Registry    string
+	Repository  string
+	Scope       string
+	Credentials string
+}
+
+// id hashes the key with the secret of the cache, so that the names of the
+// cached tokens can't be used to guess the credentials
+func (k Key) id(secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", k.Registry, k.Repository, k.Scope, k.Credentials)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type Token struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// TokenCache keeps registry bearer tokens in a directory, so that they can
+// be reused by later processes until they expire. Tokens are fetched under
+// the lock of their key, so concurrent processes wait for the one fetching a
+// token instead of fetching their own.
+type TokenCache struct {
+	path      string
+	locksmith groot.Locksmith
+
+	// mutex guards secret, as tokens can be fetched concurrently
+	mutex  *sync.Mutex
+	secret []byte
+}
+
+func NewTokenCache(path string, locksmith groot.Locksmith) *TokenCache {
+	return &TokenCache{
+		path:      path,
+		locksmith: locksmith,
+		mutex:     &sync.Mutex{},
+	}
+}
+
+// Fetch returns the cached token for the key. The token is fetched and cached
+// when there is none, when it is about to expire, or when it is the token the
+// registry just rejected.
+func (c *TokenCache) Fetch(logger lager.Logger, key Key, rejectedToken string, fetch func() (Token, error)) (string, error) {
+	logger = logger.Session("fetching-cached-token", lager.Data{"registry": key.Registry, "repository": key.Repository, "scope": key.Scope})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	secret, err := c.readSecret(logger)
+	if err != nil {
+		return "", err
+	}
+
+	id := key.id(secret)
+	lockFile, err := c.locksmith.Lock("registry-token-" + id)
+	if err != nil {
+		return "", errorspkg.Wrap(err, "locking token cache")
+	}
+	defer func() {
+		if err := c.locksmith.Unlock(lockFile); err != nil {
+			logger.Error("unlocking-token-cache-failed", err)
+		}
+	}()
+
+	cachedToken, err := c.read(id)
+	if err != nil && !os.IsNotExist(err) {
+		logger.Error("reading-cached-token-failed", err)
+	}
+	if err == nil && cachedToken.Token != rejectedToken && time.Now().Add(ExpiryMargin).Before(cachedToken.ExpiresAt) {
+		logger.Debug("using-cached-token", lager.Data{"expiresAt": cachedToken.ExpiresAt})
+		return cachedToken.Token, nil
+	}
+
+	token, err := fetch()
+	if err != nil {
+		return "", err
+	}
+
+	if err := c.write(id, token); err != nil {
+		logger.Error("caching-token-failed", err)
+	}
+
+	return token.Token, nil
+}
+
+// readSecret returns the secret of the cache, which is created by the first
+// process to use the cache
+func (c *TokenCache) readSecret(logger lager.Logger) ([]byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.secret != nil {
+		return c.secret, nil
+	}
+
+	secretPath := filepath.Join(c.path, secretFileName)
+	secret, err := ioutil.ReadFile(secretPath)
+	if os.IsNotExist(err) {
+		secret, err = c.createSecret(logger, secretPath)
+	}
+	if err != nil {
+		return nil, errorspkg.Wrap(err, "reading token cache secret")
+	}
+	c.secret = secret
+
+	return secret, nil
+}
+
+func (c *TokenCache) createSecret(logger lager.Logger, secretPath string) ([]byte, error) {
+	lockFile, err := c.locksmith.Lock("registry-token-secret")
+	if err != nil {
+		return nil, errorspkg.Wrap(err, "locking token cache")
+	}
+	defer func() {
+		if err := c.locksmith.Unlock(lockFile); err != nil {
+			logger.Error("unlocking-token-cache-failed", err)
+		}
+	}()
+
+	// another process might have created it while this one waited for the lock
+	secret, err := ioutil.ReadFile(secretPath)
+	if !os.IsNotExist(err) {
+		return secret, err
+	}
+
+	logger.Debug("creating-secret")
+	secret = make([]byte, sha256.Size)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, errorspkg.Wrap(err, "generating secret")
+	}
+
+	if err := cache_dir.WriteFile(secretPath, secret, 0700); err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+func (c *TokenCache) read(id string) (Token, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(c.path, id+".json"))
+	if err != nil {
+		return Token{}, err
+	}
+
+	var token Token
+	if err := json.Unmarshal(contents, &token); err != nil {
+		return Token{}, errorspkg.Wrap(err, "parsing cached token")
+	}
+
+	return token, nil
+}
+
+// write replaces the cached token atomically. Tokens are only readable by
+// the owner of the store.
+func (c *TokenCache) write(id string, token Token) error {
+	contents, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	return cache_dir.WriteFile(filepath.Join(c.path, id+".json"), contents, 0700)
+}
@@ -0,0 +1,13 @@
+package token_cache_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestTokenCache(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "TokenCache Suite")
+}
@@ -0,0 +1,180 @@
+package token_cache_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/grootfs/groot/grootfakes"
+	"code.cloudfoundry.org/grootfs/store/locksmith"
+	"code.cloudfoundry.org/grootfs/store/token_cache"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TokenCache", func() {
+	var (
+		tmpDir     string
+		cachePath  string
+		cache      *token_cache.TokenCache
+		logger     lager.Logger
+		key        token_cache.Key
+		fetchCount int32
+		expiresAt  time.Time
+	)
+
+	fetch := func() (token_cache.Token, error) {
+		count := atomic.AddInt32(&fetchCount, 1)
+		return token_cache.Token{Token: fmt.Sprintf("token-%d", count), ExpiresAt: expiresAt}, nil
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "token-cache")
+		Expect(err).NotTo(HaveOccurred())
+		cachePath = filepath.Join(tmpDir, "tokens")
+		cache = token_cache.NewTokenCache(cachePath, locksmith.NewExclusiveFileSystem(filepath.Join(tmpDir, "locks")))
+		logger = lagertest.NewTestLogger("token-cache")
+
+		key = token_cache.Key{Registry: "registry.example.com", Repository: "groot/image", Scope: "repository:groot/image:pull", Credentials: "user:pass"}
+		fetchCount = 0
+		expiresAt = time.Now().Add(time.Hour)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("fetches the token the first time", func() {
+		Expect(cache.Fetch(logger, key, "", fetch)).To(Equal("token-1"))
+		Expect(fetchCount).To(BeEquivalentTo(1))
+	})
+
+	It("reuses the token until it expires", func() {
+		Expect(cache.Fetch(logger, key, "", fetch)).To(Equal("token-1"))
+
+		otherCache := token_cache.NewTokenCache(cachePath, locksmith.NewExclusiveFileSystem(filepath.Join(tmpDir, "locks")))
+		Expect(otherCache.Fetch(logger, key, "", fetch)).To(Equal("token-1"))
+		Expect(fetchCount).To(BeEquivalentTo(1))
+	})
+
+	It("only lets the owner read the tokens", func() {
+		Expect(cache.Fetch(logger, key, "", fetch)).To(Equal("token-1"))
+
+		stat, err := os.Stat(cachePath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stat.Mode().Perm()).To(Equal(os.FileMode(0700)))
+	})
+
+	It("doesn't name the cached tokens after a plain hash of the key", func() {
+		Expect(cache.Fetch(logger, key, "", fetch)).To(Equal("token-1"))
+
+		plainHash := sha256.Sum256([]byte(fmt.Sprintf("%s\n%s\n%s\n%s", key.Registry, key.Repository, key.Scope, key.Credentials)))
+		tokenFiles, err := filepath.Glob(filepath.Join(cachePath, "*.json"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tokenFiles).To(HaveLen(1))
+		Expect(filepath.Base(tokenFiles[0])).NotTo(Equal(hex.EncodeToString(plainHash[:]) + ".json"))
+	})
+
+	It("names the cached tokens differently in each store", func() {
+		Expect(cache.Fetch(logger, key, "", fetch)).To(Equal("token-1"))
+
+		otherCachePath := filepath.Join(tmpDir, "other-tokens")
+		otherCache := token_cache.NewTokenCache(otherCachePath, locksmith.NewExclusiveFileSystem(filepath.Join(tmpDir, "locks")))
+		Expect(otherCache.Fetch(logger, key, "", fetch)).To(Equal("token-2"))
+
+		tokenFiles, err := filepath.Glob(filepath.Join(cachePath, "*.json"))
+		Expect(err).NotTo(HaveOccurred())
+		otherTokenFiles, err := filepath.Glob(filepath.Join(otherCachePath, "*.json"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(filepath.Base(tokenFiles[0])).NotTo(Equal(filepath.Base(otherTokenFiles[0])))
+	})
+
+	It("doesn't share tokens between keys", func() {
+		Expect(cache.Fetch(logger, key, "", fetch)).To(Equal("token-1"))
+
+		key.Credentials = "another-user:pass"
+		Expect(cache.Fetch(logger, key, "", fetch)).To(Equal("token-2"))
+	})
+
+	It("fetches a new token when the registry rejected the cached one", func() {
+		Expect(cache.Fetch(logger, key, "", fetch)).To(Equal("token-1"))
+		Expect(cache.Fetch(logger, key, "token-1", fetch)).To(Equal("token-2"))
+		Expect(cache.Fetch(logger, key, "", fetch)).To(Equal("token-2"))
+	})
+
+	It("only lets one of many concurrent fetches get a new token", func() {
+		slowFetch := func() (token_cache.Token, error) {
+			time.Sleep(100 * time.Millisecond)
+			return fetch()
+		}
+
+		wg := sync.WaitGroup{}
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				Expect(cache.Fetch(logger, key, "", slowFetch)).To(Equal("token-1"))
+			}()
+		}
+		wg.Wait()
+
+		Expect(fetchCount).To(BeEquivalentTo(1))
+	})
+
+	Context("when the token is about to expire", func() {
+		BeforeEach(func() {
+			expiresAt = time.Now().Add(token_cache.ExpiryMargin / 2)
+		})
+
+		It("fetches a new one", func() {
+			Expect(cache.Fetch(logger, key, "", fetch)).To(Equal("token-1"))
+			Expect(cache.Fetch(logger, key, "", fetch)).To(Equal("token-2"))
+		})
+	})
+
+	Context("when the cached token is corrupted", func() {
+		It("fetches a new one", func() {
+			Expect(cache.Fetch(logger, key, "", fetch)).To(Equal("token-1"))
+
+			tokenFiles, err := filepath.Glob(filepath.Join(cachePath, "*.json"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tokenFiles).To(HaveLen(1))
+			Expect(ioutil.WriteFile(tokenFiles[0], []byte("{"), 0600)).To(Succeed())
+
+			Expect(cache.Fetch(logger, key, "", fetch)).To(Equal("token-2"))
+		})
+	})
+
+	Context("when fetching the token fails", func() {
+		It("returns the error", func() {
+			_, err := cache.Fetch(logger, key, "", func() (token_cache.Token, error) {
+				return token_cache.Token{}, errors.New("registry is down")
+			})
+			Expect(err).To(MatchError("registry is down"))
+		})
+	})
+
+	Context("when locking fails", func() {
+		It("returns an error", func() {
+			fakeLocksmith := new(grootfakes.FakeLocksmith)
+			fakeLocksmith.LockReturns(nil, errors.New("no locks today"))
+			cache = token_cache.NewTokenCache(cachePath, fakeLocksmith)
+
+			_, err := cache.Fetch(logger, key, "", fetch)
+			Expect(err).To(MatchError(ContainSubstring("no locks today")))
+			Expect(fetchCount).To(BeZero())
+		})
+	})
+})
@@ -99,7 +99,7 @@ func (r *FakeRegistry) serveHTTP(rw http.ResponseWriter, req *http.Request) {
 func (r *FakeRegistry) serveManifest(rw http.ResponseWriter, req *http.Request) {
 	if r.failNextRequests > 0 {
 		r.failNextRequests--
-		rw.WriteHeader(http.StatusTeapot)
+		rw.WriteHeader(http.StatusServiceUnavailable)
 		_, _ = rw.Write([]byte("null"))
 		return
 	}
@@ -110,7 +110,7 @@ func (r *FakeRegistry) serveManifest(rw http.ResponseWriter, req *http.Request)
 func (r *FakeRegistry) serveBlob(rw http.ResponseWriter, req *http.Request) {
 	if r.failNextRequests > 0 {
 		r.failNextRequests--
-		rw.WriteHeader(http.StatusTeapot)
+		rw.WriteHeader(http.StatusServiceUnavailable)
 		_, _ = rw.Write([]byte("null"))
 		return
 	}